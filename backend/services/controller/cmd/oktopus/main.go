@@ -8,6 +8,10 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/leandrofars/oktopus/internal/api"
 	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/events"
+	"github.com/leandrofars/oktopus/internal/filestore"
+	"github.com/leandrofars/oktopus/internal/liveness"
+	"github.com/leandrofars/oktopus/internal/metrics"
 	usp_msg "github.com/leandrofars/oktopus/internal/usp_message"
 	"log"
 	"os"
@@ -56,6 +60,13 @@ func main() {
 	flBrokerQos := flag.Int("q", 0, "Quality of service of mqtt messages delivery")
 	flAddrDB := flag.String("mongo", "mongodb://localhost:27017/", "MongoDB URI")
 	flApiPort := flag.String("ap", "8000", "Rest api port")
+	flFilesDir := flag.String("files", "files", "Directory where firmware images and other files served to devices are kept")
+	flFilesUrl := flag.String("files_url", "", "Url devices reach the rest api at to download files, defaults to the address the api was called at")
+	flLivenessInterval := flag.Duration("liveness_interval", liveness.DefaultInterval, "How long a device may stay quiet before the controller checks it's still there, 0 turns checks off")
+	flLivenessSilence := flag.Duration("liveness_silence", liveness.DefaultSilence, "How long a device may stay silent before it's considered offline")
+	flMetricsInterval := flag.Duration("metrics_interval", metrics.DefaultInterval, "How often metrics are collected from online devices, 0 turns collection off")
+	flMetricsRaw := flag.Duration("metrics_raw_retention", metrics.DefaultRawRetention, "How long metrics samples are kept")
+	flMetricsHourly := flag.Duration("metrics_retention", metrics.DefaultHourlyRetention, "How long hourly averages of metrics are kept")
 	flHelp := flag.Bool("help", false, "Help")
 
 	flag.Parse()
@@ -70,8 +81,9 @@ func main() {
 	*/
 	ctx, cancel := context.WithCancel(context.Background())
 	database := db.NewDatabase(ctx, *flAddrDB)
-	apiMsgQueue := make(map[string](chan usp_msg.Msg))
+	apiMsgQueue := make(map[string](chan *usp_msg.Msg))
 	var m sync.Mutex
+	bus := events.NewBus()
 	/*
 	 If you want to use another message protocol just make it implement Broker interface.
 	*/
@@ -89,10 +101,21 @@ func main() {
 		DB:           database,
 		MsgQueue:     apiMsgQueue,
 		QMutex:       &m,
+		Events:       bus,
+	}
+
+	files, err := filestore.NewStore(*flFilesDir)
+	if err != nil {
+		log.Fatal("Couldn't create files directory --> ", err)
 	}
 
 	mtp.MtpService(&mqttClient, done)
-	a := api.NewApi(*flApiPort, database, &mqttClient, apiMsgQueue, &m)
+	a := api.NewApi(*flApiPort, database, &mqttClient, apiMsgQueue, &m, bus, files, *flFilesUrl)
+	a.Liveness.Interval = *flLivenessInterval
+	a.Liveness.Silence = *flLivenessSilence
+	a.Metrics.Interval = *flMetricsInterval
+	a.Metrics.RawRetention = *flMetricsRaw
+	a.Metrics.HourlyRetention = *flMetricsHourly
 	api.StartApi(a)
 
 	<-done
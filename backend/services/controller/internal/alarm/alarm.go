@@ -0,0 +1,323 @@
+// Raises and clears alarms by evaluating operator rules against devices.
+package alarm
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/events"
+	"github.com/leandrofars/oktopus/internal/metrics"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/utils"
+)
+
+// How often offline and firmware rules are evaluated over the whole fleet
+const evalInterval = time.Minute
+
+// Name alarms cleared by the controller itself are cleared by
+const system = "system"
+
+var operators = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+type Engine struct {
+	Db     db.Database
+	Events *events.Bus
+	mu     sync.Mutex
+	// Since when the condition of a threshold rule holds, by rule, device and path
+	since map[string]time.Time
+}
+
+func NewEngine(database db.Database, bus *events.Bus) *Engine {
+	return &Engine{Db: database, Events: bus, since: map[string]time.Time{}}
+}
+
+// Validate checks the rule and parses its duration.
+func Validate(rule *db.AlarmRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("%w: rule name is required", usp.ErrInvalidRequest)
+	}
+	switch rule.Severity {
+	case db.SeverityCritical, db.SeverityMajor, db.SeverityMinor, db.SeverityWarning:
+	default:
+		return fmt.Errorf("%w: severity must be critical, major, minor or warning", usp.ErrInvalidRequest)
+	}
+	rule.Duration = 0
+	if rule.For != "" {
+		duration, err := time.ParseDuration(rule.For)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("%w: invalid duration %q", usp.ErrInvalidRequest, rule.For)
+		}
+		rule.Duration = duration
+	}
+
+	switch rule.Kind {
+	case db.RuleThreshold:
+		if !strings.HasPrefix(rule.Path, "Device.") || strings.HasSuffix(rule.Path, ".") {
+			return fmt.Errorf("%w: invalid param path %q", usp.ErrInvalidRequest, rule.Path)
+		}
+		if _, ok := operators[rule.Operator]; !ok {
+			return fmt.Errorf("%w: operator must be one of <, <=, >, >=, == or !=", usp.ErrInvalidRequest)
+		}
+	case db.RuleOffline:
+	case db.RuleFirmware:
+		if len(rule.Approved) == 0 {
+			return fmt.Errorf("%w: firmware rule has no approved versions", usp.ErrInvalidRequest)
+		}
+	default:
+		return fmt.Errorf("%w: rule kind must be threshold, offline or firmware", usp.ErrInvalidRequest)
+	}
+	return nil
+}
+
+// Start evaluates the rules when devices connect or disconnect, or notify
+// a value change, and from time to time for the ones depending on how long
+// a condition lasts.
+func (e *Engine) Start() {
+	deviceEvents, _ := e.Events.Subscribe("")
+	go func() {
+		ticker := time.NewTicker(evalInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case ev := <-deviceEvents:
+				switch ev.Kind {
+				case events.DeviceOnline:
+					go e.evaluateDevice(ev.SN)
+				case events.DeviceOffline:
+					// Values of a device which went away aren't known to keep meeting conditions
+					e.forgetDevice(ev.SN)
+					go e.evaluateDevice(ev.SN)
+				case events.Notification:
+					if change := ev.Notify.GetValueChange(); change != nil {
+						values := metrics.Values(map[string]string{change.GetParamPath(): change.GetParamValue()})
+						if len(values) > 0 {
+							go e.Observe(ev.SN, ev.Time, values)
+						}
+					}
+				}
+			case <-ticker.C:
+				go e.evaluateFleet()
+			}
+		}
+	}()
+	log.Println("Alarm engine started")
+}
+
+/*
+Observe evaluates the threshold rules against values collected from the
+device. An alarm is raised once the condition held for the rule duration
+and cleared as soon as a value no longer meets it.
+*/
+func (e *Engine) Observe(sn string, at time.Time, values map[string]float64) {
+	rules, device, ok := e.rulesOf(sn)
+	if !ok {
+		return
+	}
+	for _, rule := range rules {
+		if rule.Kind != db.RuleThreshold {
+			continue
+		}
+		compare := operators[rule.Operator]
+		for path, value := range values {
+			if !Match(rule.Path, path) {
+				continue
+			}
+			key := rule.Id + "|" + sn + "|" + path
+			if !compare(value, rule.Value) {
+				e.mu.Lock()
+				delete(e.since, key)
+				e.mu.Unlock()
+				e.Db.ClearAlarms(rule.Id, sn, path, system)
+				continue
+			}
+
+			e.mu.Lock()
+			since, ok := e.since[key]
+			if !ok {
+				since = at
+				e.since[key] = at
+			}
+			e.mu.Unlock()
+			if at.Sub(since) >= rule.Duration {
+				msg := fmt.Sprintf("%s is %s, %s %s for %s", path, format(value), rule.Operator, format(rule.Value), at.Sub(since).Round(time.Second))
+				e.raise(rule, device, path, msg)
+			}
+		}
+	}
+}
+
+// Forget drops what is known about a rule, clearing its active alarms, as
+// when it's changed or deleted.
+func (e *Engine) Forget(id string) {
+	e.mu.Lock()
+	for key := range e.since {
+		if strings.HasPrefix(key, id+"|") {
+			delete(e.since, key)
+		}
+	}
+	e.mu.Unlock()
+	e.Db.ClearAlarms(id, "", "", system)
+}
+
+// Drops since when the conditions of threshold rules hold on the device.
+func (e *Engine) forgetDevice(sn string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key := range e.since {
+		if strings.Split(key, "|")[1] == sn {
+			delete(e.since, key)
+		}
+	}
+}
+
+func (e *Engine) evaluateFleet() {
+	devices, err := e.Db.RetrieveDevices()
+	if err != nil {
+		return
+	}
+	rules, err := e.enabledRules()
+	if err != nil {
+		return
+	}
+	for _, d := range devices {
+		e.evaluate(rules, d)
+	}
+}
+
+func (e *Engine) evaluateDevice(sn string) {
+	rules, device, ok := e.rulesOf(sn)
+	if ok {
+		e.evaluate(rules, device)
+	}
+}
+
+// Evaluates the offline and firmware rules, threshold ones only get
+// evaluated as values come
+func (e *Engine) evaluate(rules []db.AlarmRule, d db.Device) {
+	now := time.Now()
+	for _, rule := range rules {
+		if rule.Selector != nil && !rule.Selector.Match(d) {
+			continue
+		}
+		switch rule.Kind {
+		case db.RuleOffline:
+			if d.Status == utils.Online {
+				e.Db.ClearAlarms(rule.Id, d.SN, "", system)
+			} else if since, ok := e.offlineSince(d); ok && now.Sub(since) >= rule.Duration {
+				e.raise(rule, d, "", fmt.Sprintf("Device is offline for %s", now.Sub(since).Round(time.Minute)))
+			}
+		case db.RuleFirmware:
+			if approved(rule, d.Version) {
+				e.Db.ClearAlarms(rule.Id, d.SN, "", system)
+			} else if d.Version != "" {
+				e.raise(rule, d, "", fmt.Sprintf("Software version %s isn't approved", d.Version))
+			}
+		}
+	}
+}
+
+// Devices saved before they were last seen at went offline when their status
+// last changed, if it's known
+func (e *Engine) offlineSince(d db.Device) (time.Time, bool) {
+	if !d.LastSeen.IsZero() {
+		return d.LastSeen, true
+	}
+	p, err := e.Db.LastPresence(d.SN)
+	if err != nil || p == nil {
+		return time.Time{}, false
+	}
+	return p.Time, true
+}
+
+func (e *Engine) raise(rule db.AlarmRule, d db.Device, path, msg string) {
+	raised, err := e.Db.RaiseAlarm(db.Alarm{
+		Rule:     rule.Id,
+		RuleName: rule.Name,
+		SN:       d.SN,
+		Path:     path,
+		Severity: rule.Severity,
+		Message:  msg,
+		RaisedAt: time.Now(),
+	})
+	if err == nil && raised {
+		log.Printf("Alarm %s raised on %s: %s", rule.Name, d.SN, msg)
+	}
+}
+
+// Enabled rules which apply to the device
+func (e *Engine) rulesOf(sn string) ([]db.AlarmRule, db.Device, bool) {
+	device, err := e.Db.RetrieveDevice(sn)
+	if err != nil {
+		return nil, device, false
+	}
+	rules, err := e.enabledRules()
+	if err != nil {
+		return nil, device, false
+	}
+	var result []db.AlarmRule
+	for _, rule := range rules {
+		if rule.Selector == nil || rule.Selector.Match(device) {
+			result = append(result, rule)
+		}
+	}
+	return result, device, true
+}
+
+func (e *Engine) enabledRules() ([]db.AlarmRule, error) {
+	rules, err := e.Db.RetrieveAlarmRules()
+	if err != nil {
+		return nil, err
+	}
+	var result []db.AlarmRule
+	for _, rule := range rules {
+		if rule.Enabled && Validate(&rule) == nil {
+			result = append(result, rule)
+		}
+	}
+	return result, nil
+}
+
+// Match tells whether the path is one of the pattern, where * stands for
+// any instance number.
+func Match(pattern, path string) bool {
+	p := strings.Split(pattern, ".")
+	x := strings.Split(path, ".")
+	if len(p) != len(x) {
+		return false
+	}
+	for i := range p {
+		if p[i] == "*" {
+			if _, err := strconv.Atoi(x[i]); err != nil {
+				return false
+			}
+		} else if p[i] != x[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func approved(rule db.AlarmRule, version string) bool {
+	for _, v := range rule.Approved {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func format(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,104 @@
+package alarm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"Device.DeviceInfo.ProcessStatus.CPUUsage", "Device.DeviceInfo.ProcessStatus.CPUUsage", true},
+		{"Device.WiFi.Radio.*.Stats.Noise", "Device.WiFi.Radio.1.Stats.Noise", true},
+		{"Device.WiFi.Radio.*.Stats.Noise", "Device.WiFi.Radio.12.Stats.Noise", true},
+		{"Device.WiFi.Radio.1.Stats.Noise", "Device.WiFi.Radio.2.Stats.Noise", false},
+		{"Device.WiFi.Radio.*.Stats.Noise", "Device.WiFi.Radio.x.Stats.Noise", false},
+		{"Device.WiFi.Radio.*.Stats.Noise", "Device.WiFi.Radio.1.Stats.Noise.Extra", false},
+		{"Device.WiFi.Radio.*.Stats.Noise", "Device.WiFi.Radio.Stats.Noise", false},
+		{"Device.IP.Interface.*.Stats.*", "Device.IP.Interface.1.Stats.BytesSent", false},
+		{"Device.IP.Interface.*.IPv4Address.*.Status", "Device.IP.Interface.2.IPv4Address.3.Status", true},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	threshold := func(change func(r *db.AlarmRule)) db.AlarmRule {
+		r := db.AlarmRule{
+			Name:     "High CPU",
+			Kind:     db.RuleThreshold,
+			Severity: db.SeverityMajor,
+			Path:     "Device.DeviceInfo.ProcessStatus.CPUUsage",
+			Operator: ">",
+			Value:    90,
+		}
+		if change != nil {
+			change(&r)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		rule     db.AlarmRule
+		ok       bool
+		duration time.Duration
+	}{
+		{"threshold", threshold(nil), true, 0},
+		{"threshold for a while", threshold(func(r *db.AlarmRule) { r.For = "5m" }), true, 5 * time.Minute},
+		{"no name", threshold(func(r *db.AlarmRule) { r.Name = "" }), false, 0},
+		{"bad severity", threshold(func(r *db.AlarmRule) { r.Severity = "urgent" }), false, 0},
+		{"bad duration", threshold(func(r *db.AlarmRule) { r.For = "soon" }), false, 0},
+		{"negative duration", threshold(func(r *db.AlarmRule) { r.For = "-1m" }), false, 0},
+		{"object path", threshold(func(r *db.AlarmRule) { r.Path = "Device.DeviceInfo." }), false, 0},
+		{"outside the data model", threshold(func(r *db.AlarmRule) { r.Path = "DeviceInfo.UpTime" }), false, 0},
+		{"bad operator", threshold(func(r *db.AlarmRule) { r.Operator = "=>" }), false, 0},
+		{"offline", db.AlarmRule{Name: "Offline", Kind: db.RuleOffline, Severity: db.SeverityCritical, For: "10m"}, true, 10 * time.Minute},
+		{"firmware", db.AlarmRule{Name: "Firmware", Kind: db.RuleFirmware, Severity: db.SeverityWarning, Approved: []string{"1.2.3"}}, true, 0},
+		{"firmware without versions", db.AlarmRule{Name: "Firmware", Kind: db.RuleFirmware, Severity: db.SeverityWarning}, false, 0},
+		{"unknown kind", db.AlarmRule{Name: "Other", Kind: "reboot", Severity: db.SeverityMinor}, false, 0},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		err := Validate(&rule)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err != nil && !errors.Is(err, usp.ErrInvalidRequest) {
+			t.Errorf("%s: Validate() error = %v, want an invalid request", tt.name, err)
+		}
+		if err == nil && rule.Duration != tt.duration {
+			t.Errorf("%s: Duration = %v, want %v", tt.name, rule.Duration, tt.duration)
+		}
+	}
+}
+
+func TestForgetDevice(t *testing.T) {
+	now := time.Now()
+	e := &Engine{since: map[string]time.Time{
+		"rule1|sn1|Device.DeviceInfo.ProcessStatus.CPUUsage":  now,
+		"rule2|sn1|Device.WiFi.Radio.1.Stats.Noise":           now,
+		"rule1|sn10|Device.DeviceInfo.ProcessStatus.CPUUsage": now,
+		"rule1|sn2|Device.DeviceInfo.ProcessStatus.CPUUsage":  now,
+	}}
+	e.forgetDevice("sn1")
+	if len(e.since) != 2 {
+		t.Errorf("since = %v, want the entries of sn10 and sn2 only", e.since)
+	}
+	for key := range e.since {
+		if strings.HasPrefix(key, "rule1|sn1|") || strings.HasPrefix(key, "rule2|sn1|") {
+			t.Errorf("entry %s of sn1 kept", key)
+		}
+	}
+}
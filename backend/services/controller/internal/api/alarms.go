@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/alarm"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Period the alarm history is returned for, unless asked for another one
+const alarmsWindow = 7 * 24 * time.Hour
+
+func (a *Api) createAlarmRule(w http.ResponseWriter, r *http.Request) {
+	var receiver db.AlarmRule
+	err := usp.DecodeRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	if err := alarm.Validate(&receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+
+	receiver.Id = uuid.NewString()
+	receiver.CreatedAt = time.Now()
+	receiver.UpdatedAt = receiver.CreatedAt
+	if err := a.Db.CreateAlarmRule(receiver); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(receiver)
+}
+
+func (a *Api) retrieveAlarmRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := a.Db.RetrieveAlarmRules()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(rules)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) retrieveAlarmRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := a.alarmRule(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	err := json.NewEncoder(w).Encode(rule)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Replaces the rule, its active alarms are cleared and raised again if the
+// new condition still holds
+func (a *Api) updateAlarmRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := a.alarmRule(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	var receiver db.AlarmRule
+	err := usp.DecodeRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	if err := alarm.Validate(&receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+
+	receiver.Id = rule.Id
+	receiver.CreatedAt = rule.CreatedAt
+	receiver.UpdatedAt = time.Now()
+	if err := a.Db.UpdateAlarmRule(receiver); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	a.Alarms.Forget(rule.Id)
+
+	json.NewEncoder(w).Encode(receiver)
+}
+
+// Deletes the rule and clears its active alarms, which stay in the history
+func (a *Api) deleteAlarmRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := a.alarmRule(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if err := a.Db.DeleteAlarmRule(rule.Id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	a.Alarms.Forget(rule.Id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Active alarms, filtered by the sn, severity and rule query parameters
+func (a *Api) retrieveActiveAlarms(w http.ResponseWriter, r *http.Request) {
+	filter := alarmFilter(r)
+	filter.Active = true
+	a.encodeAlarms(w, filter)
+}
+
+// Alarms raised between from and to, the last week by default, whether they
+// are active or not
+func (a *Api) retrieveAlarmHistory(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := timeRange(w, r, alarmsWindow)
+	if !ok {
+		return
+	}
+	filter := alarmFilter(r)
+	filter.From = &from
+	filter.To = &to
+	a.encodeAlarms(w, filter)
+}
+
+func (a *Api) acknowledgeAlarm(w http.ResponseWriter, r *http.Request) {
+	a.alarmAction(w, r, a.Db.AcknowledgeAlarm)
+}
+
+func (a *Api) clearAlarm(w http.ResponseWriter, r *http.Request) {
+	a.alarmAction(w, r, a.Db.ClearAlarm)
+}
+
+func (a *Api) alarmAction(w http.ResponseWriter, r *http.Request, action func(id, by string) (db.Alarm, error)) {
+	id := mux.Vars(r)["id"]
+	by, _ := r.Context().Value("email").(string)
+
+	result, err := action(id, by)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if _, err := a.Db.RetrieveAlarm(id); err == nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode("Alarm " + id + " is already cleared")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode("No alarm with id " + id + " was found")
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (a *Api) encodeAlarms(w http.ResponseWriter, filter db.AlarmFilter) {
+	alarms, err := a.Db.RetrieveAlarms(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(alarms)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func alarmFilter(r *http.Request) db.AlarmFilter {
+	query := r.URL.Query()
+	return db.AlarmFilter{
+		SN:       query.Get("sn"),
+		Severity: query.Get("severity"),
+		Rule:     query.Get("rule"),
+	}
+}
+
+func (a *Api) alarmRule(w http.ResponseWriter, id string) (db.AlarmRule, bool) {
+	rule, err := a.Db.RetrieveAlarmRule(id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode("No alarm rule with id " + id + " was found")
+			return rule, false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return rule, false
+	}
+	return rule, true
+}
@@ -1,45 +1,61 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/alarm"
 	"github.com/leandrofars/oktopus/internal/api/auth"
 	"github.com/leandrofars/oktopus/internal/api/cors"
 	"github.com/leandrofars/oktopus/internal/api/middleware"
+	"github.com/leandrofars/oktopus/internal/backup"
+	"github.com/leandrofars/oktopus/internal/bulk"
+	"github.com/leandrofars/oktopus/internal/campaign"
+	"github.com/leandrofars/oktopus/internal/command"
 	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/events"
+	"github.com/leandrofars/oktopus/internal/filestore"
+	"github.com/leandrofars/oktopus/internal/firmware"
+	"github.com/leandrofars/oktopus/internal/jobs"
+	"github.com/leandrofars/oktopus/internal/liveness"
+	"github.com/leandrofars/oktopus/internal/metrics"
 	"github.com/leandrofars/oktopus/internal/mtp"
+	"github.com/leandrofars/oktopus/internal/profile"
+	"github.com/leandrofars/oktopus/internal/reboot"
+	"github.com/leandrofars/oktopus/internal/scheduler"
+	"github.com/leandrofars/oktopus/internal/usp"
 	usp_msg "github.com/leandrofars/oktopus/internal/usp_message"
-	"github.com/leandrofars/oktopus/internal/utils"
+	"github.com/leandrofars/oktopus/internal/wifi"
 	"go.mongodb.org/mongo-driver/mongo"
-	"google.golang.org/protobuf/proto"
 )
 
 type Api struct {
-	Port     string
-	Db       db.Database
-	Broker   mtp.Broker
-	MsgQueue map[string](chan usp_msg.Msg)
-	QMutex   *sync.Mutex
-}
-
-type WiFi struct {
-	SSID                 string   `json:"ssid"`
-	Password             string   `json:"password"`
-	Security             string   `json:"security"`
-	SecurityCapabilities []string `json:"securityCapabilities"`
-	AutoChannelEnable    bool     `json:"autoChannelEnable"`
-	Channel              int      `json:"channel"`
-	ChannelBandwidth     string   `json:"channelBandwidth"`
-	FrequencyBand        string   `json:"frequencyBand"`
-	//PossibleChannels     		[]int    `json:"PossibleChannels"`
-	SupportedChannelBandwidths []string `json:"supportedChannelBandwidths"`
+	Port      string
+	Db        db.Database
+	Broker    mtp.Broker
+	Usp       *usp.Dispatcher
+	Jobs      *jobs.Manager
+	Bulk      *bulk.Engine
+	Scheduler *scheduler.Scheduler
+	Events    *events.Bus
+	Firmware  *firmware.Updater
+	Campaigns *campaign.Engine
+	Profiles  *profile.Reconciler
+	Liveness  *liveness.Monitor
+	Metrics   *metrics.Collector
+	Alarms    *alarm.Engine
+	Commands  *command.Runner
+	Reboot    *reboot.Service
+	Backups   *backup.Service
+	Files     *filestore.Store
+	FilesUrl  string
 }
 
 const (
@@ -47,18 +63,38 @@ const (
 	AdminUser
 )
 
-func NewApi(port string, db db.Database, b mtp.Broker, msgQueue map[string](chan usp_msg.Msg), m *sync.Mutex) Api {
+func NewApi(port string, db db.Database, b mtp.Broker, msgQueue map[string](chan *usp_msg.Msg), m *sync.Mutex, bus *events.Bus, files *filestore.Store, filesUrl string) Api {
+	dispatcher := usp.NewDispatcher(b, msgQueue, m)
+	bulkEngine := bulk.NewEngine(db, dispatcher)
+	updater := firmware.NewUpdater(dispatcher, bus)
+	alarms := alarm.NewEngine(db, bus)
+	collector := metrics.NewCollector(db, dispatcher)
+	collector.OnCollect = alarms.Observe
+	profiles := profile.NewReconciler(db, dispatcher, bus)
+	backups := backup.NewService(db, dispatcher)
 	return Api{
-		Port:     port,
-		Db:       db,
-		Broker:   b,
-		MsgQueue: msgQueue,
-		QMutex:   m,
+		Port:      port,
+		Db:        db,
+		Broker:    b,
+		Usp:       dispatcher,
+		Jobs:      jobs.NewManager(db),
+		Bulk:      bulkEngine,
+		Scheduler: scheduler.NewScheduler(db, bulkEngine),
+		Events:    bus,
+		Firmware:  updater,
+		Campaigns: campaign.NewEngine(db, updater),
+		Profiles:  profiles,
+		Liveness:  liveness.NewMonitor(db, dispatcher, bus),
+		Metrics:   collector,
+		Alarms:    alarms,
+		Commands:  command.NewRunner(dispatcher, bus),
+		Backups:   backups,
+		Reboot:    reboot.NewService(dispatcher, bus, profiles, backups),
+		Files:     files,
+		FilesUrl:  strings.TrimSuffix(filesUrl, "/"),
 	}
 }
 
-//TODO: restructure http api calls for mqtt, to use golang generics and avoid code repetition
-//TODO: standardize timeouts through code
 //TODO: fix api methods
 
 func StartApi(a Api) {
@@ -70,20 +106,186 @@ func StartApi(a Api) {
 	authentication.HandleFunc("/admin/exists", a.adminUserExists).Methods("GET")
 	iot := r.PathPrefix("/api/device").Subrouter()
 	iot.HandleFunc("", a.retrieveDevices).Methods("GET")
-	iot.HandleFunc("/{sn}/get", a.deviceGetMsg).Methods("PUT")
-	iot.HandleFunc("/{sn}/add", a.deviceCreateMsg).Methods("PUT")
-	iot.HandleFunc("/{sn}/del", a.deviceDeleteMsg).Methods("PUT")
-	iot.HandleFunc("/{sn}/set", a.deviceUpdateMsg).Methods("PUT")
-	iot.HandleFunc("/{sn}/parameters", a.deviceGetSupportedParametersMsg).Methods("PUT")
-	iot.HandleFunc("/{sn}/instances", a.deviceGetParameterInstances).Methods("PUT")
+	iot.HandleFunc("/availability", a.fleetAvailability).Methods("GET")
+	iot.HandleFunc("/{sn}/"+usp.Get.Name, uspHandler(&a, usp.Get)).Methods("PUT")
+	iot.HandleFunc("/{sn}/"+usp.Add.Name, uspHandler(&a, usp.Add)).Methods("PUT")
+	iot.HandleFunc("/{sn}/"+usp.Delete.Name, uspHandler(&a, usp.Delete)).Methods("PUT")
+	iot.HandleFunc("/{sn}/"+usp.Set.Name, uspHandler(&a, usp.Set)).Methods("PUT")
+	iot.HandleFunc("/{sn}/"+usp.Operate.Name, uspHandler(&a, usp.Operate)).Methods("PUT")
+	iot.HandleFunc("/{sn}/"+usp.GetSupportedDM.Name, uspHandler(&a, usp.GetSupportedDM)).Methods("PUT")
+	iot.HandleFunc("/{sn}/"+usp.GetInstances.Name, uspHandler(&a, usp.GetInstances)).Methods("PUT")
+	iot.HandleFunc("/{sn}/"+usp.Get.Name, uspJobHandler(&a, usp.Get)).Methods("POST")
+	iot.HandleFunc("/{sn}/"+usp.Add.Name, uspJobHandler(&a, usp.Add)).Methods("POST")
+	iot.HandleFunc("/{sn}/"+usp.Delete.Name, uspJobHandler(&a, usp.Delete)).Methods("POST")
+	iot.HandleFunc("/{sn}/"+usp.Set.Name, uspJobHandler(&a, usp.Set)).Methods("POST")
+	iot.HandleFunc("/{sn}/"+usp.Operate.Name, uspJobHandler(&a, usp.Operate)).Methods("POST")
+	iot.HandleFunc("/{sn}/"+usp.GetSupportedDM.Name, uspJobHandler(&a, usp.GetSupportedDM)).Methods("POST")
+	iot.HandleFunc("/{sn}/"+usp.GetInstances.Name, uspJobHandler(&a, usp.GetInstances)).Methods("POST")
 	iot.HandleFunc("/{sn}/update", a.deviceFwUpdate).Methods("PUT")
 	iot.HandleFunc("/{sn}/wifi", a.deviceWifi).Methods("PUT", "GET")
+	iot.HandleFunc("/{sn}/wifi/scan", a.deviceWifiScan).Methods("POST")
+	iot.HandleFunc("/{sn}/wan", a.deviceWan).Methods("GET")
+	iot.HandleFunc("/{sn}/optical", a.deviceOptical).Methods("GET")
+	iot.HandleFunc("/{sn}/dhcp", a.deviceDhcp).Methods("GET", "PUT")
+	iot.HandleFunc("/{sn}/voice", a.deviceVoice).Methods("GET", "PUT")
+	iot.HandleFunc("/{sn}/nat/portmappings", a.devicePortMappings).Methods("GET", "POST")
+	iot.HandleFunc("/{sn}/nat/portmappings/{id}", a.devicePortMapping).Methods("GET", "PUT", "DELETE")
+	iot.HandleFunc("/{sn}/firewall", a.deviceFirewall).Methods("GET", "PUT")
+	iot.HandleFunc("/{sn}/firewall/chains", a.createFirewallChain).Methods("POST")
+	iot.HandleFunc("/{sn}/firewall/chains/{chain}", a.firewallChain).Methods("PUT", "DELETE")
+	iot.HandleFunc("/{sn}/firewall/chains/{chain}/rules", a.createFirewallRule).Methods("POST")
+	iot.HandleFunc("/{sn}/firewall/chains/{chain}/rules/{id}", a.firewallRule).Methods("PUT", "DELETE")
+	iot.HandleFunc("/{sn}/software", a.deviceSoftware).Methods("GET")
+	iot.HandleFunc("/{sn}/software/install", a.deviceInstallDU).Methods("POST")
+	iot.HandleFunc("/{sn}/software/du/{uuid}/update", a.deviceUpdateDU).Methods("POST")
+	iot.HandleFunc("/{sn}/software/du/{uuid}/uninstall", a.deviceUninstallDU).Methods("POST")
+	iot.HandleFunc("/{sn}/software/eu/{euid}/state", a.deviceSetEUState).Methods("POST")
+	iot.HandleFunc("/{sn}/hosts", a.deviceHosts).Methods("GET")
+	iot.HandleFunc("/{sn}/hosts/history", a.deviceHostsHistory).Methods("GET")
+	iot.HandleFunc("/{sn}/reboot", a.deviceReboot).Methods("POST")
+	iot.HandleFunc("/{sn}/factory-reset", a.deviceFactoryReset).Methods("POST")
+	iot.HandleFunc("/{sn}/diagnostics/ping", a.devicePing).Methods("POST")
+	iot.HandleFunc("/{sn}/diagnostics/traceroute", a.deviceTraceRoute).Methods("POST")
+	iot.HandleFunc("/{sn}/diagnostics/download", a.deviceDownloadTest).Methods("POST")
+	iot.HandleFunc("/{sn}/diagnostics/upload", a.deviceUploadTest).Methods("POST")
+	iot.HandleFunc("/{sn}/presence", a.devicePresence).Methods("GET")
+	iot.HandleFunc("/{sn}/metrics", a.deviceMetrics).Methods("GET")
+	iot.HandleFunc("/{sn}/backup", a.deviceBackup).Methods("POST")
+	iot.HandleFunc("/{sn}/backups", a.deviceBackups).Methods("GET")
+	iot.HandleFunc("/{sn}/restore", a.deviceRestore).Methods("POST")
+	iot.HandleFunc("/{sn}/profiles", a.deviceProfiles).Methods("GET")
+	iot.HandleFunc("/{sn}/profiles/{id}/check", a.deviceProfileCheck).Methods("PUT")
+	iot.HandleFunc("/{sn}/profiles/{id}/apply", a.deviceProfileApply).Methods("PUT")
 
 	// Middleware for requests which requires user to be authenticated
 	iot.Use(func(handler http.Handler) http.Handler {
 		return middleware.Middleware(handler)
 	})
 
+	// Job updates stream, which browsers can only authenticate through the url
+	jobEvents := r.PathPrefix("/api/jobs/events").Subrouter()
+	jobEvents.HandleFunc("", a.jobEvents).Methods("GET")
+
+	jobEvents.Use(middleware.QueryToken, func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	// Asynchronous device requests, started by POST at device endpoints
+	jobs := r.PathPrefix("/api/jobs").Subrouter()
+	jobs.HandleFunc("", a.retrieveJobs).Methods("GET")
+	jobs.HandleFunc("/{id}", a.retrieveJob).Methods("GET")
+
+	jobs.Use(func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	// Operations against many devices at once
+	bulkJobs := r.PathPrefix("/api/bulk").Subrouter()
+	bulkJobs.HandleFunc("", a.retrieveBulkJobs).Methods("GET")
+	bulkJobs.HandleFunc("", a.createBulkJob).Methods("POST")
+	bulkJobs.HandleFunc("/{id}", a.retrieveBulkJob).Methods("GET")
+	bulkJobs.HandleFunc("/{id}/results", a.retrieveBulkResults).Methods("GET")
+	bulkJobs.HandleFunc("/{id}/report", a.bulkJobReport).Methods("GET")
+	bulkJobs.HandleFunc("/{id}/retry", a.retryBulkJob).Methods("POST")
+
+	bulkJobs.Use(func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	// Operations scheduled at a given time or recurrently
+	tasks := r.PathPrefix("/api/tasks").Subrouter()
+	tasks.HandleFunc("", a.retrieveTasks).Methods("GET")
+	tasks.HandleFunc("", a.createTask).Methods("POST")
+	tasks.HandleFunc("/{id}", a.retrieveTask).Methods("GET")
+	tasks.HandleFunc("/{id}", a.updateTask).Methods("PUT")
+	tasks.HandleFunc("/{id}", a.deleteTask).Methods("DELETE")
+	tasks.HandleFunc("/{id}/runs", a.retrieveTaskRuns).Methods("GET")
+	tasks.HandleFunc("/{id}/run", a.runTask).Methods("POST")
+
+	tasks.Use(func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	// Firmware images repository
+	firmware := r.PathPrefix("/api/firmware").Subrouter()
+	firmware.HandleFunc("", a.retrieveFirmwares).Methods("GET")
+	firmware.HandleFunc("", a.uploadFirmware).Methods("POST")
+	firmware.HandleFunc("/{id}", a.retrieveFirmware).Methods("GET")
+	firmware.HandleFunc("/{id}", a.deleteFirmware).Methods("DELETE")
+
+	firmware.Use(func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	// Software packages devices install as deployment units
+	packages := r.PathPrefix("/api/packages").Subrouter()
+	packages.HandleFunc("", a.retrievePackages).Methods("GET")
+	packages.HandleFunc("", a.uploadPackage).Methods("POST")
+	packages.HandleFunc("/{id}", a.retrievePackage).Methods("GET")
+	packages.HandleFunc("/{id}", a.deletePackage).Methods("DELETE")
+
+	packages.Use(func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	// Staged rollouts of firmware images
+	campaigns := r.PathPrefix("/api/campaigns").Subrouter()
+	campaigns.HandleFunc("", a.retrieveCampaigns).Methods("GET")
+	campaigns.HandleFunc("", a.createCampaign).Methods("POST")
+	campaigns.HandleFunc("/{id}", a.retrieveCampaign).Methods("GET")
+	campaigns.HandleFunc("/{id}/devices", a.retrieveCampaignDevices).Methods("GET")
+	campaigns.HandleFunc("/{id}/pause", a.pauseCampaign).Methods("POST")
+	campaigns.HandleFunc("/{id}/continue", a.continueCampaign).Methods("POST")
+	campaigns.HandleFunc("/{id}/cancel", a.cancelCampaign).Methods("POST")
+
+	campaigns.Use(func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	// Configuration desired for groups of devices
+	profiles := r.PathPrefix("/api/profiles").Subrouter()
+	profiles.HandleFunc("", a.retrieveProfiles).Methods("GET")
+	profiles.HandleFunc("", a.createProfile).Methods("POST")
+	profiles.HandleFunc("/{id}", a.retrieveProfile).Methods("GET")
+	profiles.HandleFunc("/{id}", a.updateProfile).Methods("PUT")
+	profiles.HandleFunc("/{id}", a.deleteProfile).Methods("DELETE")
+	profiles.HandleFunc("/{id}/status", a.retrieveProfileStatus).Methods("GET")
+	profiles.HandleFunc("/{id}/reconcile", a.reconcileProfile).Methods("POST")
+
+	profiles.Use(func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	backups := r.PathPrefix("/api/backups").Subrouter()
+	backups.HandleFunc("/{id}", a.retrieveBackup).Methods("GET")
+	backups.HandleFunc("/{id}", a.deleteBackup).Methods("DELETE")
+
+	backups.Use(func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	alarms := r.PathPrefix("/api/alarms").Subrouter()
+	alarms.HandleFunc("", a.retrieveActiveAlarms).Methods("GET")
+	alarms.HandleFunc("/history", a.retrieveAlarmHistory).Methods("GET")
+	alarms.HandleFunc("/rules", a.retrieveAlarmRules).Methods("GET")
+	alarms.HandleFunc("/rules", a.createAlarmRule).Methods("POST")
+	alarms.HandleFunc("/rules/{id}", a.retrieveAlarmRule).Methods("GET")
+	alarms.HandleFunc("/rules/{id}", a.updateAlarmRule).Methods("PUT")
+	alarms.HandleFunc("/rules/{id}", a.deleteAlarmRule).Methods("DELETE")
+	alarms.HandleFunc("/{id}/acknowledge", a.acknowledgeAlarm).Methods("PUT")
+	alarms.HandleFunc("/{id}/clear", a.clearAlarm).Methods("PUT")
+
+	alarms.Use(func(handler http.Handler) http.Handler {
+		return middleware.Middleware(handler)
+	})
+
+	// Files downloaded by devices, which have no user credentials
+	files := r.PathPrefix("/files").Subrouter()
+	files.HandleFunc("/firmware/{id}/{file}", a.downloadFirmware).Methods("GET", "HEAD")
+	files.HandleFunc("/packages/{id}/{file}", a.downloadPackage).Methods("GET", "HEAD")
+	files.HandleFunc("/speedtest/download", a.speedTestDownload).Methods("GET", "HEAD")
+	files.HandleFunc("/speedtest/upload", a.speedTestUpload).Methods("PUT", "POST")
+
 	users := r.PathPrefix("/api/users").Subrouter()
 	users.HandleFunc("", a.retrieveUsers).Methods("GET")
 
@@ -101,6 +303,9 @@ func StartApi(a Api) {
 		ReadTimeout:  time.Second * 60,
 		IdleTimeout:  time.Second * 60,
 		Handler:      corsOpts.Handler(r), // Pass our instance of gorilla/mux in.
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
 	}
 
 	// Run our server in a goroutine so that it doesn't block.
@@ -110,6 +315,18 @@ func StartApi(a Api) {
 		}
 	}()
 	log.Println("Running Api at port", a.Port)
+	if a.FilesUrl == "" {
+		log.Println("Files url is not set, devices will download files from the host the api is called at, set files_url if they can't reach it")
+	}
+
+	a.Bulk.Resume()
+	a.Commands.Start()
+	a.Scheduler.Start()
+	a.Campaigns.Resume()
+	a.Profiles.Start()
+	a.Liveness.Start()
+	a.Metrics.Start()
+	a.Alarms.Start()
 }
 
 func (a *Api) retrieveDevices(w http.ResponseWriter, r *http.Request) {
@@ -119,6 +336,23 @@ func (a *Api) retrieveDevices(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	sns := make([]string, len(devices))
+	for i, d := range devices {
+		sns[i] = d.SN
+	}
+	now := time.Now()
+	uptime, err := a.Db.Uptime(sns, now.Add(-uptimeWindow), now)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range devices {
+		if u, ok := uptime[devices[i].SN]; ok {
+			devices[i].Uptime = &u
+		}
+	}
+
 	err = json.NewEncoder(w).Encode(devices)
 	if err != nil {
 		log.Println(err)
@@ -146,566 +380,90 @@ func (a *Api) retrieveUsers(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-// Check which fw image is activated
-func checkAvaiableFwPartition(reqPathResult []*usp_msg.GetResp_RequestedPathResult) int {
-	for _, x := range reqPathResult {
-		partitionsNumber := len(x.ResolvedPathResults)
-		if partitionsNumber > 1 {
-			log.Printf("Device has %d firmware partitions", partitionsNumber)
-		}
-		for i, y := range x.ResolvedPathResults {
-			if y.ResultParams["Status"] == "Available" {
-				log.Printf("Partition %d is avaiable", i)
-				return i
-			}
-		}
-	}
-	return -1
-}
-
+// Updates the device with an image of the firmware repository, the update
+// goes on in a job since it lasts at least until the device reboots
 func (a *Api) deviceFwUpdate(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sn := vars["sn"]
-	a.deviceExists(sn, w)
-
-	msg := utils.NewGetMsg(usp_msg.Get{
-		ParamPaths: []string{"Device.DeviceInfo.FirmwareImage.*.Status"},
-		MaxDepth:   1,
-	})
-	encodedMsg, err := proto.Marshal(&msg)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+	if !a.deviceExists(sn, w) {
 		return
 	}
 
-	record := utils.NewUspRecord(encodedMsg, sn)
-	tr369Message, err := proto.Marshal(&record)
+	var receiver firmware.Request
+	err := usp.DecodeRequest(r.Body, &receiver)
 	if err != nil {
-		log.Fatalln("Failed to encode tr369 record:", err)
-	}
-
-	a.MsgQueue[msg.Header.MsgId] = make(chan usp_msg.Msg)
-	log.Println("Sending Msg:", msg.Header.MsgId)
-	a.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
-
-	var getMsgAnswer *usp_msg.GetResp
-
-	select {
-	case msg := <-a.MsgQueue[msg.Header.MsgId]:
-		log.Printf("Received Msg: %s", msg.Header.MsgId)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		getMsgAnswer = msg.Body.GetResponse().GetGetResp()
-	case <-time.After(time.Second * 55):
-		log.Printf("Request %s Timed Out", msg.Header.MsgId)
-		w.WriteHeader(http.StatusGatewayTimeout)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode("Request Timed Out")
+		uspError(w, err)
 		return
 	}
-
-	// Check which fw image is activated
-	partition := checkAvaiableFwPartition(getMsgAnswer.ReqPathResults)
-	if partition < 0 {
-		log.Println("Error to get device available firmware partition, probably it has only one partition")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode("Server don't have the hability to update device with only one partition")
+	if err := receiver.Validate(); err != nil {
+		uspError(w, err)
 		return
-		//TODO: update device with only one partition
-	}
-
-	var receiver = usp_msg.Operate{
-		Command:    "Device.DeviceInfo.FirmwareImage.1.Download()",
-		CommandKey: "Download()",
-		SendResp:   true,
-		InputArgs: map[string]string{
-			"URL":          "http://cronos.intelbras.com.br/download/PON/121AC/beta/121AC-2.3-230620-77753201df4f1e2c607a7236746c8491.tar", //TODO: use dynamic url
-			"AutoActivate": "true",
-			//"Username": "",
-			//"Password": "",
-			"FileSize": "0", //TODO: send firmware length
-			//"CheckSumAlgorithm": "",
-			//"CheckSum":          "",
-		},
 	}
-
-	msg = utils.NewOperateMsg(receiver)
-	encodedMsg, err = proto.Marshal(&msg)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+	fw, ok := a.firmware(w, receiver.Firmware)
+	if !ok {
 		return
 	}
 
-	record = utils.NewUspRecord(encodedMsg, sn)
-	tr369Message, err = proto.Marshal(&record)
+	filesUrl := a.filesUrl(r)
+	job, err := a.Jobs.Start(sn, "firmware", receiver, func(ctx context.Context) (interface{}, error) {
+		return a.Firmware.Update(ctx, sn, fw, filesUrl, receiver.Windows, nil)
+	})
 	if err != nil {
-		log.Fatalln("Failed to encode tr369 record:", err)
-	}
-
-	a.MsgQueue[msg.Header.MsgId] = make(chan usp_msg.Msg)
-	log.Println("Sending Msg:", msg.Header.MsgId)
-	a.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
-
-	select {
-	case msg := <-a.MsgQueue[msg.Header.MsgId]:
-		log.Printf("Received Msg: %s", msg.Header.MsgId)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode(msg.Body.GetResponse().GetSetResp())
-		return
-	case <-time.After(time.Second * 55):
-		log.Printf("Request %s Timed Out", msg.Header.MsgId)
-		w.WriteHeader(http.StatusGatewayTimeout)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode("Request Timed Out")
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
 }
 
+/*
+GET answers the radios of the device along with their SSIDs, PUT changes
+them after checking the device supports the new settings, answering the
+configuration once changed.
+*/
 func (a *Api) deviceWifi(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sn := vars["sn"]
-	a.deviceExists(sn, w)
+	if !a.deviceExists(sn, w) {
+		return
+	}
 
+	var radios []wifi.Radio
+	var err error
 	if r.Method == http.MethodGet {
-		msg := utils.NewGetMsg(usp_msg.Get{
-			ParamPaths: []string{
-				"Device.WiFi.SSID.[Enable==true].SSID",
-				//"Device.WiFi.AccessPoint.[Enable==true].SSIDReference",
-				"Device.WiFi.AccessPoint.[Enable==true].Security.ModeEnabled",
-				"Device.WiFi.AccessPoint.[Enable==true].Security.ModesSupported",
-				//"Device.WiFi.EndPoint.[Enable==true].",
-				"Device.WiFi.Radio.[Enable==true].AutoChannelEnable",
-				"Device.WiFi.Radio.[Enable==true].Channel",
-				"Device.WiFi.Radio.[Enable==true].CurrentOperatingChannelBandwidth",
-				"Device.WiFi.Radio.[Enable==true].OperatingFrequencyBand",
-				//"Device.WiFi.Radio.[Enable==true].PossibleChannels",
-				"Device.WiFi.Radio.[Enable==true].SupportedOperatingChannelBandwidths",
-			},
-			MaxDepth: 2,
-		})
-
-		encodedMsg, err := proto.Marshal(&msg)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		record := utils.NewUspRecord(encodedMsg, sn)
-		tr369Message, err := proto.Marshal(&record)
-		if err != nil {
-			log.Fatalln("Failed to encode tr369 record:", err)
-		}
-
-		//a.Broker.Request(tr369Message, usp_msg.Header_GET, "oktopus/v1/agent/"+sn, "oktopus/v1/get/"+sn)
-		a.MsgQueue[msg.Header.MsgId] = make(chan usp_msg.Msg)
-		log.Println("Sending Msg:", msg.Header.MsgId)
-		a.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
-
-		//TODO: verify in protocol and in other models, the Device.Wifi parameters. Maybe in the future, to use SSIDReference from AccessPoint
-		select {
-		case msg := <-a.MsgQueue[msg.Header.MsgId]:
-			log.Printf("Received Msg: %s", msg.Header.MsgId)
-			delete(a.MsgQueue, msg.Header.MsgId)
-			log.Println("requests queue:", a.MsgQueue)
-			answer := msg.Body.GetResponse().GetGetResp()
-
-			var wifi [2]WiFi
-
-			//TODO: better algorithm, might use something faster an more reliable
-			//TODO: full fill the commented wifi resources
-			for _, x := range answer.ReqPathResults {
-				if x.RequestedPath == "Device.WiFi.SSID.[Enable==true].SSID" {
-					for i, y := range x.ResolvedPathResults {
-						wifi[i].SSID = y.ResultParams["SSID"]
-					}
-					continue
-				}
-				if x.RequestedPath == "Device.WiFi.AccessPoint.[Enable==true].Security.ModeEnabled" {
-					for i, y := range x.ResolvedPathResults {
-						wifi[i].Security = y.ResultParams["Security.ModeEnabled"]
-					}
-					continue
-				}
-				if x.RequestedPath == "Device.WiFi.AccessPoint.[Enable==true].Security.ModesSupported" {
-					for i, y := range x.ResolvedPathResults {
-						wifi[i].SecurityCapabilities = strings.Split(y.ResultParams["Security.ModesSupported"], ",")
-					}
-					continue
-				}
-				if x.RequestedPath == "Device.WiFi.Radio.[Enable==true].AutoChannelEnable" {
-					for i, y := range x.ResolvedPathResults {
-						autoChannel, err := strconv.ParseBool(y.ResultParams["AutoChannelEnable"])
-						if err != nil {
-							log.Println(err)
-							wifi[i].AutoChannelEnable = false
-						} else {
-							wifi[i].AutoChannelEnable = autoChannel
-						}
-					}
-					continue
-				}
-				if x.RequestedPath == "Device.WiFi.Radio.[Enable==true].Channel" {
-					for i, y := range x.ResolvedPathResults {
-						channel, err := strconv.Atoi(y.ResultParams["Channel"])
-						if err != nil {
-							log.Println(err)
-							wifi[i].Channel = -1
-						} else {
-							wifi[i].Channel = channel
-						}
-					}
-					continue
-				}
-				if x.RequestedPath == "Device.WiFi.Radio.[Enable==true].CurrentOperatingChannelBandwidth" {
-					for i, y := range x.ResolvedPathResults {
-						wifi[i].ChannelBandwidth = y.ResultParams["CurrentOperatingChannelBandwidth"]
-					}
-					continue
-				}
-				if x.RequestedPath == "Device.WiFi.Radio.[Enable==true].OperatingFrequencyBand" {
-					for i, y := range x.ResolvedPathResults {
-						wifi[i].FrequencyBand = y.ResultParams["OperatingFrequencyBand"]
-					}
-					continue
-				}
-				if x.RequestedPath == "Device.WiFi.Radio.[Enable==true].SupportedOperatingChannelBandwidths" {
-					for i, y := range x.ResolvedPathResults {
-						wifi[i].SupportedChannelBandwidths = strings.Split(y.ResultParams["SupportedOperatingChannelBandwidths"], ",")
-					}
-					continue
-				}
-			}
-			json.NewEncoder(w).Encode(&wifi)
-			return
-		case <-time.After(time.Second * 45):
-			log.Printf("Request %s Timed Out", msg.Header.MsgId)
-			w.WriteHeader(http.StatusGatewayTimeout)
-			delete(a.MsgQueue, msg.Header.MsgId)
-			log.Println("requests queue:", a.MsgQueue)
-			json.NewEncoder(w).Encode("Request Timed Out")
+		radios, err = wifi.Get(r.Context(), a.Usp, sn)
+	} else {
+		var receiver wifi.Request
+		if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+			uspError(w, err)
 			return
 		}
+		radios, err = wifi.Set(r.Context(), a.Usp, sn, receiver)
 	}
-}
-
-func (a *Api) deviceGetParameterInstances(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sn := vars["sn"]
-	a.deviceExists(sn, w)
-
-	var receiver usp_msg.GetInstances
-
-	err := json.NewDecoder(r.Body).Decode(&receiver)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		uspError(w, err)
 		return
 	}
-
-	msg := utils.NewGetParametersInstancesMsg(receiver)
-	encodedMsg, err := proto.Marshal(&msg)
+	err = json.NewEncoder(w).Encode(radios)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	record := utils.NewUspRecord(encodedMsg, sn)
-	tr369Message, err := proto.Marshal(&record)
-	if err != nil {
-		log.Fatalln("Failed to encode tr369 record:", err)
-	}
-
-	//a.Broker.Request(tr369Message, usp_msg.Header_GET, "oktopus/v1/agent/"+sn, "oktopus/v1/get/"+sn)
-	a.MsgQueue[msg.Header.MsgId] = make(chan usp_msg.Msg)
-	log.Println("Sending Msg:", msg.Header.MsgId)
-	a.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
-
-	select {
-	case msg := <-a.MsgQueue[msg.Header.MsgId]:
-		log.Printf("Received Msg: %s", msg.Header.MsgId)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode(msg.Body.GetResponse().GetGetInstancesResp())
-		return
-	case <-time.After(time.Second * 55):
-		log.Printf("Request %s Timed Out", msg.Header.MsgId)
-		w.WriteHeader(http.StatusGatewayTimeout)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode("Request Timed Out")
-		return
 	}
 }
 
-func (a *Api) deviceGetSupportedParametersMsg(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sn := vars["sn"]
-	a.deviceExists(sn, w)
-
-	var receiver usp_msg.GetSupportedDM
-
-	err := json.NewDecoder(r.Body).Decode(&receiver)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	msg := utils.NewGetSupportedParametersMsg(receiver)
-	encodedMsg, err := proto.Marshal(&msg)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	record := utils.NewUspRecord(encodedMsg, sn)
-	tr369Message, err := proto.Marshal(&record)
-	if err != nil {
-		log.Fatalln("Failed to encode tr369 record:", err)
-	}
-
-	//a.Broker.Request(tr369Message, usp_msg.Header_GET, "oktopus/v1/agent/"+sn, "oktopus/v1/get/"+sn)
-	a.MsgQueue[msg.Header.MsgId] = make(chan usp_msg.Msg)
-	log.Println("Sending Msg:", msg.Header.MsgId)
-	a.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
-
-	select {
-	case msg := <-a.MsgQueue[msg.Header.MsgId]:
-		log.Printf("Received Msg: %s", msg.Header.MsgId)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode(msg.Body.GetResponse().GetGetSupportedDmResp())
-		return
-	case <-time.After(time.Second * 55):
-		log.Printf("Request %s Timed Out", msg.Header.MsgId)
-		w.WriteHeader(http.StatusGatewayTimeout)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode("Request Timed Out")
-		return
-	}
-}
-
-func (a *Api) deviceCreateMsg(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sn := vars["sn"]
-	a.deviceExists(sn, w)
-
-	var receiver usp_msg.Add
-
-	err := json.NewDecoder(r.Body).Decode(&receiver)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	msg := utils.NewCreateMsg(receiver)
-	encodedMsg, err := proto.Marshal(&msg)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	record := utils.NewUspRecord(encodedMsg, sn)
-	tr369Message, err := proto.Marshal(&record)
-	if err != nil {
-		log.Fatalln("Failed to encode tr369 record:", err)
-	}
-
-	//a.Broker.Request(tr369Message, usp_msg.Header_GET, "oktopus/v1/agent/"+sn, "oktopus/v1/get/"+sn)
-	a.MsgQueue[msg.Header.MsgId] = make(chan usp_msg.Msg)
-	log.Println("Sending Msg:", msg.Header.MsgId)
-	a.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
-
-	select {
-	case msg := <-a.MsgQueue[msg.Header.MsgId]:
-		log.Printf("Received Msg: %s", msg.Header.MsgId)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode(msg.Body.GetResponse().GetAddResp())
-		return
-	case <-time.After(time.Second * 55):
-		log.Printf("Request %s Timed Out", msg.Header.MsgId)
-		w.WriteHeader(http.StatusGatewayTimeout)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode("Request Timed Out")
-		return
-	}
-}
-
-func (a *Api) deviceGetMsg(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sn := vars["sn"]
-
-	a.deviceExists(sn, w)
-
-	var receiver usp_msg.Get
-
-	err := json.NewDecoder(r.Body).Decode(&receiver)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	msg := utils.NewGetMsg(receiver)
-	encodedMsg, err := proto.Marshal(&msg)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	record := utils.NewUspRecord(encodedMsg, sn)
-	tr369Message, err := proto.Marshal(&record)
-	if err != nil {
-		log.Fatalln("Failed to encode tr369 record:", err)
-	}
-
-	a.MsgQueue[msg.Header.MsgId] = make(chan usp_msg.Msg)
-
-	log.Println("Sending Msg:", msg.Header.MsgId)
-	a.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
-
-	select {
-	case msg := <-a.MsgQueue[msg.Header.MsgId]:
-		log.Printf("Received Msg: %s", msg.Header.MsgId)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode(msg.Body.GetResponse().GetGetResp())
-		return
-	case <-time.After(time.Second * 55):
-		log.Printf("Request %s Timed Out", msg.Header.MsgId)
-		w.WriteHeader(http.StatusGatewayTimeout)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode("Request Timed Out")
-		return
-	}
-}
-
-func (a *Api) deviceDeleteMsg(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sn := vars["sn"]
-	a.deviceExists(sn, w)
-
-	var receiver usp_msg.Delete
-
-	err := json.NewDecoder(r.Body).Decode(&receiver)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	msg := utils.NewDelMsg(receiver)
-	encodedMsg, err := proto.Marshal(&msg)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	record := utils.NewUspRecord(encodedMsg, sn)
-	tr369Message, err := proto.Marshal(&record)
-	if err != nil {
-		log.Fatalln("Failed to encode tr369 record:", err)
-	}
-
-	//a.Broker.Request(tr369Message, usp_msg.Header_GET, "oktopus/v1/agent/"+sn, "oktopus/v1/get/"+sn)
-	a.MsgQueue[msg.Header.MsgId] = make(chan usp_msg.Msg)
-	log.Println("Sending Msg:", msg.Header.MsgId)
-	a.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
-
-	select {
-	case msg := <-a.MsgQueue[msg.Header.MsgId]:
-		log.Printf("Received Msg: %s", msg.Header.MsgId)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode(msg.Body.GetResponse().GetDeleteResp())
-		return
-	case <-time.After(time.Second * 55):
-		log.Printf("Request %s Timed Out", msg.Header.MsgId)
-		w.WriteHeader(http.StatusGatewayTimeout)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode("Request Timed Out")
-		return
-	}
-}
-
-func (a *Api) deviceUpdateMsg(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	sn := vars["sn"]
-	a.deviceExists(sn, w)
-
-	var receiver usp_msg.Set
-
-	err := json.NewDecoder(r.Body).Decode(&receiver)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	msg := utils.NewSetMsg(receiver)
-	encodedMsg, err := proto.Marshal(&msg)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	record := utils.NewUspRecord(encodedMsg, sn)
-	tr369Message, err := proto.Marshal(&record)
-	if err != nil {
-		log.Fatalln("Failed to encode tr369 record:", err)
-	}
-
-	//a.Broker.Request(tr369Message, usp_msg.Header_GET, "oktopus/v1/agent/"+sn, "oktopus/v1/get/"+sn)
-	a.MsgQueue[msg.Header.MsgId] = make(chan usp_msg.Msg)
-	log.Println("Sending Msg:", msg.Header.MsgId)
-	a.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
-
-	select {
-	case msg := <-a.MsgQueue[msg.Header.MsgId]:
-		log.Printf("Received Msg: %s", msg.Header.MsgId)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode(msg.Body.GetResponse().GetSetResp())
-		return
-	case <-time.After(time.Second * 55):
-		log.Printf("Request %s Timed Out", msg.Header.MsgId)
-		w.WriteHeader(http.StatusGatewayTimeout)
-		delete(a.MsgQueue, msg.Header.MsgId)
-		log.Println("requests queue:", a.MsgQueue)
-		json.NewEncoder(w).Encode("Request Timed Out")
-		return
-	}
-}
-
-func (a *Api) deviceExists(sn string, w http.ResponseWriter) {
+// Writes the error answer and returns false if there is no device with that serial number
+func (a *Api) deviceExists(sn string, w http.ResponseWriter) bool {
 	_, err := a.Db.RetrieveDevice(sn)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode("No device with serial number " + sn + " was found")
-			return
+			return false
 		}
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return false
 	}
+	return true
 }
 
 func (a *Api) registerUser(w http.ResponseWriter, r *http.Request) {
@@ -1,7 +1,11 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"os"
 	"time"
@@ -60,3 +64,24 @@ func ValidateToken(signedToken string) (email string, err error) {
 
 	return
 }
+
+/*
+SignResource grants access to the resource until expires, a unix time, for
+urls given to devices, which have no user credentials. The signature is kept
+short, since devices limit the length of urls.
+*/
+func SignResource(resource string, expires int64) string {
+	mac := hmac.New(sha256.New, getJwtKey())
+	fmt.Fprintf(mac, "%s|%d", resource, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func ValidateResource(resource, signature string, expires int64) error {
+	if expires < time.Now().Unix() {
+		return errors.New("signature expired")
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignResource(resource, expires))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
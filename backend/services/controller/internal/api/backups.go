@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/backup"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Saves the configuration of the device in a job, since reading the whole
+// data model takes a while
+func (a *Api) deviceBackup(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	var receiver struct {
+		Note string `json:"note"`
+	}
+	if err := usp.DecodeOptionalRequest(r.Body, &receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+
+	job, err := a.Jobs.Start(sn, "backup", receiver, func(ctx context.Context) (interface{}, error) {
+		b, err := a.Backups.Backup(ctx, sn, receiver.Note)
+		if err != nil {
+			return nil, err
+		}
+		// The content is at /api/backups/{id}, the job only keeps a summary
+		return map[string]interface{}{
+			"id":      b.Id,
+			"version": b.Version,
+			"params":  len(b.Params),
+			"objects": len(b.Objects),
+		}, nil
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (a *Api) deviceBackups(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	backups, err := a.Db.RetrieveBackups(sn)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(backups)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Replays a backup onto the device, which may be another one than the
+// backup was taken from, and reports what couldn't be applied
+func (a *Api) deviceRestore(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	var receiver backup.RestoreRequest
+	err := usp.DecodeRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	b, ok := a.backup(w, receiver.Backup)
+	if !ok {
+		return
+	}
+
+	job, err := a.Jobs.Start(sn, "restore", receiver, func(ctx context.Context) (interface{}, error) {
+		return a.Backups.Restore(ctx, b, sn, receiver.Exclude)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (a *Api) retrieveBackup(w http.ResponseWriter, r *http.Request) {
+	b, ok := a.backup(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	err := json.NewEncoder(w).Encode(b)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) deleteBackup(w http.ResponseWriter, r *http.Request) {
+	b, ok := a.backup(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if err := a.Db.DeleteBackup(b.Id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Api) backup(w http.ResponseWriter, id string) (db.Backup, bool) {
+	b, err := a.Db.RetrieveBackup(id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode("No backup with id " + id + " was found")
+			return b, false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return b, false
+	}
+	return b, true
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/bulk"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (a *Api) createBulkJob(w http.ResponseWriter, r *http.Request) {
+	var receiver db.BulkJob
+	err := usp.DecodeRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+
+	job, err := a.Bulk.Start(receiver)
+	if err != nil {
+		if errors.Is(err, usp.ErrInvalidRequest) || errors.Is(err, bulk.ErrNoTargets) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (a *Api) retrieveBulkJobs(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	jobs, err := a.Db.RetrieveBulkJobs(limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(jobs)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) retrieveBulkJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.bulkJob(w, r)
+	if !ok {
+		return
+	}
+	err := json.NewEncoder(w).Encode(job)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Per device results, filtered by the status query parameter
+func (a *Api) retrieveBulkResults(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.bulkJob(w, r)
+	if !ok {
+		return
+	}
+
+	var status []string
+	if s := r.URL.Query().Get("status"); s != "" {
+		status = append(status, s)
+	}
+	results, err := a.Db.RetrieveBulkResults(job.Id, status...)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) retryBulkJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.bulkJob(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := a.Bulk.Retry(job.Id)
+	if err != nil {
+		if err == bulk.ErrRunning {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// Downloads the results of a bulk job as a csv file
+func (a *Api) bulkJobReport(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.bulkJob(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := a.Db.RetrieveBulkResults(job.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"bulk-"+job.Id+".csv\"")
+
+	report := csv.NewWriter(w)
+	report.Write([]string{"sn", "status", "attempts", "updatedAt", "result", "error"})
+	for _, x := range results {
+		report.Write([]string{
+			x.SN,
+			x.Status,
+			strconv.Itoa(x.Attempts),
+			x.UpdatedAt.Format("2006-01-02T15:04:05Z07:00"),
+			string(x.Result),
+			string(x.Error),
+		})
+	}
+	report.Flush()
+	if err := report.Error(); err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) bulkJob(w http.ResponseWriter, r *http.Request) (db.BulkJob, bool) {
+	id := mux.Vars(r)["id"]
+
+	job, err := a.Db.RetrieveBulkJob(id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode("No bulk job with id " + id + " was found")
+			return job, false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return job, false
+	}
+	return job, true
+}
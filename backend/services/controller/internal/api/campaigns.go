@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/bulk"
+	"github.com/leandrofars/oktopus/internal/campaign"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (a *Api) createCampaign(w http.ResponseWriter, r *http.Request) {
+	var receiver db.Campaign
+	err := usp.DecodeRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	if receiver.FilesUrl == "" {
+		receiver.FilesUrl = a.filesUrl(r)
+	}
+
+	c, err := a.Campaigns.Create(receiver)
+	if err != nil {
+		if errors.Is(err, usp.ErrInvalidRequest) || errors.Is(err, bulk.ErrNoTargets) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// Campaigns, filtered by the status query parameter
+func (a *Api) retrieveCampaigns(w http.ResponseWriter, r *http.Request) {
+	var status []string
+	if s := r.URL.Query().Get("status"); s != "" {
+		status = append(status, s)
+	}
+	campaigns, err := a.Db.RetrieveCampaigns(status...)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(campaigns)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) retrieveCampaign(w http.ResponseWriter, r *http.Request) {
+	c, ok := a.campaign(w, r)
+	if !ok {
+		return
+	}
+	err := json.NewEncoder(w).Encode(c)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Per device progress, filtered by the wave and status query parameters
+func (a *Api) retrieveCampaignDevices(w http.ResponseWriter, r *http.Request) {
+	c, ok := a.campaign(w, r)
+	if !ok {
+		return
+	}
+
+	wave, err := strconv.Atoi(r.URL.Query().Get("wave"))
+	if err != nil {
+		wave = -1
+	}
+	var status []string
+	if s := r.URL.Query().Get("status"); s != "" {
+		status = append(status, s)
+	}
+
+	devices, err := a.Db.RetrieveCampaignDevices(c.Id, wave, status...)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(devices)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) pauseCampaign(w http.ResponseWriter, r *http.Request) {
+	a.campaignAction(w, r, func(id string) (db.Campaign, error) {
+		return a.Campaigns.Pause(id, "Paused by user")
+	})
+}
+
+func (a *Api) continueCampaign(w http.ResponseWriter, r *http.Request) {
+	a.campaignAction(w, r, a.Campaigns.Continue)
+}
+
+func (a *Api) cancelCampaign(w http.ResponseWriter, r *http.Request) {
+	a.campaignAction(w, r, a.Campaigns.Cancel)
+}
+
+func (a *Api) campaignAction(w http.ResponseWriter, r *http.Request, action func(id string) (db.Campaign, error)) {
+	c, ok := a.campaign(w, r)
+	if !ok {
+		return
+	}
+
+	c, err := action(c.Id)
+	if err != nil {
+		if err == campaign.ErrState {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode("Campaign is " + c.Status + ", it can't do that")
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+func (a *Api) campaign(w http.ResponseWriter, r *http.Request) (db.Campaign, bool) {
+	id := mux.Vars(r)["id"]
+
+	c, err := a.Db.RetrieveCampaign(id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode("No campaign with id " + id + " was found")
+			return c, false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return c, false
+	}
+	return c, true
+}
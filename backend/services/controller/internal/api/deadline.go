@@ -0,0 +1,24 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Context key of the connection a request came through
+type connKey struct{}
+
+/*
+Gives the handler until deadline to read the request and write its answer,
+instead of the server timeouts, a zero deadline meaning none. Meant for
+streams and big transfers, everything else keeps the server timeouts.
+*/
+func setDeadline(r *http.Request, deadline time.Time) {
+	c, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+	c.SetReadDeadline(deadline)
+	c.SetWriteDeadline(deadline)
+}
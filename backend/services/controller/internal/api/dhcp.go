@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/dhcp"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+/*
+GET answers the DHCPv4 server of the device with its pools, PUT changes them
+after checking each pool fits the subnet of its interface, answering the
+server once changed.
+*/
+func (a *Api) deviceDhcp(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	var server dhcp.Server
+	var err error
+	if r.Method == http.MethodGet {
+		server, err = dhcp.Get(r.Context(), a.Usp, sn)
+	} else {
+		var receiver dhcp.Request
+		if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+			uspError(w, err)
+			return
+		}
+		server, err = dhcp.Set(r.Context(), a.Usp, sn, receiver)
+	}
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(server)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/api/auth"
+	"github.com/leandrofars/oktopus/internal/diagnostics"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+const (
+	// Bounds how long the device may take to run a diagnostic
+	diagnosticsTimeout = 5 * time.Minute
+	// Time based speed tests must end well before the diagnostic times out
+	maxSpeedTestDuration = 4 * time.Minute
+	// Bytes moved by speed tests against the controller, unless told otherwise
+	speedTestSize    = 25 << 20
+	maxSpeedTestSize = 1 << 30
+
+	speedTestDownloadPath = "/files/speedtest/download"
+	speedTestUploadPath   = "/files/speedtest/upload"
+)
+
+func (a *Api) devicePing(w http.ResponseWriter, r *http.Request) {
+	var receiver diagnostics.PingRequest
+	a.diagnostic(w, r, "ping", &receiver, receiver.Validate, func(ctx context.Context, sn string) (interface{}, error) {
+		return diagnostics.Ping(ctx, a.Commands, sn, receiver)
+	})
+}
+
+func (a *Api) deviceTraceRoute(w http.ResponseWriter, r *http.Request) {
+	var receiver diagnostics.TraceRouteRequest
+	a.diagnostic(w, r, "traceroute", &receiver, receiver.Validate, func(ctx context.Context, sn string) (interface{}, error) {
+		return diagnostics.TraceRoute(ctx, a.Commands, sn, receiver)
+	})
+}
+
+// Downloads from the controller speed test endpoint unless an url is given
+func (a *Api) deviceDownloadTest(w http.ResponseWriter, r *http.Request) {
+	var receiver diagnostics.SpeedRequest
+	a.diagnostic(w, r, "download", &receiver, func() error {
+		if receiver.URL == "" {
+			receiver.FileLength = speedTestLength(receiver.FileLength)
+			receiver.URL = a.filesUrl(r) + speedTestDownloadPath + "?" + speedTestQuery(speedTestDownloadPath, receiver.FileLength)
+		}
+		if err := speedTestDuration(receiver); err != nil {
+			return err
+		}
+		return receiver.Validate()
+	}, func(ctx context.Context, sn string) (interface{}, error) {
+		return diagnostics.Download(ctx, a.Commands, sn, receiver)
+	})
+}
+
+// Uploads to the controller speed test endpoint unless an url is given
+func (a *Api) deviceUploadTest(w http.ResponseWriter, r *http.Request) {
+	var receiver diagnostics.SpeedRequest
+	a.diagnostic(w, r, "upload", &receiver, func() error {
+		if receiver.URL == "" {
+			receiver.FileLength = speedTestLength(receiver.FileLength)
+			// Time based tests upload as much as they can
+			limit := receiver.FileLength
+			if receiver.Duration > 0 {
+				limit = maxSpeedTestSize
+			}
+			receiver.URL = a.filesUrl(r) + speedTestUploadPath + "?" + speedTestQuery(speedTestUploadPath, limit)
+		}
+		if err := speedTestDuration(receiver); err != nil {
+			return err
+		}
+		return receiver.ValidateUpload()
+	}, func(ctx context.Context, sn string) (interface{}, error) {
+		return diagnostics.Upload(ctx, a.Commands, sn, receiver)
+	})
+}
+
+/*
+Decodes the request, then fills its defaults and validates it through the
+prepare function, and runs the diagnostic as a job, whose result holds the
+outcome once the device completes it
+*/
+func (a *Api) diagnostic(w http.ResponseWriter, r *http.Request, name string, receiver interface{}, prepare func() error, run func(ctx context.Context, sn string) (interface{}, error)) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	err := usp.DecodeOptionalRequest(r.Body, receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	if err := prepare(); err != nil {
+		uspError(w, err)
+		return
+	}
+
+	job, err := a.Jobs.Start(sn, name, receiver, func(ctx context.Context) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, diagnosticsTimeout)
+		defer cancel()
+		return run(ctx, sn)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func speedTestDuration(req diagnostics.SpeedRequest) error {
+	if time.Duration(req.Duration)*time.Second > maxSpeedTestDuration {
+		return fmt.Errorf("%w: duration can't be over %s", usp.ErrInvalidRequest, maxSpeedTestDuration)
+	}
+	return nil
+}
+
+/*
+Query of the speed test url given to a device, which lets it move up to size
+bytes while the diagnostic may run. Whoever lacks it is turned away, so the
+endpoints can't be used by anyone to waste the controller bandwidth.
+*/
+func speedTestQuery(path string, size int64) string {
+	expires := time.Now().Add(diagnosticsTimeout).Unix()
+	query := url.Values{}
+	query.Set("size", strconv.FormatInt(size, 10))
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("token", auth.SignResource(speedTestResource(path, size), expires))
+	return query.Encode()
+}
+
+// Size the speed test url was signed for, ok is false if it wasn't
+func speedTestAllowed(r *http.Request, path string) (size int64, ok bool) {
+	query := r.URL.Query()
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || size <= 0 || size > maxSpeedTestSize {
+		return 0, false
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if err := auth.ValidateResource(speedTestResource(path, size), query.Get("token"), expires); err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+func speedTestResource(path string, size int64) string {
+	return path + "?size=" + strconv.FormatInt(size, 10)
+}
+
+// Streams the size bytes the url was signed for, for devices to measure
+// their download throughput. The transfer may last as long as the diagnostic.
+func (a *Api) speedTestDownload(w http.ResponseWriter, r *http.Request) {
+	size, ok := speedTestAllowed(r, speedTestDownloadPath)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	setDeadline(r, time.Now().Add(diagnosticsTimeout))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	chunk := make([]byte, 64<<10)
+	for size > 0 {
+		n := int64(len(chunk))
+		if n > size {
+			n = size
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return
+		}
+		size -= n
+	}
+}
+
+// Takes up to the size the url was signed for, for devices to measure their
+// upload throughput. The transfer may last as long as the diagnostic.
+func (a *Api) speedTestUpload(w http.ResponseWriter, r *http.Request) {
+	size, ok := speedTestAllowed(r, speedTestUploadPath)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	setDeadline(r, time.Now().Add(diagnosticsTimeout))
+	if _, err := io.Copy(io.Discard, io.LimitReader(r.Body, size)); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func speedTestLength(size int64) int64 {
+	if size <= 0 {
+		return speedTestSize
+	}
+	if size > maxSpeedTestSize {
+		return maxSpeedTestSize
+	}
+	return size
+}
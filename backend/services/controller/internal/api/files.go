@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Files bigger than that are buffered on disk while uploading
+const maxUploadMemory = 32 << 20
+
+const (
+	// Slowest link files are expected to move through, in bytes per second,
+	// as devices on a poor line downloading an image
+	minTransferRate = 32 << 10
+	// Time a transfer gets on top of what its size takes at the slowest rate
+	transferSlack = time.Minute
+	// Time a transfer of unknown size gets
+	maxTransferTime = time.Hour
+)
+
+// Deadline of a transfer of size bytes, the server timeouts being too short
+// for big files over slow links
+func transferDeadline(size int64) time.Time {
+	if size < 0 {
+		return time.Now().Add(maxTransferTime)
+	}
+	return time.Now().Add(transferSlack + time.Duration(size/minTransferRate)*time.Second)
+}
+
+// File field of a multipart form upload
+type upload struct {
+	multipart.File
+	// Base name of the file as sent by the client
+	Name string
+	form *multipart.Form
+}
+
+// Close closes the file and removes the form files buffered on disk.
+func (u *upload) Close() error {
+	u.File.Close()
+	return u.form.RemoveAll()
+}
+
+/*
+Reads an upload sent as a multipart form with a file field, what naming the
+kind of file in the answers and fallback being the name of files sent
+without one. It writes the answer itself if it fails. The other fields are
+left in the form of the request.
+*/
+func receiveUpload(w http.ResponseWriter, r *http.Request, what, fallback string) (*upload, bool) {
+	setDeadline(r, transferDeadline(r.ContentLength))
+	err := r.ParseMultipartForm(maxUploadMemory)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(what + " must be sent as multipart/form-data")
+		return nil, false
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		r.MultipartForm.RemoveAll()
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(what + " file is required")
+		return nil, false
+	}
+
+	name := path.Base(header.Filename)
+	if name == "." || name == "/" {
+		name = fallback
+	}
+	return &upload{File: file, Name: name, form: r.MultipartForm}, true
+}
+
+// Serves a file of the store to devices, which have no user credentials, so
+// it doesn't require authentication
+func (a *Api) serveFile(w http.ResponseWriter, r *http.Request, storePath, name string, size int64, modTime time.Time) {
+	file, err := a.Files.Open(storePath)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	setDeadline(r, transferDeadline(size))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, name, modTime, file)
+}
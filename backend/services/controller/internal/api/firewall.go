@@ -0,0 +1,168 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/firewall"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+// GET lists the port mappings of the device, POST creates one answering it
+// along with the ID it's known by from then on
+func (a *Api) devicePortMappings(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		mappings, err := firewall.PortMappings(r.Context(), a.Usp, sn)
+		firewallAnswer(w, http.StatusOK, mappings, err)
+		return
+	}
+	receiver := firewall.DefaultPortMapping()
+	if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+	m, err := firewall.AddPortMapping(r.Context(), a.Usp, sn, receiver)
+	firewallAnswer(w, http.StatusCreated, m, err)
+}
+
+func (a *Api) devicePortMapping(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sn, id := vars["sn"], vars["id"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		m, err := firewall.PortMappingById(r.Context(), a.Usp, sn, id)
+		firewallAnswer(w, http.StatusOK, m, err)
+	case http.MethodDelete:
+		err := firewall.DeletePortMapping(r.Context(), a.Usp, sn, id)
+		firewallAnswer(w, http.StatusNoContent, nil, err)
+	default:
+		receiver := firewall.DefaultPortMapping()
+		if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+			uspError(w, err)
+			return
+		}
+		m, err := firewall.UpdatePortMapping(r.Context(), a.Usp, sn, id, receiver)
+		firewallAnswer(w, http.StatusOK, m, err)
+	}
+}
+
+// GET answers the firewall settings with every chain and rule, PUT changes
+// the settings
+func (a *Api) deviceFirewall(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		f, err := firewall.Get(r.Context(), a.Usp, sn)
+		firewallAnswer(w, http.StatusOK, f, err)
+		return
+	}
+	var receiver firewall.Settings
+	if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+	f, err := firewall.Configure(r.Context(), a.Usp, sn, receiver)
+	firewallAnswer(w, http.StatusOK, f, err)
+}
+
+func (a *Api) createFirewallChain(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	receiver := firewall.Chain{Enable: true}
+	if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+	c, err := firewall.AddChain(r.Context(), a.Usp, sn, receiver)
+	firewallAnswer(w, http.StatusCreated, c, err)
+}
+
+func (a *Api) firewallChain(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sn, id := vars["sn"], vars["chain"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err := firewall.DeleteChain(r.Context(), a.Usp, sn, id)
+		firewallAnswer(w, http.StatusNoContent, nil, err)
+		return
+	}
+	receiver := firewall.Chain{Enable: true}
+	if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+	c, err := firewall.UpdateChain(r.Context(), a.Usp, sn, id, receiver)
+	firewallAnswer(w, http.StatusOK, c, err)
+}
+
+func (a *Api) createFirewallRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sn, chain := vars["sn"], vars["chain"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	receiver := firewall.DefaultRule()
+	if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+	rule, err := firewall.AddRule(r.Context(), a.Usp, sn, chain, receiver)
+	firewallAnswer(w, http.StatusCreated, rule, err)
+}
+
+func (a *Api) firewallRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sn, chain, id := vars["sn"], vars["chain"], vars["id"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err := firewall.DeleteRule(r.Context(), a.Usp, sn, chain, id)
+		firewallAnswer(w, http.StatusNoContent, nil, err)
+		return
+	}
+	receiver := firewall.DefaultRule()
+	if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+	rule, err := firewall.UpdateRule(r.Context(), a.Usp, sn, chain, id, receiver)
+	firewallAnswer(w, http.StatusOK, rule, err)
+}
+
+func firewallAnswer(w http.ResponseWriter, status int, result interface{}, err error) {
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	w.WriteHeader(status)
+	if status == http.StatusNoContent {
+		return
+	}
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Println(err)
+	}
+}
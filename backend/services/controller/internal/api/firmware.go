@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/db"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+Uploads a firmware image as a multipart form with the fields vendor, model,
+version and file. Its size and checksum are computed while saving it.
+*/
+func (a *Api) uploadFirmware(w http.ResponseWriter, r *http.Request) {
+	file, ok := receiveUpload(w, r, "Firmware", "firmware.bin")
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	fw := db.Firmware{
+		Id:      uuid.NewString(),
+		Vendor:  r.FormValue("vendor"),
+		Model:   r.FormValue("model"),
+		Version: r.FormValue("version"),
+		File:    file.Name,
+	}
+	if fw.Version == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("Firmware version is required")
+		return
+	}
+
+	exists, err := a.Db.FirmwareExists(fw.Vendor, fw.Model, fw.Version)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode("Firmware " + fw.Version + " of " + fw.Vendor + " " + fw.Model + " already exists")
+		return
+	}
+
+	fw.Size, fw.SHA256, err = a.Files.Save(firmwarePath(fw), file)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fw.CreatedAt = time.Now()
+
+	if err := a.Db.CreateFirmware(fw); err != nil {
+		a.Files.Remove(firmwarePath(fw))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fw)
+}
+
+func (a *Api) retrieveFirmwares(w http.ResponseWriter, r *http.Request) {
+	firmwares, err := a.Db.RetrieveFirmwares(r.URL.Query().Get("vendor"), r.URL.Query().Get("model"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(firmwares)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) retrieveFirmware(w http.ResponseWriter, r *http.Request) {
+	fw, ok := a.firmware(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	err := json.NewEncoder(w).Encode(fw)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) deleteFirmware(w http.ResponseWriter, r *http.Request) {
+	fw, ok := a.firmware(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if err := a.Db.DeleteFirmware(fw.Id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := a.Files.Remove(firmwarePath(fw)); err != nil {
+		log.Println(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serves the image to devices
+func (a *Api) downloadFirmware(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fw, err := a.Db.RetrieveFirmware(vars["id"])
+	if err != nil || fw.File != vars["file"] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a.serveFile(w, r, firmwarePath(fw), fw.File, fw.Size, fw.CreatedAt)
+}
+
+func (a *Api) firmware(w http.ResponseWriter, id string) (db.Firmware, bool) {
+	fw, err := a.Db.RetrieveFirmware(id)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode("No firmware with id " + id + " was found")
+			return fw, false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return fw, false
+	}
+	return fw, true
+}
+
+// Address devices reach the controller at, the one the api was called at if
+// none was configured
+func (a *Api) filesUrl(r *http.Request) string {
+	if a.FilesUrl != "" {
+		return a.FilesUrl
+	}
+	return "http://" + r.Host
+}
+
+func firmwarePath(fw db.Firmware) string {
+	return path.Join("firmware", fw.Id, fw.File)
+}
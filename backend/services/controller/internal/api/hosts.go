@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/hosts"
+)
+
+// Period the hosts history is returned for, unless asked for another one
+const hostsWindow = 7 * 24 * time.Hour
+
+/*
+Clients on the LAN of the device, only the connected ones unless the all
+query parameter is true. With save=true the list is kept in the device
+hosts history as well.
+*/
+func (a *Api) deviceHosts(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	query := r.URL.Query()
+
+	list, err := hosts.Inventory(r.Context(), a.Usp, sn, query.Get("all") == "true")
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	if query.Get("save") == "true" {
+		_, err := a.Db.CreateHostsSnapshot(db.HostsSnapshot{SN: sn, Time: time.Now(), Hosts: list})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(list)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Saved host lists of the device between from and to, the last week by default
+func (a *Api) deviceHostsHistory(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	from, to, ok := timeRange(w, r, hostsWindow)
+	if !ok {
+		return
+	}
+
+	snapshots, err := a.Db.RetrieveHostsSnapshots(sn, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(snapshots)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (a *Api) retrieveJobs(w http.ResponseWriter, r *http.Request) {
+	sn := r.URL.Query().Get("sn")
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	jobs, err := a.Db.RetrieveJobs(sn, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(jobs)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) retrieveJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	job, err := a.Db.RetrieveJob(id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode("No job with id " + id + " was found")
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(job)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+const sseKeepAlive = 30 * time.Second
+
+/*
+Streams job updates as server-sent events, filtered by device if the sn
+query parameter is set. The token may come in the token query parameter,
+and the stream lasts until the client goes away.
+*/
+func (a *Api) jobEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sn := r.URL.Query().Get("sn")
+	setDeadline(r, time.Time{})
+
+	updates, unsubscribe := a.Jobs.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments written now and then find out about clients gone silently
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case job := <-updates:
+			if sn != "" && job.SN != sn {
+				continue
+			}
+			data, err := json.Marshal(job)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: job\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/db"
+)
+
+// Period metrics are returned for, unless asked for another one
+const metricsWindow = 24 * time.Hour
+
+type metricsResponse struct {
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Resolution string            `json:"resolution"`
+	Series     []db.MetricSeries `json:"series"`
+}
+
+/*
+Series of the params under the path query parameter, or of the param itself,
+between from and to. Resolution is raw or hour, by default raw samples as long
+as they are still kept for the whole period.
+*/
+func (a *Api) deviceMetrics(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("Path of the metrics is required")
+		return
+	}
+	from, to, ok := timeRange(w, r, metricsWindow)
+	if !ok {
+		return
+	}
+
+	resolution := r.URL.Query().Get("resolution")
+	switch resolution {
+	case "":
+		resolution = a.Metrics.Resolution(from)
+	case db.MetricsRaw, db.MetricsHourly:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("Resolution must be " + db.MetricsRaw + " or " + db.MetricsHourly)
+		return
+	}
+
+	series, err := a.Db.RetrieveMetrics(sn, path, resolution, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(metricsResponse{From: from, To: to, Resolution: resolution, Series: series})
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -26,3 +26,17 @@ func Middleware(next http.Handler) http.Handler {
 		},
 	)
 }
+
+// QueryToken takes the token from the token query parameter when there is no
+// Authorization header, for clients which can't set headers, as the browser
+// EventSource.
+func QueryToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+				r.Header.Set("Authorization", token)
+			}
+			next.ServeHTTP(w, r)
+		},
+	)
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/optical"
+)
+
+// Optical interfaces of the device with their levels in dBm, bias current,
+// temperature and vendor extensions
+func (a *Api) deviceOptical(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	interfaces, err := optical.Get(r.Context(), a.Usp, sn)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(interfaces)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/utils"
+)
+
+// Period devices uptime is computed over, unless asked for another one
+const uptimeWindow = 7 * 24 * time.Hour
+
+type presenceTimeline struct {
+	From     time.Time     `json:"from"`
+	To       time.Time     `json:"to"`
+	Uptime   *float64      `json:"uptime,omitempty"`
+	Timeline []db.Presence `json:"timeline"`
+}
+
+type deviceUptime struct {
+	SN     string  `json:"sn"`
+	Uptime float64 `json:"uptime"`
+}
+
+type availability struct {
+	From          time.Time      `json:"from"`
+	To            time.Time      `json:"to"`
+	Total         int            `json:"total"`
+	Online        int            `json:"online"`
+	Associating   int            `json:"associating"`
+	Offline       int            `json:"offline"`
+	AverageUptime *float64       `json:"averageUptime,omitempty"`
+	Devices       []deviceUptime `json:"devices"`
+}
+
+// Online and offline transitions of the device between the from and to query
+// parameters, the last week by default
+func (a *Api) devicePresence(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	from, to, ok := timeRange(w, r, uptimeWindow)
+	if !ok {
+		return
+	}
+
+	timeline, err := a.Db.RetrievePresence(sn, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	uptime, err := a.Db.Uptime([]string{sn}, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := presenceTimeline{From: from, To: to, Timeline: timeline}
+	if u, ok := uptime[sn]; ok {
+		resp.Uptime = &u
+	}
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Fleet status right now and uptime of each device over the period, the
+// least available devices first
+func (a *Api) fleetAvailability(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := timeRange(w, r, uptimeWindow)
+	if !ok {
+		return
+	}
+
+	devices, err := a.Db.RetrieveDevices()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	uptime, err := a.Db.Uptime(nil, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := availability{From: from, To: to, Total: len(devices), Devices: []deviceUptime{}}
+	var sum float64
+	for _, d := range devices {
+		switch d.Status {
+		case utils.Online:
+			resp.Online++
+		case utils.Associating:
+			resp.Associating++
+		default:
+			resp.Offline++
+		}
+		if u, ok := uptime[d.SN]; ok {
+			resp.Devices = append(resp.Devices, deviceUptime{SN: d.SN, Uptime: u})
+			sum += u
+		}
+	}
+	if len(resp.Devices) > 0 {
+		average := sum / float64(len(resp.Devices))
+		resp.AverageUptime = &average
+	}
+	sort.Slice(resp.Devices, func(i, j int) bool {
+		return resp.Devices[i].Uptime < resp.Devices[j].Uptime
+	})
+
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Reads the from and to query parameters as RFC 3339 times, to defaults to
+// now and from to the period before it
+func timeRange(w http.ResponseWriter, r *http.Request, period time.Duration) (time.Time, time.Time, bool) {
+	to := time.Now()
+	if s := r.URL.Query().Get("to"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode("Invalid to time, it must be in RFC 3339 format")
+			return to, to, false
+		}
+		to = t
+	}
+	from := to.Add(-period)
+	if s := r.URL.Query().Get("from"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode("Invalid from time, it must be in RFC 3339 format")
+			return from, to, false
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("From time must be before to time")
+		return from, to, false
+	}
+	return from, to, true
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/profile"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (a *Api) createProfile(w http.ResponseWriter, r *http.Request) {
+	var receiver db.Profile
+	err := usp.DecodeRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	if err := profile.Validate(&receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+
+	receiver.Id = uuid.NewString()
+	receiver.CreatedAt = time.Now()
+	receiver.UpdatedAt = receiver.CreatedAt
+	if err := a.Db.CreateProfile(receiver); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	go a.Profiles.ReconcileProfile(receiver, false)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(receiver)
+}
+
+func (a *Api) retrieveProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := a.Db.RetrieveProfiles()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(profiles)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) retrieveProfile(w http.ResponseWriter, r *http.Request) {
+	p, ok := a.profile(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	err := json.NewEncoder(w).Encode(p)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) updateProfile(w http.ResponseWriter, r *http.Request) {
+	p, ok := a.profile(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	var receiver db.Profile
+	err := usp.DecodeRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	if err := profile.Validate(&receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+
+	receiver.Id = p.Id
+	receiver.CreatedAt = p.CreatedAt
+	receiver.UpdatedAt = time.Now()
+	if err := a.Db.UpdateProfile(receiver); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	go a.Profiles.ReconcileProfile(receiver, false)
+
+	json.NewEncoder(w).Encode(receiver)
+}
+
+func (a *Api) deleteProfile(w http.ResponseWriter, r *http.Request) {
+	p, ok := a.profile(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if err := a.Db.DeleteProfile(p.Id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Compliance of the devices the profile is assigned to, as of their last check
+func (a *Api) retrieveProfileStatus(w http.ResponseWriter, r *http.Request) {
+	p, ok := a.profile(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	statuses, err := a.Db.RetrieveProfileStatuses(p.Id, "")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(statuses)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Checks every device of the profile in background, applying it to the ones
+// which drifted if the apply query parameter is true
+func (a *Api) reconcileProfile(w http.ResponseWriter, r *http.Request) {
+	p, ok := a.profile(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	go a.Profiles.ReconcileProfile(p, r.URL.Query().Get("apply") == "true")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *Api) deviceProfiles(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	statuses, err := a.Db.RetrieveProfileStatuses("", sn)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(statuses)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) deviceProfileCheck(w http.ResponseWriter, r *http.Request) {
+	a.deviceProfileAction(w, r, a.Profiles.Check)
+}
+
+func (a *Api) deviceProfileApply(w http.ResponseWriter, r *http.Request) {
+	a.deviceProfileAction(w, r, a.Profiles.Apply)
+}
+
+func (a *Api) deviceProfileAction(w http.ResponseWriter, r *http.Request, action func(context.Context, db.Profile, string) (db.ProfileStatus, error)) {
+	vars := mux.Vars(r)
+	sn := vars["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	p, ok := a.profile(w, vars["id"])
+	if !ok {
+		return
+	}
+
+	status, err := action(r.Context(), p, sn)
+	if err != nil {
+		var deviceErr *usp.Error
+		if errors.Is(err, usp.ErrTimeout) || errors.As(err, &deviceErr) {
+			uspError(w, err)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func (a *Api) profile(w http.ResponseWriter, id string) (db.Profile, bool) {
+	p, err := a.Db.RetrieveProfile(id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode("No profile with id " + id + " was found")
+			return p, false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return p, false
+	}
+	return p, true
+}
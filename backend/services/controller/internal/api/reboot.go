@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/reboot"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+func (a *Api) deviceReboot(w http.ResponseWriter, r *http.Request) {
+	a.deviceRestart(w, r, reboot.ActionReboot)
+}
+
+func (a *Api) deviceFactoryReset(w http.ResponseWriter, r *http.Request) {
+	a.deviceRestart(w, r, reboot.ActionFactoryReset)
+}
+
+// Runs the action as a job, which finishes once the device comes back or the
+// deadline passes
+func (a *Api) deviceRestart(w http.ResponseWriter, r *http.Request, action string) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	var receiver reboot.Request
+	err := usp.DecodeOptionalRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	if err := reboot.Validate(action, &receiver); err != nil {
+		uspError(w, err)
+		return
+	}
+
+	var restore *db.Backup
+	if receiver.Backup != "" {
+		b, ok := a.backup(w, receiver.Backup)
+		if !ok {
+			return
+		}
+		restore = &b
+	}
+
+	job, err := a.Jobs.Start(sn, action, receiver, func(ctx context.Context) (interface{}, error) {
+		return a.Reboot.Run(ctx, sn, action, receiver, restore)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
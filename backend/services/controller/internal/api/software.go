@@ -0,0 +1,296 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/software"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Bounds how long the device may take to download and install a package
+const softwareTimeout = 15 * time.Minute
+
+// Install from the package repository if Package is set, from URL otherwise
+type installRequest struct {
+	Package string `json:"package,omitempty"`
+	software.InstallRequest
+}
+
+type updateRequest struct {
+	Package string `json:"package,omitempty"`
+	software.UpdateRequest
+}
+
+type stateRequest struct {
+	State string `json:"state"`
+}
+
+func (x *stateRequest) Validate() error {
+	return software.ValidateState(x.State)
+}
+
+// Requests checked before their job starts
+type validator interface {
+	Validate() error
+}
+
+// Requests holding credentials, which are left out of job records
+type redactable interface {
+	redacted() interface{}
+}
+
+func (x installRequest) redacted() interface{} {
+	x.Password = ""
+	return x
+}
+
+func (x updateRequest) redacted() interface{} {
+	x.Password = ""
+	return x
+}
+
+/*
+Uploads a package as a multipart form with the fields name, version,
+description and file. Its size and checksum are computed while saving it.
+*/
+func (a *Api) uploadPackage(w http.ResponseWriter, r *http.Request) {
+	file, ok := receiveUpload(w, r, "Package", "package.bin")
+	if !ok {
+		return
+	}
+	defer file.Close()
+
+	p := db.Package{
+		Id:          uuid.NewString(),
+		Name:        r.FormValue("name"),
+		Version:     r.FormValue("version"),
+		Description: r.FormValue("description"),
+		File:        file.Name,
+	}
+	if p.Name == "" || p.Version == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode("Package name and version are required")
+		return
+	}
+
+	exists, err := a.Db.PackageExists(p.Name, p.Version)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode("Package " + p.Name + " " + p.Version + " already exists")
+		return
+	}
+
+	p.Size, p.SHA256, err = a.Files.Save(packagePath(p), file)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	p.CreatedAt = time.Now()
+
+	if err := a.Db.CreatePackage(p); err != nil {
+		a.Files.Remove(packagePath(p))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (a *Api) retrievePackages(w http.ResponseWriter, r *http.Request) {
+	packages, err := a.Db.RetrievePackages(r.URL.Query().Get("name"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(packages)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) retrievePackage(w http.ResponseWriter, r *http.Request) {
+	p, ok := a.softwarePackage(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	err := json.NewEncoder(w).Encode(p)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) deletePackage(w http.ResponseWriter, r *http.Request) {
+	p, ok := a.softwarePackage(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if err := a.Db.DeletePackage(p.Id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := a.Files.Remove(packagePath(p)); err != nil {
+		log.Println(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serves the package to devices
+func (a *Api) downloadPackage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p, err := a.Db.RetrievePackage(vars["id"])
+	if err != nil || p.File != vars["file"] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a.serveFile(w, r, packagePath(p), p.File, p.Size, p.CreatedAt)
+}
+
+// Execution environments, deployment units and execution units of the device
+func (a *Api) deviceSoftware(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	inventory, err := software.Get(r.Context(), a.Usp, sn)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(inventory)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Installs a package of the repository, or one at any url, as a job whose
+// result is the deployment unit once installed
+func (a *Api) deviceInstallDU(w http.ResponseWriter, r *http.Request) {
+	var receiver installRequest
+	a.softwareOperation(w, r, "install-du", &receiver, func() bool {
+		if receiver.Package == "" {
+			return true
+		}
+		p, ok := a.softwarePackage(w, receiver.Package)
+		if ok {
+			receiver.URL = a.packageUrl(r, p)
+		}
+		return ok
+	}, func(ctx context.Context, sn string) (interface{}, error) {
+		return software.Install(ctx, a.Commands, sn, receiver.InstallRequest)
+	})
+}
+
+func (a *Api) deviceUpdateDU(w http.ResponseWriter, r *http.Request) {
+	var receiver updateRequest
+	id := mux.Vars(r)["uuid"]
+	a.softwareOperation(w, r, "update-du", &receiver, func() bool {
+		if receiver.Package == "" {
+			return true
+		}
+		p, ok := a.softwarePackage(w, receiver.Package)
+		if ok {
+			receiver.URL = a.packageUrl(r, p)
+		}
+		return ok
+	}, func(ctx context.Context, sn string) (interface{}, error) {
+		return software.Update(ctx, a.Commands, sn, id, receiver.UpdateRequest)
+	})
+}
+
+func (a *Api) deviceUninstallDU(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+	a.softwareOperation(w, r, "uninstall-du", nil, nil, func(ctx context.Context, sn string) (interface{}, error) {
+		return nil, software.Uninstall(ctx, a.Commands, sn, id)
+	})
+}
+
+func (a *Api) deviceSetEUState(w http.ResponseWriter, r *http.Request) {
+	var receiver stateRequest
+	id := mux.Vars(r)["euid"]
+	a.softwareOperation(w, r, "eu-state", &receiver, nil, func(ctx context.Context, sn string) (interface{}, error) {
+		return software.SetRequestedState(ctx, a.Commands, sn, id, receiver.State)
+	})
+}
+
+// Decodes the request into receiver if any, lets prepare fill it in, which
+// writes the answer itself if it fails, validates it and runs the operation
+// as a job tracked until the device completes it
+func (a *Api) softwareOperation(w http.ResponseWriter, r *http.Request, name string, receiver interface{}, prepare func() bool, run func(ctx context.Context, sn string) (interface{}, error)) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	if receiver != nil {
+		err := usp.DecodeOptionalRequest(r.Body, receiver)
+		if err != nil {
+			uspError(w, err)
+			return
+		}
+	}
+	if prepare != nil && !prepare() {
+		return
+	}
+	if x, ok := receiver.(validator); ok {
+		if err := x.Validate(); err != nil {
+			uspError(w, err)
+			return
+		}
+	}
+
+	record := receiver
+	if x, ok := receiver.(redactable); ok {
+		record = x.redacted()
+	}
+	job, err := a.Jobs.Start(sn, name, record, func(ctx context.Context) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, softwareTimeout)
+		defer cancel()
+		return run(ctx, sn)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (a *Api) softwarePackage(w http.ResponseWriter, id string) (db.Package, bool) {
+	p, err := a.Db.RetrievePackage(id)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode("No package with id " + id + " was found")
+			return p, false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return p, false
+	}
+	return p, true
+}
+
+func (a *Api) packageUrl(r *http.Request, p db.Package) string {
+	return a.filesUrl(r) + "/files/packages/" + p.Id + "/" + url.PathEscape(p.File)
+}
+
+func packagePath(p db.Package) string {
+	return path.Join("packages", p.Id, p.File)
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/bulk"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Creates a task, enabled unless told otherwise
+func (a *Api) createTask(w http.ResponseWriter, r *http.Request) {
+	receiver := db.Task{Enabled: true}
+	err := usp.DecodeRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	receiver.Id = ""
+	receiver.LastRun = nil
+	receiver.LastJob = ""
+
+	if !a.prepareTask(w, &receiver) {
+		return
+	}
+	if err := a.Db.CreateTask(receiver); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	a.Scheduler.Wake()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(receiver)
+}
+
+func (a *Api) retrieveTasks(w http.ResponseWriter, r *http.Request) {
+	tasks, err := a.Db.RetrieveTasks()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(tasks)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) retrieveTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := a.task(w, r)
+	if !ok {
+		return
+	}
+	err := json.NewEncoder(w).Encode(task)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Replaces the task definition, keeping its run history. As on creation,
+// the task is enabled unless told otherwise.
+func (a *Api) updateTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := a.task(w, r)
+	if !ok {
+		return
+	}
+
+	receiver := db.Task{Enabled: true}
+	err := usp.DecodeRequest(r.Body, &receiver)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	receiver.Id = task.Id
+	receiver.CreatedAt = task.CreatedAt
+	receiver.LastRun = task.LastRun
+	receiver.LastJob = task.LastJob
+	// A one-shot task moved to another time must run again
+	if receiver.At != nil && (task.At == nil || !receiver.At.Equal(*task.At)) {
+		receiver.LastRun = nil
+	}
+
+	if !a.prepareTask(w, &receiver) {
+		return
+	}
+	if err := a.Db.UpdateTask(receiver); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	a.Scheduler.Wake()
+
+	json.NewEncoder(w).Encode(receiver)
+}
+
+func (a *Api) deleteTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := a.task(w, r)
+	if !ok {
+		return
+	}
+	if err := a.Db.DeleteTask(task.Id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Bulk jobs started by the task, per device results are at /api/bulk/{id}/results
+func (a *Api) retrieveTaskRuns(w http.ResponseWriter, r *http.Request) {
+	task, ok := a.task(w, r)
+	if !ok {
+		return
+	}
+
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	runs, err := a.Db.RetrieveTaskRuns(task.Id, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(runs)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Api) runTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := a.task(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := a.Scheduler.RunNow(task)
+	if err != nil {
+		if errors.Is(err, usp.ErrInvalidRequest) || errors.Is(err, bulk.ErrNoTargets) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (a *Api) prepareTask(w http.ResponseWriter, task *db.Task) bool {
+	err := a.Scheduler.Prepare(task)
+	if err != nil {
+		if errors.Is(err, usp.ErrInvalidRequest) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(err.Error())
+			return false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (a *Api) task(w http.ResponseWriter, r *http.Request) (db.Task, bool) {
+	id := mux.Vars(r)["id"]
+
+	task, err := a.Db.RetrieveTask(id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode("No task with id " + id + " was found")
+			return task, false
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return task, false
+	}
+	return task, true
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+// Builds the handler of a device endpoint out of an usp operation: decodes the
+// request body, runs it against the device and encodes the answer.
+func uspHandler[Req any, Resp any](a *Api, op usp.Operation[Req, Resp]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		sn := vars["sn"]
+		if !a.deviceExists(sn, w) {
+			return
+		}
+
+		var receiver Req
+		err := usp.DecodeRequest(r.Body, &receiver)
+		if err != nil {
+			uspError(w, err)
+			return
+		}
+
+		resp, err := op.Run(r.Context(), a.Usp, sn, receiver)
+		if err != nil {
+			uspError(w, err)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Maps errors of the usp pipeline to http answers
+func uspError(w http.ResponseWriter, err error) {
+	var deviceErr *usp.Error
+	switch {
+	case errors.Is(err, usp.ErrTimeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode("Request Timed Out")
+	case errors.As(err, &deviceErr):
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(deviceErr)
+	case errors.Is(err, usp.ErrInvalidRequest):
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(err.Error())
+	case errors.Is(err, context.Canceled):
+		// Client went away, nobody is waiting for the answer
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// Same as uspHandler, but answers right away with a job which keeps the
+// device answer once it arrives.
+func uspJobHandler[Req any, Resp any](a *Api, op usp.Operation[Req, Resp]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		sn := vars["sn"]
+		if !a.deviceExists(sn, w) {
+			return
+		}
+
+		var receiver Req
+		err := usp.DecodeRequest(r.Body, &receiver)
+		if err != nil {
+			uspError(w, err)
+			return
+		}
+
+		job, err := a.Jobs.Start(sn, op.Name, receiver, func(ctx context.Context) (interface{}, error) {
+			return op.Run(ctx, a.Usp, sn, receiver)
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		err = json.NewEncoder(w).Encode(job)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
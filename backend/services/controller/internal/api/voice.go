@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/voice"
+)
+
+/*
+GET answers the voice services of the device with their SIP networks and
+phone lines, along with the registration status and call counters of these.
+PUT provisions networks and lines, answering the services once changed.
+*/
+func (a *Api) deviceVoice(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+
+	var services []voice.Service
+	var err error
+	if r.Method == http.MethodGet {
+		services, err = voice.Get(r.Context(), a.Usp, sn)
+	} else {
+		var receiver voice.Request
+		if err := usp.DecodeRequest(r.Body, &receiver); err != nil {
+			uspError(w, err)
+			return
+		}
+		services, err = voice.Set(r.Context(), a.Usp, sn, receiver)
+	}
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(services)
+	if err != nil {
+		log.Println(err)
+	}
+}
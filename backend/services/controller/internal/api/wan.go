@@ -0,0 +1,28 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/wan"
+)
+
+// IP and PPP interfaces of the device with their addresses, DNS servers,
+// default routes and uptime
+func (a *Api) deviceWan(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	status, err := wan.Get(r.Context(), a.Usp, sn)
+	if err != nil {
+		uspError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(status)
+	if err != nil {
+		log.Println(err)
+	}
+}
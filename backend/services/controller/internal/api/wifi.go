@@ -0,0 +1,35 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/leandrofars/oktopus/internal/wifi"
+)
+
+// Scans last up to a minute on most devices, the rest is leeway
+const scanTimeout = 3 * time.Minute
+
+// Runs a neighbor scan as a job, its result holds the neighbors and the
+// recommended channel of each radio
+func (a *Api) deviceWifiScan(w http.ResponseWriter, r *http.Request) {
+	sn := mux.Vars(r)["sn"]
+	if !a.deviceExists(sn, w) {
+		return
+	}
+	job, err := a.Jobs.Start(sn, "wifi-scan", nil, func(ctx context.Context) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+		defer cancel()
+		return wifi.Scan(ctx, a.Commands, sn)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,341 @@
+// Saves the configuration of devices and replays it onto them or onto others.
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+// Params set in a single message when restoring
+const setChunk = 100
+
+// Subtrees never restored unless asked for, since they hold how the device
+// reaches the controller or what belongs to that very device
+var DefaultExclude = []string{
+	"Device.LocalAgent.",
+	"Device.MQTT.",
+	"Device.DeviceInfo.FirmwareImage.",
+}
+
+type Service struct {
+	Db  db.Database
+	Usp *usp.Dispatcher
+}
+
+func NewService(database db.Database, d *usp.Dispatcher) *Service {
+	return &Service{Db: database, Usp: d}
+}
+
+type Created struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Report of a restore, Failed holds what couldn't be applied and why.
+type Report struct {
+	Backup  string          `json:"backup"`
+	SN      string          `json:"sn"`
+	Applied int             `json:"applied"`
+	Created []Created       `json:"created"`
+	Failed  []usp.PathError `json:"failed"`
+}
+
+type RestoreRequest struct {
+	Backup string `json:"backup"`
+	// Subtrees left out besides DefaultExclude
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+/*
+Backup saves the writable params of the device. They are found through the
+access flags reported by GetSupportedDM, then read with a single deep Get.
+*/
+func (s *Service) Backup(ctx context.Context, sn, note string) (db.Backup, error) {
+	supported, err := usp.GetSupportedDM.Run(ctx, s.Usp, sn, usp.GetSupportedDMRequest{
+		Paths:  []string{"Device."},
+		Params: true,
+	})
+	if err != nil {
+		return db.Backup{}, err
+	}
+
+	writable := map[string]bool{}
+	creatable := map[string]bool{}
+	for _, obj := range supported.Objects {
+		if obj.MultiInstance && (obj.Access == "addDelete" || obj.Access == "addOnly") {
+			creatable[obj.Path] = true
+		}
+		for _, p := range obj.Params {
+			if p.Access == "readWrite" {
+				writable[obj.Path+p.Name] = true
+			}
+		}
+	}
+
+	resp, err := usp.Get.Run(ctx, s.Usp, sn, usp.GetRequest{Paths: []string{"Device."}})
+	if err != nil {
+		return db.Backup{}, err
+	}
+
+	b := db.Backup{
+		Id:              uuid.NewString(),
+		SN:              sn,
+		Note:            note,
+		Vendor:          resp.Params["Device.DeviceInfo.Manufacturer"],
+		Model:           resp.Params["Device.DeviceInfo.ModelName"],
+		SoftwareVersion: resp.Params["Device.DeviceInfo.SoftwareVersion"],
+		CreatedAt:       time.Now(),
+	}
+	objects := map[string]bool{}
+	for path, value := range resp.Params {
+		if !writable[generic(path)] {
+			continue
+		}
+		b.Params = append(b.Params, db.BackupParam{Path: path, Value: value})
+		for _, instance := range instancePaths(path) {
+			if creatable[generic(instance)] {
+				objects[instance] = true
+			}
+		}
+	}
+	sort.Slice(b.Params, func(i, j int) bool { return b.Params[i].Path < b.Params[j].Path })
+	for instance := range objects {
+		b.Objects = append(b.Objects, instance)
+	}
+	sortByDepth(b.Objects)
+
+	return s.Db.CreateBackup(b)
+}
+
+/*
+Restore replays the backup onto the device, which doesn't need to be the
+one it was taken from. Instances missing on the device are added, getting
+whatever number the device gives them, then every param is set. Failures
+don't stop the restore, they end up in the report.
+*/
+func (s *Service) Restore(ctx context.Context, b db.Backup, sn string, exclude []string) (Report, error) {
+	report := Report{Backup: b.Id, SN: sn, Created: []Created{}, Failed: []usp.PathError{}}
+	exclude = append(append([]string{}, DefaultExclude...), exclude...)
+	excluded := func(path string) bool {
+		for _, prefix := range exclude {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	existing, err := s.existingInstances(ctx, sn, b.Objects)
+	if err != nil {
+		return report, err
+	}
+
+	// Params of each instance, to create it along with them
+	params := map[string]map[string]string{}
+	for _, p := range b.Params {
+		i := strings.LastIndex(p.Path, ".")
+		obj := p.Path[:i+1]
+		if params[obj] == nil {
+			params[obj] = map[string]string{}
+		}
+		params[obj][p.Path[i+1:]] = p.Value
+	}
+
+	mapping := map[string]string{}
+	failed := map[string]bool{}
+	done := map[string]bool{}
+	for _, obj := range b.Objects {
+		if excluded(obj) || underAny(obj, failed) {
+			continue
+		}
+		path := remap(obj, mapping)
+		if existing[path] {
+			mapping[obj] = path
+			continue
+		}
+
+		created, withParams, err := s.add(ctx, sn, path, params[obj])
+		if err != nil {
+			failed[obj] = true
+			report.Failed = append(report.Failed, pathError(obj, err))
+			continue
+		}
+		mapping[obj] = created
+		report.Created = append(report.Created, Created{From: obj, To: created})
+		if withParams {
+			done[obj] = true
+			report.Applied += len(params[obj])
+		}
+	}
+
+	set := map[string]string{}
+	for _, p := range b.Params {
+		obj := p.Path[:strings.LastIndex(p.Path, ".")+1]
+		if excluded(p.Path) || done[obj] {
+			continue
+		}
+		if underAny(p.Path, failed) {
+			report.Failed = append(report.Failed, usp.PathError{Path: p.Path, Message: "Object instance couldn't be created"})
+			continue
+		}
+		set[remap(p.Path, mapping)] = p.Value
+	}
+
+	paths := make([]string, 0, len(set))
+	for path := range set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for start := 0; start < len(paths); start += setChunk {
+		end := start + setChunk
+		if end > len(paths) {
+			end = len(paths)
+		}
+		chunk := map[string]string{}
+		for _, path := range paths[start:end] {
+			chunk[path] = set[path]
+		}
+
+		resp, err := usp.Set.Run(ctx, s.Usp, sn, usp.SetRequest{AllowPartial: true, Params: chunk})
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, err
+			}
+			for _, path := range paths[start:end] {
+				report.Failed = append(report.Failed, pathError(path, err))
+			}
+			continue
+		}
+		report.Failed = append(report.Failed, resp.Errors...)
+		report.Applied += len(chunk) - len(resp.Errors)
+	}
+	return report, nil
+}
+
+// Adds an instance to the table of path, with its params if the device
+// takes them, otherwise without them so they can be set one by one later
+func (s *Service) add(ctx context.Context, sn, path string, params map[string]string) (string, bool, error) {
+	table := path[:strings.LastIndex(strings.TrimSuffix(path, "."), ".")+1]
+
+	var err error
+	for _, withParams := range []bool{true, false} {
+		if !withParams && len(params) == 0 {
+			break
+		}
+		obj := usp.AddObject{Path: table}
+		if withParams {
+			obj.Params = params
+		}
+		var resp usp.AddResponse
+		resp, err = usp.Add.Run(ctx, s.Usp, sn, usp.AddRequest{Objects: []usp.AddObject{obj}})
+		if err == nil && len(resp.Errors) > 0 {
+			err = &usp.Error{Message: resp.Errors[0].Message, Code: resp.Errors[0].Code, Params: resp.Errors}
+		}
+		if err == nil && len(resp.Created) > 0 && resp.Created[0].Path != "" {
+			return resp.Created[0].Path, withParams, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("device created no instance of %s", table)
+		}
+	}
+	return "", false, err
+}
+
+// Instances of the device in the tables of the backup objects
+func (s *Service) existingInstances(ctx context.Context, sn string, objects []string) (map[string]bool, error) {
+	// Only the outermost tables are asked for, nested instances come along
+	var paths []string
+	for _, obj := range objects {
+		top := instancePaths(obj)[0]
+		table := top[:strings.LastIndex(strings.TrimSuffix(top, "."), ".")+1]
+		if !dm.Contains(paths, table) {
+			paths = append(paths, table)
+		}
+	}
+
+	existing := map[string]bool{}
+	if len(paths) == 0 {
+		return existing, nil
+	}
+	resp, err := usp.GetInstances.Run(ctx, s.Usp, sn, usp.GetInstancesRequest{Paths: paths})
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range resp.Instances {
+		existing[x.Path] = true
+	}
+	return existing, nil
+}
+
+func pathError(path string, err error) usp.PathError {
+	var deviceErr *usp.Error
+	if errors.As(err, &deviceErr) {
+		return usp.PathError{Path: path, Code: deviceErr.Code, Message: deviceErr.Message}
+	}
+	return usp.PathError{Path: path, Message: err.Error()}
+}
+
+// Replaces instance numbers by {i}, as in the paths of the supported data model
+func generic(path string) string {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			parts[i] = "{i}"
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// Instance paths a path goes through, as "Device.WiFi.SSID.1.", the path
+// itself included if it's an instance
+func instancePaths(path string) []string {
+	var result []string
+	parts := strings.Split(path, ".")
+	for i, part := range parts[:len(parts)-1] {
+		if _, err := strconv.Atoi(part); err == nil {
+			result = append(result, strings.Join(parts[:i+1], ".")+".")
+		}
+	}
+	return result
+}
+
+// Replaces the deepest instance of the path which got a new number
+func remap(path string, mapping map[string]string) string {
+	instances := instancePaths(path)
+	for i := len(instances) - 1; i >= 0; i-- {
+		if to, ok := mapping[instances[i]]; ok {
+			return to + strings.TrimPrefix(path, instances[i])
+		}
+	}
+	return path
+}
+
+func underAny(path string, objects map[string]bool) bool {
+	for _, obj := range instancePaths(path) {
+		if objects[obj] {
+			return true
+		}
+	}
+	return false
+}
+
+// Parents come before their children
+func sortByDepth(paths []string) {
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := strings.Count(paths[i], "."), strings.Count(paths[j], ".")
+		if di != dj {
+			return di < dj
+		}
+		return paths[i] < paths[j]
+	})
+}
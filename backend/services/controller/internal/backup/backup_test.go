@@ -0,0 +1,66 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGeneric(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"Device.DeviceInfo.ProvisioningCode", "Device.DeviceInfo.ProvisioningCode"},
+		{"Device.WiFi.SSID.1.SSID", "Device.WiFi.SSID.{i}.SSID"},
+		{"Device.WiFi.SSID.12.", "Device.WiFi.SSID.{i}."},
+		{"Device.NAT.PortMapping.2.X_VENDOR_Rule.10.Enable", "Device.NAT.PortMapping.{i}.X_VENDOR_Rule.{i}.Enable"},
+		{"Device.IP.Interface.1.IPv4Address.3.", "Device.IP.Interface.{i}.IPv4Address.{i}."},
+	}
+	for _, tt := range tests {
+		if got := generic(tt.path); got != tt.want {
+			t.Errorf("generic(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestInstancePaths(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"Device.DeviceInfo.ProvisioningCode", nil},
+		{"Device.WiFi.SSID.1.SSID", []string{"Device.WiFi.SSID.1."}},
+		{"Device.WiFi.SSID.1.", []string{"Device.WiFi.SSID.1."}},
+		{"Device.IP.Interface.1.IPv4Address.3.IPAddress", []string{"Device.IP.Interface.1.", "Device.IP.Interface.1.IPv4Address.3."}},
+		{"Device.IP.Interface.1.IPv4Address.3.", []string{"Device.IP.Interface.1.", "Device.IP.Interface.1.IPv4Address.3."}},
+	}
+	for _, tt := range tests {
+		if got := instancePaths(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("instancePaths(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRemap(t *testing.T) {
+	mapping := map[string]string{
+		"Device.NAT.PortMapping.2.":            "Device.NAT.PortMapping.5.",
+		"Device.IP.Interface.1.IPv4Address.3.": "Device.IP.Interface.1.IPv4Address.1.",
+		"Device.IP.Interface.4.":               "Device.IP.Interface.6.",
+	}
+	tests := []struct {
+		path, want string
+	}{
+		{"Device.NAT.PortMapping.2.Enable", "Device.NAT.PortMapping.5.Enable"},
+		{"Device.NAT.PortMapping.2.", "Device.NAT.PortMapping.5."},
+		{"Device.NAT.PortMapping.1.Enable", "Device.NAT.PortMapping.1.Enable"},
+		{"Device.IP.Interface.1.IPv4Address.3.IPAddress", "Device.IP.Interface.1.IPv4Address.1.IPAddress"},
+		{"Device.IP.Interface.1.Name", "Device.IP.Interface.1.Name"},
+		// The parent got a new number, its children come along
+		{"Device.IP.Interface.4.IPv4Address.1.IPAddress", "Device.IP.Interface.6.IPv4Address.1.IPAddress"},
+		{"Device.DeviceInfo.ProvisioningCode", "Device.DeviceInfo.ProvisioningCode"},
+	}
+	for _, tt := range tests {
+		if got := remap(tt.path, mapping); got != tt.want {
+			t.Errorf("remap(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
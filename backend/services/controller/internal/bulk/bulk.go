@@ -0,0 +1,256 @@
+// Runs an usp operation against a fleet of devices.
+package bulk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/jobs"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	DefaultConcurrency = 10
+	MaxConcurrency     = 100
+	retryDelay         = 5 * time.Second
+)
+
+var (
+	ErrNoTargets = errors.New("no target devices")
+	ErrRunning   = errors.New("bulk job is still running")
+	ErrOffline   = errors.New("device is offline")
+	ErrNotFound  = errors.New("device not found")
+)
+
+type Engine struct {
+	Db      db.Database
+	Usp     *usp.Dispatcher
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func NewEngine(database db.Database, d *usp.Dispatcher) *Engine {
+	return &Engine{
+		Db:      database,
+		Usp:     d,
+		running: map[string]bool{},
+	}
+}
+
+// Resume runs again the targets of jobs interrupted by a controller restart.
+func (e *Engine) Resume() {
+	unfinished, err := e.Db.RetrieveUnfinishedBulkJobs()
+	if err != nil {
+		return
+	}
+	for _, job := range unfinished {
+		log.Printf("Resuming bulk job %s", job.Id)
+		e.launch(job)
+	}
+}
+
+/*
+Start validates the job, resolves its targets and runs it in background.
+Targets are the explicit serial numbers plus the devices matched by the
+filter, if any.
+*/
+func (e *Engine) Start(job db.BulkJob) (db.BulkJob, error) {
+	cmd, ok := usp.Commands[job.Operation]
+	if !ok {
+		return job, fmt.Errorf("%w: unknown operation %q", usp.ErrInvalidRequest, job.Operation)
+	}
+	if err := cmd.Validate(job.Request); err != nil {
+		return job, err
+	}
+
+	targets, err := e.resolveTargets(job.Targets, job.Filter)
+	if err != nil {
+		return job, err
+	}
+	if len(targets) == 0 {
+		return job, ErrNoTargets
+	}
+
+	if job.Concurrency <= 0 {
+		job.Concurrency = DefaultConcurrency
+	}
+	if job.Concurrency > MaxConcurrency {
+		job.Concurrency = MaxConcurrency
+	}
+	if job.Retries < 0 {
+		job.Retries = 0
+	}
+
+	now := time.Now()
+	job.Id = uuid.NewString()
+	job.Targets = targets
+	job.Status = db.JobPending
+	job.Total = len(targets)
+	job.Succeeded = 0
+	job.Failed = 0
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	if err := e.Db.CreateBulkJob(job); err != nil {
+		return job, err
+	}
+
+	e.launch(job)
+	return job, nil
+}
+
+// Retry runs again the targets which failed.
+func (e *Engine) Retry(id string) (db.BulkJob, error) {
+	e.mu.Lock()
+	running := e.running[id]
+	e.mu.Unlock()
+	if running {
+		return db.BulkJob{}, ErrRunning
+	}
+
+	if _, err := e.Db.ResetFailedBulkResults(id); err != nil {
+		return db.BulkJob{}, err
+	}
+	job, err := e.Db.RetrieveBulkJob(id)
+	if err != nil {
+		return job, err
+	}
+
+	e.launch(job)
+	return job, nil
+}
+
+func (e *Engine) resolveTargets(sns []string, filter *db.DeviceFilter) ([]string, error) {
+	var targets []string
+	seen := map[string]bool{}
+	for _, sn := range sns {
+		if !seen[sn] {
+			seen[sn] = true
+			targets = append(targets, sn)
+		}
+	}
+	if filter == nil {
+		return targets, nil
+	}
+
+	devices, err := e.Db.FindDevices(*filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		if !seen[d.SN] {
+			seen[d.SN] = true
+			targets = append(targets, d.SN)
+		}
+	}
+	return targets, nil
+}
+
+func (e *Engine) launch(job db.BulkJob) {
+	e.mu.Lock()
+	if e.running[job.Id] {
+		e.mu.Unlock()
+		return
+	}
+	e.running[job.Id] = true
+	e.mu.Unlock()
+
+	go func() {
+		e.run(job)
+		e.mu.Lock()
+		delete(e.running, job.Id)
+		e.mu.Unlock()
+	}()
+}
+
+func (e *Engine) run(job db.BulkJob) {
+	results, err := e.Db.RetrieveBulkResults(job.Id, db.JobPending, db.JobRunning)
+	if err != nil {
+		return
+	}
+	e.Db.UpdateBulkJobStatus(job.Id, db.JobRunning)
+
+	cmd := usp.Commands[job.Operation]
+	queue := make(chan db.BulkResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < job.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for result := range queue {
+				e.runTarget(job, cmd, result)
+			}
+		}()
+	}
+	for _, result := range results {
+		queue <- result
+	}
+	close(queue)
+	wg.Wait()
+
+	e.Db.UpdateBulkJobStatus(job.Id, db.JobDone)
+	log.Printf("Bulk job %s finished", job.Id)
+}
+
+func (e *Engine) runTarget(job db.BulkJob, cmd usp.Command, result db.BulkResult) {
+	var resp interface{}
+	var err error
+
+	for attempt := 0; attempt <= job.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryDelay)
+		}
+		result.Attempts++
+		resp, err = e.exec(cmd, result.SN, job.Request)
+		if !retryable(err) {
+			break
+		}
+	}
+
+	result.Result = nil
+	result.Error = nil
+	if err != nil {
+		result.Status = db.JobFailed
+		result.Error = jobs.EncodeError(err)
+	} else {
+		result.Status = db.JobDone
+		result.Result, err = json.Marshal(resp)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	e.Db.FinishBulkResult(result)
+}
+
+func (e *Engine) exec(cmd usp.Command, sn string, req json.RawMessage) (interface{}, error) {
+	device, err := e.Db.RetrieveDevice(sn)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if device.Status != utils.Online {
+		return nil, ErrOffline
+	}
+	return cmd.Exec(context.Background(), e.Usp, sn, req)
+}
+
+// Errors reported by the device itself won't go away by trying again
+func retryable(err error) bool {
+	var deviceErr *usp.Error
+	if err == nil || errors.As(err, &deviceErr) || errors.Is(err, usp.ErrInvalidRequest) || errors.Is(err, ErrNotFound) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,34 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success", nil, false},
+		{"timeout", usp.ErrTimeout, true},
+		{"offline", ErrOffline, true},
+		{"wrapped timeout", fmt.Errorf("get: %w", usp.ErrTimeout), true},
+		{"canceled", context.Canceled, true},
+		{"device error", &usp.Error{Code: 7026, Message: "Invalid path"}, false},
+		{"wrapped device error", fmt.Errorf("set: %w", &usp.Error{Code: 7004}), false},
+		{"invalid request", fmt.Errorf("%w: no paths", usp.ErrInvalidRequest), false},
+		{"unknown device", ErrNotFound, false},
+		{"anything else", errors.New("broken pipe"), true},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("%s: retryable(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
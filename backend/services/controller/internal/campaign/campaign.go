@@ -0,0 +1,412 @@
+// Rolls firmware images out to fleets of devices, a growing share at a time.
+package campaign
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/leandrofars/oktopus/internal/bulk"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/firmware"
+	"github.com/leandrofars/oktopus/internal/jobs"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrState = errors.New("campaign can't do that in its current status")
+
+// Devices finished before the failure rate is trusted, unless told otherwise
+const DefaultMinSample = 10
+
+type Engine struct {
+	Db       db.Database
+	Firmware *firmware.Updater
+	mu       sync.Mutex
+	running  map[string]context.CancelFunc
+	stop     map[string]bool
+}
+
+func NewEngine(database db.Database, u *firmware.Updater) *Engine {
+	return &Engine{
+		Db:       database,
+		Firmware: u,
+		running:  map[string]context.CancelFunc{},
+		stop:     map[string]bool{},
+	}
+}
+
+// Resume goes on with the campaigns interrupted by a controller restart.
+func (e *Engine) Resume() {
+	campaigns, err := e.Db.RetrieveCampaigns(db.JobPending, db.JobRunning)
+	if err != nil {
+		return
+	}
+	for _, c := range campaigns {
+		log.Printf("Resuming campaign %s", c.Id)
+		e.Db.ResetRunningCampaignDevices(c.Id)
+		e.launch(c)
+	}
+}
+
+/*
+Create validates the campaign, splits the devices matched by its selector
+into waves, one per stage, and starts it. Devices are shuffled, so the first
+waves are a sample of the whole fleet. Devices already running the image
+version are left out.
+*/
+func (e *Engine) Create(c db.Campaign) (db.Campaign, error) {
+	fw, err := e.Db.RetrieveFirmware(c.Firmware)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return c, fmt.Errorf("%w: no firmware with id %s", usp.ErrInvalidRequest, c.Firmware)
+		}
+		return c, err
+	}
+	if err := prepare(&c, fw); err != nil {
+		return c, err
+	}
+
+	found, err := e.Db.FindDevices(c.Selector)
+	if err != nil {
+		return c, err
+	}
+	var sns []string
+	for _, d := range found {
+		if d.Version != fw.Version {
+			sns = append(sns, d.SN)
+		}
+	}
+	if len(sns) == 0 {
+		return c, bulk.ErrNoTargets
+	}
+	rand.New(rand.NewSource(time.Now().UnixNano())).Shuffle(len(sns), func(i, j int) {
+		sns[i], sns[j] = sns[j], sns[i]
+	})
+
+	now := time.Now()
+	c.Id = uuid.NewString()
+	c.Status = db.JobPending
+	c.Stage = 0
+	c.PauseReason = ""
+	c.Total = len(sns)
+	c.Succeeded, c.Failed, c.Skipped = 0, 0, 0
+	c.CreatedAt = now
+	c.UpdatedAt = now
+
+	var devices []db.CampaignDevice
+	wave := 0
+	for i, sn := range sns {
+		for i >= waveEnd(c, wave) {
+			wave++
+		}
+		devices = append(devices, db.CampaignDevice{
+			SN:        sn,
+			Wave:      wave,
+			Status:    db.JobPending,
+			UpdatedAt: now,
+		})
+	}
+
+	if err := e.Db.CreateCampaign(c, devices); err != nil {
+		return c, err
+	}
+	e.launch(c)
+	return c, nil
+}
+
+// Pause stops updating more devices, the ones being updated still finish.
+func (e *Engine) Pause(id, reason string) (db.Campaign, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, err := e.Db.RetrieveCampaign(id)
+	if err != nil {
+		return c, err
+	}
+	if c.Status != db.JobPending && c.Status != db.JobRunning {
+		return c, ErrState
+	}
+	e.stop[id] = true
+	c.Status = db.CampaignPaused
+	c.PauseReason = reason
+	return c, e.Db.UpdateCampaignStatus(c)
+}
+
+// Continue goes on with a paused campaign.
+func (e *Engine) Continue(id string) (db.Campaign, error) {
+	e.mu.Lock()
+	c, err := e.Db.RetrieveCampaign(id)
+	if err != nil {
+		e.mu.Unlock()
+		return c, err
+	}
+	_, running := e.running[id]
+	if c.Status != db.CampaignPaused || running {
+		e.mu.Unlock()
+		return c, ErrState
+	}
+	c.Status = db.JobRunning
+	c.PauseReason = ""
+	err = e.Db.UpdateCampaignStatus(c)
+	e.mu.Unlock()
+	if err != nil {
+		return c, err
+	}
+
+	e.launch(c)
+	return c, nil
+}
+
+// Cancel stops the campaign for good, updates going on are interrupted.
+func (e *Engine) Cancel(id string) (db.Campaign, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, err := e.Db.RetrieveCampaign(id)
+	if err != nil {
+		return c, err
+	}
+	if c.Status == db.JobDone || c.Status == db.CampaignCanceled {
+		return c, ErrState
+	}
+	e.stop[id] = true
+	if cancel, ok := e.running[id]; ok {
+		cancel()
+	}
+	c.Status = db.CampaignCanceled
+	return c, e.Db.UpdateCampaignStatus(c)
+}
+
+func prepare(c *db.Campaign, fw db.Firmware) error {
+	// Images are only meant to the devices they were built for
+	if c.Selector.Vendor == "" {
+		c.Selector.Vendor = fw.Vendor
+	}
+	if c.Selector.Model == "" {
+		c.Selector.Model = fw.Model
+	}
+	if (fw.Vendor != "" && c.Selector.Vendor != fw.Vendor) || (fw.Model != "" && c.Selector.Model != fw.Model) {
+		return fmt.Errorf("%w: firmware is for %s %s devices", usp.ErrInvalidRequest, fw.Vendor, fw.Model)
+	}
+
+	if len(c.Stages) == 0 || c.Stages[len(c.Stages)-1] < 100 {
+		c.Stages = append(c.Stages, 100)
+	}
+	for i, pct := range c.Stages {
+		if pct <= 0 || pct > 100 || (i > 0 && pct <= c.Stages[i-1]) {
+			return fmt.Errorf("%w: stages must be increasing percentages up to 100", usp.ErrInvalidRequest)
+		}
+	}
+	if c.FailureThreshold < 0 || c.FailureThreshold > 100 {
+		return fmt.Errorf("%w: failure threshold must be a percentage", usp.ErrInvalidRequest)
+	}
+
+	if c.MinSample < 0 {
+		return fmt.Errorf("%w: min sample can't be negative", usp.ErrInvalidRequest)
+	}
+	if c.MinSample == 0 {
+		c.MinSample = DefaultMinSample
+	}
+
+	if c.Concurrency <= 0 {
+		c.Concurrency = bulk.DefaultConcurrency
+	}
+	if c.Concurrency > bulk.MaxConcurrency {
+		c.Concurrency = bulk.MaxConcurrency
+	}
+	return nil
+}
+
+// Number of devices updated once the wave is over, each wave has at least one
+func waveEnd(c db.Campaign, wave int) int {
+	if wave >= len(c.Stages)-1 {
+		return c.Total
+	}
+	end := int(math.Ceil(float64(c.Total) * c.Stages[wave] / 100))
+	if end < wave+1 {
+		end = wave + 1
+	}
+	return end
+}
+
+func (e *Engine) launch(c db.Campaign) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	e.mu.Lock()
+	if _, ok := e.running[c.Id]; ok {
+		e.mu.Unlock()
+		cancel()
+		return
+	}
+	e.running[c.Id] = cancel
+	delete(e.stop, c.Id)
+	e.mu.Unlock()
+
+	go func() {
+		e.run(ctx, c)
+		cancel()
+		e.mu.Lock()
+		delete(e.running, c.Id)
+		e.mu.Unlock()
+	}()
+}
+
+func (e *Engine) run(ctx context.Context, c db.Campaign) {
+	fw, err := e.Db.RetrieveFirmware(c.Firmware)
+	if err != nil {
+		e.Pause(c.Id, "Firmware image is gone: "+err.Error())
+		return
+	}
+
+	if !e.setStatus(c, db.JobRunning) {
+		return
+	}
+	for c.Stage < len(c.Stages) {
+		devices, err := e.Db.RetrieveCampaignDevices(c.Id, c.Stage, db.JobPending)
+		if err != nil {
+			return
+		}
+		e.runWave(ctx, c, fw, devices)
+		// The first stage is the sample, whatever its size. It's only checked
+		// once, a campaign continued after it ran has nothing left there.
+		if c.Stage == 0 && len(devices) > 0 {
+			if updated, err := e.Db.RetrieveCampaign(c.Id); err == nil && e.checkFailures(c, updated) {
+				return
+			}
+		}
+
+		c.Stage++
+		status := db.JobRunning
+		if c.Stage == len(c.Stages) {
+			status = db.JobDone
+		} else if c.Confirm {
+			status = db.CampaignPaused
+			c.PauseReason = fmt.Sprintf("Stage %d finished, waiting to go on", c.Stage)
+		}
+		if !e.setStatus(c, status) {
+			return
+		}
+		if status != db.JobRunning {
+			log.Printf("Campaign %s is %s after stage %d", c.Id, status, c.Stage)
+			return
+		}
+	}
+}
+
+// Saves the campaign status, unless it was paused or canceled meanwhile
+func (e *Engine) setStatus(c db.Campaign, status string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stop[c.Id] {
+		return false
+	}
+	c.Status = status
+	return e.Db.UpdateCampaignStatus(c) == nil
+}
+
+func (e *Engine) stopped(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stop[id]
+}
+
+func (e *Engine) runWave(ctx context.Context, c db.Campaign, fw db.Firmware, devices []db.CampaignDevice) {
+	queue := make(chan db.CampaignDevice)
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for device := range queue {
+				e.runDevice(ctx, c, fw, device)
+			}
+		}()
+	}
+	for _, device := range devices {
+		if e.stopped(c.Id) {
+			break
+		}
+		queue <- device
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func (e *Engine) runDevice(ctx context.Context, c db.Campaign, fw db.Firmware, device db.CampaignDevice) {
+	d, err := e.Db.RetrieveDevice(device.SN)
+	if err != nil || d.Status != utils.Online {
+		device.Status = db.CampaignSkipped
+		device.Error = jobs.EncodeError(bulk.ErrOffline)
+		if err != nil {
+			device.Error = jobs.EncodeError(bulk.ErrNotFound)
+		}
+		e.Db.FinishCampaignDevice(device)
+		return
+	}
+
+	device.Status = db.JobRunning
+	e.Db.UpdateCampaignDevice(device)
+
+	progress := func(r firmware.Result) {
+		device.Stage = r.Stages[len(r.Stages)-1].Name
+		device.Progress, _ = json.Marshal(r)
+		e.Db.UpdateCampaignDevice(device)
+	}
+	result, err := e.Firmware.Update(ctx, device.SN, fw, c.FilesUrl, nil, progress)
+	device.Progress, _ = json.Marshal(result)
+	device.Status = db.JobDone
+	if err != nil {
+		device.Status = db.JobFailed
+		device.Error = jobs.EncodeError(err)
+	}
+
+	updated, err := e.Db.FinishCampaignDevice(device)
+	if err != nil || device.Status != db.JobFailed {
+		return
+	}
+	e.checkFailures(c, updated)
+}
+
+// Pauses the campaign if its failure rate went over the threshold, telling
+// whether it did
+func (e *Engine) checkFailures(c, updated db.Campaign) bool {
+	rate, failing := failureRate(c, updated)
+	if !failing {
+		return false
+	}
+	reason := fmt.Sprintf("Failure rate of %.1f%% is over the threshold of %.1f%%", rate, c.FailureThreshold)
+	if _, err := e.Pause(c.Id, reason); err == nil {
+		log.Printf("Campaign %s paused: %s", c.Id, reason)
+	}
+	return true
+}
+
+// Failure rate of the campaign once updated, telling whether it's over the
+// threshold. The first wave only counts once it has finished min sample
+// devices, so a couple of early failures don't stop the whole campaign.
+func failureRate(c, updated db.Campaign) (float64, bool) {
+	finished := updated.Failed + updated.Succeeded
+	if finished == 0 || (c.Stage == 0 && finished < minSample(c)) {
+		return 0, false
+	}
+	rate := 100 * float64(updated.Failed) / float64(finished)
+	return rate, rate > c.FailureThreshold
+}
+
+// Campaigns created before there was a min sample take the default one
+func minSample(c db.Campaign) int {
+	if c.MinSample <= 0 {
+		return DefaultMinSample
+	}
+	return c.MinSample
+}
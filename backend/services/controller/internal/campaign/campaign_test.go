@@ -0,0 +1,103 @@
+package campaign
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+func TestWaveEnd(t *testing.T) {
+	tests := []struct {
+		total  int
+		stages []float64
+		want   []int
+	}{
+		{100, []float64{1, 10, 50, 100}, []int{1, 10, 50, 100}},
+		{10, []float64{1, 10, 100}, []int{1, 2, 10}},
+		{3, []float64{50, 100}, []int{2, 3}},
+		{7, []float64{33.3, 66.6, 100}, []int{3, 5, 7}},
+		{1, []float64{10, 100}, []int{1, 1}},
+		{0, []float64{100}, []int{0}},
+	}
+	for _, tt := range tests {
+		c := db.Campaign{Total: tt.total, Stages: tt.stages}
+		for wave, want := range tt.want {
+			if got := waveEnd(c, wave); got != want {
+				t.Errorf("waveEnd(%d devices, %v, %d) = %d, want %d", tt.total, tt.stages, wave, got, want)
+			}
+		}
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	tests := []struct {
+		name              string
+		stage             int
+		minSample         int
+		failed, succeeded int
+		rate              float64
+		failing           bool
+	}{
+		{"nothing finished", 1, 10, 0, 0, 0, false},
+		{"first wave under the sample", 0, 10, 3, 0, 0, false},
+		{"first wave at the sample", 0, 10, 3, 7, 30, true},
+		{"first wave under the threshold", 0, 10, 1, 9, 10, false},
+		{"later wave under the sample", 1, 10, 2, 1, 100 * 2.0 / 3, true},
+		{"default sample", 0, 0, 5, 4, 0, false},
+		{"at the threshold", 1, 10, 1, 4, 20, false},
+	}
+	for _, tt := range tests {
+		c := db.Campaign{Stage: tt.stage, MinSample: tt.minSample, FailureThreshold: 20}
+		updated := c
+		updated.Failed = tt.failed
+		updated.Succeeded = tt.succeeded
+		rate, failing := failureRate(c, updated)
+		if rate != tt.rate || failing != tt.failing {
+			t.Errorf("%s: failureRate() = %v, %v, want %v, %v", tt.name, rate, failing, tt.rate, tt.failing)
+		}
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	fw := db.Firmware{Vendor: "Oktopus", Model: "ONT-1"}
+	tests := []struct {
+		name   string
+		c      db.Campaign
+		ok     bool
+		stages []float64
+	}{
+		{"defaults", db.Campaign{}, true, []float64{100}},
+		{"last stage added", db.Campaign{Stages: []float64{1, 10}}, true, []float64{1, 10, 100}},
+		{"decreasing stages", db.Campaign{Stages: []float64{10, 5, 100}}, false, nil},
+		{"stage over 100", db.Campaign{Stages: []float64{150}}, false, nil},
+		{"bad threshold", db.Campaign{FailureThreshold: 120}, false, nil},
+		{"negative min sample", db.Campaign{MinSample: -1}, false, nil},
+		{"same model", db.Campaign{Selector: db.DeviceFilter{Model: "ONT-1"}}, true, []float64{100}},
+		{"other model", db.Campaign{Selector: db.DeviceFilter{Model: "ONT-2"}}, false, nil},
+	}
+	for _, tt := range tests {
+		c := tt.c
+		err := prepare(&c, fw)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: prepare() error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, usp.ErrInvalidRequest) {
+				t.Errorf("%s: prepare() error = %v, want an invalid request", tt.name, err)
+			}
+			continue
+		}
+		if len(c.Stages) != len(tt.stages) || c.Stages[len(c.Stages)-1] != 100 {
+			t.Errorf("%s: stages = %v, want %v", tt.name, c.Stages, tt.stages)
+		}
+		if c.Selector.Vendor != fw.Vendor || c.Selector.Model != fw.Model {
+			t.Errorf("%s: selector = %+v, want the firmware vendor and model", tt.name, c.Selector)
+		}
+		if c.MinSample != DefaultMinSample || c.Concurrency <= 0 {
+			t.Errorf("%s: min sample %d and concurrency %d left unset", tt.name, c.MinSample, c.Concurrency)
+		}
+	}
+}
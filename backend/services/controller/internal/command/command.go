@@ -0,0 +1,199 @@
+// Runs USP commands, waiting for the outcome of the asynchronous ones.
+package command
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/leandrofars/oktopus/internal/events"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+	"github.com/leandrofars/oktopus/internal/utils"
+)
+
+// ID of the subscription the controller creates on devices to learn about
+// completed commands
+const SubscriptionId = "oktopus-operation-complete"
+
+type Runner struct {
+	Usp    *usp.Dispatcher
+	Events *events.Bus
+	mu     sync.Mutex
+	// Devices known to hold the subscription, since they last connected
+	subscribed map[string]bool
+	// Keeps concurrent runs from subscribing the same device twice
+	locks map[string]*sync.Mutex
+}
+
+func NewRunner(d *usp.Dispatcher, bus *events.Bus) *Runner {
+	return &Runner{Usp: d, Events: bus, subscribed: map[string]bool{}, locks: map[string]*sync.Mutex{}}
+}
+
+// Start forgets the subscription of devices as they connect or disconnect,
+// they may have been reset meanwhile.
+func (r *Runner) Start() {
+	deviceEvents, _ := r.Events.Subscribe("")
+	go func() {
+		for e := range deviceEvents {
+			if e.Kind == events.DeviceOnline || e.Kind == events.DeviceOffline {
+				r.mu.Lock()
+				delete(r.subscribed, e.SN)
+				r.mu.Unlock()
+			}
+		}
+	}()
+}
+
+/*
+Run executes the command on the device and returns its output arguments.
+Asynchronous commands are followed until the device notifies that they
+completed, or ctx is done. A failed command is returned as *usp.Error.
+*/
+func (r *Runner) Run(ctx context.Context, sn, command string, input map[string]string) (map[string]string, error) {
+	if err := r.subscribe(ctx, sn); err != nil {
+		return nil, err
+	}
+
+	// Listening before operating, the notification may come right away
+	deviceEvents, unsubscribe := r.Events.Subscribe(sn)
+	defer unsubscribe()
+
+	key := uuid.NewString()
+	resp, err := usp.Operate.Run(ctx, r.Usp, sn, usp.OperateRequest{
+		Command:    command,
+		CommandKey: key,
+		InputArgs:  input,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Results) == 0 {
+		return nil, fmt.Errorf("device gave no result for %s", command)
+	}
+	result := resp.Results[0]
+	if result.Error != nil {
+		return nil, &usp.Error{Code: result.Error.Code, Message: result.Error.Message, Params: []usp.PathError{*result.Error}}
+	}
+	if result.Path == "" {
+		return result.Outputs, nil
+	}
+
+	log.Printf("Waiting for %s to complete on %s", command, sn)
+	for {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, usp.ErrTimeout
+			}
+			return nil, ctx.Err()
+		case e := <-deviceEvents:
+			done := e.Notify.GetOperComplete()
+			if e.Kind != events.Notification || done == nil || done.GetCommandKey() != key {
+				continue
+			}
+			if failure := done.GetCmdFailure(); failure != nil {
+				return nil, &usp.Error{Code: failure.GetErrCode(), Message: failure.GetErrMsg()}
+			}
+			return done.GetReqOutputArgs().GetOutputArgs(), nil
+		}
+	}
+}
+
+// Makes sure the device notifies the controller of every completed command
+func (r *Runner) subscribe(ctx context.Context, sn string) error {
+	r.mu.Lock()
+	lock, ok := r.locks[sn]
+	if !ok {
+		lock = &sync.Mutex{}
+		r.locks[sn] = lock
+	}
+	r.mu.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	r.mu.Lock()
+	done := r.subscribed[sn]
+	r.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	resp, err := usp.Get.Run(ctx, r.Usp, sn, usp.GetRequest{
+		Paths: []string{"Device.LocalAgent.Subscription.*.", "Device.LocalAgent.Controller.*.EndpointID"},
+	})
+	if err != nil {
+		return err
+	}
+	found, broken := findSubscription(resp.Params)
+
+	// Subscriptions disabled or sending elsewhere are replaced, as agents
+	// may not allow changing their recipient
+	if len(broken) > 0 {
+		log.Printf("Replacing the completed commands subscription of %s", sn)
+		deleted, err := usp.Delete.Run(ctx, r.Usp, sn, usp.DeleteRequest{Paths: broken})
+		if err != nil {
+			return err
+		}
+		if len(deleted.Errors) > 0 {
+			e := deleted.Errors[0]
+			return &usp.Error{Code: e.Code, Message: "couldn't remove the subscription to completed commands: " + e.Message, Params: deleted.Errors}
+		}
+	}
+
+	if !found {
+		added, err := usp.Add.Run(ctx, r.Usp, sn, usp.AddRequest{Objects: []usp.AddObject{{
+			Path: "Device.LocalAgent.Subscription.",
+			Params: map[string]string{
+				"Enable":        "true",
+				"ID":            SubscriptionId,
+				"NotifType":     "OperationComplete",
+				"ReferenceList": "Device.",
+				"Persistent":    "true",
+			},
+		}}})
+		if err != nil {
+			return err
+		}
+		if len(added.Errors) > 0 {
+			e := added.Errors[0]
+			return &usp.Error{Code: e.Code, Message: "couldn't subscribe to completed commands: " + e.Message, Params: added.Errors}
+		}
+		log.Printf("Subscribed to completed commands of %s", sn)
+	}
+
+	r.mu.Lock()
+	r.subscribed[sn] = true
+	r.mu.Unlock()
+	return nil
+}
+
+/*
+Looks for the subscription to completed commands among the values of the
+subscriptions and controllers of a device. Found tells if one notifies the
+controller, broken lists those that are disabled or notify another recipient.
+*/
+func findSubscription(values map[string]string) (found bool, broken []string) {
+	controller := ""
+	for _, c := range dm.Instances(values, "Device.LocalAgent.Controller.") {
+		if values[c+"EndpointID"] == utils.ControllerId {
+			controller = c
+		}
+	}
+
+	for _, s := range dm.Instances(values, "Device.LocalAgent.Subscription.") {
+		if values[s+"ID"] != SubscriptionId {
+			continue
+		}
+		// Without the controllers of the device any recipient is trusted
+		recipient := controller == "" || dm.WithDot(values[s+"Recipient"]) == controller
+		if found || !recipient || !dm.ParseBool(values[s+"Enable"]) || values[s+"NotifType"] != "OperationComplete" {
+			broken = append(broken, s)
+			continue
+		}
+		found = true
+	}
+	return found, broken
+}
@@ -0,0 +1,54 @@
+package command
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindSubscription(t *testing.T) {
+	controllers := map[string]string{
+		"Device.LocalAgent.Controller.1.EndpointID": "self::other",
+		"Device.LocalAgent.Controller.2.EndpointID": "oktopusController",
+	}
+	subscription := func(enable, recipient, notifType string) map[string]string {
+		values := map[string]string{
+			"Device.LocalAgent.Subscription.1.ID":        "someone-else",
+			"Device.LocalAgent.Subscription.1.Enable":    "true",
+			"Device.LocalAgent.Subscription.3.ID":        SubscriptionId,
+			"Device.LocalAgent.Subscription.3.Enable":    enable,
+			"Device.LocalAgent.Subscription.3.Recipient": recipient,
+			"Device.LocalAgent.Subscription.3.NotifType": notifType,
+		}
+		for k, v := range controllers {
+			values[k] = v
+		}
+		return values
+	}
+
+	tests := []struct {
+		name   string
+		values map[string]string
+		found  bool
+		broken []string
+	}{
+		{"no subscription", controllers, false, nil},
+		{"healthy", subscription("true", "Device.LocalAgent.Controller.2.", "OperationComplete"), true, nil},
+		{"recipient without trailing dot", subscription("1", "Device.LocalAgent.Controller.2", "OperationComplete"), true, nil},
+		{"disabled", subscription("false", "Device.LocalAgent.Controller.2.", "OperationComplete"), false, []string{"Device.LocalAgent.Subscription.3."}},
+		{"other recipient", subscription("true", "Device.LocalAgent.Controller.1.", "OperationComplete"), false, []string{"Device.LocalAgent.Subscription.3."}},
+		{"no recipient", subscription("true", "", "OperationComplete"), false, []string{"Device.LocalAgent.Subscription.3."}},
+		{"other notification type", subscription("true", "Device.LocalAgent.Controller.2.", "ValueChange"), false, []string{"Device.LocalAgent.Subscription.3."}},
+		{"controllers unknown", map[string]string{
+			"Device.LocalAgent.Subscription.1.ID":        SubscriptionId,
+			"Device.LocalAgent.Subscription.1.Enable":    "true",
+			"Device.LocalAgent.Subscription.1.Recipient": "Device.LocalAgent.Controller.5.",
+			"Device.LocalAgent.Subscription.1.NotifType": "OperationComplete",
+		}, true, nil},
+	}
+	for _, tt := range tests {
+		found, broken := findSubscription(tt.values)
+		if found != tt.found || !reflect.DeepEqual(broken, tt.broken) {
+			t.Errorf("%s: findSubscription() = %v, %v, want %v, %v", tt.name, found, broken, tt.found, tt.broken)
+		}
+	}
+}
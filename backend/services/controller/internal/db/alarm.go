@@ -0,0 +1,227 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of alarm rules
+const (
+	// A param value compared against Value, as collected by the metrics
+	RuleThreshold = "threshold"
+	// A device offline for longer than For
+	RuleOffline = "offline"
+	// A device running a software version missing from Approved
+	RuleFirmware = "firmware"
+)
+
+// Severities of alarms, the most severe first
+const (
+	SeverityCritical = "critical"
+	SeverityMajor    = "major"
+	SeverityMinor    = "minor"
+	SeverityWarning  = "warning"
+)
+
+/*
+AlarmRule raises an alarm on the devices matched by Selector, every device if
+it's nil, when its condition held for longer than For, as "10m". Threshold
+rules compare the params under Path, where * stands for any instance number,
+using Operator.
+*/
+type AlarmRule struct {
+	Id       string        `json:"id" bson:"_id"`
+	Name     string        `json:"name"`
+	Kind     string        `json:"kind"`
+	Severity string        `json:"severity"`
+	Selector *DeviceFilter `json:"selector,omitempty"`
+	Path     string        `json:"path,omitempty"`
+	Operator string        `json:"operator,omitempty"`
+	Value    float64       `json:"value"`
+	For      string        `json:"for,omitempty"`
+	Approved []string      `json:"approved,omitempty"`
+	Enabled  bool          `json:"enabled"`
+	// Parsed For, set on validation
+	Duration  time.Duration `json:"-" bson:"-"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+// Alarm is raised once per rule, device and path until it's cleared, either
+// by the condition going away or by an operator.
+type Alarm struct {
+	Id             string     `json:"id" bson:"_id"`
+	Rule           string     `json:"rule"`
+	RuleName       string     `json:"ruleName"`
+	SN             string     `json:"sn"`
+	Path           string     `json:"path,omitempty"`
+	Severity       string     `json:"severity"`
+	Message        string     `json:"message"`
+	RaisedAt       time.Time  `json:"raisedAt"`
+	AcknowledgedAt *time.Time `json:"acknowledgedAt,omitempty"`
+	AcknowledgedBy string     `json:"acknowledgedBy,omitempty"`
+	ClearedAt      *time.Time `json:"clearedAt,omitempty"`
+	ClearedBy      string     `json:"clearedBy,omitempty"`
+}
+
+// Empty fields match any alarm
+type AlarmFilter struct {
+	Active   bool
+	SN       string
+	Rule     string
+	Severity string
+	From     *time.Time
+	To       *time.Time
+}
+
+func (f AlarmFilter) query() bson.M {
+	filter := bson.M{}
+	if f.Active {
+		filter["clearedat"] = nil
+	}
+	if f.SN != "" {
+		filter["sn"] = f.SN
+	}
+	if f.Rule != "" {
+		filter["rule"] = f.Rule
+	}
+	if f.Severity != "" {
+		filter["severity"] = f.Severity
+	}
+	raised := bson.M{}
+	if f.From != nil {
+		raised["$gte"] = *f.From
+	}
+	if f.To != nil {
+		raised["$lte"] = *f.To
+	}
+	if len(raised) > 0 {
+		filter["raisedat"] = raised
+	}
+	return filter
+}
+
+func (d *Database) CreateAlarmRule(rule AlarmRule) error {
+	_, err := d.alarmRules.InsertOne(d.ctx, rule)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) UpdateAlarmRule(rule AlarmRule) error {
+	_, err := d.alarmRules.ReplaceOne(d.ctx, bson.M{"_id": rule.Id}, rule)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) DeleteAlarmRule(id string) error {
+	_, err := d.alarmRules.DeleteOne(d.ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) RetrieveAlarmRule(id string) (AlarmRule, error) {
+	var result AlarmRule
+	err := d.alarmRules.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+func (d *Database) RetrieveAlarmRules() ([]AlarmRule, error) {
+	results := []AlarmRule{}
+	cursor, err := d.alarmRules.Find(d.ctx, bson.M{}, options.Find().SetSort(bson.M{"createdat": 1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// RaiseAlarm saves the alarm unless the same one is already active, and
+// tells whether it was raised.
+func (d *Database) RaiseAlarm(alarm Alarm) (bool, error) {
+	alarm.Id = uuid.NewString()
+	filter := bson.M{"rule": alarm.Rule, "sn": alarm.SN, "path": alarm.Path, "clearedat": nil}
+	result, err := d.alarms.UpdateOne(d.ctx, filter,
+		bson.M{"$setOnInsert": alarm},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Println(err)
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+// ClearAlarms clears the active alarms of the rule on the device, only the
+// one of the path if it isn't empty, and the ones of every device if sn is.
+func (d *Database) ClearAlarms(rule, sn, path, by string) error {
+	filter := bson.M{"rule": rule, "clearedat": nil}
+	if sn != "" {
+		filter["sn"] = sn
+	}
+	if path != "" {
+		filter["path"] = path
+	}
+	_, err := d.alarms.UpdateMany(d.ctx, filter,
+		bson.M{"$set": bson.M{"clearedat": time.Now(), "clearedby": by}},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// ClearAlarm clears an active alarm by hand.
+func (d *Database) ClearAlarm(id, by string) (Alarm, error) {
+	return d.updateActiveAlarm(id, bson.M{"clearedat": time.Now(), "clearedby": by})
+}
+
+func (d *Database) AcknowledgeAlarm(id, by string) (Alarm, error) {
+	return d.updateActiveAlarm(id, bson.M{"acknowledgedat": time.Now(), "acknowledgedby": by})
+}
+
+// Returns mongo.ErrNoDocuments if the alarm doesn't exist or was cleared
+func (d *Database) updateActiveAlarm(id string, set bson.M) (Alarm, error) {
+	var result Alarm
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := d.alarms.FindOneAndUpdate(d.ctx, bson.M{"_id": id, "clearedat": nil}, bson.M{"$set": set}, opts).Decode(&result)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Println(err)
+	}
+	return result, err
+}
+
+func (d *Database) RetrieveAlarm(id string) (Alarm, error) {
+	var result Alarm
+	err := d.alarms.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+// Alarms matching the filter, the latest first
+func (d *Database) RetrieveAlarms(filter AlarmFilter) ([]Alarm, error) {
+	results := []Alarm{}
+	cursor, err := d.alarms.Find(d.ctx, filter.query(), options.Find().SetSort(bson.M{"raisedat": -1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type BackupParam struct {
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+/*
+Backup is the writable configuration of a device. Objects are the instances
+of multi-instance objects the controller may create, as
+"Device.NAT.PortMapping.2.". Version counts the backups of the device.
+*/
+type Backup struct {
+	Id              string        `json:"id" bson:"_id"`
+	SN              string        `json:"sn"`
+	Version         int           `json:"version"`
+	Note            string        `json:"note,omitempty"`
+	Vendor          string        `json:"vendor"`
+	Model           string        `json:"model"`
+	SoftwareVersion string        `json:"softwareVersion"`
+	Params          []BackupParam `json:"params,omitempty"`
+	Objects         []string      `json:"objects,omitempty"`
+	CreatedAt       time.Time     `json:"createdAt"`
+}
+
+// Saves the backup with the version following the latest one of the device
+func (d *Database) CreateBackup(b Backup) (Backup, error) {
+	var latest Backup
+	opts := options.FindOne().SetSort(bson.M{"version": -1}).SetProjection(bson.M{"version": 1})
+	err := d.backups.FindOne(d.ctx, bson.M{"sn": b.SN}, opts).Decode(&latest)
+	if err == nil {
+		b.Version = latest.Version + 1
+	} else {
+		b.Version = 1
+	}
+
+	_, err = d.backups.InsertOne(d.ctx, b)
+	if err != nil {
+		log.Println(err)
+	}
+	return b, err
+}
+
+func (d *Database) RetrieveBackup(id string) (Backup, error) {
+	var result Backup
+	err := d.backups.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+// Backups of a device without their content, the latest first
+func (d *Database) RetrieveBackups(sn string) ([]Backup, error) {
+	results := []Backup{}
+	opts := options.Find().SetSort(bson.M{"version": -1}).SetProjection(bson.M{"params": 0, "objects": 0})
+	cursor, err := d.backups.Find(d.ctx, bson.M{"sn": sn}, opts)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+func (d *Database) DeleteBackup(id string) error {
+	_, err := d.backups.DeleteOne(d.ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
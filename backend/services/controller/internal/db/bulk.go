@@ -0,0 +1,181 @@
+package db
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BulkJob runs the same operation against many devices, the outcome for each
+// device is kept as a BulkResult. Status follows the Job status constants.
+type BulkJob struct {
+	Id          string          `json:"id" bson:"_id"`
+	Operation   string          `json:"operation"`
+	Request     json.RawMessage `json:"request"`
+	Targets     []string        `json:"targets,omitempty"`
+	Filter      *DeviceFilter   `json:"filter,omitempty"`
+	Concurrency int             `json:"concurrency"`
+	Retries     int             `json:"retries"`
+	Status      string          `json:"status"`
+	Total       int             `json:"total"`
+	Succeeded   int             `json:"succeeded"`
+	Failed      int             `json:"failed"`
+	Task        string          `json:"task,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+type BulkResult struct {
+	Id        string          `json:"-" bson:"_id"`
+	Job       string          `json:"job"`
+	SN        string          `json:"sn"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     json.RawMessage `json:"error,omitempty"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+func bulkResultId(job, sn string) string {
+	return job + ":" + sn
+}
+
+// Saves the job along with a pending result for each one of its targets
+func (d *Database) CreateBulkJob(job BulkJob) error {
+	_, err := d.bulk.InsertOne(d.ctx, job)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if len(job.Targets) == 0 {
+		return nil
+	}
+
+	var results []interface{}
+	for _, sn := range job.Targets {
+		results = append(results, BulkResult{
+			Id:        bulkResultId(job.Id, sn),
+			Job:       job.Id,
+			SN:        sn,
+			Status:    JobPending,
+			UpdatedAt: job.CreatedAt,
+		})
+	}
+	_, err = d.results.InsertMany(d.ctx, results)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) RetrieveBulkJob(id string) (BulkJob, error) {
+	var result BulkJob
+	err := d.bulk.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+func (d *Database) RetrieveBulkJobs(limit int64) ([]BulkJob, error) {
+	return d.findBulkJobs(bson.M{}, limit)
+}
+
+func (d *Database) findBulkJobs(filter bson.M, limit int64) ([]BulkJob, error) {
+	results := []BulkJob{}
+	opts := options.Find().SetSort(bson.M{"createdat": -1}).SetLimit(limit)
+	cursor, err := d.bulk.Find(d.ctx, filter, opts)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// Bulk jobs started by a scheduled task, the latest first
+func (d *Database) RetrieveTaskRuns(task string, limit int64) ([]BulkJob, error) {
+	return d.findBulkJobs(bson.M{"task": task}, limit)
+}
+
+// Jobs which have targets left to run, used to resume them after a restart
+func (d *Database) RetrieveUnfinishedBulkJobs() ([]BulkJob, error) {
+	return d.findBulkJobs(bson.M{"status": bson.M{"$in": []string{JobPending, JobRunning}}}, 0)
+}
+
+func (d *Database) UpdateBulkJobStatus(id, status string) error {
+	_, err := d.bulk.UpdateOne(d.ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"status": status, "updatedat": time.Now()}},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// Retrieves results of a job, only the ones with the given status if it isn't empty
+func (d *Database) RetrieveBulkResults(job string, status ...string) ([]BulkResult, error) {
+	results := []BulkResult{}
+	filter := bson.M{"job": job}
+	if len(status) > 0 {
+		filter["status"] = bson.M{"$in": status}
+	}
+	cursor, err := d.results.Find(d.ctx, filter, options.Find().SetSort(bson.M{"sn": 1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// Saves the outcome of a target and updates the job counters
+func (d *Database) FinishBulkResult(result BulkResult) error {
+	result.Id = bulkResultId(result.Job, result.SN)
+	result.UpdatedAt = time.Now()
+	_, err := d.results.ReplaceOne(d.ctx, bson.M{"_id": result.Id}, result)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	counter := "succeeded"
+	if result.Status == JobFailed {
+		counter = "failed"
+	}
+	_, err = d.bulk.UpdateOne(d.ctx, bson.M{"_id": result.Job},
+		bson.M{"$inc": bson.M{counter: 1}, "$set": bson.M{"updatedat": result.UpdatedAt}},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// Turns failed targets back to pending, so they run again
+func (d *Database) ResetFailedBulkResults(job string) (int64, error) {
+	res, err := d.results.UpdateMany(d.ctx,
+		bson.M{"job": job, "status": JobFailed},
+		bson.M{"$set": bson.M{"status": JobPending, "updatedat": time.Now()}},
+	)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	if res.ModifiedCount == 0 {
+		return 0, nil
+	}
+	_, err = d.bulk.UpdateOne(d.ctx, bson.M{"_id": job},
+		bson.M{"$inc": bson.M{"failed": -res.ModifiedCount}, "$set": bson.M{"status": JobPending}},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	return res.ModifiedCount, err
+}
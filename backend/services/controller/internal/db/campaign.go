@@ -0,0 +1,204 @@
+package db
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Status of campaigns besides the Job status constants
+const (
+	CampaignPaused   = "paused"
+	CampaignCanceled = "canceled"
+)
+
+// Status of campaign devices which were left out, as offline ones
+const CampaignSkipped = "skipped"
+
+/*
+Campaign rolls a firmware image out to the devices matched by Selector, in
+stages. Stages are cumulative percentages of the devices, as [1, 10, 100],
+and Stage is the index of the current one. The campaign pauses as soon as
+the failure rate, in percent of the finished devices, goes over
+FailureThreshold, 0 by default, so any failure pauses it. The rate is only
+trusted once MinSample devices finished, or the first stage did.
+*/
+type Campaign struct {
+	Id               string       `json:"id" bson:"_id"`
+	Name             string       `json:"name"`
+	Firmware         string       `json:"firmware"`
+	Selector         DeviceFilter `json:"selector"`
+	Stages           []float64    `json:"stages"`
+	FailureThreshold float64      `json:"failureThreshold"`
+	MinSample        int          `json:"minSample"`
+	Concurrency      int          `json:"concurrency"`
+	// Waits to be resumed after each stage, instead of going on by itself
+	Confirm     bool      `json:"confirm"`
+	FilesUrl    string    `json:"filesUrl"`
+	Status      string    `json:"status"`
+	Stage       int       `json:"stage"`
+	PauseReason string    `json:"pauseReason,omitempty"`
+	Total       int       `json:"total"`
+	Succeeded   int       `json:"succeeded"`
+	Failed      int       `json:"failed"`
+	Skipped     int       `json:"skipped"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// CampaignDevice is the rollout of a campaign to one device. Stage is the
+// firmware update stage it's in, and Progress the details of every stage.
+type CampaignDevice struct {
+	Id        string          `json:"-" bson:"_id"`
+	Campaign  string          `json:"campaign"`
+	SN        string          `json:"sn"`
+	Wave      int             `json:"wave"`
+	Status    string          `json:"status"`
+	Stage     string          `json:"stage,omitempty"`
+	Progress  json.RawMessage `json:"progress,omitempty"`
+	Error     json.RawMessage `json:"error,omitempty"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+func campaignDeviceId(campaign, sn string) string {
+	return campaign + ":" + sn
+}
+
+// Saves the campaign along with its devices
+func (d *Database) CreateCampaign(c Campaign, devices []CampaignDevice) error {
+	_, err := d.campaigns.InsertOne(d.ctx, c)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+
+	var docs []interface{}
+	for _, x := range devices {
+		x.Id = campaignDeviceId(c.Id, x.SN)
+		x.Campaign = c.Id
+		docs = append(docs, x)
+	}
+	_, err = d.campaignDevices.InsertMany(d.ctx, docs)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) RetrieveCampaign(id string) (Campaign, error) {
+	var result Campaign
+	err := d.campaigns.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+func (d *Database) RetrieveCampaigns(status ...string) ([]Campaign, error) {
+	filter := bson.M{}
+	if len(status) > 0 {
+		filter["status"] = bson.M{"$in": status}
+	}
+
+	results := []Campaign{}
+	cursor, err := d.campaigns.Find(d.ctx, filter, options.Find().SetSort(bson.M{"createdat": -1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// Sets the status, stage and pause reason of the campaign
+func (d *Database) UpdateCampaignStatus(c Campaign) error {
+	_, err := d.campaigns.UpdateOne(d.ctx, bson.M{"_id": c.Id},
+		bson.M{"$set": bson.M{
+			"status":      c.Status,
+			"stage":       c.Stage,
+			"pausereason": c.PauseReason,
+			"updatedat":   time.Now(),
+		}},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// Devices of a campaign, only of a wave if it isn't negative, and only with
+// the given status if any
+func (d *Database) RetrieveCampaignDevices(campaign string, wave int, status ...string) ([]CampaignDevice, error) {
+	filter := bson.M{"campaign": campaign}
+	if wave >= 0 {
+		filter["wave"] = wave
+	}
+	if len(status) > 0 {
+		filter["status"] = bson.M{"$in": status}
+	}
+
+	results := []CampaignDevice{}
+	cursor, err := d.campaignDevices.Find(d.ctx, filter, options.Find().SetSort(bson.D{{Key: "wave", Value: 1}, {Key: "sn", Value: 1}}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+func (d *Database) UpdateCampaignDevice(device CampaignDevice) error {
+	device.Id = campaignDeviceId(device.Campaign, device.SN)
+	device.UpdatedAt = time.Now()
+	_, err := d.campaignDevices.ReplaceOne(d.ctx, bson.M{"_id": device.Id}, device)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// Saves the outcome of a device and updates the campaign counters
+func (d *Database) FinishCampaignDevice(device CampaignDevice) (Campaign, error) {
+	var c Campaign
+	if err := d.UpdateCampaignDevice(device); err != nil {
+		return c, err
+	}
+
+	counter := "succeeded"
+	switch device.Status {
+	case JobFailed:
+		counter = "failed"
+	case CampaignSkipped:
+		counter = "skipped"
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := d.campaigns.FindOneAndUpdate(d.ctx, bson.M{"_id": device.Campaign},
+		bson.M{"$inc": bson.M{counter: 1}, "$set": bson.M{"updatedat": time.Now()}},
+		opts,
+	).Decode(&c)
+	if err != nil {
+		log.Println(err)
+	}
+	return c, err
+}
+
+// Devices left running by a controller restart go back to pending
+func (d *Database) ResetRunningCampaignDevices(campaign string) error {
+	_, err := d.campaignDevices.UpdateMany(d.ctx,
+		bson.M{"campaign": campaign, "status": JobRunning},
+		bson.M{"$set": bson.M{"status": JobPending, "updatedat": time.Now()}},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
@@ -2,15 +2,33 @@ package db
 
 import (
 	"context"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
 )
 
 type Database struct {
-	devices *mongo.Collection
-	users   *mongo.Collection
-	ctx     context.Context
+	devices         *mongo.Collection
+	users           *mongo.Collection
+	jobs            *mongo.Collection
+	bulk            *mongo.Collection
+	results         *mongo.Collection
+	tasks           *mongo.Collection
+	firmwares       *mongo.Collection
+	campaigns       *mongo.Collection
+	campaignDevices *mongo.Collection
+	profiles        *mongo.Collection
+	profileStatus   *mongo.Collection
+	backups         *mongo.Collection
+	presence        *mongo.Collection
+	metrics         *mongo.Collection
+	metricsHourly   *mongo.Collection
+	alarmRules      *mongo.Collection
+	alarms          *mongo.Collection
+	hosts           *mongo.Collection
+	packages        *mongo.Collection
+	ctx             context.Context
 }
 
 func NewDatabase(ctx context.Context, mongoUri string) Database {
@@ -29,8 +47,61 @@ func NewDatabase(ctx context.Context, mongoUri string) Database {
 	log.Println("Connected to MongoDB-->", mongoUri)
 	devices := client.Database("oktopus").Collection("devices")
 	users := client.Database("oktopus").Collection("users")
+	jobs := client.Database("oktopus").Collection("jobs")
+	bulk := client.Database("oktopus").Collection("bulk_jobs")
+	results := client.Database("oktopus").Collection("bulk_results")
+	tasks := client.Database("oktopus").Collection("tasks")
+	firmwares := client.Database("oktopus").Collection("firmwares")
+	campaigns := client.Database("oktopus").Collection("campaigns")
+	campaignDevices := client.Database("oktopus").Collection("campaign_devices")
+	profiles := client.Database("oktopus").Collection("profiles")
+	profileStatus := client.Database("oktopus").Collection("profile_status")
+	backups := client.Database("oktopus").Collection("backups")
+	presence := client.Database("oktopus").Collection("presence")
+	metrics := client.Database("oktopus").Collection("metrics")
+	metricsHourly := client.Database("oktopus").Collection("metrics_hourly")
+	alarmRules := client.Database("oktopus").Collection("alarm_rules")
+	alarms := client.Database("oktopus").Collection("alarms")
+	hosts := client.Database("oktopus").Collection("hosts")
+	packages := client.Database("oktopus").Collection("packages")
+
+	// Presence is read per device, the newest transitions first
+	_, err = presence.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "sn", Value: 1}, {Key: "time", Value: -1}},
+	})
+	if err != nil {
+		log.Println("Couldn't create presence index -->", err)
+	}
+
+	// Metrics are read per device and path over a period
+	for _, c := range []*mongo.Collection{metrics, metricsHourly} {
+		_, err = c.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "sn", Value: 1}, {Key: "path", Value: 1}, {Key: "time", Value: 1}},
+		})
+		if err != nil {
+			log.Println("Couldn't create "+c.Name()+" index -->", err)
+		}
+	}
+
 	db.devices = devices
 	db.users = users
+	db.jobs = jobs
+	db.bulk = bulk
+	db.results = results
+	db.tasks = tasks
+	db.firmwares = firmwares
+	db.campaigns = campaigns
+	db.campaignDevices = campaignDevices
+	db.profiles = profiles
+	db.profileStatus = profileStatus
+	db.backups = backups
+	db.presence = presence
+	db.metrics = metrics
+	db.metricsHourly = metricsHourly
+	db.alarmRules = alarmRules
+	db.alarms = alarms
+	db.hosts = hosts
+	db.packages = packages
 	db.ctx = ctx
 	return db
 }
@@ -5,21 +5,26 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
+	"time"
 )
 
 type Device struct {
-	SN       string
-	Model    string
-	Customer string
-	Vendor   string
-	Version  string
-	Status   uint8
+	SN             string
+	Model          string
+	Customer       string
+	Vendor         string
+	Version        string
+	Status         uint8
+	LastSeen       time.Time
+	ConnectedSince *time.Time
+	// Percentage of time online lately, computed when retrieving devices
+	Uptime *float64 `bson:"-"`
 }
 
 func (d *Database) CreateDevice(device Device) error {
 	var result bson.M
 	opts := options.FindOneAndReplace().SetUpsert(true)
-	err := d.devices.FindOneAndReplace(d.ctx, bson.D{{"sn", device.SN}}, device, opts).Decode(&result)
+	err := d.devices.FindOneAndReplace(d.ctx, bson.D{{Key: "sn", Value: device.SN}}, device, opts).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			log.Printf("New device %s added to database", device.SN)
@@ -46,10 +51,57 @@ func (d *Database) RetrieveDevices() ([]Device, error) {
 	return results, nil
 }
 
+// Empty fields match any device
+type DeviceFilter struct {
+	Vendor  string `json:"vendor,omitempty"`
+	Model   string `json:"model,omitempty"`
+	Version string `json:"version,omitempty"`
+	Status  *uint8 `json:"status,omitempty"`
+}
+
+func (f DeviceFilter) query() bson.M {
+	query := bson.M{}
+	if f.Vendor != "" {
+		query["vendor"] = f.Vendor
+	}
+	if f.Model != "" {
+		query["model"] = f.Model
+	}
+	if f.Version != "" {
+		query["version"] = f.Version
+	}
+	if f.Status != nil {
+		query["status"] = *f.Status
+	}
+	return query
+}
+
+// Match tells if the device is one of the filter, as FindDevices would.
+func (f DeviceFilter) Match(device Device) bool {
+	return (f.Vendor == "" || f.Vendor == device.Vendor) &&
+		(f.Model == "" || f.Model == device.Model) &&
+		(f.Version == "" || f.Version == device.Version) &&
+		(f.Status == nil || *f.Status == device.Status)
+}
+
+func (d *Database) FindDevices(filter DeviceFilter) ([]Device, error) {
+	var results []Device
+	cursor, err := d.devices.Find(d.ctx, filter.query())
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
 func (d *Database) RetrieveDevice(sn string) (Device, error) {
 	var result Device
 	//TODO: filter devices by user ownership
-	err := d.devices.FindOne(d.ctx, bson.D{{"sn", sn}}, nil).Decode(&result)
+	err := d.devices.FindOne(d.ctx, bson.D{{Key: "sn", Value: sn}}, nil).Decode(&result)
 	if err != nil {
 		log.Println(err)
 	}
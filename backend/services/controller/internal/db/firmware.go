@@ -0,0 +1,74 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Firmware is an image kept in the controller file store.
+type Firmware struct {
+	Id        string    `json:"id" bson:"_id"`
+	Vendor    string    `json:"vendor"`
+	Model     string    `json:"model"`
+	Version   string    `json:"version"`
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (d *Database) CreateFirmware(fw Firmware) error {
+	_, err := d.firmwares.InsertOne(d.ctx, fw)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) DeleteFirmware(id string) error {
+	_, err := d.firmwares.DeleteOne(d.ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) RetrieveFirmware(id string) (Firmware, error) {
+	var result Firmware
+	err := d.firmwares.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+// Images of a vendor and model, any of them if empty, newest first
+func (d *Database) RetrieveFirmwares(vendor, model string) ([]Firmware, error) {
+	filter := bson.M{}
+	if vendor != "" {
+		filter["vendor"] = vendor
+	}
+	if model != "" {
+		filter["model"] = model
+	}
+
+	results := []Firmware{}
+	cursor, err := d.firmwares.Find(d.ctx, filter, options.Find().SetSort(bson.M{"createdat": -1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+func (d *Database) FirmwareExists(vendor, model, version string) (bool, error) {
+	count, err := d.firmwares.CountDocuments(d.ctx, bson.M{"vendor": vendor, "model": model, "version": version})
+	if err != nil {
+		log.Println(err)
+	}
+	return count > 0, err
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Host is a client on the LAN of a device, with its WiFi link if it's a
+// wireless one.
+type Host struct {
+	MAC                string      `json:"mac"`
+	IP                 string      `json:"ip,omitempty"`
+	HostName           string      `json:"hostName,omitempty"`
+	Active             bool        `json:"active"`
+	InterfaceType      string      `json:"interfaceType,omitempty"`
+	Interface          string      `json:"interface,omitempty"`
+	AddressSource      string      `json:"addressSource,omitempty"`
+	LeaseTimeRemaining int         `json:"leaseTimeRemaining,omitempty"`
+	WiFi               *WiFiClient `json:"wifi,omitempty"`
+}
+
+// Rates are in kbit/s and signal levels in dBm
+type WiFiClient struct {
+	AccessPoint       string `json:"accessPoint"`
+	SSID              string `json:"ssid,omitempty"`
+	FrequencyBand     string `json:"frequencyBand,omitempty"`
+	SignalStrength    int    `json:"signalStrength"`
+	Noise             int    `json:"noise,omitempty"`
+	DownlinkRate      int    `json:"downlinkRate"`
+	UplinkRate        int    `json:"uplinkRate"`
+	OperatingStandard string `json:"operatingStandard,omitempty"`
+}
+
+// HostsSnapshot is the inventory of the LAN of a device at some time
+type HostsSnapshot struct {
+	Id    string    `json:"id" bson:"_id"`
+	SN    string    `json:"sn"`
+	Time  time.Time `json:"time"`
+	Hosts []Host    `json:"hosts"`
+}
+
+func (d *Database) CreateHostsSnapshot(s HostsSnapshot) (HostsSnapshot, error) {
+	s.Id = uuid.NewString()
+	_, err := d.hosts.InsertOne(d.ctx, s)
+	if err != nil {
+		log.Println(err)
+	}
+	return s, err
+}
+
+// Snapshots of the device between from and to, the latest first
+func (d *Database) RetrieveHostsSnapshots(sn string, from, to time.Time) ([]HostsSnapshot, error) {
+	results := []HostsSnapshot{}
+	filter := bson.M{"sn": sn, "time": bson.M{"$gte": from, "$lte": to}}
+	cursor, err := d.hosts.Find(d.ctx, filter, options.Find().SetSort(bson.M{"time": -1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Job status
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a device request executed in background, its result is kept so the
+// client can fetch it later.
+type Job struct {
+	Id        string          `json:"id" bson:"_id"`
+	SN        string          `json:"sn"`
+	Operation string          `json:"operation"`
+	Status    string          `json:"status"`
+	Request   json.RawMessage `json:"request,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     json.RawMessage `json:"error,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+func (d *Database) CreateJob(job Job) error {
+	_, err := d.jobs.InsertOne(d.ctx, job)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) UpdateJob(job Job) error {
+	_, err := d.jobs.ReplaceOne(d.ctx, bson.M{"_id": job.Id}, job)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) RetrieveJob(id string) (Job, error) {
+	var result Job
+	err := d.jobs.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+// Retrieves the latest jobs, of a single device if sn isn't empty
+func (d *Database) RetrieveJobs(sn string, limit int64) ([]Job, error) {
+	results := []Job{}
+	filter := bson.M{}
+	if sn != "" {
+		filter["sn"] = sn
+	}
+	opts := options.Find().SetSort(bson.M{"createdat": -1}).SetLimit(limit)
+	cursor, err := d.jobs.Find(d.ctx, filter, opts)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// Jobs that were still running when the controller stopped will never finish
+func (d *Database) InterruptJobs(reason json.RawMessage) error {
+	_, err := d.jobs.UpdateMany(d.ctx,
+		bson.M{"status": bson.M{"$in": []string{JobPending, JobRunning}}},
+		bson.M{"$set": bson.M{"status": JobFailed, "error": reason, "updatedat": time.Now()}},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
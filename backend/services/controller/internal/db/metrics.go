@@ -0,0 +1,183 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Resolutions metrics are kept at
+const (
+	MetricsRaw    = "raw"
+	MetricsHourly = "hour"
+)
+
+// Mongo error code of an index created again with other options
+const indexOptionsConflict = 85
+
+// Samples of a param of a device, as collected
+type metricSample struct {
+	SN    string
+	Path  string
+	Time  time.Time
+	Value float64
+}
+
+// Samples of a param of a device over an hour, downsampled as they arrive
+type metricBucket struct {
+	Id    string `bson:"_id"`
+	SN    string
+	Path  string
+	Time  time.Time
+	Sum   float64
+	Count int
+	Min   float64
+	Max   float64
+}
+
+// MetricPoint is a sample, or the average of the samples of an hour along
+// with their minimum and maximum.
+type MetricPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Min   *float64  `json:"min,omitempty"`
+	Max   *float64  `json:"max,omitempty"`
+}
+
+type MetricSeries struct {
+	Path   string        `json:"path"`
+	Points []MetricPoint `json:"points"`
+}
+
+// SaveMetrics keeps the values of the device params collected at the time,
+// adding them to their hourly buckets as well.
+func (d *Database) SaveMetrics(sn string, at time.Time, values map[string]float64) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	hour := at.Truncate(time.Hour)
+	var samples []interface{}
+	var buckets []mongo.WriteModel
+	for path, value := range values {
+		samples = append(samples, metricSample{SN: sn, Path: path, Time: at, Value: value})
+		buckets = append(buckets, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": fmt.Sprintf("%s|%s|%d", sn, path, hour.Unix())}).
+			SetUpdate(bson.M{
+				"$setOnInsert": bson.M{"sn": sn, "path": path, "time": hour},
+				"$inc":         bson.M{"sum": value, "count": 1},
+				"$min":         bson.M{"min": value},
+				"$max":         bson.M{"max": value},
+			}).
+			SetUpsert(true))
+	}
+
+	_, err := d.metrics.InsertMany(d.ctx, samples)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	_, err = d.metricsHourly.BulkWrite(d.ctx, buckets, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+/*
+RetrieveMetrics returns the series of the device between from and to, at the
+given resolution. A path ending with a dot matches every param under it,
+otherwise only the param itself.
+*/
+func (d *Database) RetrieveMetrics(sn, path, resolution string, from, to time.Time) ([]MetricSeries, error) {
+	filter := bson.M{"sn": sn, "time": bson.M{"$gte": from, "$lte": to}}
+	if strings.HasSuffix(path, ".") {
+		filter["path"] = bson.M{"$regex": "^" + regexp.QuoteMeta(path)}
+	} else {
+		filter["path"] = path
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "path", Value: 1}, {Key: "time", Value: 1}})
+
+	result := []MetricSeries{}
+	if resolution == MetricsHourly {
+		var buckets []metricBucket
+		cursor, err := d.metricsHourly.Find(d.ctx, filter, opts)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		if err = cursor.All(d.ctx, &buckets); err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		for _, b := range buckets {
+			min, max := b.Min, b.Max
+			result = appendPoint(result, b.Path, MetricPoint{Time: b.Time, Value: b.Sum / float64(b.Count), Min: &min, Max: &max})
+		}
+		return result, nil
+	}
+
+	var samples []metricSample
+	cursor, err := d.metrics.Find(d.ctx, filter, opts)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &samples); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	for _, x := range samples {
+		result = appendPoint(result, x.Path, MetricPoint{Time: x.Time, Value: x.Value})
+	}
+	return result, nil
+}
+
+// Points come sorted by path, so a new path starts a new series
+func appendPoint(series []MetricSeries, path string, p MetricPoint) []MetricSeries {
+	if len(series) == 0 || series[len(series)-1].Path != path {
+		series = append(series, MetricSeries{Path: path})
+	}
+	last := &series[len(series)-1]
+	last.Points = append(last.Points, p)
+	return series
+}
+
+/*
+ExpireMetrics has Mongo delete samples once older than raw and hourly
+buckets once older than hourly, through TTL indexes on their time. The
+indexes of a previous run are updated if the retentions changed.
+*/
+func (d *Database) ExpireMetrics(raw, hourly time.Duration) error {
+	if err := d.expireAfter(d.metrics, raw); err != nil {
+		return err
+	}
+	return d.expireAfter(d.metricsHourly, hourly)
+}
+
+func (d *Database) expireAfter(c *mongo.Collection, ttl time.Duration) error {
+	keys := bson.D{{Key: "time", Value: 1}}
+	seconds := int32(ttl / time.Second)
+	_, err := c.Indexes().CreateOne(d.ctx, mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetExpireAfterSeconds(seconds),
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.HasErrorCode(indexOptionsConflict) {
+		err = c.Database().RunCommand(d.ctx, bson.D{
+			{Key: "collMod", Value: c.Name()},
+			{Key: "index", Value: bson.D{{Key: "keyPattern", Value: keys}, {Key: "expireAfterSeconds", Value: seconds}}},
+		}).Err()
+	}
+	if err != nil {
+		log.Println("Couldn't set "+c.Name()+" expiry -->", err)
+	}
+	return err
+}
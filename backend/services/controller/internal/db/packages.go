@@ -0,0 +1,72 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Package is a deployment unit kept in the controller file store, for
+// devices to install as software modules.
+type Package struct {
+	Id          string    `json:"id" bson:"_id"`
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	Description string    `json:"description"`
+	File        string    `json:"file"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func (d *Database) CreatePackage(p Package) error {
+	_, err := d.packages.InsertOne(d.ctx, p)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) DeletePackage(id string) error {
+	_, err := d.packages.DeleteOne(d.ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) RetrievePackage(id string) (Package, error) {
+	var result Package
+	err := d.packages.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+// Packages with the name, any of them if empty, newest first
+func (d *Database) RetrievePackages(name string) ([]Package, error) {
+	filter := bson.M{}
+	if name != "" {
+		filter["name"] = name
+	}
+
+	results := []Package{}
+	cursor, err := d.packages.Find(d.ctx, filter, options.Find().SetSort(bson.M{"createdat": -1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+func (d *Database) PackageExists(name, version string) (bool, error) {
+	count, err := d.packages.CountDocuments(d.ctx, bson.M{"name": name, "version": version})
+	if err != nil {
+		log.Println(err)
+	}
+	return count > 0, err
+}
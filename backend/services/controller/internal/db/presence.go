@@ -0,0 +1,161 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	PresenceOnline      = "online"
+	PresenceAssociating = "associating"
+	PresenceOffline     = "offline"
+)
+
+// Presence is a status transition of a device.
+type Presence struct {
+	Id     string    `json:"-" bson:"_id"`
+	SN     string    `json:"sn"`
+	Status string    `json:"status"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+func (d *Database) createPresence(p Presence) error {
+	p.Id = uuid.NewString()
+	_, err := d.presence.InsertOne(d.ctx, p)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// LastPresence is the last transition of the device, nil if it has none.
+func (d *Database) LastPresence(sn string) (*Presence, error) {
+	var p Presence
+	opts := options.FindOne().SetSort(bson.D{{Key: "time", Value: -1}})
+	err := d.presence.FindOne(d.ctx, bson.M{"sn": sn}, opts).Decode(&p)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		log.Println(err)
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Transitions of the device between from and to, the oldest first
+func (d *Database) RetrievePresence(sn string, from, to time.Time) ([]Presence, error) {
+	return d.findPresence(bson.M{"sn": sn, "time": bson.M{"$gte": from, "$lte": to}})
+}
+
+func (d *Database) findPresence(filter bson.M) ([]Presence, error) {
+	results := []Presence{}
+	opts := options.Find().SetSort(bson.D{{Key: "sn", Value: 1}, {Key: "time", Value: 1}})
+	cursor, err := d.presence.Find(d.ctx, filter, opts)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// Status of each device right before the time, as of its last transition
+func (d *Database) presenceAt(sns []string, at time.Time) (map[string]Presence, error) {
+	match := bson.M{"time": bson.M{"$lt": at}}
+	if sns != nil {
+		match["sn"] = bson.M{"$in": sns}
+	}
+	pipeline := []bson.M{
+		{"$match": match},
+		// Follows the {sn, time} index, so only the newest transitions are read
+		{"$sort": bson.D{{Key: "sn", Value: 1}, {Key: "time", Value: -1}}},
+		{"$group": bson.M{
+			"_id":    "$sn",
+			"sn":     bson.M{"$first": "$sn"},
+			"status": bson.M{"$first": "$status"},
+			"reason": bson.M{"$first": "$reason"},
+			"time":   bson.M{"$first": "$time"},
+		}},
+	}
+	cursor, err := d.presence.Aggregate(d.ctx, pipeline)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	var last []Presence
+	if err = cursor.All(d.ctx, &last); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	result := map[string]Presence{}
+	for _, p := range last {
+		result[p.SN] = p
+	}
+	return result, nil
+}
+
+/*
+Uptime returns the percentage of time each device spent online between from
+and to, for the given devices or every one if sns is nil. Only the time the
+device was known to the controller counts, so a device added yesterday which
+never went offline has a 100% uptime.
+*/
+func (d *Database) Uptime(sns []string, from, to time.Time) (map[string]float64, error) {
+	before, err := d.presenceAt(sns, from)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"time": bson.M{"$gte": from, "$lte": to}}
+	if sns != nil {
+		filter["sn"] = bson.M{"$in": sns}
+	}
+	transitions, err := d.findPresence(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return uptime(before, transitions, from, to), nil
+}
+
+// Computes the uptime out of the status of each device at from and their
+// transitions up to to, the oldest first
+func uptime(before map[string]Presence, transitions []Presence, from, to time.Time) map[string]float64 {
+	bySN := map[string][]Presence{}
+	for sn, p := range before {
+		p.Time = from
+		bySN[sn] = []Presence{p}
+	}
+	for _, p := range transitions {
+		bySN[p.SN] = append(bySN[p.SN], p)
+	}
+
+	result := map[string]float64{}
+	for sn, events := range bySN {
+		var online, known time.Duration
+		for i, p := range events {
+			end := to
+			if i+1 < len(events) {
+				end = events[i+1].Time
+			}
+			known += end.Sub(p.Time)
+			if p.Status == PresenceOnline {
+				online += end.Sub(p.Time)
+			}
+		}
+		if known > 0 {
+			result[sn] = 100 * float64(online) / float64(known)
+		}
+	}
+	return result
+}
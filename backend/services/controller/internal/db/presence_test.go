@@ -0,0 +1,58 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUptime(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	at := func(h float64) time.Time {
+		return from.Add(time.Duration(h * float64(time.Hour)))
+	}
+
+	tests := []struct {
+		name        string
+		before      map[string]Presence
+		transitions []Presence
+		want        map[string]float64
+	}{
+		{"no history", nil, nil, map[string]float64{}},
+		{"online all along", map[string]Presence{
+			"a": {SN: "a", Status: PresenceOnline, Time: at(-48)},
+		}, nil, map[string]float64{"a": 100}},
+		{"offline all along", map[string]Presence{
+			"a": {SN: "a", Status: PresenceOffline, Time: at(-48)},
+		}, nil, map[string]float64{"a": 0}},
+		{"went offline", map[string]Presence{
+			"a": {SN: "a", Status: PresenceOnline, Time: at(-1)},
+		}, []Presence{
+			{SN: "a", Status: PresenceOffline, Time: at(4)},
+		}, map[string]float64{"a": 40}},
+		{"added during the period", nil, []Presence{
+			{SN: "a", Status: PresenceOnline, Time: at(5)},
+		}, map[string]float64{"a": 100}},
+		{"associating isn't online", nil, []Presence{
+			{SN: "a", Status: PresenceAssociating, Time: at(2)},
+			{SN: "a", Status: PresenceOnline, Time: at(4)},
+			{SN: "a", Status: PresenceOffline, Time: at(7)},
+		}, map[string]float64{"a": 37.5}},
+		{"several devices", map[string]Presence{
+			"a": {SN: "a", Status: PresenceOnline, Time: at(-1)},
+			"b": {SN: "b", Status: PresenceOffline, Time: at(-1)},
+		}, []Presence{
+			{SN: "a", Status: PresenceOffline, Time: at(5)},
+			{SN: "b", Status: PresenceOnline, Time: at(8)},
+		}, map[string]float64{"a": 50, "b": 20}},
+		{"added at the end", nil, []Presence{
+			{SN: "a", Status: PresenceOnline, Time: to},
+		}, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		if got := uptime(tt.before, tt.transitions, from, to); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: uptime() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
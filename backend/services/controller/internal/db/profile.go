@@ -0,0 +1,166 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ProfileParam is a parameter value, paths are full ones, except for params
+// of objects, which are relative to the object.
+type ProfileParam struct {
+	Path  string `json:"path"`
+	Value string `json:"value"`
+	// Devices don't read write-only params back, so they are only set
+	WriteOnly bool `json:"writeOnly,omitempty"`
+}
+
+// ProfileObject is an object instance the device must have. The instance is
+// told apart from the other ones of Path by the value of its Key param,
+// which is Alias if none is given.
+type ProfileObject struct {
+	Path   string         `json:"path"`
+	Key    string         `json:"key,omitempty"`
+	Params []ProfileParam `json:"params"`
+}
+
+/*
+Profile is the configuration desired for the devices it's assigned to, the
+ones in Targets plus the ones matched by Filter. With AutoApply the profile
+is applied again whenever a device reconnects or drifts from it.
+*/
+type Profile struct {
+	Id          string          `json:"id" bson:"_id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Params      []ProfileParam  `json:"params"`
+	Objects     []ProfileObject `json:"objects"`
+	Targets     []string        `json:"targets,omitempty"`
+	Filter      *DeviceFilter   `json:"filter,omitempty"`
+	AutoApply   bool            `json:"autoApply"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// Assigned tells if the profile applies to the device.
+func (p Profile) Assigned(device Device) bool {
+	for _, sn := range p.Targets {
+		if sn == device.SN {
+			return true
+		}
+	}
+	return p.Filter != nil && p.Filter.Match(device)
+}
+
+// Drift is a difference between the profile and the device, Actual is empty
+// when the parameter or object is missing.
+type Drift struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual,omitempty"`
+	Missing  bool   `json:"missing,omitempty"`
+}
+
+// ProfileStatus is the outcome of the last check of a profile on a device.
+type ProfileStatus struct {
+	Id        string     `json:"-" bson:"_id"`
+	Profile   string     `json:"profile"`
+	SN        string     `json:"sn"`
+	Compliant bool       `json:"compliant"`
+	Drift     []Drift    `json:"drift,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt time.Time  `json:"checkedAt"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+func (d *Database) CreateProfile(p Profile) error {
+	_, err := d.profiles.InsertOne(d.ctx, p)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) UpdateProfile(p Profile) error {
+	_, err := d.profiles.ReplaceOne(d.ctx, bson.M{"_id": p.Id}, p)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// Deletes the profile along with its status on every device
+func (d *Database) DeleteProfile(id string) error {
+	_, err := d.profiles.DeleteOne(d.ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	_, err = d.profileStatus.DeleteMany(d.ctx, bson.M{"profile": id})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) RetrieveProfile(id string) (Profile, error) {
+	var result Profile
+	err := d.profiles.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+func (d *Database) RetrieveProfiles() ([]Profile, error) {
+	results := []Profile{}
+	cursor, err := d.profiles.Find(d.ctx, bson.M{}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
+
+func (d *Database) SaveProfileStatus(status ProfileStatus) error {
+	status.Id = status.Profile + ":" + status.SN
+	opts := options.Replace().SetUpsert(true)
+	_, err := d.profileStatus.ReplaceOne(d.ctx, bson.M{"_id": status.Id}, status, opts)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) RetrieveProfileStatus(profile, sn string) (ProfileStatus, error) {
+	var result ProfileStatus
+	err := d.profileStatus.FindOne(d.ctx, bson.M{"_id": profile + ":" + sn}).Decode(&result)
+	return result, err
+}
+
+// Status of a profile on its devices, or of every profile on a device,
+// filters are ignored when empty
+func (d *Database) RetrieveProfileStatuses(profile, sn string) ([]ProfileStatus, error) {
+	filter := bson.M{}
+	if profile != "" {
+		filter["profile"] = profile
+	}
+	if sn != "" {
+		filter["sn"] = sn
+	}
+
+	results := []ProfileStatus{}
+	cursor, err := d.profileStatus.Find(d.ctx, filter, options.Find().SetSort(bson.M{"sn": 1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
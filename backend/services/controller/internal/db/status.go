@@ -1,21 +1,77 @@
 package db
 
 import (
+	"log"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"log"
 )
 
-func (d *Database) UpdateStatus(sn string, status uint8) error {
-	var result bson.M
-	err := d.devices.FindOneAndUpdate(d.ctx, bson.D{{"sn", sn}}, bson.D{{"$set", bson.D{{"status", status}}}}).Decode(&result)
+/*
+UpdateStatus saves the status of the device and keeps the transition in its
+presence history, along with the reason of it. ConnectedSince is kept while
+the device stays online. Nothing is added to the history when the status is
+the same as of the last transition.
+*/
+func (d *Database) UpdateStatus(sn string, status uint8, reason string) error {
+	now := time.Now()
+	set := bson.M{"status": status, "lastseen": now}
+	if status != utils.Online {
+		set["connectedsince"] = nil
+	}
+
+	var previous Device
+	err := d.devices.FindOneAndUpdate(d.ctx, bson.D{{Key: "sn", Value: sn}}, bson.M{"$set": set}).Decode(&previous)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			log.Printf("Device %s is not mapped into database", sn)
 			return nil
 		}
 		log.Println(err)
+		return err
+	}
+
+	if status == utils.Online && (previous.Status != utils.Online || previous.ConnectedSince == nil) {
+		_, err = d.devices.UpdateOne(d.ctx, bson.D{{Key: "sn", Value: sn}},
+			bson.M{"$set": bson.M{"connectedsince": now}},
+		)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	last, err := d.LastPresence(sn)
+	if err != nil {
+		return err
+	}
+	if last != nil && last.Status == statusName(status) {
+		return nil
+	}
+
+	log.Printf("%s is now %s.", sn, statusName(status))
+	return d.createPresence(Presence{SN: sn, Status: statusName(status), Reason: reason, Time: now})
+}
+
+// UpdateLastSeen saves the last time the device was heard of.
+func (d *Database) UpdateLastSeen(sn string) error {
+	_, err := d.devices.UpdateOne(d.ctx, bson.D{{Key: "sn", Value: sn}},
+		bson.M{"$set": bson.M{"lastseen": time.Now()}},
+	)
+	if err != nil {
+		log.Println(err)
 	}
-	log.Printf("%s is now offline.", sn)
 	return err
 }
+
+func statusName(status uint8) string {
+	switch status {
+	case utils.Online:
+		return PresenceOnline
+	case utils.Associating:
+		return PresenceAssociating
+	default:
+		return PresenceOffline
+	}
+}
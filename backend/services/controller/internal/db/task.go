@@ -0,0 +1,84 @@
+package db
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Task runs an operation as a bulk job, once at a given time or recurrently
+// following a cron expression. Each run is a BulkJob with the task id.
+type Task struct {
+	Id          string          `json:"id" bson:"_id"`
+	Name        string          `json:"name"`
+	Operation   string          `json:"operation"`
+	Request     json.RawMessage `json:"request"`
+	Targets     []string        `json:"targets,omitempty"`
+	Filter      *DeviceFilter   `json:"filter,omitempty"`
+	Concurrency int             `json:"concurrency"`
+	Retries     int             `json:"retries"`
+	At          *time.Time      `json:"at,omitempty"`
+	Cron        string          `json:"cron,omitempty"`
+	Timezone    string          `json:"timezone,omitempty"`
+	Enabled     bool            `json:"enabled"`
+	NextRun     *time.Time      `json:"nextRun,omitempty"`
+	LastRun     *time.Time      `json:"lastRun,omitempty"`
+	LastJob     string          `json:"lastJob,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+}
+
+func (d *Database) CreateTask(task Task) error {
+	_, err := d.tasks.InsertOne(d.ctx, task)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) UpdateTask(task Task) error {
+	_, err := d.tasks.ReplaceOne(d.ctx, bson.M{"_id": task.Id}, task)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) DeleteTask(id string) error {
+	_, err := d.tasks.DeleteOne(d.ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (d *Database) RetrieveTask(id string) (Task, error) {
+	var result Task
+	err := d.tasks.FindOne(d.ctx, bson.M{"_id": id}).Decode(&result)
+	return result, err
+}
+
+func (d *Database) RetrieveTasks() ([]Task, error) {
+	return d.findTasks(bson.M{})
+}
+
+// Enabled tasks which should have already run
+func (d *Database) RetrieveDueTasks(now time.Time) ([]Task, error) {
+	return d.findTasks(bson.M{"enabled": true, "nextrun": bson.M{"$lte": now}})
+}
+
+func (d *Database) findTasks(filter bson.M) ([]Task, error) {
+	results := []Task{}
+	cursor, err := d.tasks.Find(d.ctx, filter, options.Find().SetSort(bson.M{"createdat": 1}))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if err = cursor.All(d.ctx, &results); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return results, nil
+}
@@ -15,7 +15,7 @@ type User struct {
 }
 
 func (d *Database) RegisterUser(user User) error {
-	err := d.users.FindOne(d.ctx, bson.D{{"email", user.Email}}).Err()
+	err := d.users.FindOne(d.ctx, bson.D{{Key: "email", Value: user.Email}}).Err()
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			_, err = d.users.InsertOne(d.ctx, user)
@@ -40,7 +40,7 @@ func (d *Database) FindAllUsers() ([]map[string]interface{}, error) {
 
 func (d *Database) FindUser(email string) (User, error) {
 	var result User
-	err := d.users.FindOne(d.ctx, bson.D{{"email", email}}).Decode(&result)
+	err := d.users.FindOne(d.ctx, bson.D{{Key: "email", Value: email}}).Decode(&result)
 	return result, err
 }
 
@@ -0,0 +1,429 @@
+// Reads and changes the DHCPv4 server of devices, keeping pools within the
+// subnets of the interfaces they serve.
+package dhcp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const (
+	server         = "Device.DHCPv4.Server."
+	poolTable      = "Device.DHCPv4.Server.Pool."
+	interfaceTable = "Device.IP.Interface."
+)
+
+type Server struct {
+	Enable bool   `json:"enable"`
+	Pools  []Pool `json:"pools"`
+}
+
+/*
+Pool hands out addresses from MinAddress to MaxAddress to the hosts of
+Interface, whose own address is InterfaceAddress. A lease time of -1 never
+expires.
+*/
+type Pool struct {
+	Path             string          `json:"path"`
+	Enable           bool            `json:"enable"`
+	Status           string          `json:"status"`
+	Interface        string          `json:"interface"`
+	InterfaceAddress string          `json:"interfaceAddress,omitempty"`
+	MinAddress       string          `json:"minAddress"`
+	MaxAddress       string          `json:"maxAddress"`
+	SubnetMask       string          `json:"subnetMask"`
+	LeaseTime        int             `json:"leaseTime"`
+	DNSServers       []string        `json:"dnsServers"`
+	IPRouters        []string        `json:"ipRouters"`
+	DomainName       string          `json:"domainName"`
+	StaticAddresses  []StaticAddress `json:"staticAddresses"`
+}
+
+// Reservation of an address for the host with the MAC address
+type StaticAddress struct {
+	Path   string `json:"path,omitempty"`
+	Enable bool   `json:"enable"`
+	MAC    string `json:"mac"`
+	IP     string `json:"ip"`
+}
+
+// Changes to apply, fields left out are kept as they are. StaticAddresses
+// replaces every reservation of the pool.
+type PoolChange struct {
+	Path            string           `json:"path"`
+	Enable          *bool            `json:"enable,omitempty"`
+	MinAddress      *string          `json:"minAddress,omitempty"`
+	MaxAddress      *string          `json:"maxAddress,omitempty"`
+	SubnetMask      *string          `json:"subnetMask,omitempty"`
+	LeaseTime       *int             `json:"leaseTime,omitempty"`
+	DNSServers      *[]string        `json:"dnsServers,omitempty"`
+	IPRouters       *[]string        `json:"ipRouters,omitempty"`
+	DomainName      *string          `json:"domainName,omitempty"`
+	StaticAddresses *[]StaticAddress `json:"staticAddresses,omitempty"`
+}
+
+type Request struct {
+	Enable *bool        `json:"enable,omitempty"`
+	Pools  []PoolChange `json:"pools"`
+}
+
+// IPv4 address of an IP interface along with its subnet
+type address struct {
+	ip     net.IP
+	subnet *net.IPNet
+}
+
+// Get reads the DHCPv4 server with its pools and their reservations.
+func Get(ctx context.Context, d *usp.Dispatcher, sn string) (Server, error) {
+	s, _, err := get(ctx, d, sn)
+	return s, err
+}
+
+func get(ctx context.Context, d *usp.Dispatcher, sn string) (Server, map[string][]address, error) {
+	resp, err := usp.Get.Run(ctx, d, sn, usp.GetRequest{Paths: []string{
+		server,
+		interfaceTable + "*.IPv4Address.*.",
+	}})
+	if err != nil {
+		return Server{}, nil, err
+	}
+	values := resp.Params
+
+	addresses := map[string][]address{}
+	for _, iface := range dm.Instances(values, interfaceTable) {
+		for _, path := range dm.Instances(values, iface+"IPv4Address.") {
+			if values[path+"Enable"] != "" && !dm.ParseBool(values[path+"Enable"]) {
+				continue
+			}
+			ip := parseIPv4(values[path+"IPAddress"])
+			mask := parseIPv4(values[path+"SubnetMask"])
+			if ip == nil || mask == nil {
+				continue
+			}
+			subnet := &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+			addresses[iface] = append(addresses[iface], address{ip: ip, subnet: subnet})
+		}
+	}
+
+	s := Server{Enable: dm.ParseBool(values[server+"Enable"]), Pools: []Pool{}}
+	for _, path := range dm.Instances(values, poolTable) {
+		p := Pool{
+			Path:            path,
+			Enable:          dm.ParseBool(values[path+"Enable"]),
+			Status:          values[path+"Status"],
+			Interface:       dm.WithDot(values[path+"Interface"]),
+			MinAddress:      values[path+"MinAddress"],
+			MaxAddress:      values[path+"MaxAddress"],
+			SubnetMask:      values[path+"SubnetMask"],
+			LeaseTime:       dm.Atoi(values[path+"LeaseTime"]),
+			DNSServers:      dm.List(values[path+"DNSServers"]),
+			IPRouters:       dm.List(values[path+"IPRouters"]),
+			DomainName:      values[path+"DomainName"],
+			StaticAddresses: []StaticAddress{},
+		}
+		if a, ok := interfaceAddress(addresses, p); ok {
+			p.InterfaceAddress = a.ip.String()
+		}
+		for _, static := range dm.Instances(values, path+"StaticAddress.") {
+			p.StaticAddresses = append(p.StaticAddresses, StaticAddress{
+				Path:   static,
+				Enable: dm.ParseBool(values[static+"Enable"]),
+				MAC:    values[static+"Chaddr"],
+				IP:     values[static+"Yiaddr"],
+			})
+		}
+		s.Pools = append(s.Pools, p)
+	}
+	return s, addresses, nil
+}
+
+/*
+Set applies the changes to the pools once each of them is checked against
+the subnet of the interface it serves. Pool settings are set at once, then
+reservations are deleted and added as needed.
+*/
+func Set(ctx context.Context, d *usp.Dispatcher, sn string, req Request) (Server, error) {
+	if req.Enable == nil && len(req.Pools) == 0 {
+		return Server{}, fmt.Errorf("%w: no changes", usp.ErrInvalidRequest)
+	}
+	current, addresses, err := get(ctx, d, sn)
+	if err != nil {
+		return Server{}, err
+	}
+
+	set := map[string]string{}
+	var remove []string
+	var add []usp.AddObject
+	if req.Enable != nil {
+		set[server+"Enable"] = strconv.FormatBool(*req.Enable)
+	}
+	for _, change := range req.Pools {
+		var pool *Pool
+		for i := range current.Pools {
+			if current.Pools[i].Path == dm.WithDot(change.Path) {
+				pool = &current.Pools[i]
+			}
+		}
+		if pool == nil {
+			return Server{}, fmt.Errorf("%w: no pool %s", usp.ErrInvalidRequest, change.Path)
+		}
+
+		updated := apply(*pool, change, set)
+		if err := check(updated, addresses); err != nil {
+			return Server{}, err
+		}
+		if change.StaticAddresses != nil {
+			r, a := reservations(*pool, updated, set)
+			remove = append(remove, r...)
+			add = append(add, a...)
+		}
+	}
+
+	if len(set) > 0 {
+		if _, err := usp.Set.Run(ctx, d, sn, usp.SetRequest{Params: set}); err != nil {
+			return Server{}, err
+		}
+	}
+	if len(remove) > 0 {
+		resp, err := usp.Delete.Run(ctx, d, sn, usp.DeleteRequest{Paths: remove})
+		if err == nil && len(resp.Errors) > 0 {
+			err = failure(resp.Errors)
+		}
+		if err != nil {
+			return Server{}, err
+		}
+	}
+	if len(add) > 0 {
+		resp, err := usp.Add.Run(ctx, d, sn, usp.AddRequest{Objects: add})
+		if err == nil && len(resp.Errors) > 0 {
+			err = failure(resp.Errors)
+		}
+		if err != nil {
+			return Server{}, err
+		}
+	}
+	return Get(ctx, d, sn)
+}
+
+// Pool as it is once changed, its changed params go to set
+func apply(p Pool, change PoolChange, set map[string]string) Pool {
+	path := p.Path
+	if change.Enable != nil {
+		p.Enable = *change.Enable
+		set[path+"Enable"] = strconv.FormatBool(p.Enable)
+	}
+	if change.MinAddress != nil {
+		p.MinAddress = *change.MinAddress
+		set[path+"MinAddress"] = p.MinAddress
+	}
+	if change.MaxAddress != nil {
+		p.MaxAddress = *change.MaxAddress
+		set[path+"MaxAddress"] = p.MaxAddress
+	}
+	if change.SubnetMask != nil {
+		p.SubnetMask = *change.SubnetMask
+		set[path+"SubnetMask"] = p.SubnetMask
+	}
+	if change.LeaseTime != nil {
+		p.LeaseTime = *change.LeaseTime
+		set[path+"LeaseTime"] = strconv.Itoa(p.LeaseTime)
+	}
+	if change.DNSServers != nil {
+		p.DNSServers = *change.DNSServers
+		set[path+"DNSServers"] = strings.Join(p.DNSServers, ",")
+	}
+	if change.IPRouters != nil {
+		p.IPRouters = *change.IPRouters
+		set[path+"IPRouters"] = strings.Join(p.IPRouters, ",")
+	}
+	if change.DomainName != nil {
+		p.DomainName = *change.DomainName
+		set[path+"DomainName"] = p.DomainName
+	}
+	if change.StaticAddresses != nil {
+		p.StaticAddresses = *change.StaticAddresses
+	}
+	return p
+}
+
+// Checks the pool fits in the subnet of its interface, along with its
+// routers and reservations
+func check(p Pool, addresses map[string][]address) error {
+	min, max := parseIPv4(p.MinAddress), parseIPv4(p.MaxAddress)
+	if min == nil || max == nil {
+		return fmt.Errorf("%w: pool %s needs valid IPv4 min and max addresses", usp.ErrInvalidRequest, p.Path)
+	}
+	if toInt(min) > toInt(max) {
+		return fmt.Errorf("%w: pool %s min address is after its max address", usp.ErrInvalidRequest, p.Path)
+	}
+	mask := parseIPv4(p.SubnetMask)
+	if mask == nil {
+		return fmt.Errorf("%w: invalid subnet mask %s", usp.ErrInvalidRequest, p.SubnetMask)
+	}
+	if ones, bits := net.IPMask(mask).Size(); bits == 0 || ones == 0 {
+		return fmt.Errorf("%w: invalid subnet mask %s", usp.ErrInvalidRequest, p.SubnetMask)
+	}
+
+	a, ok := interfaceAddress(addresses, p)
+	if !ok {
+		return fmt.Errorf("%w: pool %s isn't within the subnet of any IPv4 address of %s", usp.ErrInvalidRequest, p.Path, interfaceName(p))
+	}
+	subnet := a.subnet.String()
+	if net.IPMask(mask).String() != a.subnet.Mask.String() {
+		return fmt.Errorf("%w: pool %s subnet mask %s differs from the one of %s, %s", usp.ErrInvalidRequest, p.Path, p.SubnetMask, interfaceName(p), subnet)
+	}
+	if !a.subnet.Contains(max) {
+		return fmt.Errorf("%w: pool %s max address %s is out of the subnet %s", usp.ErrInvalidRequest, p.Path, p.MaxAddress, subnet)
+	}
+	if inRange(a.ip, min, max) {
+		return fmt.Errorf("%w: pool %s range holds the interface address %s", usp.ErrInvalidRequest, p.Path, a.ip)
+	}
+	if p.LeaseTime == 0 || p.LeaseTime < -1 {
+		return fmt.Errorf("%w: lease time must be a number of seconds, or -1 for infinite", usp.ErrInvalidRequest)
+	}
+	if len(p.DomainName) > 64 {
+		return fmt.Errorf("%w: domain name must have up to 64 characters", usp.ErrInvalidRequest)
+	}
+	for _, x := range p.DNSServers {
+		if parseIPv4(x) == nil {
+			return fmt.Errorf("%w: invalid DNS server %s", usp.ErrInvalidRequest, x)
+		}
+	}
+	for _, x := range p.IPRouters {
+		ip := parseIPv4(x)
+		if ip == nil || !a.subnet.Contains(ip) {
+			return fmt.Errorf("%w: router %s isn't an address of the subnet %s", usp.ErrInvalidRequest, x, subnet)
+		}
+	}
+
+	macs := map[string]bool{}
+	ips := map[string]bool{}
+	for _, x := range p.StaticAddresses {
+		mac, err := net.ParseMAC(x.MAC)
+		if err != nil || len(mac) != 6 {
+			return fmt.Errorf("%w: invalid MAC address %s", usp.ErrInvalidRequest, x.MAC)
+		}
+		ip := parseIPv4(x.IP)
+		if ip == nil || !a.subnet.Contains(ip) {
+			return fmt.Errorf("%w: reserved address %s isn't an address of the subnet %s", usp.ErrInvalidRequest, x.IP, subnet)
+		}
+		if ip.Equal(a.ip) || ip.Equal(a.subnet.IP) || ip.Equal(broadcast(a.subnet)) {
+			return fmt.Errorf("%w: address %s can't be reserved", usp.ErrInvalidRequest, x.IP)
+		}
+		if macs[mac.String()] || ips[ip.String()] {
+			return fmt.Errorf("%w: %s and %s are reserved more than once", usp.ErrInvalidRequest, x.MAC, x.IP)
+		}
+		macs[mac.String()] = true
+		ips[ip.String()] = true
+	}
+	return nil
+}
+
+// Tells what the reservations of the pool need to become the updated ones:
+// changed ones go to set, while the ones to delete and to add are answered
+func reservations(current, updated Pool, set map[string]string) ([]string, []usp.AddObject) {
+	existing := map[string]StaticAddress{}
+	for _, x := range current.StaticAddresses {
+		existing[normalMAC(x.MAC)] = x
+	}
+
+	var add []usp.AddObject
+	kept := map[string]bool{}
+	for _, x := range updated.StaticAddresses {
+		mac := normalMAC(x.MAC)
+		old, ok := existing[mac]
+		if !ok {
+			add = append(add, usp.AddObject{Path: current.Path + "StaticAddress.", Params: map[string]string{
+				"Enable": strconv.FormatBool(x.Enable),
+				"Chaddr": mac,
+				"Yiaddr": x.IP,
+			}})
+			continue
+		}
+		kept[mac] = true
+		if old.Enable != x.Enable {
+			set[old.Path+"Enable"] = strconv.FormatBool(x.Enable)
+		}
+		if old.IP != x.IP {
+			set[old.Path+"Yiaddr"] = x.IP
+		}
+	}
+
+	var remove []string
+	for mac, x := range existing {
+		if !kept[mac] {
+			remove = append(remove, x.Path)
+		}
+	}
+	sort.Strings(remove)
+	return remove, add
+}
+
+// Address of the pool interface whose subnet holds the pool, any interface
+// will do if the pool names none
+func interfaceAddress(addresses map[string][]address, p Pool) (address, bool) {
+	min := parseIPv4(p.MinAddress)
+	if min == nil {
+		return address{}, false
+	}
+	for iface, list := range addresses {
+		if p.Interface != "" && iface != p.Interface {
+			continue
+		}
+		for _, a := range list {
+			if a.subnet.Contains(min) {
+				return a, true
+			}
+		}
+	}
+	return address{}, false
+}
+
+func interfaceName(p Pool) string {
+	if p.Interface == "" {
+		return "the device interfaces"
+	}
+	return p.Interface
+}
+
+func failure(errs []usp.PathError) error {
+	return &usp.Error{Message: errs[0].Message, Code: errs[0].Code, Params: errs}
+}
+
+func parseIPv4(s string) net.IP {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return nil
+	}
+	return ip.To4()
+}
+
+func toInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func inRange(ip, min, max net.IP) bool {
+	return toInt(ip) >= toInt(min) && toInt(ip) <= toInt(max)
+}
+
+func broadcast(n *net.IPNet) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, toInt(n.IP)|^binary.BigEndian.Uint32(n.Mask))
+	return ip
+}
+
+// Devices may report MAC addresses in either case
+func normalMAC(mac string) string {
+	if parsed, err := net.ParseMAC(mac); err == nil {
+		return parsed.String()
+	}
+	return strings.ToLower(mac)
+}
@@ -0,0 +1,147 @@
+package dhcp
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+func TestCheck(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, guest, _ := net.ParseCIDR("10.0.0.0/16")
+	addresses := map[string][]address{
+		"Device.IP.Interface.1.": {{ip: net.ParseIP("192.168.1.1").To4(), subnet: lan}},
+		"Device.IP.Interface.2.": {{ip: net.ParseIP("10.0.0.1").To4(), subnet: guest}},
+	}
+	pool := func(change func(p *Pool)) Pool {
+		p := Pool{
+			Path:       "Device.DHCPv4.Server.Pool.1.",
+			Interface:  "Device.IP.Interface.1.",
+			MinAddress: "192.168.1.100",
+			MaxAddress: "192.168.1.200",
+			SubnetMask: "255.255.255.0",
+			LeaseTime:  86400,
+			DNSServers: []string{"8.8.8.8"},
+			IPRouters:  []string{"192.168.1.1"},
+			StaticAddresses: []StaticAddress{
+				{Enable: true, MAC: "AA:BB:CC:DD:EE:01", IP: "192.168.1.50"},
+			},
+		}
+		if change != nil {
+			change(&p)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name string
+		pool Pool
+		ok   bool
+	}{
+		{"valid pool", pool(nil), true},
+		{"any interface", pool(func(p *Pool) { p.Interface = "" }), true},
+		{"infinite lease", pool(func(p *Pool) { p.LeaseTime = -1 }), true},
+		{"reservation in the range", pool(func(p *Pool) { p.StaticAddresses[0].IP = "192.168.1.150" }), true},
+		{"bad min address", pool(func(p *Pool) { p.MinAddress = "192.168.1" }), false},
+		{"IPv6 max address", pool(func(p *Pool) { p.MaxAddress = "fe80::1" }), false},
+		{"min after max", pool(func(p *Pool) { p.MinAddress = "192.168.1.201" }), false},
+		{"bad mask", pool(func(p *Pool) { p.SubnetMask = "255.0.255.0" }), false},
+		{"empty mask", pool(func(p *Pool) { p.SubnetMask = "0.0.0.0" }), false},
+		{"mask of another subnet", pool(func(p *Pool) { p.SubnetMask = "255.255.0.0" }), false},
+		{"outside the interface subnet", pool(func(p *Pool) { p.MinAddress = "10.0.0.100"; p.MaxAddress = "10.0.0.200" }), false},
+		{"max out of the subnet", pool(func(p *Pool) { p.MaxAddress = "192.168.2.10" }), false},
+		{"range holding the interface address", pool(func(p *Pool) { p.MinAddress = "192.168.1.1" }), false},
+		{"zero lease", pool(func(p *Pool) { p.LeaseTime = 0 }), false},
+		{"bad DNS server", pool(func(p *Pool) { p.DNSServers = []string{"dns"} }), false},
+		{"router out of the subnet", pool(func(p *Pool) { p.IPRouters = []string{"10.0.0.1"} }), false},
+		{"bad MAC", pool(func(p *Pool) { p.StaticAddresses[0].MAC = "AA:BB:CC" }), false},
+		{"reservation out of the subnet", pool(func(p *Pool) { p.StaticAddresses[0].IP = "192.168.2.50" }), false},
+		{"reserving the interface address", pool(func(p *Pool) { p.StaticAddresses[0].IP = "192.168.1.1" }), false},
+		{"reserving the broadcast address", pool(func(p *Pool) { p.StaticAddresses[0].IP = "192.168.1.255" }), false},
+		{"reserving the network address", pool(func(p *Pool) { p.StaticAddresses[0].IP = "192.168.1.0" }), false},
+		{"MAC reserved twice", pool(func(p *Pool) {
+			p.StaticAddresses = append(p.StaticAddresses, StaticAddress{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.51"})
+		}), false},
+		{"address reserved twice", pool(func(p *Pool) {
+			p.StaticAddresses = append(p.StaticAddresses, StaticAddress{MAC: "AA:BB:CC:DD:EE:02", IP: "192.168.1.50"})
+		}), false},
+	}
+	for _, tt := range tests {
+		err := check(tt.pool, addresses)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: check() error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err != nil && !errors.Is(err, usp.ErrInvalidRequest) {
+			t.Errorf("%s: check() error = %v, want an invalid request", tt.name, err)
+		}
+	}
+}
+
+func TestReservations(t *testing.T) {
+	current := Pool{
+		Path: "Device.DHCPv4.Server.Pool.1.",
+		StaticAddresses: []StaticAddress{
+			{Path: "Device.DHCPv4.Server.Pool.1.StaticAddress.1.", Enable: true, MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.50"},
+			{Path: "Device.DHCPv4.Server.Pool.1.StaticAddress.2.", Enable: true, MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.51"},
+			{Path: "Device.DHCPv4.Server.Pool.1.StaticAddress.3.", Enable: true, MAC: "aa:bb:cc:dd:ee:03", IP: "192.168.1.52"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		updated []StaticAddress
+		set     map[string]string
+		remove  []string
+		add     []usp.AddObject
+	}{
+		{"unchanged", current.StaticAddresses, map[string]string{}, nil, nil},
+		{"MAC in another case", []StaticAddress{
+			{Enable: true, MAC: "AA:BB:CC:DD:EE:01", IP: "192.168.1.50"},
+			{Enable: true, MAC: "AA-BB-CC-DD-EE-02", IP: "192.168.1.51"},
+			{Enable: true, MAC: "aa:bb:cc:dd:ee:03", IP: "192.168.1.52"},
+		}, map[string]string{}, nil, nil},
+		{"changed", []StaticAddress{
+			{Enable: false, MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.50"},
+			{Enable: true, MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.61"},
+			{Enable: true, MAC: "aa:bb:cc:dd:ee:03", IP: "192.168.1.52"},
+		}, map[string]string{
+			"Device.DHCPv4.Server.Pool.1.StaticAddress.1.Enable": "false",
+			"Device.DHCPv4.Server.Pool.1.StaticAddress.2.Yiaddr": "192.168.1.61",
+		}, nil, nil},
+		{"added and removed", []StaticAddress{
+			{Enable: true, MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.51"},
+			{Enable: true, MAC: "AA:BB:CC:DD:EE:04", IP: "192.168.1.53"},
+		}, map[string]string{}, []string{
+			"Device.DHCPv4.Server.Pool.1.StaticAddress.1.",
+			"Device.DHCPv4.Server.Pool.1.StaticAddress.3.",
+		}, []usp.AddObject{{Path: "Device.DHCPv4.Server.Pool.1.StaticAddress.", Params: map[string]string{
+			"Enable": "true",
+			"Chaddr": "aa:bb:cc:dd:ee:04",
+			"Yiaddr": "192.168.1.53",
+		}}}},
+		{"all removed", []StaticAddress{}, map[string]string{}, []string{
+			"Device.DHCPv4.Server.Pool.1.StaticAddress.1.",
+			"Device.DHCPv4.Server.Pool.1.StaticAddress.2.",
+			"Device.DHCPv4.Server.Pool.1.StaticAddress.3.",
+		}, nil},
+	}
+	for _, tt := range tests {
+		updated := current
+		updated.StaticAddresses = tt.updated
+		set := map[string]string{}
+		remove, add := reservations(current, updated, set)
+		if !reflect.DeepEqual(set, tt.set) {
+			t.Errorf("%s: set = %v, want %v", tt.name, set, tt.set)
+		}
+		if !reflect.DeepEqual(remove, tt.remove) {
+			t.Errorf("%s: remove = %v, want %v", tt.name, remove, tt.remove)
+		}
+		if !reflect.DeepEqual(add, tt.add) {
+			t.Errorf("%s: add = %v, want %v", tt.name, add, tt.add)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Runs the TR-181 IP diagnostics of devices and shapes their results.
+package diagnostics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/command"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const (
+	pingCommand       = "Device.IP.Diagnostics.IPPing()"
+	traceRouteCommand = "Device.IP.Diagnostics.TraceRoute()"
+	downloadCommand   = "Device.IP.Diagnostics.DownloadDiagnostics()"
+	uploadCommand     = "Device.IP.Diagnostics.UploadDiagnostics()"
+)
+
+// Diagnostics status of a successful run, any other one tells what failed
+const StatusComplete = "Complete"
+
+// Longest time based speed test, in seconds
+const MaxDuration = 999
+
+// Fields left empty take the device defaults. Timeouts are in milliseconds.
+type PingRequest struct {
+	Host            string `json:"host"`
+	Repetitions     int    `json:"repetitions,omitempty"`
+	Timeout         int    `json:"timeout,omitempty"`
+	DataBlockSize   int    `json:"dataBlockSize,omitempty"`
+	Interface       string `json:"interface,omitempty"`
+	ProtocolVersion string `json:"protocolVersion,omitempty"`
+}
+
+func (r *PingRequest) Validate() error {
+	if r.Host == "" {
+		return fmt.Errorf("%w: host is required", usp.ErrInvalidRequest)
+	}
+	if r.Repetitions < 0 || r.Timeout < 0 || r.DataBlockSize < 0 {
+		return fmt.Errorf("%w: repetitions, timeout and data block size can't be negative", usp.ErrInvalidRequest)
+	}
+	return nil
+}
+
+// Response times are in milliseconds
+type PingResult struct {
+	Status              string `json:"status"`
+	IPAddressUsed       string `json:"ipAddressUsed"`
+	SuccessCount        int    `json:"successCount"`
+	FailureCount        int    `json:"failureCount"`
+	AverageResponseTime int    `json:"averageResponseTime"`
+	MinimumResponseTime int    `json:"minimumResponseTime"`
+	MaximumResponseTime int    `json:"maximumResponseTime"`
+}
+
+type TraceRouteRequest struct {
+	Host            string `json:"host"`
+	Tries           int    `json:"tries,omitempty"`
+	Timeout         int    `json:"timeout,omitempty"`
+	DataBlockSize   int    `json:"dataBlockSize,omitempty"`
+	MaxHopCount     int    `json:"maxHopCount,omitempty"`
+	Interface       string `json:"interface,omitempty"`
+	ProtocolVersion string `json:"protocolVersion,omitempty"`
+}
+
+func (r *TraceRouteRequest) Validate() error {
+	if r.Host == "" {
+		return fmt.Errorf("%w: host is required", usp.ErrInvalidRequest)
+	}
+	if r.Tries < 0 || r.Timeout < 0 || r.DataBlockSize < 0 || r.MaxHopCount < 0 {
+		return fmt.Errorf("%w: tries, timeout, data block size and max hop count can't be negative", usp.ErrInvalidRequest)
+	}
+	return nil
+}
+
+type Hop struct {
+	Host        string `json:"host"`
+	HostAddress string `json:"hostAddress"`
+	ErrorCode   int    `json:"errorCode"`
+	// Response time of each try, in milliseconds
+	RTTimes []int `json:"rtTimes"`
+}
+
+type TraceRouteResult struct {
+	Status        string `json:"status"`
+	IPAddressUsed string `json:"ipAddressUsed"`
+	ResponseTime  int    `json:"responseTime"`
+	Hops          []Hop  `json:"hops"`
+}
+
+/*
+SpeedRequest is a download or upload test. URL defaults to the speed test
+endpoint of the controller, which the device uploads FileLength bytes to or
+downloads them from. Duration, in seconds, makes the test time based.
+*/
+type SpeedRequest struct {
+	URL             string `json:"url,omitempty"`
+	FileLength      int64  `json:"fileLength,omitempty"`
+	Duration        int    `json:"duration,omitempty"`
+	Connections     int    `json:"connections,omitempty"`
+	Interface       string `json:"interface,omitempty"`
+	ProtocolVersion string `json:"protocolVersion,omitempty"`
+}
+
+func (r *SpeedRequest) Validate() error {
+	if r.URL == "" {
+		return fmt.Errorf("%w: url is required", usp.ErrInvalidRequest)
+	}
+	if r.FileLength < 0 || r.Connections < 0 {
+		return fmt.Errorf("%w: file length and connections can't be negative", usp.ErrInvalidRequest)
+	}
+	if r.Duration < 0 || r.Duration > MaxDuration {
+		return fmt.Errorf("%w: duration must be between 0 and %d seconds", usp.ErrInvalidRequest, MaxDuration)
+	}
+	return nil
+}
+
+// ValidateUpload also wants to know how much to upload
+func (r *SpeedRequest) ValidateUpload() error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if r.FileLength <= 0 && r.Duration <= 0 {
+		return fmt.Errorf("%w: file length or duration is required", usp.ErrInvalidRequest)
+	}
+	return nil
+}
+
+// Throughput is in Mbit/s, taken between the begin and the end of the
+// transfer, so connection setup doesn't count
+type SpeedResult struct {
+	Status     string     `json:"status"`
+	URL        string     `json:"url"`
+	Bytes      int64      `json:"bytes"`
+	TotalBytes int64      `json:"totalBytes"`
+	BOMTime    *time.Time `json:"bomTime,omitempty"`
+	EOMTime    *time.Time `json:"eomTime,omitempty"`
+	Throughput float64    `json:"throughput"`
+}
+
+func Ping(ctx context.Context, r *command.Runner, sn string, req PingRequest) (PingResult, error) {
+	if err := req.Validate(); err != nil {
+		return PingResult{}, err
+	}
+	out, err := r.Run(ctx, sn, pingCommand, args(
+		"Host", req.Host,
+		"NumberOfRepetitions", number(req.Repetitions),
+		"Timeout", number(req.Timeout),
+		"DataBlockSize", number(req.DataBlockSize),
+		"Interface", req.Interface,
+		"ProtocolVersion", req.ProtocolVersion,
+	))
+	if err != nil {
+		return PingResult{}, err
+	}
+	return PingResult{
+		Status:              out["Status"],
+		IPAddressUsed:       out["IPAddressUsed"],
+		SuccessCount:        dm.Atoi(out["SuccessCount"]),
+		FailureCount:        dm.Atoi(out["FailureCount"]),
+		AverageResponseTime: dm.Atoi(out["AverageResponseTime"]),
+		MinimumResponseTime: dm.Atoi(out["MinimumResponseTime"]),
+		MaximumResponseTime: dm.Atoi(out["MaximumResponseTime"]),
+	}, nil
+}
+
+func TraceRoute(ctx context.Context, r *command.Runner, sn string, req TraceRouteRequest) (TraceRouteResult, error) {
+	if err := req.Validate(); err != nil {
+		return TraceRouteResult{}, err
+	}
+	out, err := r.Run(ctx, sn, traceRouteCommand, args(
+		"Host", req.Host,
+		"NumberOfTries", number(req.Tries),
+		"Timeout", number(req.Timeout),
+		"DataBlockSize", number(req.DataBlockSize),
+		"MaxHopCount", number(req.MaxHopCount),
+		"Interface", req.Interface,
+		"ProtocolVersion", req.ProtocolVersion,
+	))
+	if err != nil {
+		return TraceRouteResult{}, err
+	}
+
+	result := TraceRouteResult{
+		Status:        out["Status"],
+		IPAddressUsed: out["IPAddressUsed"],
+		ResponseTime:  dm.Atoi(out["ResponseTime"]),
+		Hops:          []Hop{},
+	}
+	hops := map[int]*Hop{}
+	for key, value := range out {
+		_, n, param, ok := dm.Split(key, "RouteHops.")
+		if !ok {
+			continue
+		}
+		if hops[n] == nil {
+			hops[n] = &Hop{RTTimes: []int{}}
+		}
+		switch param {
+		case "Host":
+			hops[n].Host = value
+		case "HostAddress":
+			hops[n].HostAddress = value
+		case "ErrorCode":
+			hops[n].ErrorCode = dm.Atoi(value)
+		case "RTTimes":
+			for _, t := range strings.Split(value, ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					hops[n].RTTimes = append(hops[n].RTTimes, dm.Atoi(t))
+				}
+			}
+		}
+	}
+	numbers := make([]int, 0, len(hops))
+	for n := range hops {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		result.Hops = append(result.Hops, *hops[n])
+	}
+	return result, nil
+}
+
+func Download(ctx context.Context, r *command.Runner, sn string, req SpeedRequest) (SpeedResult, error) {
+	if err := req.Validate(); err != nil {
+		return SpeedResult{}, err
+	}
+	out, err := r.Run(ctx, sn, downloadCommand, args(
+		"DownloadURL", req.URL,
+		"TimeBasedTestDuration", number(req.Duration),
+		"NumberOfConnections", number(req.Connections),
+		"Interface", req.Interface,
+		"ProtocolVersion", req.ProtocolVersion,
+	))
+	if err != nil {
+		return SpeedResult{}, err
+	}
+	return speedResult(req.URL, out, "TestBytesReceived", "TotalBytesReceived"), nil
+}
+
+func Upload(ctx context.Context, r *command.Runner, sn string, req SpeedRequest) (SpeedResult, error) {
+	if err := req.ValidateUpload(); err != nil {
+		return SpeedResult{}, err
+	}
+	out, err := r.Run(ctx, sn, uploadCommand, args(
+		"UploadURL", req.URL,
+		"TestFileLength", number64(req.FileLength),
+		"TimeBasedTestDuration", number(req.Duration),
+		"NumberOfConnections", number(req.Connections),
+		"Interface", req.Interface,
+		"ProtocolVersion", req.ProtocolVersion,
+	))
+	if err != nil {
+		return SpeedResult{}, err
+	}
+	return speedResult(req.URL, out, "TestBytesSent", "TotalBytesSent"), nil
+}
+
+func speedResult(url string, out map[string]string, testBytes, totalBytes string) SpeedResult {
+	result := SpeedResult{
+		Status:     out["Status"],
+		URL:        url,
+		Bytes:      atoi64(out[testBytes]),
+		TotalBytes: atoi64(out[totalBytes]),
+		BOMTime:    parseTime(out["BOMTime"]),
+		EOMTime:    parseTime(out["EOMTime"]),
+	}
+	if result.Bytes == 0 {
+		// Devices not telling apart test and total bytes
+		result.Bytes = result.TotalBytes
+	}
+	if result.BOMTime != nil && result.EOMTime != nil {
+		if elapsed := result.EOMTime.Sub(*result.BOMTime).Seconds(); elapsed > 0 {
+			result.Throughput = float64(result.Bytes) * 8 / elapsed / 1e6
+		}
+	}
+	return result
+}
+
+// Input arguments out of name and value pairs, leaving out empty values
+func args(pairs ...string) map[string]string {
+	result := map[string]string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			result[pairs[i]] = pairs[i+1]
+		}
+	}
+	return result
+}
+
+func number(n int) string {
+	return number64(int64(n))
+}
+
+func number64(n int64) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func atoi64(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// Devices report unknown times as the zero dateTime
+func parseTime(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil || t.Year() <= 1 {
+		return nil
+	}
+	return &t
+}
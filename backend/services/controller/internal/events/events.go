@@ -0,0 +1,125 @@
+// Spreads what happens to devices to the parts of the controller waiting on it.
+package events
+
+import (
+	"sync"
+	"time"
+
+	usp_msg "github.com/leandrofars/oktopus/internal/usp_message"
+)
+
+type Kind string
+
+const (
+	DeviceOnline  Kind = "online"
+	DeviceOffline Kind = "offline"
+	// A Notify message sent by the device, as OperationComplete
+	Notification Kind = "notification"
+)
+
+type Event struct {
+	SN   string
+	Kind Kind
+	Time time.Time
+	// Set on Notification events
+	Notify *usp_msg.Notify
+}
+
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: map[*subscriber]bool{}}
+}
+
+// Subscribe returns a channel which receives the events of the device with
+// serial number sn, or of every device if sn is empty, until unsubscribe is called.
+// Events are queued until the subscriber reads them, so none is lost when many
+// devices reconnect at once.
+func (b *Bus) Subscribe(sn string) (<-chan Event, func()) {
+	s := &subscriber{
+		sn:   sn,
+		out:  make(chan Event),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go s.deliver()
+
+	b.mu.Lock()
+	b.subscribers[s] = true
+	b.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, s)
+			b.mu.Unlock()
+			close(s.done)
+		})
+	}
+	return s.out, unsubscribe
+}
+
+// Publish never blocks, whatever the subscribers are up to
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		if s.sn != "" && s.sn != e.SN {
+			continue
+		}
+		s.push(e)
+	}
+}
+
+type subscriber struct {
+	sn    string
+	out   chan Event
+	mu    sync.Mutex
+	queue []Event
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+func (s *subscriber) push(e Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Hands the queued events to the subscriber, in order
+func (s *subscriber) deliver() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		e := s.queue[0]
+		s.queue[0] = Event{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.out <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,473 @@
+// Manages the NAT port mappings and the firewall chains and rules of devices.
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const (
+	root       = "Device.Firewall."
+	chainTable = "Device.Firewall.Chain."
+)
+
+var (
+	configs = []string{"High", "Low", "Typical", "Advanced"}
+	targets = []string{"Drop", "Accept", "Reject", "Return", "TargetChain"}
+)
+
+type Firewall struct {
+	Enable        bool    `json:"enable"`
+	Status        string  `json:"status"`
+	Config        string  `json:"config"`
+	AdvancedLevel string  `json:"advancedLevel"`
+	Type          string  `json:"type"`
+	Chains        []Chain `json:"chains"`
+}
+
+// Changes to the firewall settings, fields left out are kept as they are
+type Settings struct {
+	Enable        *bool   `json:"enable,omitempty"`
+	Config        *string `json:"config,omitempty"`
+	AdvancedLevel *string `json:"advancedLevel,omitempty"`
+}
+
+// Rules are sorted by their order, the one they are matched in
+type Chain struct {
+	ID      string `json:"id"`
+	Path    string `json:"path"`
+	Enable  bool   `json:"enable"`
+	Name    string `json:"name"`
+	Creator string `json:"creator"`
+	Rules   []Rule `json:"rules"`
+}
+
+/*
+Rule of a chain. IPVersion, Protocol and ports take -1 for any, masks are
+prefix lengths as "/24". TargetChain is the ID of the chain jumped to when
+Target is TargetChain. Order 0 on creation puts the rule last.
+*/
+type Rule struct {
+	ID                 string `json:"id"`
+	Path               string `json:"path"`
+	Enable             bool   `json:"enable"`
+	Status             string `json:"status"`
+	Order              int    `json:"order"`
+	Description        string `json:"description"`
+	Target             string `json:"target"`
+	TargetChain        string `json:"targetChain,omitempty"`
+	SourceInterface    string `json:"sourceInterface"`
+	DestInterface      string `json:"destInterface"`
+	IPVersion          int    `json:"ipVersion"`
+	SourceIP           string `json:"sourceIP"`
+	SourceMask         string `json:"sourceMask"`
+	DestIP             string `json:"destIP"`
+	DestMask           string `json:"destMask"`
+	Protocol           int    `json:"protocol"`
+	SourcePort         int    `json:"sourcePort"`
+	SourcePortRangeMax int    `json:"sourcePortRangeMax"`
+	DestPort           int    `json:"destPort"`
+	DestPortRangeMax   int    `json:"destPortRangeMax"`
+}
+
+// DefaultRule is what a rule is made of unless told otherwise: an enabled
+// rule accepting anything.
+func DefaultRule() Rule {
+	return Rule{
+		Enable:             true,
+		Target:             "Accept",
+		IPVersion:          -1,
+		Protocol:           -1,
+		SourcePort:         -1,
+		SourcePortRangeMax: -1,
+		DestPort:           -1,
+		DestPortRangeMax:   -1,
+	}
+}
+
+// Get reads the firewall settings along with every chain and rule.
+func Get(ctx context.Context, d *usp.Dispatcher, sn string) (Firewall, error) {
+	resp, err := usp.Get.Run(ctx, d, sn, usp.GetRequest{Paths: []string{root}})
+	if err != nil {
+		return Firewall{}, err
+	}
+	values := resp.Params
+
+	f := Firewall{
+		Enable:        dm.ParseBool(values[root+"Enable"]),
+		Status:        values[root+"Status"],
+		Config:        values[root+"Config"],
+		AdvancedLevel: values[root+"AdvancedLevel"],
+		Type:          values[root+"Type"],
+		Chains:        []Chain{},
+	}
+	chainIds := map[string]string{}
+	for _, path := range dm.Instances(values, chainTable) {
+		chainIds[path] = idOf(values, chainTable, path)
+	}
+	for _, path := range dm.Instances(values, chainTable) {
+		c := Chain{
+			ID:      chainIds[path],
+			Path:    path,
+			Enable:  dm.ParseBool(values[path+"Enable"]),
+			Name:    values[path+"Name"],
+			Creator: values[path+"Creator"],
+			Rules:   []Rule{},
+		}
+		for _, rule := range dm.Instances(values, path+"Rule.") {
+			c.Rules = append(c.Rules, Rule{
+				ID:                 idOf(values, path+"Rule.", rule),
+				Path:               rule,
+				Enable:             dm.ParseBool(values[rule+"Enable"]),
+				Status:             values[rule+"Status"],
+				Order:              dm.Atoi(values[rule+"Order"]),
+				Description:        values[rule+"Description"],
+				Target:             values[rule+"Target"],
+				TargetChain:        chainIds[dm.WithDot(values[rule+"TargetChain"])],
+				SourceInterface:    values[rule+"SourceInterface"],
+				DestInterface:      values[rule+"DestInterface"],
+				IPVersion:          dm.AtoiOr(values[rule+"IPVersion"], -1),
+				SourceIP:           values[rule+"SourceIP"],
+				SourceMask:         values[rule+"SourceMask"],
+				DestIP:             values[rule+"DestIP"],
+				DestMask:           values[rule+"DestMask"],
+				Protocol:           dm.AtoiOr(values[rule+"Protocol"], -1),
+				SourcePort:         dm.AtoiOr(values[rule+"SourcePort"], -1),
+				SourcePortRangeMax: dm.AtoiOr(values[rule+"SourcePortRangeMax"], -1),
+				DestPort:           dm.AtoiOr(values[rule+"DestPort"], -1),
+				DestPortRangeMax:   dm.AtoiOr(values[rule+"DestPortRangeMax"], -1),
+			})
+		}
+		sort.SliceStable(c.Rules, func(i, j int) bool { return c.Rules[i].Order < c.Rules[j].Order })
+		f.Chains = append(f.Chains, c)
+	}
+	return f, nil
+}
+
+// Configure changes the firewall settings.
+func Configure(ctx context.Context, d *usp.Dispatcher, sn string, s Settings) (Firewall, error) {
+	set := map[string]string{}
+	if s.Enable != nil {
+		set[root+"Enable"] = strconv.FormatBool(*s.Enable)
+	}
+	if s.Config != nil {
+		if !dm.Contains(configs, *s.Config) {
+			return Firewall{}, fmt.Errorf("%w: config must be one of %v", usp.ErrInvalidRequest, configs)
+		}
+		set[root+"Config"] = *s.Config
+	}
+	if s.AdvancedLevel != nil {
+		set[root+"AdvancedLevel"] = *s.AdvancedLevel
+	}
+	if len(set) == 0 {
+		return Firewall{}, fmt.Errorf("%w: no changes", usp.ErrInvalidRequest)
+	}
+	if _, err := usp.Set.Run(ctx, d, sn, usp.SetRequest{Params: set}); err != nil {
+		return Firewall{}, err
+	}
+	return Get(ctx, d, sn)
+}
+
+// AddChain creates a chain, as made by the controller.
+func AddChain(ctx context.Context, d *usp.Dispatcher, sn string, c Chain) (Chain, error) {
+	if c.Name == "" {
+		return Chain{}, fmt.Errorf("%w: chain name is required", usp.ErrInvalidRequest)
+	}
+	_, id, err := add(ctx, d, sn, chainTable, map[string]string{
+		"Enable":  strconv.FormatBool(c.Enable),
+		"Name":    c.Name,
+		"Creator": "ACS",
+	})
+	if err != nil {
+		return Chain{}, err
+	}
+	return chain(ctx, d, sn, id)
+}
+
+// UpdateChain renames the chain and turns it on or off.
+func UpdateChain(ctx context.Context, d *usp.Dispatcher, sn, id string, c Chain) (Chain, error) {
+	if c.Name == "" {
+		return Chain{}, fmt.Errorf("%w: chain name is required", usp.ErrInvalidRequest)
+	}
+	current, err := chain(ctx, d, sn, id)
+	if err != nil {
+		return Chain{}, err
+	}
+	_, err = usp.Set.Run(ctx, d, sn, usp.SetRequest{Params: map[string]string{
+		current.Path + "Enable": strconv.FormatBool(c.Enable),
+		current.Path + "Name":   c.Name,
+	}})
+	if err != nil {
+		return Chain{}, err
+	}
+	return chain(ctx, d, sn, id)
+}
+
+// DeleteChain deletes the chain along with its rules.
+func DeleteChain(ctx context.Context, d *usp.Dispatcher, sn, id string) error {
+	c, err := chain(ctx, d, sn, id)
+	if err != nil {
+		return err
+	}
+	return remove(ctx, d, sn, c.Path)
+}
+
+// AddRule validates the rule and appends it to the chain, or puts it at its
+// order if it has one.
+func AddRule(ctx context.Context, d *usp.Dispatcher, sn, chainId string, r Rule) (Rule, error) {
+	f, err := Get(ctx, d, sn)
+	if err != nil {
+		return Rule{}, err
+	}
+	c, err := findChain(f, chainId)
+	if err != nil {
+		return Rule{}, err
+	}
+	params, err := ruleParams(f, c, r)
+	if err != nil {
+		return Rule{}, err
+	}
+	_, id, err := add(ctx, d, sn, c.Path+"Rule.", params)
+	if err != nil {
+		return Rule{}, err
+	}
+	return rule(ctx, d, sn, chainId, id)
+}
+
+// UpdateRule replaces every setting of the rule by the given ones.
+func UpdateRule(ctx context.Context, d *usp.Dispatcher, sn, chainId, id string, r Rule) (Rule, error) {
+	f, err := Get(ctx, d, sn)
+	if err != nil {
+		return Rule{}, err
+	}
+	c, err := findChain(f, chainId)
+	if err != nil {
+		return Rule{}, err
+	}
+	current, err := findRule(c, id)
+	if err != nil {
+		return Rule{}, err
+	}
+	params, err := ruleParams(f, c, r)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	set := map[string]string{}
+	for param, value := range params {
+		set[current.Path+param] = value
+	}
+	if _, err := usp.Set.Run(ctx, d, sn, usp.SetRequest{Params: set}); err != nil {
+		return Rule{}, err
+	}
+	return rule(ctx, d, sn, chainId, id)
+}
+
+func DeleteRule(ctx context.Context, d *usp.Dispatcher, sn, chainId, id string) error {
+	r, err := rule(ctx, d, sn, chainId, id)
+	if err != nil {
+		return err
+	}
+	return remove(ctx, d, sn, r.Path)
+}
+
+func chain(ctx context.Context, d *usp.Dispatcher, sn, id string) (Chain, error) {
+	f, err := Get(ctx, d, sn)
+	if err != nil {
+		return Chain{}, err
+	}
+	return findChain(f, id)
+}
+
+func rule(ctx context.Context, d *usp.Dispatcher, sn, chainId, id string) (Rule, error) {
+	c, err := chain(ctx, d, sn, chainId)
+	if err != nil {
+		return Rule{}, err
+	}
+	return findRule(c, id)
+}
+
+func findChain(f Firewall, id string) (Chain, error) {
+	for _, c := range f.Chains {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return Chain{}, fmt.Errorf("%w: no firewall chain %s", usp.ErrInvalidRequest, id)
+}
+
+func findRule(c Chain, id string) (Rule, error) {
+	for _, r := range c.Rules {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return Rule{}, fmt.Errorf("%w: no rule %s in firewall chain %s", usp.ErrInvalidRequest, id, c.ID)
+}
+
+// Checks the rule, answering its params to be written
+func ruleParams(f Firewall, c Chain, r Rule) (map[string]string, error) {
+	if !dm.Contains(targets, r.Target) {
+		return nil, fmt.Errorf("%w: target must be one of %v", usp.ErrInvalidRequest, targets)
+	}
+	targetChain := ""
+	if r.Target == "TargetChain" {
+		target, err := findChain(f, r.TargetChain)
+		if err != nil {
+			return nil, err
+		}
+		if target.Path == c.Path {
+			return nil, fmt.Errorf("%w: a chain can't jump to itself", usp.ErrInvalidRequest)
+		}
+		targetChain = target.Path
+	}
+	if len(r.Description) > 256 {
+		return nil, fmt.Errorf("%w: description must have up to 256 characters", usp.ErrInvalidRequest)
+	}
+	if r.Order < 0 {
+		return nil, fmt.Errorf("%w: order can't be negative", usp.ErrInvalidRequest)
+	}
+	if r.IPVersion != -1 && r.IPVersion != 4 && r.IPVersion != 6 {
+		return nil, fmt.Errorf("%w: ip version must be 4, 6 or -1 for any", usp.ErrInvalidRequest)
+	}
+	for _, x := range []struct{ name, ip, mask string }{
+		{"source", r.SourceIP, r.SourceMask},
+		{"destination", r.DestIP, r.DestMask},
+	} {
+		if err := checkAddress(x.name, x.ip, x.mask, r.IPVersion); err != nil {
+			return nil, err
+		}
+	}
+	if r.Protocol < -1 || r.Protocol > 255 {
+		return nil, fmt.Errorf("%w: protocol must be an IP protocol number or -1 for any", usp.ErrInvalidRequest)
+	}
+	ports := r.SourcePort != -1 || r.SourcePortRangeMax != -1 || r.DestPort != -1 || r.DestPortRangeMax != -1
+	if ports && r.Protocol != -1 && r.Protocol != 6 && r.Protocol != 17 {
+		return nil, fmt.Errorf("%w: ports only apply to TCP and UDP", usp.ErrInvalidRequest)
+	}
+	for _, x := range []struct {
+		name      string
+		port, max int
+	}{
+		{"source", r.SourcePort, r.SourcePortRangeMax},
+		{"destination", r.DestPort, r.DestPortRangeMax},
+	} {
+		if x.port < -1 || x.port > 65535 || x.max < -1 || x.max > 65535 {
+			return nil, fmt.Errorf("%w: %s ports must be up to 65535, or -1 for any", usp.ErrInvalidRequest, x.name)
+		}
+		if x.max != -1 && (x.port == -1 || x.max < x.port) {
+			return nil, fmt.Errorf("%w: %s port range must end after it starts", usp.ErrInvalidRequest, x.name)
+		}
+	}
+
+	params := map[string]string{
+		"Enable":             strconv.FormatBool(r.Enable),
+		"Description":        r.Description,
+		"Target":             r.Target,
+		"TargetChain":        targetChain,
+		"SourceInterface":    r.SourceInterface,
+		"DestInterface":      r.DestInterface,
+		"IPVersion":          strconv.Itoa(r.IPVersion),
+		"SourceIP":           r.SourceIP,
+		"SourceMask":         r.SourceMask,
+		"DestIP":             r.DestIP,
+		"DestMask":           r.DestMask,
+		"Protocol":           strconv.Itoa(r.Protocol),
+		"SourcePort":         strconv.Itoa(r.SourcePort),
+		"SourcePortRangeMax": strconv.Itoa(r.SourcePortRangeMax),
+		"DestPort":           strconv.Itoa(r.DestPort),
+		"DestPortRangeMax":   strconv.Itoa(r.DestPortRangeMax),
+	}
+	if r.Order > 0 {
+		params["Order"] = strconv.Itoa(r.Order)
+	}
+	return params, nil
+}
+
+// Masks are prefix lengths, with or without the address before them
+func checkAddress(name, ip, mask string, version int) error {
+	bits := 128
+	if ip != "" {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return fmt.Errorf("%w: invalid %s ip %s", usp.ErrInvalidRequest, name, ip)
+		}
+		v4 := parsed.To4() != nil
+		if (version == 4 && !v4) || (version == 6 && v4) {
+			return fmt.Errorf("%w: %s ip %s isn't an IPv%d address", usp.ErrInvalidRequest, name, ip, version)
+		}
+		if v4 {
+			bits = 32
+		}
+	} else if version == 4 {
+		bits = 32
+	}
+	if mask == "" {
+		return nil
+	}
+	i := strings.LastIndex(mask, "/")
+	prefix, err := strconv.Atoi(mask[i+1:])
+	if i < 0 || err != nil || prefix < 0 || prefix > bits {
+		return fmt.Errorf("%w: %s mask must be a prefix length up to /%d", usp.ErrInvalidRequest, name, bits)
+	}
+	return nil
+}
+
+/*
+Adds an instance to the table, giving it an alias of its own. Aliases are
+the IDs instances are known by, since devices may renumber them, and
+instances made elsewhere are known by their number while they have none.
+*/
+func add(ctx context.Context, d *usp.Dispatcher, sn, table string, params map[string]string) (string, string, error) {
+	params["Alias"] = "oktopus-" + uuid.NewString()
+	resp, err := usp.Add.Run(ctx, d, sn, usp.AddRequest{Objects: []usp.AddObject{{Path: table, Params: params}}})
+	if err != nil {
+		return "", "", err
+	}
+	if len(resp.Errors) > 0 {
+		return "", "", failure(resp.Errors)
+	}
+	if len(resp.Created) == 0 || resp.Created[0].Path == "" {
+		return "", "", fmt.Errorf("device created no instance of %s", table)
+	}
+	created := resp.Created[0]
+	if len(created.Errors) > 0 {
+		return "", "", failure(created.Errors)
+	}
+	id := params["Alias"]
+	if alias := created.UniqueKeys["Alias"]; alias != "" {
+		id = alias
+	}
+	return created.Path, id, nil
+}
+
+func remove(ctx context.Context, d *usp.Dispatcher, sn, path string) error {
+	resp, err := usp.Delete.Run(ctx, d, sn, usp.DeleteRequest{Paths: []string{path}})
+	if err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		return failure(resp.Errors)
+	}
+	return nil
+}
+
+func failure(errs []usp.PathError) error {
+	return &usp.Error{Message: errs[0].Message, Code: errs[0].Code, Params: errs}
+}
+
+// ID of an instance, its alias or its number if the device gave it none
+func idOf(values map[string]string, table, path string) string {
+	if alias := values[path+"Alias"]; alias != "" {
+		return alias
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(path, table), ".")
+}
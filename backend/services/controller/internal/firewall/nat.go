@@ -0,0 +1,211 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const portMappingTable = "Device.NAT.PortMapping."
+
+var protocols = []string{"TCP", "UDP"}
+
+/*
+PortMapping forwards the external ports, from ExternalPort up to
+ExternalPortEndRange if set, to InternalPort of InternalClient. An external
+port of 0 forwards any port, and a lease duration of 0 never expires. Without
+Interface nor AllInterfaces the device picks the interface.
+*/
+type PortMapping struct {
+	ID                   string `json:"id"`
+	Path                 string `json:"path"`
+	Enable               bool   `json:"enable"`
+	Status               string `json:"status"`
+	Description          string `json:"description"`
+	Interface            string `json:"interface"`
+	AllInterfaces        bool   `json:"allInterfaces"`
+	LeaseDuration        int    `json:"leaseDuration"`
+	RemoteHost           string `json:"remoteHost"`
+	ExternalPort         int    `json:"externalPort"`
+	ExternalPortEndRange int    `json:"externalPortEndRange"`
+	InternalPort         int    `json:"internalPort"`
+	Protocol             string `json:"protocol"`
+	InternalClient       string `json:"internalClient"`
+}
+
+// DefaultPortMapping is what a port mapping is made of unless told otherwise.
+func DefaultPortMapping() PortMapping {
+	return PortMapping{Enable: true, Protocol: "TCP"}
+}
+
+func PortMappings(ctx context.Context, d *usp.Dispatcher, sn string) ([]PortMapping, error) {
+	resp, err := usp.Get.Run(ctx, d, sn, usp.GetRequest{Paths: []string{portMappingTable}})
+	if err != nil {
+		return nil, err
+	}
+	values := resp.Params
+
+	result := []PortMapping{}
+	for _, path := range dm.Instances(values, portMappingTable) {
+		result = append(result, PortMapping{
+			ID:                   idOf(values, portMappingTable, path),
+			Path:                 path,
+			Enable:               dm.ParseBool(values[path+"Enable"]),
+			Status:               values[path+"Status"],
+			Description:          values[path+"Description"],
+			Interface:            values[path+"Interface"],
+			AllInterfaces:        dm.ParseBool(values[path+"AllInterfaces"]),
+			LeaseDuration:        dm.Atoi(values[path+"LeaseDuration"]),
+			RemoteHost:           values[path+"RemoteHost"],
+			ExternalPort:         dm.Atoi(values[path+"ExternalPort"]),
+			ExternalPortEndRange: dm.Atoi(values[path+"ExternalPortEndRange"]),
+			InternalPort:         dm.Atoi(values[path+"InternalPort"]),
+			Protocol:             values[path+"Protocol"],
+			InternalClient:       values[path+"InternalClient"],
+		})
+	}
+	return result, nil
+}
+
+func PortMappingById(ctx context.Context, d *usp.Dispatcher, sn, id string) (PortMapping, error) {
+	mappings, err := PortMappings(ctx, d, sn)
+	if err != nil {
+		return PortMapping{}, err
+	}
+	return findPortMapping(mappings, id)
+}
+
+// AddPortMapping validates the port mapping, checking it doesn't clash with
+// the ones the device has, and creates it.
+func AddPortMapping(ctx context.Context, d *usp.Dispatcher, sn string, m PortMapping) (PortMapping, error) {
+	mappings, err := PortMappings(ctx, d, sn)
+	if err != nil {
+		return PortMapping{}, err
+	}
+	params, err := portMappingParams(mappings, "", m)
+	if err != nil {
+		return PortMapping{}, err
+	}
+	_, id, err := add(ctx, d, sn, portMappingTable, params)
+	if err != nil {
+		return PortMapping{}, err
+	}
+	return PortMappingById(ctx, d, sn, id)
+}
+
+// UpdatePortMapping replaces every setting of the port mapping by the given ones.
+func UpdatePortMapping(ctx context.Context, d *usp.Dispatcher, sn, id string, m PortMapping) (PortMapping, error) {
+	mappings, err := PortMappings(ctx, d, sn)
+	if err != nil {
+		return PortMapping{}, err
+	}
+	current, err := findPortMapping(mappings, id)
+	if err != nil {
+		return PortMapping{}, err
+	}
+	params, err := portMappingParams(mappings, current.Path, m)
+	if err != nil {
+		return PortMapping{}, err
+	}
+
+	set := map[string]string{}
+	for param, value := range params {
+		set[current.Path+param] = value
+	}
+	if _, err := usp.Set.Run(ctx, d, sn, usp.SetRequest{Params: set}); err != nil {
+		return PortMapping{}, err
+	}
+	return PortMappingById(ctx, d, sn, id)
+}
+
+func DeletePortMapping(ctx context.Context, d *usp.Dispatcher, sn, id string) error {
+	m, err := PortMappingById(ctx, d, sn, id)
+	if err != nil {
+		return err
+	}
+	return remove(ctx, d, sn, m.Path)
+}
+
+func findPortMapping(mappings []PortMapping, id string) (PortMapping, error) {
+	for _, m := range mappings {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return PortMapping{}, fmt.Errorf("%w: no port mapping %s", usp.ErrInvalidRequest, id)
+}
+
+// Checks the port mapping against the other enabled ones, skipping the one
+// at path, answering its params to be written
+func portMappingParams(mappings []PortMapping, path string, m PortMapping) (map[string]string, error) {
+	if !dm.Contains(protocols, m.Protocol) {
+		return nil, fmt.Errorf("%w: protocol must be one of %v", usp.ErrInvalidRequest, protocols)
+	}
+	if m.ExternalPort < 0 || m.ExternalPort > 65535 || m.ExternalPortEndRange < 0 || m.ExternalPortEndRange > 65535 {
+		return nil, fmt.Errorf("%w: external ports must be up to 65535", usp.ErrInvalidRequest)
+	}
+	if m.ExternalPortEndRange != 0 && (m.ExternalPort == 0 || m.ExternalPortEndRange < m.ExternalPort) {
+		return nil, fmt.Errorf("%w: external port range must end after it starts", usp.ErrInvalidRequest)
+	}
+	if m.InternalPort < 1 || m.InternalPort > 65535 {
+		return nil, fmt.Errorf("%w: internal port must be from 1 to 65535", usp.ErrInvalidRequest)
+	}
+	if m.InternalClient == "" {
+		return nil, fmt.Errorf("%w: internal client is required", usp.ErrInvalidRequest)
+	}
+	if ip := net.ParseIP(m.InternalClient); ip != nil && ip.To4() == nil {
+		return nil, fmt.Errorf("%w: internal client must be an IPv4 address or a host name", usp.ErrInvalidRequest)
+	}
+	if m.RemoteHost != "" && net.ParseIP(m.RemoteHost) == nil {
+		return nil, fmt.Errorf("%w: invalid remote host %s", usp.ErrInvalidRequest, m.RemoteHost)
+	}
+	if m.LeaseDuration < 0 {
+		return nil, fmt.Errorf("%w: lease duration can't be negative", usp.ErrInvalidRequest)
+	}
+	if len(m.Description) > 256 {
+		return nil, fmt.Errorf("%w: description must have up to 256 characters", usp.ErrInvalidRequest)
+	}
+
+	if m.Enable && m.ExternalPort != 0 {
+		for _, x := range mappings {
+			if x.Path == path || !x.Enable || x.ExternalPort == 0 || x.Protocol != m.Protocol || x.RemoteHost != m.RemoteHost {
+				continue
+			}
+			if overlap(x.ExternalPort, x.ExternalPortEndRange, m.ExternalPort, m.ExternalPortEndRange) {
+				return nil, fmt.Errorf("%w: external ports clash with port mapping %s", usp.ErrInvalidRequest, x.ID)
+			}
+		}
+	}
+
+	params := map[string]string{
+		"Enable":               strconv.FormatBool(m.Enable),
+		"Description":          m.Description,
+		"AllInterfaces":        strconv.FormatBool(m.AllInterfaces),
+		"LeaseDuration":        strconv.Itoa(m.LeaseDuration),
+		"RemoteHost":           m.RemoteHost,
+		"ExternalPort":         strconv.Itoa(m.ExternalPort),
+		"ExternalPortEndRange": strconv.Itoa(m.ExternalPortEndRange),
+		"InternalPort":         strconv.Itoa(m.InternalPort),
+		"Protocol":             m.Protocol,
+		"InternalClient":       m.InternalClient,
+	}
+	if m.Interface != "" {
+		params["Interface"] = m.Interface
+	}
+	return params, nil
+}
+
+// Whether two port ranges overlap, an end of 0 meaning a single port
+func overlap(start1, end1, start2, end2 int) bool {
+	if end1 == 0 {
+		end1 = start1
+	}
+	if end2 == 0 {
+		end2 = start2
+	}
+	return start1 <= end2 && start2 <= end1
+}
@@ -0,0 +1,117 @@
+package firewall
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		start1, end1, start2, end2 int
+		want                       bool
+	}{
+		{80, 0, 80, 0, true},
+		{80, 0, 443, 0, false},
+		{8000, 8100, 8080, 0, true},
+		{8080, 0, 8000, 8100, true},
+		{8000, 8100, 8100, 8200, true},
+		{8000, 8100, 8101, 8200, false},
+		{8000, 8100, 7000, 9000, true},
+		{7000, 7999, 8000, 0, false},
+	}
+	for _, tt := range tests {
+		if got := overlap(tt.start1, tt.end1, tt.start2, tt.end2); got != tt.want {
+			t.Errorf("overlap(%d, %d, %d, %d) = %v, want %v", tt.start1, tt.end1, tt.start2, tt.end2, got, tt.want)
+		}
+	}
+}
+
+func TestPortMappingParams(t *testing.T) {
+	mappings := []PortMapping{
+		{ID: "web", Path: "Device.NAT.PortMapping.1.", Enable: true, Protocol: "TCP", ExternalPort: 8080, InternalPort: 80, InternalClient: "192.168.1.10"},
+		{ID: "games", Path: "Device.NAT.PortMapping.2.", Enable: true, Protocol: "UDP", ExternalPort: 27000, ExternalPortEndRange: 27100, InternalPort: 27000, InternalClient: "192.168.1.20"},
+		{ID: "old", Path: "Device.NAT.PortMapping.3.", Enable: false, Protocol: "TCP", ExternalPort: 2222, InternalPort: 22, InternalClient: "192.168.1.30"},
+	}
+	mapping := func(change func(m *PortMapping)) PortMapping {
+		m := DefaultPortMapping()
+		m.ExternalPort = 9000
+		m.InternalPort = 9000
+		m.InternalClient = "192.168.1.40"
+		if change != nil {
+			change(&m)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name string
+		path string
+		m    PortMapping
+		ok   bool
+	}{
+		{"new mapping", "", mapping(nil), true},
+		{"host name client", "", mapping(func(m *PortMapping) { m.InternalClient = "nas.lan" }), true},
+		{"every external port", "", mapping(func(m *PortMapping) { m.ExternalPort = 0 }), true},
+		{"bad protocol", "", mapping(func(m *PortMapping) { m.Protocol = "SCTP" }), false},
+		{"external port too big", "", mapping(func(m *PortMapping) { m.ExternalPort = 70000 }), false},
+		{"range ending before it starts", "", mapping(func(m *PortMapping) { m.ExternalPortEndRange = 8999 }), false},
+		{"range without start", "", mapping(func(m *PortMapping) { m.ExternalPort = 0; m.ExternalPortEndRange = 9100 }), false},
+		{"no internal port", "", mapping(func(m *PortMapping) { m.InternalPort = 0 }), false},
+		{"no internal client", "", mapping(func(m *PortMapping) { m.InternalClient = "" }), false},
+		{"IPv6 internal client", "", mapping(func(m *PortMapping) { m.InternalClient = "fe80::1" }), false},
+		{"bad remote host", "", mapping(func(m *PortMapping) { m.RemoteHost = "somewhere" }), false},
+		{"negative lease", "", mapping(func(m *PortMapping) { m.LeaseDuration = -1 }), false},
+		{"clashing port", "", mapping(func(m *PortMapping) { m.ExternalPort = 8080 }), false},
+		{"clashing range", "", mapping(func(m *PortMapping) {
+			m.Protocol = "UDP"
+			m.ExternalPort = 26990
+			m.ExternalPortEndRange = 27000
+		}), false},
+		{"same port other protocol", "", mapping(func(m *PortMapping) { m.ExternalPort = 8080; m.Protocol = "UDP" }), true},
+		{"same port other remote host", "", mapping(func(m *PortMapping) { m.ExternalPort = 8080; m.RemoteHost = "203.0.113.5" }), true},
+		{"same port as a disabled one", "", mapping(func(m *PortMapping) { m.ExternalPort = 2222 }), true},
+		{"disabled clashing mapping", "", mapping(func(m *PortMapping) { m.ExternalPort = 8080; m.Enable = false }), true},
+		{"updating itself", "Device.NAT.PortMapping.1.", mapping(func(m *PortMapping) { m.ExternalPort = 8080 }), true},
+	}
+	for _, tt := range tests {
+		params, err := portMappingParams(mappings, tt.path, tt.m)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: portMappingParams() error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err != nil && !errors.Is(err, usp.ErrInvalidRequest) {
+			t.Errorf("%s: portMappingParams() error = %v, want an invalid request", tt.name, err)
+		}
+		if err == nil && params["InternalClient"] != tt.m.InternalClient {
+			t.Errorf("%s: InternalClient = %q, want %q", tt.name, params["InternalClient"], tt.m.InternalClient)
+		}
+	}
+
+	params, err := portMappingParams(mappings, "", mapping(func(m *PortMapping) { m.Interface = "Device.IP.Interface.1." }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Enable":               "true",
+		"Description":          "",
+		"AllInterfaces":        "false",
+		"LeaseDuration":        "0",
+		"RemoteHost":           "",
+		"ExternalPort":         "9000",
+		"ExternalPortEndRange": "0",
+		"InternalPort":         "9000",
+		"Protocol":             "TCP",
+		"InternalClient":       "192.168.1.40",
+		"Interface":            "Device.IP.Interface.1.",
+	}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("params[%q] = %q, want %q", k, params[k], v)
+		}
+	}
+	if len(params) != len(want) {
+		t.Errorf("params = %v, want %v", params, want)
+	}
+}
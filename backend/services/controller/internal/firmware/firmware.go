@@ -0,0 +1,482 @@
+// Updates devices with firmware images of the controller repository.
+package firmware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/events"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+const (
+	pollInterval    = 10 * time.Second
+	downloadTimeout = 30 * time.Minute
+	rebootTimeout   = 10 * time.Minute
+)
+
+const (
+	StageSelect   = "select"
+	StageDownload = "download"
+	StageActivate = "activate"
+	StageReboot   = "reboot"
+	StageVerify   = "verify"
+)
+
+const imagesPath = "Device.DeviceInfo.FirmwareImage."
+
+var (
+	ErrNoImage            = errors.New("device reports no firmware image")
+	ErrDeferredActivation = errors.New("activation can't be deferred on a device with a single firmware image")
+	ErrDownloadFailed     = errors.New("firmware download failed")
+	ErrDownloadTimeout    = errors.New("firmware download didn't finish in time")
+	ErrRebootTimeout      = errors.New("device didn't come back online after activating the firmware")
+	ErrVersionMismatch    = errors.New("device doesn't run the new firmware version")
+)
+
+var windowModes = map[string]bool{
+	"AnyTime":            true,
+	"Immediately":        true,
+	"WhenIdle":           true,
+	"ConfirmationNeeded": true,
+}
+
+// TimeWindow of the Activate() command. Start and End are seconds from the
+// moment the command is sent.
+type TimeWindow struct {
+	Start       int    `json:"start"`
+	End         int    `json:"end"`
+	Mode        string `json:"mode"`
+	UserMessage string `json:"userMessage,omitempty"`
+	MaxRetries  int    `json:"maxRetries"`
+}
+
+// Request of a firmware update. Without time windows the image is activated
+// right after being downloaded.
+type Request struct {
+	Firmware string       `json:"firmware"`
+	Windows  []TimeWindow `json:"windows,omitempty"`
+}
+
+func (r *Request) Validate() error {
+	if r.Firmware == "" {
+		return fmt.Errorf("%w: firmware id is required", usp.ErrInvalidRequest)
+	}
+	for i := range r.Windows {
+		w := &r.Windows[i]
+		if w.Mode == "" {
+			w.Mode = "AnyTime"
+		}
+		if !windowModes[w.Mode] {
+			return fmt.Errorf("%w: invalid time window mode %q", usp.ErrInvalidRequest, w.Mode)
+		}
+		if w.Start < 0 || w.End <= w.Start {
+			return fmt.Errorf("%w: time window %d must end after it starts", usp.ErrInvalidRequest, i+1)
+		}
+		if i > 0 && w.Start < r.Windows[i-1].End {
+			return fmt.Errorf("%w: time windows must be in order and must not overlap", usp.ErrInvalidRequest)
+		}
+	}
+	return nil
+}
+
+type Stage struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	Message    string     `json:"message,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type Result struct {
+	Image           string  `json:"image,omitempty"`
+	PreviousVersion string  `json:"previousVersion,omitempty"`
+	Version         string  `json:"version,omitempty"`
+	Stages          []Stage `json:"stages"`
+}
+
+// Progress is called every time a stage starts or finishes.
+type Progress func(Result)
+
+type Updater struct {
+	Usp    *usp.Dispatcher
+	Events *events.Bus
+}
+
+func NewUpdater(d *usp.Dispatcher, bus *events.Bus) *Updater {
+	return &Updater{Usp: d, Events: bus}
+}
+
+// DownloadArgs are the arguments of FirmwareImage.{i}.Download() to fetch fw
+// from the controller reachable at filesUrl.
+func DownloadArgs(fw db.Firmware, filesUrl string) map[string]string {
+	return map[string]string{
+		"URL":               filesUrl + "/files/firmware/" + fw.Id + "/" + url.PathEscape(fw.File),
+		"FileSize":          strconv.FormatInt(fw.Size, 10),
+		"CheckSumAlgorithm": "SHA-256",
+		"CheckSum":          fw.SHA256,
+	}
+}
+
+type image struct {
+	path    string
+	status  string
+	version string
+}
+
+type update struct {
+	*Updater
+	sn       string
+	result   Result
+	progress Progress
+	events   <-chan events.Event
+}
+
+/*
+Update installs fw on the device and waits for it to run the new version:
+
+  - select: picks an image slot other than the active one, or the only one
+  - download: downloads fw into it, skipped if it already holds fw
+  - activate: activates it, inside the time windows if any
+  - reboot: waits for the device to come back online
+  - verify: checks the device reports the new software version
+
+Devices with a single image activate it as soon as it's downloaded.
+*/
+func (u *Updater) Update(ctx context.Context, sn string, fw db.Firmware, filesUrl string, windows []TimeWindow, progress Progress) (Result, error) {
+	deviceEvents, unsubscribe := u.Events.Subscribe(sn)
+	defer unsubscribe()
+
+	up := &update{
+		Updater:  u,
+		sn:       sn,
+		result:   Result{Version: fw.Version, Stages: []Stage{}},
+		progress: progress,
+		events:   deviceEvents,
+	}
+
+	var target image
+	var single, downloaded bool
+	err := up.stage(StageSelect, func() (string, error) {
+		images, active, version, err := up.images(ctx)
+		if err != nil {
+			return "", err
+		}
+		up.result.PreviousVersion = version
+		if len(images) == 0 {
+			return "", ErrNoImage
+		}
+		target, single = choose(images, active, fw.Version)
+		up.result.Image = target.path
+		if single && len(windows) > 0 {
+			return "", ErrDeferredActivation
+		}
+		downloaded = target.version == fw.Version && target.status == "Available"
+		if single {
+			return "Device has a single firmware image", nil
+		}
+		return "", nil
+	})
+	if err != nil {
+		return up.result, err
+	}
+	if up.result.PreviousVersion == fw.Version {
+		return up.result, nil
+	}
+
+	if !downloaded {
+		err = up.stage(StageDownload, func() (string, error) {
+			return "", up.download(ctx, target, fw, filesUrl, single)
+		})
+		if err != nil {
+			return up.result, err
+		}
+	}
+
+	wait := rebootTimeout
+	if single {
+		// The device downloads, activates and reboots all by itself
+		wait += downloadTimeout
+	} else {
+		err = up.stage(StageActivate, func() (string, error) {
+			return up.activate(ctx, target, windows)
+		})
+		if err != nil {
+			return up.result, err
+		}
+		if len(windows) > 0 {
+			wait += time.Duration(windows[len(windows)-1].End) * time.Second
+		}
+	}
+
+	err = up.stage(StageReboot, func() (string, error) {
+		return "", up.waitOnline(ctx, wait)
+	})
+	if err != nil {
+		return up.result, err
+	}
+
+	err = up.stage(StageVerify, func() (string, error) {
+		resp, err := usp.Get.Run(ctx, up.Usp, sn, usp.GetRequest{
+			Paths: []string{"Device.DeviceInfo.SoftwareVersion"},
+		})
+		if err != nil {
+			return "", err
+		}
+		version := resp.Params["Device.DeviceInfo.SoftwareVersion"]
+		if version != fw.Version {
+			return "", fmt.Errorf("%w: it runs %q instead of %q", ErrVersionMismatch, version, fw.Version)
+		}
+		return "Device runs version " + version, nil
+	})
+	return up.result, err
+}
+
+func (up *update) stage(name string, run func() (string, error)) error {
+	up.result.Stages = append(up.result.Stages, Stage{
+		Name:      name,
+		Status:    db.JobRunning,
+		StartedAt: time.Now(),
+	})
+	up.report()
+
+	message, err := run()
+
+	stage := &up.result.Stages[len(up.result.Stages)-1]
+	now := time.Now()
+	stage.FinishedAt = &now
+	stage.Status = db.JobDone
+	stage.Message = message
+	if err != nil {
+		stage.Status = db.JobFailed
+		stage.Message = err.Error()
+	}
+	up.report()
+	return err
+}
+
+func (up *update) report() {
+	if up.progress == nil {
+		return
+	}
+	result := up.result
+	result.Stages = append([]Stage(nil), up.result.Stages...)
+	up.progress(result)
+}
+
+// Returns the device images ordered by instance number, the path of the
+// active one and the running software version
+func (up *update) images(ctx context.Context) ([]image, string, string, error) {
+	resp, err := usp.Get.Run(ctx, up.Usp, up.sn, usp.GetRequest{
+		Paths: []string{
+			"Device.DeviceInfo.SoftwareVersion",
+			"Device.DeviceInfo.ActiveFirmwareImage",
+			imagesPath + "*.",
+		},
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	byPath := map[string]*image{}
+	for param, value := range resp.Params {
+		rest := strings.TrimPrefix(param, imagesPath)
+		if rest == param {
+			continue
+		}
+		i := strings.Index(rest, ".")
+		if i < 0 {
+			continue
+		}
+		path := imagesPath + rest[:i+1]
+		img, ok := byPath[path]
+		if !ok {
+			img = &image{path: path}
+			byPath[path] = img
+		}
+		switch rest[i+1:] {
+		case "Status":
+			img.status = value
+		case "Version":
+			img.version = value
+		}
+	}
+
+	var images []image
+	for _, img := range byPath {
+		images = append(images, *img)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return instance(images[i].path) < instance(images[j].path)
+	})
+
+	active := strings.TrimSuffix(resp.Params["Device.DeviceInfo.ActiveFirmwareImage"], ".")
+	if active != "" {
+		active += "."
+	}
+	return images, active, resp.Params["Device.DeviceInfo.SoftwareVersion"], nil
+}
+
+/*
+Picks the image to install the firmware into, which is never the active one,
+unless it's the only one. An image already holding the version comes first,
+then empty or broken ones, so a working fallback is kept as long as possible.
+*/
+func choose(images []image, active string, version string) (image, bool) {
+	var candidates []image
+	for _, img := range images {
+		if img.path == active || (active == "" && img.status == "Active") {
+			continue
+		}
+		candidates = append(candidates, img)
+	}
+	if len(candidates) == 0 {
+		for _, img := range images {
+			if img.path == active || img.status == "Active" {
+				return img, true
+			}
+		}
+		return images[0], true
+	}
+
+	rank := func(img image) int {
+		switch {
+		case img.version == version && img.status == "Available":
+			return 0
+		case img.status == "Available":
+			return 2
+		default:
+			return 1
+		}
+	}
+	best := candidates[0]
+	for _, img := range candidates[1:] {
+		if rank(img) < rank(best) {
+			best = img
+		}
+	}
+	return best, false
+}
+
+func (up *update) download(ctx context.Context, target image, fw db.Firmware, filesUrl string, single bool) error {
+	args := DownloadArgs(fw, filesUrl)
+	args["AutoActivate"] = strconv.FormatBool(single)
+	up.drainEvents()
+
+	err := up.operate(ctx, target.path+"Download()", args)
+	if err != nil || single {
+		return err
+	}
+
+	deadline := time.Now().Add(downloadTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+
+		resp, err := usp.Get.Run(ctx, up.Usp, up.sn, usp.GetRequest{
+			Paths: []string{target.path + "Status"},
+		})
+		if err != nil {
+			var deviceErr *usp.Error
+			if errors.As(err, &deviceErr) {
+				return err
+			}
+			// The device might be busy or reconnecting, try again later
+			continue
+		}
+		switch status := resp.Params[target.path+"Status"]; status {
+		case "Available":
+			return nil
+		case "DownloadFailed", "ValidationFailed", "InstallationFailed":
+			return fmt.Errorf("%w: image status is %s", ErrDownloadFailed, status)
+		}
+	}
+	return ErrDownloadTimeout
+}
+
+func (up *update) activate(ctx context.Context, target image, windows []TimeWindow) (string, error) {
+	args := map[string]string{}
+	for i, w := range windows {
+		prefix := "TimeWindow." + strconv.Itoa(i+1) + "."
+		args[prefix+"Start"] = strconv.Itoa(w.Start)
+		args[prefix+"End"] = strconv.Itoa(w.End)
+		args[prefix+"Mode"] = w.Mode
+		args[prefix+"MaxRetries"] = strconv.Itoa(w.MaxRetries)
+		if w.UserMessage != "" {
+			args[prefix+"UserMessage"] = w.UserMessage
+		}
+	}
+	up.drainEvents()
+
+	if err := up.operate(ctx, target.path+"Activate()", args); err != nil {
+		return "", err
+	}
+	if len(windows) > 0 {
+		start := time.Now().Add(time.Duration(windows[0].Start) * time.Second)
+		return "Activation scheduled from " + start.Format(time.RFC3339), nil
+	}
+	return "", nil
+}
+
+func (up *update) operate(ctx context.Context, command string, args map[string]string) error {
+	resp, err := usp.Operate.Run(ctx, up.Usp, up.sn, usp.OperateRequest{
+		Command:    command,
+		CommandKey: "oktopus-firmware",
+		InputArgs:  args,
+	})
+	if err != nil {
+		return err
+	}
+	for _, x := range resp.Results {
+		if x.Error != nil {
+			return &usp.Error{Code: x.Error.Code, Message: x.Error.Message, Params: []usp.PathError{*x.Error}}
+		}
+	}
+	return nil
+}
+
+// Waits for the device to connect again, going offline first is not
+// required since it may reconnect before the broker notices it left
+func (up *update) waitOnline(ctx context.Context, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return ErrRebootTimeout
+		case e := <-up.events:
+			if e.Kind == events.DeviceOnline {
+				return nil
+			}
+		}
+	}
+}
+
+// Forgets events from before the device was asked to reboot
+func (up *update) drainEvents() {
+	for {
+		select {
+		case <-up.events:
+		default:
+			return
+		}
+	}
+}
+
+func instance(path string) int {
+	parts := strings.Split(strings.TrimSuffix(path, "."), ".")
+	n, _ := strconv.Atoi(parts[len(parts)-1])
+	return n
+}
@@ -0,0 +1,96 @@
+package firmware
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+func TestChoose(t *testing.T) {
+	const (
+		image1 = "Device.DeviceInfo.FirmwareImage.1."
+		image2 = "Device.DeviceInfo.FirmwareImage.2."
+		image3 = "Device.DeviceInfo.FirmwareImage.3."
+	)
+	tests := []struct {
+		name    string
+		images  []image
+		active  string
+		version string
+		want    string
+		single  bool
+	}{
+		{"single image", []image{
+			{image1, "Active", "1.0"},
+		}, image1, "2.0", image1, true},
+		{"single image without active reference", []image{
+			{image1, "Active", "1.0"},
+		}, "", "2.0", image1, true},
+		{"dual image", []image{
+			{image1, "Active", "1.0"},
+			{image2, "Available", "0.9"},
+		}, image1, "2.0", image2, false},
+		{"second image active", []image{
+			{image1, "Available", "0.9"},
+			{image2, "Active", "1.0"},
+		}, image2, "2.0", image1, false},
+		{"active found by status", []image{
+			{image1, "Active", "1.0"},
+			{image2, "Available", "0.9"},
+		}, "", "2.0", image2, false},
+		{"empty image before a working fallback", []image{
+			{image1, "Active", "1.0"},
+			{image2, "Available", "0.9"},
+			{image3, "NoImage", ""},
+		}, image1, "2.0", image3, false},
+		{"broken image before a working fallback", []image{
+			{image1, "Active", "1.0"},
+			{image2, "ImageCorrupted", "0.8"},
+			{image3, "Available", "0.9"},
+		}, image1, "2.0", image2, false},
+		{"image already holding the version", []image{
+			{image1, "Active", "1.0"},
+			{image2, "NoImage", ""},
+			{image3, "Available", "2.0"},
+		}, image1, "2.0", image3, false},
+	}
+	for _, tt := range tests {
+		got, single := choose(tt.images, tt.active, tt.version)
+		if got.path != tt.want || single != tt.single {
+			t.Errorf("%s: choose() = %s, %v, want %s, %v", tt.name, got.path, single, tt.want, tt.single)
+		}
+	}
+}
+
+func TestRequestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Request
+		ok   bool
+	}{
+		{"no windows", Request{Firmware: "fw"}, true},
+		{"no firmware", Request{}, false},
+		{"windows in order", Request{Firmware: "fw", Windows: []TimeWindow{{Start: 0, End: 60}, {Start: 60, End: 120, Mode: "WhenIdle"}}}, true},
+		{"bad mode", Request{Firmware: "fw", Windows: []TimeWindow{{Start: 0, End: 60, Mode: "Later"}}}, false},
+		{"empty window", Request{Firmware: "fw", Windows: []TimeWindow{{Start: 60, End: 60}}}, false},
+		{"negative start", Request{Firmware: "fw", Windows: []TimeWindow{{Start: -1, End: 60}}}, false},
+		{"overlapping windows", Request{Firmware: "fw", Windows: []TimeWindow{{Start: 0, End: 60}, {Start: 30, End: 90}}}, false},
+	}
+	for _, tt := range tests {
+		req := tt.req
+		err := req.Validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err != nil && !errors.Is(err, usp.ErrInvalidRequest) {
+			t.Errorf("%s: Validate() error = %v, want an invalid request", tt.name, err)
+		}
+		for _, w := range req.Windows {
+			if err == nil && w.Mode == "" {
+				t.Errorf("%s: window mode left empty", tt.name)
+			}
+		}
+	}
+}
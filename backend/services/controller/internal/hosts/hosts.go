@@ -0,0 +1,146 @@
+// Lists the clients behind devices, joining the hosts table with WiFi associations.
+package hosts
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const (
+	hostTable = "Device.Hosts.Host."
+	apTable   = "Device.WiFi.AccessPoint."
+	ssidTable = "Device.WiFi.SSID."
+)
+
+var params = []string{
+	hostTable + "*.PhysAddress",
+	hostTable + "*.IPAddress",
+	hostTable + "*.HostName",
+	hostTable + "*.Active",
+	hostTable + "*.InterfaceType",
+	hostTable + "*.Layer1Interface",
+	hostTable + "*.AddressSource",
+	hostTable + "*.LeaseTimeRemaining",
+	apTable + "*.SSIDReference",
+	apTable + "*.AssociatedDevice.*.MACAddress",
+	apTable + "*.AssociatedDevice.*.Active",
+	apTable + "*.AssociatedDevice.*.SignalStrength",
+	apTable + "*.AssociatedDevice.*.Noise",
+	apTable + "*.AssociatedDevice.*.LastDataDownlinkRate",
+	apTable + "*.AssociatedDevice.*.LastDataUplinkRate",
+	apTable + "*.AssociatedDevice.*.OperatingStandard",
+	ssidTable + "*.SSID",
+	ssidTable + "*.LowerLayers",
+	"Device.WiFi.Radio.*.OperatingFrequencyBand",
+}
+
+// Layer 1 interfaces of hosts by the data model table they are in
+var interfaceTypes = map[string]string{
+	"Device.Ethernet.": "Ethernet",
+	"Device.WiFi.":     "WiFi",
+	"Device.MoCA.":     "MoCA",
+	"Device.USB.":      "USB",
+	"Device.HomePlug.": "HomePlug",
+	"Device.HPNA.":     "HPNA",
+}
+
+/*
+Inventory lists the hosts of the device, only the active ones unless all is
+set. Hosts are joined with the WiFi stations associated to the device by
+MAC address, and stations missing from the hosts table are listed as well.
+*/
+func Inventory(ctx context.Context, d *usp.Dispatcher, sn string, all bool) ([]db.Host, error) {
+	resp, err := usp.Get.Run(ctx, d, sn, usp.GetRequest{Paths: params})
+	if err != nil {
+		return nil, err
+	}
+	values := resp.Params
+
+	stations := map[string]*db.WiFiClient{}
+	active := map[string]bool{}
+	for path, mac := range values {
+		if !strings.HasPrefix(path, apTable) || !strings.Contains(path, ".AssociatedDevice.") || lastSegment(path) != "MACAddress" {
+			continue
+		}
+		station := strings.TrimSuffix(path, "MACAddress")
+		ap := station[:strings.Index(station, ".AssociatedDevice.")+1]
+		ssid := dm.WithDot(values[ap+"SSIDReference"])
+		radio := dm.WithDot(values[ssid+"LowerLayers"])
+
+		mac = strings.ToLower(mac)
+		active[mac] = values[station+"Active"] == "" || dm.ParseBool(values[station+"Active"])
+		stations[mac] = &db.WiFiClient{
+			AccessPoint:       ap,
+			SSID:              values[ssid+"SSID"],
+			FrequencyBand:     values[radio+"OperatingFrequencyBand"],
+			SignalStrength:    dm.Atoi(values[station+"SignalStrength"]),
+			Noise:             dm.Atoi(values[station+"Noise"]),
+			DownlinkRate:      dm.Atoi(values[station+"LastDataDownlinkRate"]),
+			UplinkRate:        dm.Atoi(values[station+"LastDataUplinkRate"]),
+			OperatingStandard: values[station+"OperatingStandard"],
+		}
+	}
+
+	result := []db.Host{}
+	seen := map[string]bool{}
+	for path, mac := range values {
+		if !strings.HasPrefix(path, hostTable) || lastSegment(path) != "PhysAddress" {
+			continue
+		}
+		host := strings.TrimSuffix(path, "PhysAddress")
+		mac = strings.ToLower(mac)
+		h := db.Host{
+			MAC:                mac,
+			IP:                 values[host+"IPAddress"],
+			HostName:           values[host+"HostName"],
+			Active:             dm.ParseBool(values[host+"Active"]),
+			InterfaceType:      values[host+"InterfaceType"],
+			Interface:          dm.WithDot(values[host+"Layer1Interface"]),
+			AddressSource:      values[host+"AddressSource"],
+			LeaseTimeRemaining: dm.Atoi(values[host+"LeaseTimeRemaining"]),
+			WiFi:               stations[mac],
+		}
+		if h.InterfaceType == "" {
+			h.InterfaceType = interfaceType(h)
+		}
+		seen[mac] = true
+		if h.Active || all {
+			result = append(result, h)
+		}
+	}
+	for mac, station := range stations {
+		if seen[mac] || !(active[mac] || all) {
+			continue
+		}
+		result = append(result, db.Host{MAC: mac, Active: active[mac], InterfaceType: "WiFi", WiFi: station})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Active != result[j].Active {
+			return result[i].Active
+		}
+		return result[i].MAC < result[j].MAC
+	})
+	return result, nil
+}
+
+func interfaceType(h db.Host) string {
+	if h.WiFi != nil {
+		return "WiFi"
+	}
+	for table, name := range interfaceTypes {
+		if strings.HasPrefix(h.Interface, table) {
+			return name
+		}
+	}
+	return ""
+}
+
+func lastSegment(path string) string {
+	return path[strings.LastIndex(path, ".")+1:]
+}
@@ -0,0 +1,124 @@
+// Runs device requests in background and keeps track of their results.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+// Func does the actual work of a job, its result is saved as JSON.
+type Func func(ctx context.Context) (interface{}, error)
+
+type Manager struct {
+	Db          db.Database
+	mu          sync.Mutex
+	subscribers map[chan db.Job]struct{}
+}
+
+func NewManager(database db.Database) *Manager {
+	reason, _ := json.Marshal("Interrupted by controller restart")
+	database.InterruptJobs(reason)
+	return &Manager{
+		Db:          database,
+		subscribers: map[chan db.Job]struct{}{},
+	}
+}
+
+// Start saves a new job and runs it in background, the returned job is still pending.
+func (m *Manager) Start(sn, operation string, req interface{}, run Func) (db.Job, error) {
+	encodedReq, err := json.Marshal(req)
+	if err != nil {
+		return db.Job{}, err
+	}
+
+	now := time.Now()
+	job := db.Job{
+		Id:        uuid.NewString(),
+		SN:        sn,
+		Operation: operation,
+		Status:    db.JobPending,
+		Request:   encodedReq,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := m.Db.CreateJob(job); err != nil {
+		return db.Job{}, err
+	}
+	m.publish(job)
+
+	go m.run(job, run)
+
+	return job, nil
+}
+
+func (m *Manager) run(job db.Job, run Func) {
+	job.Status = db.JobRunning
+	job.UpdatedAt = time.Now()
+	m.Db.UpdateJob(job)
+	m.publish(job)
+
+	result, err := run(context.Background())
+	if err != nil {
+		log.Printf("Job %s failed: %s", job.Id, err)
+		job.Status = db.JobFailed
+		job.Error = EncodeError(err)
+	} else {
+		job.Status = db.JobDone
+		job.Result, err = json.Marshal(result)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	job.UpdatedAt = time.Now()
+
+	m.Db.UpdateJob(job)
+	m.publish(job)
+}
+
+// EncodeError keeps the details of errors reported by devices.
+func EncodeError(err error) json.RawMessage {
+	var deviceErr *usp.Error
+	var encoded []byte
+	if errors.As(err, &deviceErr) {
+		encoded, _ = json.Marshal(deviceErr)
+	} else {
+		encoded, _ = json.Marshal(err.Error())
+	}
+	return encoded
+}
+
+// Subscribe returns a channel which receives every job update, until unsubscribe is called.
+func (m *Manager) Subscribe() (<-chan db.Job, func()) {
+	updates := make(chan db.Job, 16)
+
+	m.mu.Lock()
+	m.subscribers[updates] = struct{}{}
+	m.mu.Unlock()
+
+	unsubscribe := func() {
+		m.mu.Lock()
+		delete(m.subscribers, updates)
+		m.mu.Unlock()
+	}
+	return updates, unsubscribe
+}
+
+func (m *Manager) publish(job db.Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for s := range m.subscribers {
+		select {
+		case s <- job:
+		default:
+			// Slow subscribers miss updates, they can still poll the job
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Finds out which devices are really connected, whatever the database says.
+package liveness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/bulk"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/events"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/utils"
+)
+
+const (
+	DefaultInterval = time.Minute
+	DefaultSilence  = 5 * time.Minute
+	// How long a device has to answer a probe
+	probeTimeout = 20 * time.Second
+	// Leaves time to the broker connection to come up before rebuilding
+	startupDelay = 10 * time.Second
+	// How long offline devices are still probed after they went offline, in
+	// case they were only slow to answer
+	recoveryWindow = time.Hour
+)
+
+// Param every device has, asked for to check it's there
+const probePath = "Device.DeviceInfo.UpTime"
+
+/*
+Monitor probes online devices which were quiet for longer than Interval, and
+marks them offline once they were silent for longer than Silence. Devices
+which went offline lately are probed as well, and back online if they answer.
+It covers
+disconnections the controller missed, as while it was down or when the
+broker lost the last will of the device.
+*/
+type Monitor struct {
+	Db       db.Database
+	Usp      *usp.Dispatcher
+	Events   *events.Bus
+	Interval time.Duration
+	Silence  time.Duration
+	// Limits how many devices are probed at once
+	slots chan struct{}
+}
+
+func NewMonitor(database db.Database, d *usp.Dispatcher, bus *events.Bus) *Monitor {
+	return &Monitor{
+		Db:       database,
+		Usp:      d,
+		Events:   bus,
+		Interval: DefaultInterval,
+		Silence:  DefaultSilence,
+		slots:    make(chan struct{}, bulk.DefaultConcurrency),
+	}
+}
+
+// Start rebuilds the status of every device, since the stored one can't be
+// trusted after the controller was down, then keeps checking online devices
+// unless Interval is not positive.
+func (m *Monitor) Start() {
+	go func() {
+		time.Sleep(startupDelay)
+		m.Rebuild()
+		if m.Interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(m.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.check()
+		}
+	}()
+	if m.Interval <= 0 {
+		log.Println("Liveness checks are disabled")
+		return
+	}
+	log.Printf("Liveness monitor started, devices silent for %s are offline", m.Silence)
+}
+
+/*
+Rebuild probes every device and saves whether it answered. Devices get a
+second chance before going offline, as the first probes may go out while
+the broker connection is still coming up.
+*/
+func (m *Monitor) Rebuild() {
+	devices, err := m.Db.RetrieveDevices()
+	if err != nil {
+		return
+	}
+	var mu sync.Mutex
+	var silent []db.Device
+	m.probeAll(devices, func(d db.Device, start time.Time, alive bool) {
+		if alive {
+			m.setOnline(d, "Device answered after controller restart")
+		} else if d.Status != utils.Offline {
+			mu.Lock()
+			silent = append(silent, d)
+			mu.Unlock()
+		}
+	})
+	m.probeAll(silent, func(d db.Device, start time.Time, alive bool) {
+		if alive {
+			m.setOnline(d, "Device answered after controller restart")
+		} else {
+			m.setOffline(d, start, "Device didn't answer after controller restart")
+		}
+	})
+	log.Printf("Status of %d devices rebuilt", len(devices))
+}
+
+// Probes the online devices which were quiet for a while, and the offline
+// ones which may be back
+func (m *Monitor) check() {
+	devices, err := m.Db.RetrieveDevices()
+	if err != nil {
+		return
+	}
+	m.probeAll(m.toProbe(devices, time.Now()), func(d db.Device, start time.Time, alive bool) {
+		if d.Status != utils.Online {
+			if alive {
+				m.setOnline(d, "Device answered while offline")
+			}
+		} else if !alive && start.Sub(d.LastSeen) >= m.Silence {
+			m.setOffline(d, start, fmt.Sprintf("No answer for %s", start.Sub(d.LastSeen).Round(time.Second)))
+		}
+	})
+}
+
+// Devices to probe at now, going offline sets their last seen time
+func (m *Monitor) toProbe(devices []db.Device, now time.Time) []db.Device {
+	var result []db.Device
+	for _, d := range devices {
+		quiet := now.Sub(d.LastSeen)
+		if quiet < m.Interval || d.Status != utils.Online && quiet >= recoveryWindow {
+			continue
+		}
+		result = append(result, d)
+	}
+	return result
+}
+
+func (m *Monitor) probeAll(devices []db.Device, done func(d db.Device, start time.Time, alive bool)) {
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		wg.Add(1)
+		m.slots <- struct{}{}
+		go func(d db.Device) {
+			defer wg.Done()
+			defer func() { <-m.slots }()
+			start := time.Now()
+			done(d, start, m.probe(d.SN))
+		}(d)
+	}
+	wg.Wait()
+}
+
+// Answers of the device update its last seen time on their way in
+func (m *Monitor) probe(sn string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	_, err := usp.Get.Run(ctx, m.Usp, sn, usp.GetRequest{Paths: []string{probePath}})
+	// An USP error is an answer as well
+	var deviceErr *usp.Error
+	return err == nil || errors.As(err, &deviceErr)
+}
+
+func (m *Monitor) setOnline(d db.Device, reason string) {
+	if d.Status == utils.Online {
+		return
+	}
+	if m.Db.UpdateStatus(d.SN, utils.Online, reason) == nil {
+		m.Events.Publish(events.Event{SN: d.SN, Kind: events.DeviceOnline})
+	}
+}
+
+// Unless the device was heard of while being probed
+func (m *Monitor) setOffline(d db.Device, start time.Time, reason string) {
+	current, err := m.Db.RetrieveDevice(d.SN)
+	if err != nil || current.Status == utils.Offline || current.LastSeen.After(start) {
+		return
+	}
+	if m.Db.UpdateStatus(d.SN, utils.Offline, reason) == nil {
+		m.Events.Publish(events.Event{SN: d.SN, Kind: events.DeviceOffline})
+	}
+}
@@ -0,0 +1,34 @@
+package liveness
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/utils"
+)
+
+func TestToProbe(t *testing.T) {
+	now := time.Now()
+	m := &Monitor{Interval: time.Minute, Silence: 5 * time.Minute}
+	devices := []db.Device{
+		{SN: "online-active", Status: utils.Online, LastSeen: now.Add(-10 * time.Second)},
+		{SN: "online-quiet", Status: utils.Online, LastSeen: now.Add(-2 * time.Minute)},
+		{SN: "online-never-seen", Status: utils.Online},
+		{SN: "offline-just-now", Status: utils.Offline, LastSeen: now.Add(-10 * time.Second)},
+		{SN: "offline-lately", Status: utils.Offline, LastSeen: now.Add(-10 * time.Minute)},
+		{SN: "associating-lately", Status: utils.Associating, LastSeen: now.Add(-10 * time.Minute)},
+		{SN: "offline-long-ago", Status: utils.Offline, LastSeen: now.Add(-2 * time.Hour)},
+		{SN: "offline-never-seen", Status: utils.Offline},
+	}
+
+	var got []string
+	for _, d := range m.toProbe(devices, now) {
+		got = append(got, d.SN)
+	}
+	want := []string{"online-quiet", "online-never-seen", "offline-lately", "associating-lately"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("toProbe() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,146 @@
+// Collects numeric params of devices over time, for dashboard charts.
+package metrics
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/bulk"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/optical"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/utils"
+)
+
+const (
+	DefaultInterval        = 5 * time.Minute
+	DefaultRawRetention    = 48 * time.Hour
+	DefaultHourlyRetention = 90 * 24 * time.Hour
+)
+
+// Params collected unless told otherwise, devices lacking some of them
+// just answer with errors for those
+var DefaultPaths = []string{
+	"Device.IP.Interface.*.Stats.",
+	"Device.WiFi.Radio.*.Stats.",
+	"Device.Optical.Interface.*.",
+	"Device.DeviceInfo.ProcessStatus.CPUUsage",
+	"Device.DeviceInfo.MemoryStatus.",
+}
+
+/*
+Collector gets the params of every online device each Interval. Samples are
+kept for RawRetention, and averaged into hourly buckets kept for
+HourlyRetention. A zero Interval turns collection off.
+*/
+type Collector struct {
+	Db              db.Database
+	Usp             *usp.Dispatcher
+	Interval        time.Duration
+	RawRetention    time.Duration
+	HourlyRetention time.Duration
+	Paths           []string
+	// Called with the values of each collection, once they are saved
+	OnCollect func(sn string, at time.Time, values map[string]float64)
+	// Limits how many devices are polled at once
+	slots chan struct{}
+}
+
+func NewCollector(database db.Database, d *usp.Dispatcher) *Collector {
+	return &Collector{
+		Db:              database,
+		Usp:             d,
+		Interval:        DefaultInterval,
+		RawRetention:    DefaultRawRetention,
+		HourlyRetention: DefaultHourlyRetention,
+		Paths:           DefaultPaths,
+		slots:           make(chan struct{}, bulk.DefaultConcurrency),
+	}
+}
+
+func (c *Collector) Start() {
+	// Samples of earlier runs expire even with collection off
+	c.Db.ExpireMetrics(c.RawRetention, c.HourlyRetention)
+	if c.Interval <= 0 {
+		log.Println("Metrics collection is disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.collectFleet()
+		}
+	}()
+	log.Printf("Metrics collector started, polling devices every %s", c.Interval)
+}
+
+// Resolution fitting the period, raw samples as long as they are still kept
+func (c *Collector) Resolution(from time.Time) string {
+	if from.Before(time.Now().Add(-c.RawRetention)) {
+		return db.MetricsHourly
+	}
+	return db.MetricsRaw
+}
+
+// Collect gets the params of the device and saves the numeric ones. Optical
+// levels are saved in dBm, whatever unit the device reports them in.
+func (c *Collector) Collect(ctx context.Context, sn string) error {
+	resp, err := usp.Get.Run(ctx, c.Usp, sn, usp.GetRequest{Paths: c.Paths})
+	if err != nil {
+		return err
+	}
+
+	values := Values(resp.Params)
+	now := time.Now()
+	if err := c.Db.SaveMetrics(sn, now, values); err != nil {
+		return err
+	}
+	if c.OnCollect != nil {
+		c.OnCollect(sn, now, values)
+	}
+	return nil
+}
+
+// Values keeps the numeric params, with optical levels in dBm
+func Values(params map[string]string) map[string]float64 {
+	values := map[string]float64{}
+	for path, value := range params {
+		if strings.HasPrefix(path, optical.Table) {
+			if v, ok := optical.Normalize(path, value); ok {
+				values[path] = v
+				continue
+			}
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			values[path] = v
+		}
+	}
+	return values
+}
+
+func (c *Collector) collectFleet() {
+	online := uint8(utils.Online)
+	devices, err := c.Db.FindDevices(db.DeviceFilter{Status: &online})
+	if err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		wg.Add(1)
+		c.slots <- struct{}{}
+		go func(sn string) {
+			defer wg.Done()
+			defer func() { <-c.slots }()
+			if err := c.Collect(context.Background(), sn); err != nil {
+				log.Printf("Couldn't collect metrics of %s: %s", sn, err)
+			}
+		}(d.SN)
+	}
+	wg.Wait()
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/events"
 	usp_msg "github.com/leandrofars/oktopus/internal/usp_message"
 	"github.com/leandrofars/oktopus/internal/usp_record"
 	"github.com/leandrofars/oktopus/internal/utils"
@@ -29,8 +30,9 @@ type Mqtt struct {
 	DevicesTopic string
 	TLS          bool
 	DB           db.Database
-	MsgQueue     map[string](chan usp_msg.Msg)
+	MsgQueue     map[string](chan *usp_msg.Msg)
 	QMutex       *sync.Mutex
+	Events       *events.Bus
 }
 
 const (
@@ -146,9 +148,9 @@ func (m *Mqtt) buildClientConfig(status, controller, apiMsg chan *paho.Publish)
 		Router: singleHandler,
 		OnServerDisconnect: func(d *paho.Disconnect) {
 			if d.Properties != nil {
-				log.Printf("Requested disconnect: %s\n", clientConfig.ClientID, d.Properties.ReasonString)
+				log.Printf("Requested disconnect: %s, reason: %s\n", clientConfig.ClientID, d.Properties.ReasonString)
 			} else {
-				log.Printf("Requested disconnect; reason code: %d\n", clientConfig.ClientID, d.ReasonCode)
+				log.Printf("Requested disconnect: %s, reason code: %d\n", clientConfig.ClientID, d.ReasonCode)
 			}
 		},
 		OnClientError: func(err error) {
@@ -197,7 +199,9 @@ func (m *Mqtt) messageHandler(status, controller, apiMsg chan *paho.Publish) {
 			m.handleNewDevicesResponse(c.Payload, sn[3])
 		case api := <-apiMsg:
 			log.Println("Handle api request")
-			m.handleApiRequest(api.Payload)
+			paths := strings.Split(api.Topic, "/")
+			m.handleApiRequest(api.Payload, paths[len(paths)-1])
+			m.DB.UpdateLastSeen(paths[len(paths)-1])
 		}
 	}
 }
@@ -208,25 +212,41 @@ func (m *Mqtt) messageHandler(status, controller, apiMsg chan *paho.Publish) {
 //	log.Println("Message contains the retain flag, deleting it, as it's already received")
 //}
 
-func (m *Mqtt) handleApiRequest(api []byte) {
+func (m *Mqtt) handleApiRequest(api []byte, sn string) {
 	var record usp_record.Record
 	err := proto.Unmarshal(api, &record)
 	if err != nil {
 		log.Println(err)
+		return
 	}
 
 	var msg usp_msg.Msg
-	err = proto.Unmarshal(record.GetNoSessionContext().Payload, &msg)
+	err = proto.Unmarshal(record.GetNoSessionContext().GetPayload(), &msg)
 	if err != nil {
 		log.Println(err)
+		return
 	}
 
-	if _, ok := m.MsgQueue[msg.Header.MsgId]; ok {
-		//m.QMutex.Lock()
-		m.MsgQueue[msg.Header.MsgId] <- msg
-		//m.QMutex.Unlock()
-	} else {
-		log.Printf("Message answer to request %s arrived too late", msg.Header.MsgId)
+	// Notifications answer no request, agents may send them on this topic too
+	if notify := msg.GetBody().GetRequest().GetNotify(); notify != nil {
+		m.handleNotify(msg.GetHeader().GetMsgId(), notify, sn)
+		return
+	}
+
+	m.QMutex.Lock()
+	answer, ok := m.MsgQueue[msg.Header.GetMsgId()]
+	m.QMutex.Unlock()
+
+	if !ok {
+		log.Printf("Message answer to request %s arrived too late", msg.Header.GetMsgId())
+		return
+	}
+
+	// Only the first answer matters, a duplicate must not block the handler
+	select {
+	case answer <- &msg:
+	default:
+		log.Printf("Duplicated answer to request %s", msg.Header.GetMsgId())
 	}
 }
 
@@ -277,6 +297,12 @@ func (m *Mqtt) handleNewDevicesResponse(p []byte, sn string) {
 		log.Fatal(err)
 	}
 
+	// Agents send their notifications to the controller topic as well
+	if notify := message.GetBody().GetRequest().GetNotify(); notify != nil {
+		m.handleNotify(message.GetHeader().GetMsgId(), notify, sn)
+		return
+	}
+
 	var device db.Device
 	msg := message.Body.MsgBody.(*usp_msg.Body_Response).Response.GetGetResp()
 
@@ -290,14 +316,39 @@ func (m *Mqtt) handleNewDevicesResponse(p []byte, sn string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	m.DB.UpdateStatus(sn, utils.Online, "Device connected")
+	m.Events.Publish(events.Event{SN: sn, Kind: events.DeviceOnline})
+}
+
+func (m *Mqtt) handleNotify(msgId string, notify *usp_msg.Notify, sn string) {
+	log.Printf("Notification of subscription %s from %s", notify.GetSubscriptionId(), sn)
+	m.DB.UpdateLastSeen(sn)
+	m.Events.Publish(events.Event{SN: sn, Kind: events.Notification, Notify: notify})
+
+	if !notify.GetSendResp() {
+		return
+	}
+	payload, err := proto.Marshal(utils.NewNotifyRespMsg(msgId, notify.GetSubscriptionId()))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	record := utils.NewUspRecord(payload, sn)
+	tr369Message, err := proto.Marshal(&record)
+	if err != nil {
+		log.Println("Failed to encode tr369 record:", err)
+		return
+	}
+	m.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/controller/"+sn, false)
 }
 
 func (m *Mqtt) handleDevicesDisconnect(p string) {
 	// Update status of device at database
-	err := m.DB.UpdateStatus(p, utils.Offline)
+	err := m.DB.UpdateStatus(p, utils.Offline, "Device disconnected")
 	if err != nil {
 		log.Fatal(err)
 	}
+	m.Events.Publish(events.Event{SN: p, Kind: events.DeviceOffline})
 }
 
 /*
@@ -0,0 +1,246 @@
+// Reads the optical interfaces of PON devices, with their levels in dBm.
+package optical
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const Table = "Device.Optical.Interface."
+
+// What a param measures, told by its name
+const (
+	kindRxPower     = "rx"
+	kindTxPower     = "tx"
+	kindBias        = "bias"
+	kindTemperature = "temperature"
+	kindVoltage     = "voltage"
+)
+
+// Standard params, levels are in thousandths of dBm
+var standard = map[string]string{
+	"OpticalSignalLevel":          kindRxPower,
+	"LowerOpticalThreshold":       kindRxPower,
+	"UpperOpticalThreshold":       kindRxPower,
+	"TransmitOpticalLevel":        kindTxPower,
+	"LowerTransmitPowerThreshold": kindTxPower,
+	"UpperTransmitPowerThreshold": kindTxPower,
+}
+
+// Pieces of vendor extension names, as X_VENDOR_RxPower, lowercased
+var vendorKinds = []struct {
+	kind  string
+	names []string
+}{
+	{kindRxPower, []string{"rxpower", "rxopticalpower", "receivepower", "receivedpower", "rxlevel"}},
+	{kindTxPower, []string{"txpower", "txopticalpower", "transmitpower", "txlevel"}},
+	{kindBias, []string{"bias"}},
+	{kindTemperature, []string{"temperature", "temp"}},
+	{kindVoltage, []string{"voltage", "vcc"}},
+}
+
+// Largest magnitude a sane value of each kind has in its unit, values over it
+// were reported in tenths, hundredths or thousandths
+var limits = map[string]float64{
+	kindRxPower:     60,
+	kindTxPower:     60,
+	kindBias:        200,
+	kindTemperature: 150,
+	kindVoltage:     10,
+}
+
+// Levels are in dBm, bias current in mA, temperature in °C and voltage in V.
+// Vendor holds the vendor extensions as reported.
+type Interface struct {
+	Path             string            `json:"path"`
+	Name             string            `json:"name"`
+	Enable           bool              `json:"enable"`
+	Status           string            `json:"status"`
+	LastChange       int               `json:"lastChange"`
+	RxPower          *float64          `json:"rxPower,omitempty"`
+	TxPower          *float64          `json:"txPower,omitempty"`
+	LowerRxThreshold *float64          `json:"lowerRxThreshold,omitempty"`
+	UpperRxThreshold *float64          `json:"upperRxThreshold,omitempty"`
+	LowerTxThreshold *float64          `json:"lowerTxThreshold,omitempty"`
+	UpperTxThreshold *float64          `json:"upperTxThreshold,omitempty"`
+	BiasCurrent      *float64          `json:"biasCurrent,omitempty"`
+	Temperature      *float64          `json:"temperature,omitempty"`
+	Voltage          *float64          `json:"voltage,omitempty"`
+	OutOfThresholds  bool              `json:"outOfThresholds"`
+	Vendor           map[string]string `json:"vendor,omitempty"`
+}
+
+// Get reads every optical interface of the device.
+func Get(ctx context.Context, d *usp.Dispatcher, sn string) ([]Interface, error) {
+	resp, err := usp.Get.Run(ctx, d, sn, usp.GetRequest{Paths: []string{Table}})
+	if err != nil {
+		return nil, err
+	}
+
+	byInstance := map[int]*Interface{}
+	for path, value := range resp.Params {
+		instance, n, param, ok := dm.Split(path, Table)
+		if !ok {
+			continue
+		}
+		x, ok := byInstance[n]
+		if !ok {
+			x = &Interface{Path: instance, Vendor: map[string]string{}}
+			byInstance[n] = x
+		}
+		x.set(param, value)
+	}
+
+	numbers := make([]int, 0, len(byInstance))
+	for n := range byInstance {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	result := []Interface{}
+	for _, n := range numbers {
+		x := byInstance[n]
+		x.OutOfThresholds = outside(x.RxPower, x.LowerRxThreshold, x.UpperRxThreshold) ||
+			outside(x.TxPower, x.LowerTxThreshold, x.UpperTxThreshold)
+		result = append(result, *x)
+	}
+	return result, nil
+}
+
+func (x *Interface) set(param, value string) {
+	switch param {
+	case "Name":
+		x.Name = value
+		return
+	case "Enable":
+		x.Enable = dm.ParseBool(value)
+		return
+	case "Status":
+		x.Status = value
+		return
+	case "LastChange":
+		x.LastChange = dm.Atoi(value)
+		return
+	}
+
+	vendor := strings.HasPrefix(param, "X_")
+	if vendor {
+		x.Vendor[param] = value
+	}
+	v, ok := Normalize(param, value)
+	if !ok {
+		return
+	}
+	target := map[string]**float64{
+		"OpticalSignalLevel":          &x.RxPower,
+		"TransmitOpticalLevel":        &x.TxPower,
+		"LowerOpticalThreshold":       &x.LowerRxThreshold,
+		"UpperOpticalThreshold":       &x.UpperRxThreshold,
+		"LowerTransmitPowerThreshold": &x.LowerTxThreshold,
+		"UpperTransmitPowerThreshold": &x.UpperTxThreshold,
+	}[param]
+	if vendor {
+		// Vendor values fill in what the standard params don't tell
+		target = map[string]**float64{
+			kindRxPower:     &x.RxPower,
+			kindTxPower:     &x.TxPower,
+			kindBias:        &x.BiasCurrent,
+			kindTemperature: &x.Temperature,
+			kindVoltage:     &x.Voltage,
+		}[kind(param)]
+		if target != nil && *target != nil {
+			return
+		}
+	}
+	if target != nil {
+		*target = &v
+	}
+}
+
+/*
+Normalize converts an optical param, standard or vendor extension, to the
+unit of what it measures, telling whether it's one it knows. Standard levels
+are thousandths of dBm. Vendor power given in mW or µW, as told by its name
+or value, is converted to dBm. Vendor values without a unit which are too
+large for theirs are taken as scaled by powers of ten.
+*/
+func Normalize(param, value string) (float64, bool) {
+	param = param[strings.LastIndex(param, ".")+1:]
+	k := kind(param)
+	if k == "" {
+		return 0, false
+	}
+
+	value = strings.TrimSpace(value)
+	number := strings.TrimSpace(strings.TrimRightFunc(value, func(r rune) bool {
+		return !(r >= '0' && r <= '9') && r != '.'
+	}))
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, false
+	}
+	if _, ok := standard[param]; ok {
+		return round(v / 1000), true
+	}
+
+	lower := strings.ToLower(param + " " + value)
+	if k == kindRxPower || k == kindTxPower {
+		switch {
+		case strings.Contains(lower, "dbm"):
+			return round(v), true
+		case strings.Contains(lower, "uw") || strings.Contains(lower, "µw"):
+			return milliwatts(v / 1000)
+		case strings.Contains(lower, "mw"):
+			return milliwatts(v)
+		}
+	}
+	if number != value {
+		// The value tells its unit
+		return round(v), true
+	}
+	for math.Abs(v) > limits[k] {
+		v /= 10
+	}
+	return round(v), true
+}
+
+func kind(param string) string {
+	if k, ok := standard[param]; ok {
+		return k
+	}
+	if !strings.HasPrefix(param, "X_") {
+		return ""
+	}
+	lower := strings.ToLower(param)
+	for _, x := range vendorKinds {
+		for _, name := range x.names {
+			if strings.Contains(lower, name) {
+				return x.kind
+			}
+		}
+	}
+	return ""
+}
+
+func milliwatts(mw float64) (float64, bool) {
+	if mw <= 0 {
+		return 0, false
+	}
+	return round(10 * math.Log10(mw)), true
+}
+
+func outside(v, lower, upper *float64) bool {
+	if v == nil {
+		return false
+	}
+	return (lower != nil && *v < *lower) || (upper != nil && *v > *upper)
+}
+
+func round(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
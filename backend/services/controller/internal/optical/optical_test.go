@@ -0,0 +1,39 @@
+package optical
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		param string
+		value string
+		want  float64
+		ok    bool
+	}{
+		{"Device.Optical.Interface.1.OpticalSignalLevel", "-21500", -21.5, true},
+		{"Device.Optical.Interface.1.OpticalSignalLevel", "-5", -0.005, true},
+		{"Device.Optical.Interface.1.TransmitOpticalLevel", "2300", 2.3, true},
+		{"Device.Optical.Interface.1.LowerOpticalThreshold", "-28000", -28, true},
+		{"Device.Optical.Interface.1.UpperTransmitPowerThreshold", "5000", 5, true},
+		{"Device.Optical.Interface.1.X_VENDOR_RxPower", "-215", -21.5, true},
+		{"Device.Optical.Interface.1.X_VENDOR_RxPower", "-21.5", -21.5, true},
+		{"Device.Optical.Interface.1.X_VENDOR_RxPower", "-18 dBm", -18, true},
+		{"Device.Optical.Interface.1.X_VENDOR_RxPower_dBm", "-80", -80, true},
+		{"Device.Optical.Interface.1.X_VENDOR_TxPower", "1 mW", 0, true},
+		{"Device.Optical.Interface.1.X_VENDOR_TxPowerMW", "2", 3.01, true},
+		{"Device.Optical.Interface.1.X_VENDOR_RxPower", "10 uW", -20, true},
+		{"Device.Optical.Interface.1.X_VENDOR_RxPower", "0 mW", 0, false},
+		{"Device.Optical.Interface.1.X_VENDOR_Temperature", "4520", 45.2, true},
+		{"Device.Optical.Interface.1.X_VENDOR_Temperature", "45.2 C", 45.2, true},
+		{"Device.Optical.Interface.1.X_VENDOR_Voltage", "3300", 3.3, true},
+		{"Device.Optical.Interface.1.X_VENDOR_BiasCurrent", "12", 12, true},
+		{"Device.Optical.Interface.1.Status", "Up", 0, false},
+		{"Device.Optical.Interface.1.X_VENDOR_Serial", "1234", 0, false},
+		{"Device.Optical.Interface.1.OpticalSignalLevel", "", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := Normalize(tt.param, tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Normalize(%q, %q) = %v, %v, want %v, %v", tt.param, tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Keeps devices in line with the configuration profiles assigned to them.
+package profile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/bulk"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/events"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/utils"
+)
+
+// How often every device is checked for drift
+const driftInterval = time.Hour
+
+type Reconciler struct {
+	Db     db.Database
+	Usp    *usp.Dispatcher
+	Events *events.Bus
+	mu     sync.Mutex
+	busy   map[string]bool
+	// Limits how many devices are reconciled at once
+	slots chan struct{}
+}
+
+func NewReconciler(database db.Database, d *usp.Dispatcher, bus *events.Bus) *Reconciler {
+	return &Reconciler{
+		Db:     database,
+		Usp:    d,
+		Events: bus,
+		busy:   map[string]bool{},
+		slots:  make(chan struct{}, bulk.DefaultConcurrency),
+	}
+}
+
+// Validate checks the profile paths and sets the default object keys.
+func Validate(p *db.Profile) error {
+	if p.Name == "" {
+		return fmt.Errorf("%w: profile name is required", usp.ErrInvalidRequest)
+	}
+	if len(p.Params) == 0 && len(p.Objects) == 0 {
+		return fmt.Errorf("%w: profile has no params nor objects", usp.ErrInvalidRequest)
+	}
+	for _, x := range p.Params {
+		if !strings.HasPrefix(x.Path, "Device.") || strings.HasSuffix(x.Path, ".") {
+			return fmt.Errorf("%w: invalid param path %q", usp.ErrInvalidRequest, x.Path)
+		}
+	}
+	for i := range p.Objects {
+		o := &p.Objects[i]
+		if !strings.HasPrefix(o.Path, "Device.") || !strings.HasSuffix(o.Path, ".") {
+			return fmt.Errorf("%w: invalid object path %q, it must end with a dot", usp.ErrInvalidRequest, o.Path)
+		}
+		if o.Key == "" {
+			o.Key = "Alias"
+		}
+		if _, ok := keyValue(*o); !ok {
+			return fmt.Errorf("%w: object %s has no value for its key %s", usp.ErrInvalidRequest, o.Path, o.Key)
+		}
+	}
+	return nil
+}
+
+// Start checks devices when they connect and from time to time, applying
+// the profiles which are set to.
+func (r *Reconciler) Start() {
+	deviceEvents, _ := r.Events.Subscribe("")
+	go func() {
+		ticker := time.NewTicker(driftInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case e := <-deviceEvents:
+				if e.Kind == events.DeviceOnline {
+					go r.ReconcileDevice(context.Background(), e.SN, false)
+				}
+			case <-ticker.C:
+				go r.reconcileFleet()
+			}
+		}
+	}()
+	log.Println("Profiles reconciler started")
+}
+
+// Check compares the device configuration with the profile and saves the outcome.
+func (r *Reconciler) Check(ctx context.Context, p db.Profile, sn string) (db.ProfileStatus, error) {
+	status := db.ProfileStatus{Profile: p.Id, SN: sn, CheckedAt: time.Now()}
+	if previous, err := r.Db.RetrieveProfileStatus(p.Id, sn); err == nil {
+		status.AppliedAt = previous.AppliedAt
+	}
+
+	diff, err := r.compare(ctx, p, sn)
+	if err != nil {
+		status.Error = err.Error()
+		r.Db.SaveProfileStatus(status)
+		return status, err
+	}
+	status.Drift = diff.drift
+	status.Compliant = len(diff.drift) == 0
+	return status, r.Db.SaveProfileStatus(status)
+}
+
+/*
+Apply sets the params which drifted and adds the missing objects, then checks
+the device again. Failures of single params don't stop the other ones, they
+are reported in the status error.
+*/
+func (r *Reconciler) Apply(ctx context.Context, p db.Profile, sn string) (db.ProfileStatus, error) {
+	diff, err := r.compare(ctx, p, sn)
+	if err != nil {
+		status := db.ProfileStatus{Profile: p.Id, SN: sn, CheckedAt: time.Now(), Error: err.Error()}
+		r.Db.SaveProfileStatus(status)
+		return status, err
+	}
+
+	var failures []string
+	if len(diff.drift) > 0 && len(diff.set) > 0 {
+		resp, err := usp.Set.Run(ctx, r.Usp, sn, usp.SetRequest{AllowPartial: true, Params: diff.set})
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+		for _, x := range resp.Errors {
+			failures = append(failures, x.Path+": "+x.Message)
+		}
+	}
+	if len(diff.add) > 0 {
+		resp, err := usp.Add.Run(ctx, r.Usp, sn, usp.AddRequest{AllowPartial: true, Objects: diff.add})
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+		for _, x := range resp.Errors {
+			failures = append(failures, x.Path+": "+x.Message)
+		}
+		for _, created := range resp.Created {
+			for _, x := range created.Errors {
+				failures = append(failures, x.Path+": "+x.Message)
+			}
+		}
+	}
+
+	now := time.Now()
+	status := db.ProfileStatus{Profile: p.Id, SN: sn, AppliedAt: &now}
+	diff, err = r.compare(ctx, p, sn)
+	status.CheckedAt = time.Now()
+	if err != nil {
+		failures = append(failures, err.Error())
+	} else {
+		status.Drift = diff.drift
+		status.Compliant = len(diff.drift) == 0
+	}
+	status.Error = strings.Join(failures, "; ")
+	return status, r.Db.SaveProfileStatus(status)
+}
+
+// Reconcile checks the profile on the device and applies it if it drifted,
+// either because the profile is set to or because apply is.
+func (r *Reconciler) Reconcile(ctx context.Context, p db.Profile, sn string, apply bool) (db.ProfileStatus, error) {
+	key := p.Id + ":" + sn
+	r.mu.Lock()
+	if r.busy[key] {
+		r.mu.Unlock()
+		return r.Db.RetrieveProfileStatus(p.Id, sn)
+	}
+	r.busy[key] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.busy, key)
+		r.mu.Unlock()
+	}()
+
+	status, err := r.Check(ctx, p, sn)
+	if err != nil || status.Compliant || !(apply || p.AutoApply) {
+		return status, err
+	}
+	log.Printf("Device %s drifted from profile %s, applying it", sn, p.Name)
+	return r.Apply(ctx, p, sn)
+}
+
+// ReconcileProfile reconciles the profile on every online device it's assigned to.
+func (r *Reconciler) ReconcileProfile(p db.Profile, apply bool) {
+	devices, err := r.devices(p)
+	if err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		if d.Status != utils.Online {
+			continue
+		}
+		wg.Add(1)
+		r.slots <- struct{}{}
+		go func(sn string) {
+			defer wg.Done()
+			defer func() { <-r.slots }()
+			r.Reconcile(context.Background(), p, sn, apply)
+		}(d.SN)
+	}
+	wg.Wait()
+}
+
+func (r *Reconciler) reconcileFleet() {
+	profiles, err := r.Db.RetrieveProfiles()
+	if err != nil {
+		return
+	}
+	for _, p := range profiles {
+		r.ReconcileProfile(p, false)
+	}
+}
+
+// ReconcileDevice reconciles every profile assigned to the device, applying
+// all of them if apply is set.
+func (r *Reconciler) ReconcileDevice(ctx context.Context, sn string, apply bool) ([]db.ProfileStatus, error) {
+	device, err := r.Db.RetrieveDevice(sn)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := r.Db.RetrieveProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	r.slots <- struct{}{}
+	defer func() { <-r.slots }()
+	statuses := []db.ProfileStatus{}
+	for _, p := range profiles {
+		if !p.Assigned(device) {
+			continue
+		}
+		status, err := r.Reconcile(ctx, p, sn, apply)
+		if err != nil && ctx.Err() != nil {
+			return statuses, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Devices the profile is assigned to
+func (r *Reconciler) devices(p db.Profile) ([]db.Device, error) {
+	var devices []db.Device
+	seen := map[string]bool{}
+	for _, sn := range p.Targets {
+		d, err := r.Db.RetrieveDevice(sn)
+		if err == nil && !seen[sn] {
+			seen[sn] = true
+			devices = append(devices, d)
+		}
+	}
+	if p.Filter == nil {
+		return devices, nil
+	}
+
+	found, err := r.Db.FindDevices(*p.Filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range found {
+		if !seen[d.SN] {
+			seen[d.SN] = true
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+// What differs between a device and a profile, along with what it takes to fix it
+type diff struct {
+	drift []db.Drift
+	set   map[string]string
+	add   []usp.AddObject
+}
+
+func (r *Reconciler) compare(ctx context.Context, p db.Profile, sn string) (diff, error) {
+	d := diff{set: map[string]string{}}
+
+	var paths []string
+	for _, x := range p.Params {
+		if !x.WriteOnly {
+			paths = append(paths, x.Path)
+		}
+	}
+	for _, o := range p.Objects {
+		paths = append(paths, o.Path+"*.")
+	}
+	actual := map[string]string{}
+	if len(paths) > 0 {
+		resp, err := usp.Get.Run(ctx, r.Usp, sn, usp.GetRequest{Paths: paths})
+		if err != nil {
+			return d, err
+		}
+		actual = resp.Params
+	}
+
+	for _, x := range p.Params {
+		d.compareParam(x, x.Path, actual)
+	}
+
+	for _, o := range p.Objects {
+		key, _ := keyValue(o)
+		instance := findInstance(o, key, actual)
+		if instance == "" {
+			d.drift = append(d.drift, db.Drift{
+				Path:     o.Path + "[" + o.Key + "==" + key + "].",
+				Expected: "present",
+				Missing:  true,
+			})
+			params := map[string]string{}
+			for _, x := range o.Params {
+				params[x.Path] = x.Value
+			}
+			d.add = append(d.add, usp.AddObject{Path: o.Path, Params: params})
+			continue
+		}
+		for _, x := range o.Params {
+			d.compareParam(x, instance+x.Path, actual)
+		}
+	}
+	return d, nil
+}
+
+// Write-only params are set along with the other ones, but never drift
+func (d *diff) compareParam(x db.ProfileParam, path string, actual map[string]string) {
+	if x.WriteOnly {
+		d.set[path] = x.Value
+		return
+	}
+	value, ok := actual[path]
+	if ok && equal(x.Value, value) {
+		return
+	}
+	d.drift = append(d.drift, db.Drift{Path: path, Expected: x.Value, Actual: value, Missing: !ok})
+	d.set[path] = x.Value
+}
+
+// Returns the path of the instance of the object with the key value, if any
+func findInstance(o db.ProfileObject, key string, actual map[string]string) string {
+	for path, value := range actual {
+		rest := strings.TrimPrefix(path, o.Path)
+		if rest == path || value != key {
+			continue
+		}
+		i := strings.Index(rest, ".")
+		if i > 0 && rest[i+1:] == o.Key {
+			return o.Path + rest[:i+1]
+		}
+	}
+	return ""
+}
+
+func keyValue(o db.ProfileObject) (string, bool) {
+	for _, x := range o.Params {
+		if x.Path == o.Key {
+			return x.Value, true
+		}
+	}
+	return "", false
+}
+
+// Devices may report booleans as 1 and 0
+func equal(expected, actual string) bool {
+	if expected == actual {
+		return true
+	}
+	e, err := strconv.ParseBool(expected)
+	if err != nil {
+		return false
+	}
+	a, err := strconv.ParseBool(actual)
+	return err == nil && e == a
+}
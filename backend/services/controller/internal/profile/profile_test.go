@@ -0,0 +1,93 @@
+package profile
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+func TestFindInstance(t *testing.T) {
+	actual := map[string]string{
+		"Device.NAT.PortMapping.1.Alias":        "web",
+		"Device.NAT.PortMapping.1.ExternalPort": "8080",
+		"Device.NAT.PortMapping.3.Alias":        "ssh",
+		"Device.NAT.PortMapping.3.Description":  "web",
+		"Device.NAT.PortMappingNumberOfEntries": "2",
+		"Device.Firewall.Chain.1.Alias":         "ssh",
+	}
+	tests := []struct {
+		name string
+		o    db.ProfileObject
+		key  string
+		want string
+	}{
+		{"by alias", db.ProfileObject{Path: "Device.NAT.PortMapping.", Key: "Alias"}, "ssh", "Device.NAT.PortMapping.3."},
+		{"other key param", db.ProfileObject{Path: "Device.NAT.PortMapping.", Key: "Description"}, "web", "Device.NAT.PortMapping.3."},
+		{"missing", db.ProfileObject{Path: "Device.NAT.PortMapping.", Key: "Alias"}, "ftp", ""},
+		{"only direct params", db.ProfileObject{Path: "Device.NAT.", Key: "Alias"}, "web", ""},
+		{"other object", db.ProfileObject{Path: "Device.NAT.PortMapping.", Key: "Alias"}, "8080", ""},
+	}
+	for _, tt := range tests {
+		if got := findInstance(tt.o, tt.key, actual); got != tt.want {
+			t.Errorf("%s: findInstance() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		expected, actual string
+		want             bool
+	}{
+		{"8080", "8080", true},
+		{"8080", "80", false},
+		{"", "", true},
+		{"true", "1", true},
+		{"1", "true", true},
+		{"false", "0", true},
+		{"true", "0", false},
+		{"true", "enabled", false},
+		{"yes", "1", false},
+	}
+	for _, tt := range tests {
+		if got := equal(tt.expected, tt.actual); got != tt.want {
+			t.Errorf("equal(%q, %q) = %v, want %v", tt.expected, tt.actual, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	object := db.ProfileObject{Path: "Device.NAT.PortMapping.", Params: []db.ProfileParam{{Path: "Alias", Value: "web"}}}
+	tests := []struct {
+		name string
+		p    db.Profile
+		ok   bool
+	}{
+		{"params", db.Profile{Name: "ntp", Params: []db.ProfileParam{{Path: "Device.Time.NTPServer1", Value: "pool.ntp.org"}}}, true},
+		{"objects", db.Profile{Name: "web", Objects: []db.ProfileObject{object}}, true},
+		{"no name", db.Profile{Params: []db.ProfileParam{{Path: "Device.Time.Enable", Value: "true"}}}, false},
+		{"empty", db.Profile{Name: "empty"}, false},
+		{"object as param", db.Profile{Name: "bad", Params: []db.ProfileParam{{Path: "Device.Time."}}}, false},
+		{"param out of the data model", db.Profile{Name: "bad", Params: []db.ProfileParam{{Path: "Time.Enable"}}}, false},
+		{"object without dot", db.Profile{Name: "bad", Objects: []db.ProfileObject{{Path: "Device.NAT.PortMapping", Params: object.Params}}}, false},
+		{"object without key value", db.Profile{Name: "bad", Objects: []db.ProfileObject{{Path: "Device.NAT.PortMapping.", Key: "Description", Params: object.Params}}}, false},
+	}
+	for _, tt := range tests {
+		p := tt.p
+		err := Validate(&p)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err != nil && !errors.Is(err, usp.ErrInvalidRequest) {
+			t.Errorf("%s: Validate() error = %v, want an invalid request", tt.name, err)
+		}
+		for _, o := range p.Objects {
+			if err == nil && o.Key == "" {
+				t.Errorf("%s: object key left empty", tt.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Reboots and factory resets devices, following them until they come back.
+package reboot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/backup"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/events"
+	"github.com/leandrofars/oktopus/internal/profile"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+const (
+	ActionReboot       = "reboot"
+	ActionFactoryReset = "factory-reset"
+
+	DefaultDeadline = 10 * time.Minute
+	// Devices may go down before answering the command
+	commandTimeout = 30 * time.Second
+)
+
+var commands = map[string]string{
+	ActionReboot:       "Device.Reboot()",
+	ActionFactoryReset: "Device.FactoryReset()",
+}
+
+/*
+Request tells how long the device has to come back, in seconds. After a
+factory reset, Reprovision applies every profile assigned to the device and
+Backup restores that backup onto it.
+*/
+type Request struct {
+	Deadline    int    `json:"deadline,omitempty"`
+	Reprovision bool   `json:"reprovision,omitempty"`
+	Backup      string `json:"backup,omitempty"`
+}
+
+// Result tells whether the device came back within the deadline. Going
+// offline may go unnoticed, as when the device reconnects before the broker
+// sees it leave.
+type Result struct {
+	Action    string             `json:"action"`
+	SentAt    time.Time          `json:"sentAt"`
+	OfflineAt *time.Time         `json:"offlineAt,omitempty"`
+	OnlineAt  *time.Time         `json:"onlineAt,omitempty"`
+	Returned  bool               `json:"returned"`
+	Downtime  float64            `json:"downtime,omitempty"`
+	Profiles  []db.ProfileStatus `json:"profiles,omitempty"`
+	Restore   *backup.Report     `json:"restore,omitempty"`
+	// Failures of the re-provisioning
+	Errors []string `json:"errors,omitempty"`
+}
+
+type Service struct {
+	Usp      *usp.Dispatcher
+	Events   *events.Bus
+	Profiles *profile.Reconciler
+	Backups  *backup.Service
+}
+
+func NewService(d *usp.Dispatcher, bus *events.Bus, p *profile.Reconciler, b *backup.Service) *Service {
+	return &Service{Usp: d, Events: bus, Profiles: p, Backups: b}
+}
+
+// Validate checks the request fits the action and sets the default deadline.
+func Validate(action string, req *Request) error {
+	if _, ok := commands[action]; !ok {
+		return fmt.Errorf("%w: unknown action %s", usp.ErrInvalidRequest, action)
+	}
+	if req.Deadline < 0 {
+		return fmt.Errorf("%w: deadline must be a number of seconds", usp.ErrInvalidRequest)
+	}
+	if req.Deadline == 0 {
+		req.Deadline = int(DefaultDeadline.Seconds())
+	}
+	if action != ActionFactoryReset && (req.Reprovision || req.Backup != "") {
+		return fmt.Errorf("%w: only factory resets can be followed by re-provisioning", usp.ErrInvalidRequest)
+	}
+	return nil
+}
+
+/*
+Run sends the action command to the device and waits for it to go offline
+and come back through the status topic. Once back, restore is restored onto
+the device if it isn't nil.
+*/
+func (s *Service) Run(ctx context.Context, sn, action string, req Request, restore *db.Backup) (Result, error) {
+	deviceEvents, unsubscribe := s.Events.Subscribe(sn)
+	defer unsubscribe()
+
+	result := Result{Action: action, SentAt: time.Now()}
+	opCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	resp, err := usp.Operate.Run(opCtx, s.Usp, sn, usp.OperateRequest{Command: commands[action], CommandKey: action})
+	cancel()
+	if err != nil && !errors.Is(err, usp.ErrTimeout) {
+		return result, err
+	}
+	for _, x := range resp.Results {
+		if x.Error != nil {
+			return result, &usp.Error{Code: x.Error.Code, Message: x.Error.Message, Params: []usp.PathError{*x.Error}}
+		}
+	}
+	log.Printf("Device %s asked to %s, waiting for it to come back", sn, action)
+
+	deadline := time.NewTimer(time.Duration(req.Deadline) * time.Second)
+	defer deadline.Stop()
+	for !result.Returned {
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-deadline.C:
+			log.Printf("Device %s didn't come back after %s", sn, action)
+			return result, nil
+		case e := <-deviceEvents:
+			switch e.Kind {
+			case events.DeviceOffline:
+				t := e.Time
+				result.OfflineAt = &t
+			case events.DeviceOnline:
+				t := e.Time
+				result.OnlineAt = &t
+				result.Returned = true
+				from := result.SentAt
+				if result.OfflineAt != nil {
+					from = *result.OfflineAt
+				}
+				result.Downtime = t.Sub(from).Seconds()
+			}
+		}
+	}
+
+	if req.Reprovision {
+		statuses, err := s.Profiles.ReconcileDevice(ctx, sn, true)
+		result.Profiles = statuses
+		if err != nil {
+			result.Errors = append(result.Errors, "profiles: "+err.Error())
+		}
+	}
+	if restore != nil {
+		report, err := s.Backups.Restore(ctx, *restore, sn, nil)
+		result.Restore = &report
+		if err != nil {
+			result.Errors = append(result.Errors, "backup: "+err.Error())
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,101 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"*/15 9-17 * * 1-5", true},
+		{"0 0 1,15 * *", true},
+		{"30 4 * * 7", true},
+		{"5/10 * * * *", true},
+		{"@daily", true},
+		{" @hourly ", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"10-5 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"1-x * * * *", false},
+		{"@never", false},
+	}
+	for _, tt := range tests {
+		_, err := ParseCron(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseCron(%q) error = %v, want ok %v", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		spec  string
+		after string
+		want  string
+	}{
+		{"* * * * *", "2024-03-10 10:20", "2024-03-10 10:21"},
+		{"*/15 * * * *", "2024-03-10 10:20", "2024-03-10 10:30"},
+		{"0 * * * *", "2024-03-10 10:00", "2024-03-10 11:00"},
+		{"@daily", "2024-03-10 23:59", "2024-03-11 00:00"},
+		{"30 2 * * *", "2024-03-10 02:30", "2024-03-11 02:30"},
+		{"0 9-17 * * 1-5", "2024-03-08 17:30", "2024-03-11 09:00"},
+		{"0 0 * * 0", "2024-03-10 00:00", "2024-03-17 00:00"},
+		{"0 0 * * 7", "2024-03-11 00:00", "2024-03-17 00:00"},
+		{"0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"@yearly", "2024-06-15 12:00", "2025-01-01 00:00"},
+		// Either day field matches when both are restricted
+		{"0 0 13 * 5", "2024-03-10 00:00", "2024-03-13 00:00"},
+		{"0 0 13 * 5", "2024-03-13 00:00", "2024-03-15 00:00"},
+		{"0 0 31 2 *", "2024-01-01 00:00", ""},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) error = %v", tt.spec, err)
+		}
+		got := c.Next(at(tt.after))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("Next(%q after %s) = %v, want none", tt.spec, tt.after, got)
+			}
+			continue
+		}
+		if want := at(tt.want); !got.Equal(want) {
+			t.Errorf("Next(%q after %s) = %v, want %v", tt.spec, tt.after, got, want)
+		}
+	}
+}
+
+func TestCronNextTimezone(t *testing.T) {
+	loc := time.FixedZone("UTC-3", -3*60*60)
+	c, err := ParseCron("0 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := c.Next(time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC).In(loc))
+	want := time.Date(2024, 3, 11, 5, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("Next() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,185 @@
+// Runs tasks at a given time or periodically, each run is a bulk job.
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/leandrofars/oktopus/internal/bulk"
+	"github.com/leandrofars/oktopus/internal/db"
+	"github.com/leandrofars/oktopus/internal/usp"
+)
+
+// How often the database is checked for due tasks
+const tick = 30 * time.Second
+
+type Scheduler struct {
+	Db   db.Database
+	Bulk *bulk.Engine
+	wake chan struct{}
+}
+
+func NewScheduler(database db.Database, b *bulk.Engine) *Scheduler {
+	return &Scheduler{
+		Db:   database,
+		Bulk: b,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Start runs due tasks until the controller stops. Tasks that were due while
+// the controller was down run once as soon as it starts.
+func (s *Scheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			s.runDueTasks()
+			select {
+			case <-ticker.C:
+			case <-s.wake:
+			}
+		}
+	}()
+	log.Println("Scheduler started")
+}
+
+// Wake makes the scheduler check for due tasks right away.
+func (s *Scheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Prepare validates a task about to be saved and computes its next run.
+func (s *Scheduler) Prepare(task *db.Task) error {
+	cmd, ok := usp.Commands[task.Operation]
+	if !ok {
+		return fmt.Errorf("%w: unknown operation %q", usp.ErrInvalidRequest, task.Operation)
+	}
+	if err := cmd.Validate(task.Request); err != nil {
+		return err
+	}
+	if len(task.Targets) == 0 && task.Filter == nil {
+		return fmt.Errorf("%w: %v", usp.ErrInvalidRequest, bulk.ErrNoTargets)
+	}
+	if (task.At == nil) == (task.Cron == "") {
+		return fmt.Errorf("%w: task must have either a time or a cron expression", usp.ErrInvalidRequest)
+	}
+	if _, err := location(task.Timezone); err != nil {
+		return fmt.Errorf("%w: %v", usp.ErrInvalidRequest, err)
+	}
+
+	if task.Id == "" {
+		task.Id = uuid.NewString()
+		task.CreatedAt = time.Now()
+	}
+
+	next, err := nextRun(*task, time.Now())
+	if err != nil {
+		return fmt.Errorf("%w: %v", usp.ErrInvalidRequest, err)
+	}
+	task.NextRun = next
+	return nil
+}
+
+// RunNow starts a run of the task, out of its schedule.
+func (s *Scheduler) RunNow(task db.Task) (db.BulkJob, error) {
+	job, err := s.Bulk.Start(bulkJob(task))
+	if err != nil {
+		return job, err
+	}
+
+	task.LastJob = job.Id
+	ran(&task, time.Now(), false)
+	err = s.Db.UpdateTask(task)
+	return job, err
+}
+
+func (s *Scheduler) runDueTasks() {
+	now := time.Now()
+	tasks, err := s.Db.RetrieveDueTasks(now)
+	if err != nil {
+		return
+	}
+
+	for _, task := range tasks {
+		log.Printf("Running task %s (%s)", task.Id, task.Name)
+		job, err := s.Bulk.Start(bulkJob(task))
+		if err != nil && !errors.Is(err, bulk.ErrNoTargets) {
+			log.Printf("Task %s failed to start: %s", task.Id, err)
+		} else {
+			task.LastJob = job.Id
+		}
+		ran(&task, now, true)
+		s.Db.UpdateTask(task)
+	}
+}
+
+/*
+Records a run of the task started at now, scheduled or not. Tasks that
+won't run anymore are disabled: one-shot tasks run once, even out of their
+schedule. Periodic tasks run out of schedule keep their next run.
+*/
+func ran(task *db.Task, now time.Time, scheduled bool) {
+	task.LastRun = &now
+	if !scheduled && task.At == nil {
+		return
+	}
+
+	// The next run is computed from now, so missed runs don't pile up
+	next, err := nextRun(*task, now)
+	if err != nil || next == nil {
+		task.Enabled = false
+		next = nil
+	}
+	task.NextRun = next
+}
+
+func bulkJob(task db.Task) db.BulkJob {
+	return db.BulkJob{
+		Operation:   task.Operation,
+		Request:     task.Request,
+		Targets:     task.Targets,
+		Filter:      task.Filter,
+		Concurrency: task.Concurrency,
+		Retries:     task.Retries,
+		Task:        task.Id,
+	}
+}
+
+// Returns nil when the task won't run anymore
+func nextRun(task db.Task, after time.Time) (*time.Time, error) {
+	if task.At != nil {
+		if task.LastRun != nil {
+			return nil, nil
+		}
+		at := *task.At
+		return &at, nil
+	}
+
+	cron, err := ParseCron(task.Cron)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := location(task.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	next := cron.Next(after.In(loc))
+	if next.IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", task.Cron)
+	}
+	return &next, nil
+}
+
+func location(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(timezone)
+}
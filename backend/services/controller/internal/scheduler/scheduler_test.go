@@ -0,0 +1,41 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/db"
+)
+
+func TestRan(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 7, 0, 0, time.UTC)
+	later := now.Add(24 * time.Hour)
+	planned := time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		task      db.Task
+		scheduled bool
+		enabled   bool
+		next      *time.Time
+	}{
+		{"one-shot run on time", db.Task{At: &now, Enabled: true, NextRun: &now}, true, false, nil},
+		{"one-shot run ahead of time", db.Task{At: &later, Enabled: true, NextRun: &later}, false, false, nil},
+		{"periodic run on time", db.Task{Cron: "0 * * * *", Timezone: "UTC", Enabled: true, NextRun: &now}, true, true, &planned},
+		{"periodic run out of schedule", db.Task{Cron: "0 0 * * *", Timezone: "UTC", Enabled: true, NextRun: &later}, false, true, &later},
+		{"bad cron expression", db.Task{Cron: "bad", Enabled: true, NextRun: &now}, true, false, nil},
+	}
+	for _, tt := range tests {
+		task := tt.task
+		ran(&task, now, tt.scheduled)
+		if task.LastRun == nil || !task.LastRun.Equal(now) {
+			t.Errorf("%s: LastRun = %v, want %v", tt.name, task.LastRun, now)
+		}
+		if task.Enabled != tt.enabled {
+			t.Errorf("%s: Enabled = %v, want %v", tt.name, task.Enabled, tt.enabled)
+		}
+		if (task.NextRun == nil) != (tt.next == nil) || task.NextRun != nil && !task.NextRun.Equal(*tt.next) {
+			t.Errorf("%s: NextRun = %v, want %v", tt.name, task.NextRun, tt.next)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Installs deployment units on devices and controls their execution units.
+package software
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/command"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const (
+	root           = "Device.SoftwareModules."
+	execEnvTable   = root + "ExecEnv."
+	duTable        = root + "DeploymentUnit."
+	euTable        = root + "ExecutionUnit."
+	installCommand = root + "InstallDU()"
+)
+
+// How often execution units are checked while they change state
+const statePoll = 2 * time.Second
+
+// States execution units can be asked to go to
+var states = []string{"Idle", "Active"}
+
+type Inventory struct {
+	ExecEnvs        []ExecEnv        `json:"execEnvs"`
+	DeploymentUnits []DeploymentUnit `json:"deploymentUnits"`
+	ExecutionUnits  []ExecutionUnit  `json:"executionUnits"`
+}
+
+// Environment execution units run in, as a container runtime. Disk space is
+// in kB and memory in kiB.
+type ExecEnv struct {
+	Path               string `json:"path"`
+	Enable             bool   `json:"enable"`
+	Status             string `json:"status"`
+	Name               string `json:"name"`
+	Type               string `json:"type"`
+	Vendor             string `json:"vendor"`
+	Version            string `json:"version"`
+	AvailableDiskSpace int    `json:"availableDiskSpace"`
+	AvailableMemory    int    `json:"availableMemory"`
+}
+
+// Deployment units are known by their UUID, which stays the same across
+// versions. ExecutionUnits holds the EUIDs of what the unit runs.
+type DeploymentUnit struct {
+	Path            string   `json:"path"`
+	UUID            string   `json:"uuid"`
+	DUID            string   `json:"duid"`
+	Name            string   `json:"name"`
+	Status          string   `json:"status"`
+	Resolved        bool     `json:"resolved"`
+	URL             string   `json:"url"`
+	Description     string   `json:"description"`
+	Vendor          string   `json:"vendor"`
+	Version         string   `json:"version"`
+	ExecutionEnvRef string   `json:"executionEnvRef"`
+	ExecutionUnits  []string `json:"executionUnits"`
+}
+
+// Execution units are known by their EUID. Disk space is in kB and memory
+// in kiB.
+type ExecutionUnit struct {
+	EUID                  string `json:"euid"`
+	Path                  string `json:"path"`
+	Name                  string `json:"name"`
+	Status                string `json:"status"`
+	ExecutionFaultCode    string `json:"executionFaultCode"`
+	ExecutionFaultMessage string `json:"executionFaultMessage,omitempty"`
+	AutoStart             bool   `json:"autoStart"`
+	Vendor                string `json:"vendor"`
+	Version               string `json:"version"`
+	Description           string `json:"description"`
+	DiskSpaceInUse        int    `json:"diskSpaceInUse"`
+	MemoryInUse           int    `json:"memoryInUse"`
+	ExecutionEnvRef       string `json:"executionEnvRef"`
+	DeploymentUnit        string `json:"deploymentUnit,omitempty"`
+}
+
+/*
+InstallRequest installs the deployment unit at URL. The device picks the UUID
+and the execution environment unless they are given, Username and Password
+are the credentials of the file server if it needs any.
+*/
+type InstallRequest struct {
+	URL             string `json:"url"`
+	UUID            string `json:"uuid,omitempty"`
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	ExecutionEnvRef string `json:"executionEnvRef,omitempty"`
+}
+
+func (r *InstallRequest) Validate() error {
+	if r.URL == "" {
+		return fmt.Errorf("%w: url is required", usp.ErrInvalidRequest)
+	}
+	return nil
+}
+
+type UpdateRequest struct {
+	URL      string `json:"url,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Get reads the execution environments, deployment units and execution units
+// of the device.
+func Get(ctx context.Context, d *usp.Dispatcher, sn string) (Inventory, error) {
+	resp, err := usp.Get.Run(ctx, d, sn, usp.GetRequest{Paths: []string{
+		execEnvTable,
+		duTable,
+		euTable,
+	}})
+	if err != nil {
+		return Inventory{}, err
+	}
+	values := resp.Params
+
+	inv := Inventory{
+		ExecEnvs:        []ExecEnv{},
+		DeploymentUnits: []DeploymentUnit{},
+		ExecutionUnits:  []ExecutionUnit{},
+	}
+	for _, path := range dm.Instances(values, execEnvTable) {
+		inv.ExecEnvs = append(inv.ExecEnvs, ExecEnv{
+			Path:               path,
+			Enable:             dm.ParseBool(values[path+"Enable"]),
+			Status:             values[path+"Status"],
+			Name:               values[path+"Name"],
+			Type:               values[path+"Type"],
+			Vendor:             values[path+"Vendor"],
+			Version:            values[path+"Version"],
+			AvailableDiskSpace: dm.Atoi(values[path+"AvailableDiskSpace"]),
+			AvailableMemory:    dm.Atoi(values[path+"AvailableMemory"]),
+		})
+	}
+
+	euids := map[string]string{}
+	for _, path := range dm.Instances(values, euTable) {
+		euids[path] = values[path+"EUID"]
+	}
+	owners := map[string]string{}
+	for _, path := range dm.Instances(values, duTable) {
+		du := DeploymentUnit{
+			Path:            path,
+			UUID:            values[path+"UUID"],
+			DUID:            values[path+"DUID"],
+			Name:            values[path+"Name"],
+			Status:          values[path+"Status"],
+			Resolved:        dm.ParseBool(values[path+"Resolved"]),
+			URL:             values[path+"URL"],
+			Description:     values[path+"Description"],
+			Vendor:          values[path+"Vendor"],
+			Version:         values[path+"Version"],
+			ExecutionEnvRef: dm.WithDot(values[path+"ExecutionEnvRef"]),
+			ExecutionUnits:  []string{},
+		}
+		for _, eu := range dm.List(values[path+"ExecutionUnitList"]) {
+			if euid, ok := euids[dm.WithDot(eu)]; ok {
+				du.ExecutionUnits = append(du.ExecutionUnits, euid)
+				owners[dm.WithDot(eu)] = du.UUID
+			}
+		}
+		inv.DeploymentUnits = append(inv.DeploymentUnits, du)
+	}
+
+	for _, path := range dm.Instances(values, euTable) {
+		inv.ExecutionUnits = append(inv.ExecutionUnits, ExecutionUnit{
+			EUID:                  euids[path],
+			Path:                  path,
+			Name:                  values[path+"Name"],
+			Status:                values[path+"Status"],
+			ExecutionFaultCode:    values[path+"ExecutionFaultCode"],
+			ExecutionFaultMessage: values[path+"ExecutionFaultMessage"],
+			AutoStart:             dm.ParseBool(values[path+"AutoStart"]),
+			Vendor:                values[path+"Vendor"],
+			Version:               values[path+"Version"],
+			Description:           values[path+"Description"],
+			DiskSpaceInUse:        dm.Atoi(values[path+"DiskSpaceInUse"]),
+			MemoryInUse:           dm.Atoi(values[path+"MemoryInUse"]),
+			ExecutionEnvRef:       dm.WithDot(values[path+"ExecutionEnvRef"]),
+			DeploymentUnit:        owners[path],
+		})
+	}
+	return inv, nil
+}
+
+/*
+Install runs InstallDU on the device and waits for it to complete, answering
+the deployment unit installed. It's the one the device tells, if it does,
+otherwise the one with the UUID given or the unit from the URL which wasn't
+there before.
+*/
+func Install(ctx context.Context, r *command.Runner, sn string, req InstallRequest) (DeploymentUnit, error) {
+	if err := req.Validate(); err != nil {
+		return DeploymentUnit{}, err
+	}
+	// Units installed before, which a reinstall of the same url must not
+	// be taken for
+	inv, err := Get(ctx, r.Usp, sn)
+	if err != nil {
+		return DeploymentUnit{}, err
+	}
+	existing := map[string]bool{}
+	for _, du := range inv.DeploymentUnits {
+		existing[du.Path] = true
+	}
+
+	input := map[string]string{"URL": req.URL}
+	for arg, value := range map[string]string{
+		"UUID":            req.UUID,
+		"Username":        req.Username,
+		"Password":        req.Password,
+		"ExecutionEnvRef": strings.TrimSuffix(req.ExecutionEnvRef, "."),
+	} {
+		if value != "" {
+			input[arg] = value
+		}
+	}
+	out, err := r.Run(ctx, sn, installCommand, input)
+	if err != nil {
+		return DeploymentUnit{}, err
+	}
+
+	inv, err = Get(ctx, r.Usp, sn)
+	if err != nil {
+		return DeploymentUnit{}, err
+	}
+	// Devices telling which unit they installed
+	if ref := dm.WithDot(out["DeploymentUnitRef"]); ref != "" {
+		for _, du := range inv.DeploymentUnits {
+			if du.Path == ref {
+				return du, nil
+			}
+		}
+	}
+	for _, du := range inv.DeploymentUnits {
+		if req.UUID != "" && du.UUID == req.UUID {
+			return du, nil
+		}
+		if req.UUID == "" && du.URL == req.URL && !existing[du.Path] {
+			return du, nil
+		}
+	}
+	return DeploymentUnit{}, fmt.Errorf("device completed the install but has no deployment unit from %s", req.URL)
+}
+
+// Update runs Update on the deployment unit with the UUID, the device picks
+// where to update from if no URL is given.
+func Update(ctx context.Context, r *command.Runner, sn, uuid string, req UpdateRequest) (DeploymentUnit, error) {
+	du, err := deploymentUnit(ctx, r.Usp, sn, uuid)
+	if err != nil {
+		return DeploymentUnit{}, err
+	}
+	input := map[string]string{}
+	for arg, value := range map[string]string{
+		"URL":      req.URL,
+		"Username": req.Username,
+		"Password": req.Password,
+	} {
+		if value != "" {
+			input[arg] = value
+		}
+	}
+	if _, err := r.Run(ctx, sn, du.Path+"Update()", input); err != nil {
+		return DeploymentUnit{}, err
+	}
+	return deploymentUnit(ctx, r.Usp, sn, uuid)
+}
+
+// Uninstall runs Uninstall on the deployment unit with the UUID, along with
+// the execution units it holds.
+func Uninstall(ctx context.Context, r *command.Runner, sn, uuid string) error {
+	du, err := deploymentUnit(ctx, r.Usp, sn, uuid)
+	if err != nil {
+		return err
+	}
+	_, err = r.Run(ctx, sn, du.Path+"Uninstall()", nil)
+	return err
+}
+
+/*
+SetRequestedState asks the execution unit with the EUID to go Idle or Active,
+then waits until it gets there or ctx is done. A fault raised meanwhile is
+returned as the failure.
+*/
+func SetRequestedState(ctx context.Context, r *command.Runner, sn, euid, state string) (ExecutionUnit, error) {
+	if err := ValidateState(state); err != nil {
+		return ExecutionUnit{}, err
+	}
+	eu, err := executionUnit(ctx, r.Usp, sn, euid)
+	if err != nil {
+		return ExecutionUnit{}, err
+	}
+	_, err = r.Run(ctx, sn, eu.Path+"SetRequestedState()", map[string]string{"RequestedState": state})
+	if err != nil {
+		return ExecutionUnit{}, err
+	}
+
+	for {
+		eu, err = executionUnit(ctx, r.Usp, sn, euid)
+		if err != nil {
+			return eu, err
+		}
+		if eu.ExecutionFaultCode != "" && eu.ExecutionFaultCode != "NoFault" {
+			return eu, fmt.Errorf("execution unit %s failed: %s %s", euid, eu.ExecutionFaultCode, eu.ExecutionFaultMessage)
+		}
+		if eu.Status == state {
+			return eu, nil
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return eu, usp.ErrTimeout
+			}
+			return eu, ctx.Err()
+		case <-time.After(statePoll):
+		}
+	}
+}
+
+// ValidateState tells whether execution units can be asked to go to state
+func ValidateState(state string) error {
+	if !dm.Contains(states, state) {
+		return fmt.Errorf("%w: state must be one of %v", usp.ErrInvalidRequest, states)
+	}
+	return nil
+}
+
+func deploymentUnit(ctx context.Context, d *usp.Dispatcher, sn, uuid string) (DeploymentUnit, error) {
+	inv, err := Get(ctx, d, sn)
+	if err != nil {
+		return DeploymentUnit{}, err
+	}
+	for _, du := range inv.DeploymentUnits {
+		if du.UUID == uuid {
+			return du, nil
+		}
+	}
+	return DeploymentUnit{}, fmt.Errorf("%w: no deployment unit %s", usp.ErrInvalidRequest, uuid)
+}
+
+func executionUnit(ctx context.Context, d *usp.Dispatcher, sn, euid string) (ExecutionUnit, error) {
+	inv, err := Get(ctx, d, sn)
+	if err != nil {
+		return ExecutionUnit{}, err
+	}
+	for _, eu := range inv.ExecutionUnits {
+		if eu.EUID == euid {
+			return eu, nil
+		}
+	}
+	return ExecutionUnit{}, fmt.Errorf("%w: no execution unit %s", usp.ErrInvalidRequest, euid)
+}
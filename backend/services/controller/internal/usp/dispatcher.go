@@ -0,0 +1,91 @@
+package usp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/leandrofars/oktopus/internal/mtp"
+	usp_msg "github.com/leandrofars/oktopus/internal/usp_message"
+	"github.com/leandrofars/oktopus/internal/utils"
+	"google.golang.org/protobuf/proto"
+)
+
+// Keeps device requests below the 60 seconds api server write timeout.
+const DefaultTimeout = 55 * time.Second
+
+var (
+	ErrTimeout        = errors.New("request timed out")
+	ErrInvalidRequest = errors.New("invalid request")
+)
+
+// Dispatcher publishes USP messages to devices and waits for their answers,
+// which the MTP layer delivers through MsgQueue, indexed by message id.
+type Dispatcher struct {
+	Broker   mtp.Broker
+	MsgQueue map[string](chan *usp_msg.Msg)
+	QMutex   *sync.Mutex
+	Timeout  time.Duration
+}
+
+func NewDispatcher(b mtp.Broker, msgQueue map[string](chan *usp_msg.Msg), m *sync.Mutex) *Dispatcher {
+	return &Dispatcher{
+		Broker:   b,
+		MsgQueue: msgQueue,
+		QMutex:   m,
+		Timeout:  DefaultTimeout,
+	}
+}
+
+// Send wraps msg into a record addressed to the device, publishes it and
+// blocks until the answer arrives, ctx is done or the timeout expires. An USP
+// Error answer is returned as *Error.
+func (d *Dispatcher) Send(ctx context.Context, sn string, msg *usp_msg.Msg) (*usp_msg.Msg, error) {
+	encodedMsg, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+
+	record := utils.NewUspRecord(encodedMsg, sn)
+	tr369Message, err := proto.Marshal(&record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode tr369 record: %w", err)
+	}
+
+	id := msg.Header.MsgId
+	answer := make(chan *usp_msg.Msg, 1)
+
+	d.QMutex.Lock()
+	d.MsgQueue[id] = answer
+	d.QMutex.Unlock()
+
+	defer func() {
+		d.QMutex.Lock()
+		delete(d.MsgQueue, id)
+		d.QMutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	log.Println("Sending Msg:", id)
+	d.Broker.Publish(tr369Message, "oktopus/v1/agent/"+sn, "oktopus/v1/api/"+sn, false)
+
+	select {
+	case msg := <-answer:
+		log.Printf("Received Msg: %s", id)
+		if e := msg.Body.GetError(); e != nil {
+			return nil, NewError(e)
+		}
+		return msg, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("Request %s Timed Out", id)
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
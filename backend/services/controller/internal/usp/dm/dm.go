@@ -0,0 +1,98 @@
+// Reads the values devices answer Get requests with, as the data model lays
+// them out.
+package dm
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Split tells the instance of the table the path is under, its number and the
+rest of the path, as "Device.WiFi.SSID.1.", 1 and "SSID" for the path
+"Device.WiFi.SSID.1.SSID" in the table "Device.WiFi.SSID.". Ok is false if
+the path isn't under an instance of the table.
+*/
+func Split(path, table string) (instance string, n int, rest string, ok bool) {
+	rest = strings.TrimPrefix(path, table)
+	i := strings.Index(rest, ".")
+	if rest == path || i <= 0 {
+		return "", 0, "", false
+	}
+	n, err := strconv.Atoi(rest[:i])
+	if err != nil {
+		return "", 0, "", false
+	}
+	return table + rest[:i+1], n, rest[i+1:], true
+}
+
+// Instances of the table found among the values, by instance number
+func Instances(values map[string]string, table string) []string {
+	found := map[int]string{}
+	for path := range values {
+		if instance, n, _, ok := Split(path, table); ok {
+			found[n] = instance
+		}
+	}
+	numbers := make([]int, 0, len(found))
+	for n := range found {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	result := make([]string, 0, len(numbers))
+	for _, n := range numbers {
+		result = append(result, found[n])
+	}
+	return result
+}
+
+// Devices may leave out the trailing dot of references
+func WithDot(path string) string {
+	if path == "" || strings.HasSuffix(path, ".") {
+		return path
+	}
+	return path + "."
+}
+
+// Items of a comma separated list, without blanks
+func List(value string) []string {
+	result := []string{}
+	for _, x := range strings.Split(value, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			result = append(result, x)
+		}
+	}
+	return result
+}
+
+// Devices may report booleans as 1 and 0
+func ParseBool(value string) bool {
+	b, _ := strconv.ParseBool(value)
+	return b
+}
+
+// Zero for values which aren't numbers
+func Atoi(value string) int {
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+// AtoiOr is Atoi for params whose zero means something, fallback standing
+// for values which aren't numbers
+func AtoiOr(value string, fallback int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func Contains[T comparable](list []T, x T) bool {
+	for _, y := range list {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
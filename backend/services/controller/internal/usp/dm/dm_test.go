@@ -0,0 +1,65 @@
+package dm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		path, table string
+		instance    string
+		n           int
+		rest        string
+		ok          bool
+	}{
+		{"Device.WiFi.SSID.1.SSID", "Device.WiFi.SSID.", "Device.WiFi.SSID.1.", 1, "SSID", true},
+		{"Device.WiFi.SSID.12.Stats.BytesSent", "Device.WiFi.SSID.", "Device.WiFi.SSID.12.", 12, "Stats.BytesSent", true},
+		{"Device.WiFi.SSID.1.", "Device.WiFi.SSID.", "Device.WiFi.SSID.1.", 1, "", true},
+		{"Device.WiFi.SSIDNumberOfEntries", "Device.WiFi.SSID.", "", 0, "", false},
+		{"Device.WiFi.SSID.x.SSID", "Device.WiFi.SSID.", "", 0, "", false},
+		{"Device.WiFi.SSID.1", "Device.WiFi.SSID.", "", 0, "", false},
+		{"Device.IP.Interface.1.Name", "Device.WiFi.SSID.", "", 0, "", false},
+	}
+	for _, tt := range tests {
+		instance, n, rest, ok := Split(tt.path, tt.table)
+		if instance != tt.instance || n != tt.n || rest != tt.rest || ok != tt.ok {
+			t.Errorf("Split(%q, %q) = %q, %d, %q, %v, want %q, %d, %q, %v",
+				tt.path, tt.table, instance, n, rest, ok, tt.instance, tt.n, tt.rest, tt.ok)
+		}
+	}
+}
+
+func TestInstances(t *testing.T) {
+	values := map[string]string{
+		"Device.WiFi.SSID.10.SSID":            "c",
+		"Device.WiFi.SSID.2.SSID":             "b",
+		"Device.WiFi.SSID.2.Enable":           "true",
+		"Device.WiFi.SSID.1.SSID":             "a",
+		"Device.WiFi.SSIDNumberOfEntries":     "3",
+		"Device.WiFi.AccessPoint.1.SSIDRefer": "Device.WiFi.SSID.1",
+	}
+	want := []string{"Device.WiFi.SSID.1.", "Device.WiFi.SSID.2.", "Device.WiFi.SSID.10."}
+	if got := Instances(values, "Device.WiFi.SSID."); !reflect.DeepEqual(got, want) {
+		t.Errorf("Instances() = %v, want %v", got, want)
+	}
+	if got := Instances(values, "Device.IP.Interface."); len(got) != 0 {
+		t.Errorf("Instances() of a missing table = %v, want none", got)
+	}
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", []string{}},
+		{"a", []string{"a"}},
+		{"a, b,,c ", []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		if got := List(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package usp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	usp_msg "github.com/leandrofars/oktopus/internal/usp_message"
+	"github.com/leandrofars/oktopus/internal/utils"
+)
+
+/*
+Operation is a typed USP request: Msg builds the message sent to the device
+out of the API request, and Response shapes the device answer into the API
+response. Adding a new operation to the API only takes declaring one.
+*/
+type Operation[Req any, Resp any] struct {
+	Name     string
+	Msg      func(Req) *usp_msg.Msg
+	Response func(*usp_msg.Response) Resp
+}
+
+func (op Operation[Req, Resp]) Run(ctx context.Context, d *Dispatcher, sn string, req Req) (Resp, error) {
+	var resp Resp
+	answer, err := d.Send(ctx, sn, op.Msg(req))
+	if err != nil {
+		return resp, err
+	}
+	return op.Response(answer.Body.GetResponse()), nil
+}
+
+// Exec runs the operation with a JSON encoded request.
+func (op Operation[Req, Resp]) Exec(ctx context.Context, d *Dispatcher, sn string, req json.RawMessage) (interface{}, error) {
+	var r Req
+	if err := DecodeRequest(bytes.NewReader(req), &r); err != nil {
+		return nil, err
+	}
+	return op.Run(ctx, d, sn, r)
+}
+
+// Validate checks that req is a valid JSON encoded request of the operation.
+func (op Operation[Req, Resp]) Validate(req json.RawMessage) error {
+	var r Req
+	return DecodeRequest(bytes.NewReader(req), &r)
+}
+
+// DecodeRequest decodes a JSON encoded request into v, rejecting the fields
+// it doesn't know, so clients of an older schema get an error instead of
+// sending an empty request to the device.
+func DecodeRequest(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	return nil
+}
+
+// DecodeOptionalRequest is DecodeRequest for requests whose body can be left
+// out, in which case v keeps its defaults.
+func DecodeOptionalRequest(r io.Reader, v interface{}) error {
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == io.EOF {
+		return nil
+	}
+	return DecodeRequest(br, v)
+}
+
+// Command is an Operation with its types erased, so it can be looked up by
+// name and fed with stored requests.
+type Command interface {
+	Exec(ctx context.Context, d *Dispatcher, sn string, req json.RawMessage) (interface{}, error)
+	Validate(req json.RawMessage) error
+}
+
+var (
+	Get = Operation[GetRequest, GetResponse]{
+		Name: "get",
+		Msg:  func(r GetRequest) *usp_msg.Msg { return utils.NewGetMsg(r.Proto()) },
+		Response: func(r *usp_msg.Response) GetResponse {
+			return NewGetResponse(r.GetGetResp())
+		},
+	}
+	Set = Operation[SetRequest, SetResponse]{
+		Name: "set",
+		Msg:  func(r SetRequest) *usp_msg.Msg { return utils.NewSetMsg(r.Proto()) },
+		Response: func(r *usp_msg.Response) SetResponse {
+			return NewSetResponse(r.GetSetResp())
+		},
+	}
+	Add = Operation[AddRequest, AddResponse]{
+		Name: "add",
+		Msg:  func(r AddRequest) *usp_msg.Msg { return utils.NewCreateMsg(r.Proto()) },
+		Response: func(r *usp_msg.Response) AddResponse {
+			return NewAddResponse(r.GetAddResp())
+		},
+	}
+	Delete = Operation[DeleteRequest, DeleteResponse]{
+		Name: "del",
+		Msg:  func(r DeleteRequest) *usp_msg.Msg { return utils.NewDelMsg(r.Proto()) },
+		Response: func(r *usp_msg.Response) DeleteResponse {
+			return NewDeleteResponse(r.GetDeleteResp())
+		},
+	}
+	Operate = Operation[OperateRequest, OperateResponse]{
+		Name: "operate",
+		Msg:  func(r OperateRequest) *usp_msg.Msg { return utils.NewOperateMsg(r.Proto()) },
+		Response: func(r *usp_msg.Response) OperateResponse {
+			return NewOperateResponse(r.GetOperateResp())
+		},
+	}
+	GetInstances = Operation[GetInstancesRequest, GetInstancesResponse]{
+		Name: "instances",
+		Msg:  func(r GetInstancesRequest) *usp_msg.Msg { return utils.NewGetParametersInstancesMsg(r.Proto()) },
+		Response: func(r *usp_msg.Response) GetInstancesResponse {
+			return NewGetInstancesResponse(r.GetGetInstancesResp())
+		},
+	}
+	GetSupportedDM = Operation[GetSupportedDMRequest, GetSupportedDMResponse]{
+		Name: "parameters",
+		Msg:  func(r GetSupportedDMRequest) *usp_msg.Msg { return utils.NewGetSupportedParametersMsg(r.Proto()) },
+		Response: func(r *usp_msg.Response) GetSupportedDMResponse {
+			return NewGetSupportedDMResponse(r.GetGetSupportedDmResp())
+		},
+	}
+)
+
+// Commands indexes every operation by its name.
+var Commands = map[string]Command{
+	Get.Name:            Get,
+	Set.Name:            Set,
+	Add.Name:            Add,
+	Delete.Name:         Delete,
+	Operate.Name:        Operate,
+	GetInstances.Name:   GetInstances,
+	GetSupportedDM.Name: GetSupportedDM,
+}
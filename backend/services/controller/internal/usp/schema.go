@@ -0,0 +1,534 @@
+/*
+Package usp defines the JSON contract of the device API and translates it
+to and from the USP protobuf messages.
+
+Clients never see the generated usp_message types, so regenerating the
+protobuf code doesn't change the API. Parameters are always addressed by
+their full path, and results come back flattened:
+
+	PUT /api/device/{sn}/get
+	{"paths": ["Device.DeviceInfo."], "maxDepth": 1}
+
+	{
+	  "params": {
+	    "Device.DeviceInfo.Manufacturer": "Oktopus",
+	    "Device.DeviceInfo.SoftwareVersion": "1.0.0"
+	  },
+	  "errors": [
+	    {"path": "Device.Foo.", "code": 7026, "message": "Invalid path"}
+	  ]
+	}
+*/
+package usp
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	usp_msg "github.com/leandrofars/oktopus/internal/usp_message"
+)
+
+// PathError is a failure reported by the device for a single path.
+type PathError struct {
+	Path    string `json:"path"`
+	Code    uint32 `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is returned when the device answers a request with an USP Error message.
+type Error struct {
+	Code    uint32      `json:"code"`
+	Message string      `json:"message"`
+	Params  []PathError `json:"params,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return "usp error " + strconv.FormatUint(uint64(e.Code), 10) + ": " + e.Message
+}
+
+func NewError(e *usp_msg.Error) *Error {
+	err := &Error{
+		Code:    e.GetErrCode(),
+		Message: e.GetErrMsg(),
+	}
+	for _, p := range e.GetParamErrs() {
+		err.Params = append(err.Params, PathError{
+			Path:    p.GetParamPath(),
+			Code:    p.GetErrCode(),
+			Message: p.GetErrMsg(),
+		})
+	}
+	return err
+}
+
+/* ----------------------------------- Get ---------------------------------- */
+
+type GetRequest struct {
+	Paths    []string `json:"paths"`
+	MaxDepth uint32   `json:"maxDepth"`
+}
+
+// Params maps each full parameter path to its value.
+type GetResponse struct {
+	Params map[string]string `json:"params"`
+	Errors []PathError       `json:"errors,omitempty"`
+}
+
+func (r GetRequest) Proto() *usp_msg.Get {
+	return &usp_msg.Get{
+		ParamPaths: r.Paths,
+		MaxDepth:   r.MaxDepth,
+	}
+}
+
+func NewGetResponse(resp *usp_msg.GetResp) GetResponse {
+	result := GetResponse{Params: map[string]string{}}
+	for _, x := range resp.GetReqPathResults() {
+		if x.GetErrCode() != 0 {
+			result.Errors = append(result.Errors, PathError{
+				Path:    x.GetRequestedPath(),
+				Code:    x.GetErrCode(),
+				Message: x.GetErrMsg(),
+			})
+			continue
+		}
+		for _, y := range x.GetResolvedPathResults() {
+			for param, value := range y.GetResultParams() {
+				result.Params[y.GetResolvedPath()+param] = value
+			}
+		}
+	}
+	return result
+}
+
+/* ----------------------------------- Set ---------------------------------- */
+
+// Params maps each full parameter path to the value it must be set to.
+// Unless AllowPartial is set, a single failure rolls back the whole request.
+type SetRequest struct {
+	AllowPartial bool              `json:"allowPartial"`
+	Params       map[string]string `json:"params"`
+}
+
+// Params holds the values the device reports as updated.
+type SetResponse struct {
+	Params map[string]string `json:"params"`
+	Errors []PathError       `json:"errors,omitempty"`
+}
+
+func (r SetRequest) Proto() *usp_msg.Set {
+	set := &usp_msg.Set{AllowPartial: r.AllowPartial}
+	objs := map[string]*usp_msg.Set_UpdateObject{}
+	for _, path := range sortedKeys(r.Params) {
+		obj, param := splitPath(path)
+		o, ok := objs[obj]
+		if !ok {
+			o = &usp_msg.Set_UpdateObject{ObjPath: obj}
+			objs[obj] = o
+			set.UpdateObjs = append(set.UpdateObjs, o)
+		}
+		o.ParamSettings = append(o.ParamSettings, &usp_msg.Set_UpdateParamSetting{
+			Param:    param,
+			Value:    r.Params[path],
+			Required: !r.AllowPartial,
+		})
+	}
+	return set
+}
+
+func NewSetResponse(resp *usp_msg.SetResp) SetResponse {
+	result := SetResponse{Params: map[string]string{}}
+	for _, x := range resp.GetUpdatedObjResults() {
+		status := x.GetOperStatus()
+		if failure := status.GetOperFailure(); failure != nil {
+			result.Errors = append(result.Errors, PathError{
+				Path:    x.GetRequestedPath(),
+				Code:    failure.GetErrCode(),
+				Message: failure.GetErrMsg(),
+			})
+			for _, inst := range failure.GetUpdatedInstFailures() {
+				result.Errors = append(result.Errors, setParamErrors(inst.GetAffectedPath(), inst.GetParamErrs())...)
+			}
+			continue
+		}
+		for _, inst := range status.GetOperSuccess().GetUpdatedInstResults() {
+			for param, value := range inst.GetUpdatedParams() {
+				result.Params[inst.GetAffectedPath()+param] = value
+			}
+			result.Errors = append(result.Errors, setParamErrors(inst.GetAffectedPath(), inst.GetParamErrs())...)
+		}
+	}
+	return result
+}
+
+func setParamErrors(obj string, errs []*usp_msg.SetResp_ParameterError) []PathError {
+	var result []PathError
+	for _, e := range errs {
+		result = append(result, PathError{
+			Path:    obj + e.GetParam(),
+			Code:    e.GetErrCode(),
+			Message: e.GetErrMsg(),
+		})
+	}
+	return result
+}
+
+/* ----------------------------------- Add ---------------------------------- */
+
+type AddObject struct {
+	Path   string            `json:"path"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+type AddRequest struct {
+	AllowPartial bool        `json:"allowPartial"`
+	Objects      []AddObject `json:"objects"`
+}
+
+// Path is the instance the device created for RequestedPath, e.g.
+// "Device.NAT.PortMapping.3.".
+type CreatedObject struct {
+	RequestedPath string            `json:"requestedPath"`
+	Path          string            `json:"path"`
+	UniqueKeys    map[string]string `json:"uniqueKeys,omitempty"`
+	Errors        []PathError       `json:"errors,omitempty"`
+}
+
+type AddResponse struct {
+	Created []CreatedObject `json:"created"`
+	Errors  []PathError     `json:"errors,omitempty"`
+}
+
+func (r AddRequest) Proto() *usp_msg.Add {
+	add := &usp_msg.Add{AllowPartial: r.AllowPartial}
+	for _, obj := range r.Objects {
+		o := &usp_msg.Add_CreateObject{ObjPath: obj.Path}
+		for _, param := range sortedKeys(obj.Params) {
+			o.ParamSettings = append(o.ParamSettings, &usp_msg.Add_CreateParamSetting{
+				Param:    param,
+				Value:    obj.Params[param],
+				Required: !r.AllowPartial,
+			})
+		}
+		add.CreateObjs = append(add.CreateObjs, o)
+	}
+	return add
+}
+
+func NewAddResponse(resp *usp_msg.AddResp) AddResponse {
+	result := AddResponse{Created: []CreatedObject{}}
+	for _, x := range resp.GetCreatedObjResults() {
+		status := x.GetOperStatus()
+		if failure := status.GetOperFailure(); failure != nil {
+			result.Errors = append(result.Errors, PathError{
+				Path:    x.GetRequestedPath(),
+				Code:    failure.GetErrCode(),
+				Message: failure.GetErrMsg(),
+			})
+			continue
+		}
+		success := status.GetOperSuccess()
+		created := CreatedObject{
+			RequestedPath: x.GetRequestedPath(),
+			Path:          success.GetInstantiatedPath(),
+			UniqueKeys:    success.GetUniqueKeys(),
+		}
+		for _, e := range success.GetParamErrs() {
+			created.Errors = append(created.Errors, PathError{
+				Path:    created.Path + e.GetParam(),
+				Code:    e.GetErrCode(),
+				Message: e.GetErrMsg(),
+			})
+		}
+		result.Created = append(result.Created, created)
+	}
+	return result
+}
+
+/* --------------------------------- Delete --------------------------------- */
+
+type DeleteRequest struct {
+	AllowPartial bool     `json:"allowPartial"`
+	Paths        []string `json:"paths"`
+}
+
+type DeleteResponse struct {
+	Deleted []string    `json:"deleted"`
+	Errors  []PathError `json:"errors,omitempty"`
+}
+
+func (r DeleteRequest) Proto() *usp_msg.Delete {
+	return &usp_msg.Delete{
+		AllowPartial: r.AllowPartial,
+		ObjPaths:     r.Paths,
+	}
+}
+
+func NewDeleteResponse(resp *usp_msg.DeleteResp) DeleteResponse {
+	result := DeleteResponse{Deleted: []string{}}
+	for _, x := range resp.GetDeletedObjResults() {
+		status := x.GetOperStatus()
+		if failure := status.GetOperFailure(); failure != nil {
+			result.Errors = append(result.Errors, PathError{
+				Path:    x.GetRequestedPath(),
+				Code:    failure.GetErrCode(),
+				Message: failure.GetErrMsg(),
+			})
+			continue
+		}
+		success := status.GetOperSuccess()
+		result.Deleted = append(result.Deleted, success.GetAffectedPaths()...)
+		for _, e := range success.GetUnaffectedPathErrs() {
+			result.Errors = append(result.Errors, PathError{
+				Path:    e.GetUnaffectedPath(),
+				Code:    e.GetErrCode(),
+				Message: e.GetErrMsg(),
+			})
+		}
+	}
+	return result
+}
+
+/* --------------------------------- Operate -------------------------------- */
+
+type OperateRequest struct {
+	Command    string            `json:"command"`
+	CommandKey string            `json:"commandKey"`
+	InputArgs  map[string]string `json:"inputArgs,omitempty"`
+}
+
+// Synchronous commands fill Outputs. Asynchronous commands fill Path with the
+// Device.LocalAgent.Request instance that tracks them until OperationComplete.
+type OperationResult struct {
+	Command string            `json:"command"`
+	Path    string            `json:"path,omitempty"`
+	Outputs map[string]string `json:"outputs,omitempty"`
+	Error   *PathError        `json:"error,omitempty"`
+}
+
+type OperateResponse struct {
+	Results []OperationResult `json:"results"`
+}
+
+func (r OperateRequest) Proto() *usp_msg.Operate {
+	return &usp_msg.Operate{
+		Command:    r.Command,
+		CommandKey: r.CommandKey,
+		SendResp:   true,
+		InputArgs:  r.InputArgs,
+	}
+}
+
+func NewOperateResponse(resp *usp_msg.OperateResp) OperateResponse {
+	result := OperateResponse{Results: []OperationResult{}}
+	for _, x := range resp.GetOperationResults() {
+		op := OperationResult{
+			Command: x.GetExecutedCommand(),
+			Path:    x.GetReqObjPath(),
+		}
+		if out := x.GetReqOutputArgs(); out != nil {
+			op.Outputs = out.GetOutputArgs()
+		}
+		if failure := x.GetCmdFailure(); failure != nil {
+			op.Error = &PathError{
+				Path:    x.GetExecutedCommand(),
+				Code:    failure.GetErrCode(),
+				Message: failure.GetErrMsg(),
+			}
+		}
+		result.Results = append(result.Results, op)
+	}
+	return result
+}
+
+/* ------------------------------ GetInstances ------------------------------ */
+
+type GetInstancesRequest struct {
+	Paths          []string `json:"paths"`
+	FirstLevelOnly bool     `json:"firstLevelOnly"`
+}
+
+type Instance struct {
+	Path       string            `json:"path"`
+	UniqueKeys map[string]string `json:"uniqueKeys,omitempty"`
+}
+
+type GetInstancesResponse struct {
+	Instances []Instance  `json:"instances"`
+	Errors    []PathError `json:"errors,omitempty"`
+}
+
+func (r GetInstancesRequest) Proto() *usp_msg.GetInstances {
+	return &usp_msg.GetInstances{
+		ObjPaths:       r.Paths,
+		FirstLevelOnly: r.FirstLevelOnly,
+	}
+}
+
+func NewGetInstancesResponse(resp *usp_msg.GetInstancesResp) GetInstancesResponse {
+	result := GetInstancesResponse{Instances: []Instance{}}
+	for _, x := range resp.GetReqPathResults() {
+		if x.GetErrCode() != 0 {
+			result.Errors = append(result.Errors, PathError{
+				Path:    x.GetRequestedPath(),
+				Code:    x.GetErrCode(),
+				Message: x.GetErrMsg(),
+			})
+			continue
+		}
+		for _, inst := range x.GetCurrInsts() {
+			result.Instances = append(result.Instances, Instance{
+				Path:       inst.GetInstantiatedObjPath(),
+				UniqueKeys: inst.GetUniqueKeys(),
+			})
+		}
+	}
+	return result
+}
+
+/* ----------------------------- GetSupportedDM ----------------------------- */
+
+type GetSupportedDMRequest struct {
+	Paths          []string `json:"paths"`
+	FirstLevelOnly bool     `json:"firstLevelOnly"`
+	Commands       bool     `json:"commands"`
+	Events         bool     `json:"events"`
+	Params         bool     `json:"params"`
+}
+
+type SupportedParam struct {
+	Name   string `json:"name"`
+	Access string `json:"access"`
+	Type   string `json:"type"`
+}
+
+type SupportedCommand struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Inputs  []string `json:"inputs,omitempty"`
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+type SupportedEvent struct {
+	Name string   `json:"name"`
+	Args []string `json:"args,omitempty"`
+}
+
+// Path is the supported object path, using "{i}" for instance numbers.
+type SupportedObject struct {
+	Path          string             `json:"path"`
+	Access        string             `json:"access"`
+	MultiInstance bool               `json:"multiInstance"`
+	Params        []SupportedParam   `json:"params,omitempty"`
+	Commands      []SupportedCommand `json:"commands,omitempty"`
+	Events        []SupportedEvent   `json:"events,omitempty"`
+}
+
+type GetSupportedDMResponse struct {
+	Objects []SupportedObject `json:"objects"`
+	Errors  []PathError       `json:"errors,omitempty"`
+}
+
+func (r GetSupportedDMRequest) Proto() *usp_msg.GetSupportedDM {
+	return &usp_msg.GetSupportedDM{
+		ObjPaths:       r.Paths,
+		FirstLevelOnly: r.FirstLevelOnly,
+		ReturnCommands: r.Commands,
+		ReturnEvents:   r.Events,
+		ReturnParams:   r.Params,
+	}
+}
+
+var (
+	objAccess = map[usp_msg.GetSupportedDMResp_ObjAccessType]string{
+		usp_msg.GetSupportedDMResp_OBJ_READ_ONLY:   "readOnly",
+		usp_msg.GetSupportedDMResp_OBJ_ADD_DELETE:  "addDelete",
+		usp_msg.GetSupportedDMResp_OBJ_ADD_ONLY:    "addOnly",
+		usp_msg.GetSupportedDMResp_OBJ_DELETE_ONLY: "deleteOnly",
+	}
+	paramAccess = map[usp_msg.GetSupportedDMResp_ParamAccessType]string{
+		usp_msg.GetSupportedDMResp_PARAM_READ_ONLY:  "readOnly",
+		usp_msg.GetSupportedDMResp_PARAM_READ_WRITE: "readWrite",
+		usp_msg.GetSupportedDMResp_PARAM_WRITE_ONLY: "writeOnly",
+	}
+	paramType = map[usp_msg.GetSupportedDMResp_ParamValueType]string{
+		usp_msg.GetSupportedDMResp_PARAM_UNKNOWN:       "unknown",
+		usp_msg.GetSupportedDMResp_PARAM_BASE_64:       "base64",
+		usp_msg.GetSupportedDMResp_PARAM_BOOLEAN:       "boolean",
+		usp_msg.GetSupportedDMResp_PARAM_DATE_TIME:     "dateTime",
+		usp_msg.GetSupportedDMResp_PARAM_DECIMAL:       "decimal",
+		usp_msg.GetSupportedDMResp_PARAM_HEX_BINARY:    "hexBinary",
+		usp_msg.GetSupportedDMResp_PARAM_INT:           "int",
+		usp_msg.GetSupportedDMResp_PARAM_LONG:          "long",
+		usp_msg.GetSupportedDMResp_PARAM_STRING:        "string",
+		usp_msg.GetSupportedDMResp_PARAM_UNSIGNED_INT:  "unsignedInt",
+		usp_msg.GetSupportedDMResp_PARAM_UNSIGNED_LONG: "unsignedLong",
+	}
+	cmdType = map[usp_msg.GetSupportedDMResp_CmdType]string{
+		usp_msg.GetSupportedDMResp_CMD_UNKNOWN: "unknown",
+		usp_msg.GetSupportedDMResp_CMD_SYNC:    "sync",
+		usp_msg.GetSupportedDMResp_CMD_ASYNC:   "async",
+	}
+)
+
+func NewGetSupportedDMResponse(resp *usp_msg.GetSupportedDMResp) GetSupportedDMResponse {
+	result := GetSupportedDMResponse{Objects: []SupportedObject{}}
+	for _, x := range resp.GetReqObjResults() {
+		if x.GetErrCode() != 0 {
+			result.Errors = append(result.Errors, PathError{
+				Path:    x.GetReqObjPath(),
+				Code:    x.GetErrCode(),
+				Message: x.GetErrMsg(),
+			})
+			continue
+		}
+		for _, obj := range x.GetSupportedObjs() {
+			o := SupportedObject{
+				Path:          obj.GetSupportedObjPath(),
+				Access:        objAccess[obj.GetAccess()],
+				MultiInstance: obj.GetIsMultiInstance(),
+			}
+			for _, p := range obj.GetSupportedParams() {
+				o.Params = append(o.Params, SupportedParam{
+					Name:   p.GetParamName(),
+					Access: paramAccess[p.GetAccess()],
+					Type:   paramType[p.GetValueType()],
+				})
+			}
+			for _, c := range obj.GetSupportedCommands() {
+				o.Commands = append(o.Commands, SupportedCommand{
+					Name:    c.GetCommandName(),
+					Type:    cmdType[c.GetCommandType()],
+					Inputs:  c.GetInputArgNames(),
+					Outputs: c.GetOutputArgNames(),
+				})
+			}
+			for _, e := range obj.GetSupportedEvents() {
+				o.Events = append(o.Events, SupportedEvent{
+					Name: e.GetEventName(),
+					Args: e.GetArgNames(),
+				})
+			}
+			result.Objects = append(result.Objects, o)
+		}
+	}
+	return result
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Splits a full parameter path into its object path and parameter name.
+func splitPath(path string) (string, string) {
+	i := strings.LastIndex(path, ".")
+	return path[:i+1], path[i+1:]
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
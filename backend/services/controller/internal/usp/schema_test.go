@@ -0,0 +1,283 @@
+package usp
+
+import (
+	"reflect"
+	"testing"
+
+	usp_msg "github.com/leandrofars/oktopus/internal/usp_message"
+)
+
+func TestNewGetResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *usp_msg.GetResp
+		want GetResponse
+	}{
+		{"empty", &usp_msg.GetResp{}, GetResponse{Params: map[string]string{}}},
+		{"params and errors", &usp_msg.GetResp{ReqPathResults: []*usp_msg.GetResp_RequestedPathResult{
+			{
+				RequestedPath: "Device.WiFi.SSID.*.",
+				ResolvedPathResults: []*usp_msg.GetResp_ResolvedPathResult{
+					{ResolvedPath: "Device.WiFi.SSID.1.", ResultParams: map[string]string{"SSID": "home", "Enable": "true"}},
+					{ResolvedPath: "Device.WiFi.SSID.2.", ResultParams: map[string]string{"SSID": "guest"}},
+				},
+			},
+			{RequestedPath: "Device.Foo.", ErrCode: 7026, ErrMsg: "Invalid path"},
+		}}, GetResponse{
+			Params: map[string]string{
+				"Device.WiFi.SSID.1.SSID":   "home",
+				"Device.WiFi.SSID.1.Enable": "true",
+				"Device.WiFi.SSID.2.SSID":   "guest",
+			},
+			Errors: []PathError{{Path: "Device.Foo.", Code: 7026, Message: "Invalid path"}},
+		}},
+	}
+	for _, tt := range tests {
+		if got := NewGetResponse(tt.resp); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: NewGetResponse() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewSetResponse(t *testing.T) {
+	success := &usp_msg.SetResp_UpdatedObjectResult{
+		RequestedPath: "Device.WiFi.SSID.1.",
+		OperStatus: &usp_msg.SetResp_UpdatedObjectResult_OperationStatus{
+			OperStatus: &usp_msg.SetResp_UpdatedObjectResult_OperationStatus_OperSuccess{
+				OperSuccess: &usp_msg.SetResp_UpdatedObjectResult_OperationStatus_OperationSuccess{
+					UpdatedInstResults: []*usp_msg.SetResp_UpdatedInstanceResult{{
+						AffectedPath:  "Device.WiFi.SSID.1.",
+						UpdatedParams: map[string]string{"SSID": "home"},
+						ParamErrs:     []*usp_msg.SetResp_ParameterError{{Param: "Enable", ErrCode: 7012, ErrMsg: "Not writable"}},
+					}},
+				},
+			},
+		},
+	}
+	failure := &usp_msg.SetResp_UpdatedObjectResult{
+		RequestedPath: "Device.IP.Interface.*.",
+		OperStatus: &usp_msg.SetResp_UpdatedObjectResult_OperationStatus{
+			OperStatus: &usp_msg.SetResp_UpdatedObjectResult_OperationStatus_OperFailure{
+				OperFailure: &usp_msg.SetResp_UpdatedObjectResult_OperationStatus_OperationFailure{
+					ErrCode: 7004,
+					ErrMsg:  "Invalid value",
+					UpdatedInstFailures: []*usp_msg.SetResp_UpdatedInstanceFailure{{
+						AffectedPath: "Device.IP.Interface.2.",
+						ParamErrs:    []*usp_msg.SetResp_ParameterError{{Param: "MaxMTUSize", ErrCode: 7004, ErrMsg: "Out of range"}},
+					}},
+				},
+			},
+		},
+	}
+
+	got := NewSetResponse(&usp_msg.SetResp{UpdatedObjResults: []*usp_msg.SetResp_UpdatedObjectResult{success, failure}})
+	want := SetResponse{
+		Params: map[string]string{"Device.WiFi.SSID.1.SSID": "home"},
+		Errors: []PathError{
+			{Path: "Device.WiFi.SSID.1.Enable", Code: 7012, Message: "Not writable"},
+			{Path: "Device.IP.Interface.*.", Code: 7004, Message: "Invalid value"},
+			{Path: "Device.IP.Interface.2.MaxMTUSize", Code: 7004, Message: "Out of range"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewSetResponse() = %+v, want %+v", got, want)
+	}
+}
+
+func TestNewAddResponse(t *testing.T) {
+	got := NewAddResponse(&usp_msg.AddResp{CreatedObjResults: []*usp_msg.AddResp_CreatedObjectResult{
+		{
+			RequestedPath: "Device.NAT.PortMapping.",
+			OperStatus: &usp_msg.AddResp_CreatedObjectResult_OperationStatus{
+				OperStatus: &usp_msg.AddResp_CreatedObjectResult_OperationStatus_OperSuccess{
+					OperSuccess: &usp_msg.AddResp_CreatedObjectResult_OperationStatus_OperationSuccess{
+						InstantiatedPath: "Device.NAT.PortMapping.3.",
+						UniqueKeys:       map[string]string{"Alias": "cpe-3"},
+						ParamErrs:        []*usp_msg.AddResp_ParameterError{{Param: "Description", ErrCode: 7004, ErrMsg: "Too long"}},
+					},
+				},
+			},
+		},
+		{
+			RequestedPath: "Device.Foo.",
+			OperStatus: &usp_msg.AddResp_CreatedObjectResult_OperationStatus{
+				OperStatus: &usp_msg.AddResp_CreatedObjectResult_OperationStatus_OperFailure{
+					OperFailure: &usp_msg.AddResp_CreatedObjectResult_OperationStatus_OperationFailure{ErrCode: 7026, ErrMsg: "Invalid path"},
+				},
+			},
+		},
+	}})
+	want := AddResponse{
+		Created: []CreatedObject{{
+			RequestedPath: "Device.NAT.PortMapping.",
+			Path:          "Device.NAT.PortMapping.3.",
+			UniqueKeys:    map[string]string{"Alias": "cpe-3"},
+			Errors:        []PathError{{Path: "Device.NAT.PortMapping.3.Description", Code: 7004, Message: "Too long"}},
+		}},
+		Errors: []PathError{{Path: "Device.Foo.", Code: 7026, Message: "Invalid path"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewAddResponse() = %+v, want %+v", got, want)
+	}
+
+	if got := NewAddResponse(&usp_msg.AddResp{}); got.Created == nil {
+		t.Error("NewAddResponse() of an empty answer has nil Created, want an empty list")
+	}
+}
+
+func TestNewDeleteResponse(t *testing.T) {
+	got := NewDeleteResponse(&usp_msg.DeleteResp{DeletedObjResults: []*usp_msg.DeleteResp_DeletedObjectResult{
+		{
+			RequestedPath: "Device.NAT.PortMapping.*.",
+			OperStatus: &usp_msg.DeleteResp_DeletedObjectResult_OperationStatus{
+				OperStatus: &usp_msg.DeleteResp_DeletedObjectResult_OperationStatus_OperSuccess{
+					OperSuccess: &usp_msg.DeleteResp_DeletedObjectResult_OperationStatus_OperationSuccess{
+						AffectedPaths:      []string{"Device.NAT.PortMapping.1.", "Device.NAT.PortMapping.2."},
+						UnaffectedPathErrs: []*usp_msg.DeleteResp_UnaffectedPathError{{UnaffectedPath: "Device.NAT.PortMapping.3.", ErrCode: 7015, ErrMsg: "Locked"}},
+					},
+				},
+			},
+		},
+		{
+			RequestedPath: "Device.DeviceInfo.",
+			OperStatus: &usp_msg.DeleteResp_DeletedObjectResult_OperationStatus{
+				OperStatus: &usp_msg.DeleteResp_DeletedObjectResult_OperationStatus_OperFailure{
+					OperFailure: &usp_msg.DeleteResp_DeletedObjectResult_OperationStatus_OperationFailure{ErrCode: 7018, ErrMsg: "Not a table"},
+				},
+			},
+		},
+	}})
+	want := DeleteResponse{
+		Deleted: []string{"Device.NAT.PortMapping.1.", "Device.NAT.PortMapping.2."},
+		Errors: []PathError{
+			{Path: "Device.NAT.PortMapping.3.", Code: 7015, Message: "Locked"},
+			{Path: "Device.DeviceInfo.", Code: 7018, Message: "Not a table"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewDeleteResponse() = %+v, want %+v", got, want)
+	}
+}
+
+func TestNewOperateResponse(t *testing.T) {
+	got := NewOperateResponse(&usp_msg.OperateResp{OperationResults: []*usp_msg.OperateResp_OperationResult{
+		{
+			ExecutedCommand: "Device.IP.Diagnostics.IPPing()",
+			OperationResp:   &usp_msg.OperateResp_OperationResult_ReqObjPath{ReqObjPath: "Device.LocalAgent.Request.4."},
+		},
+		{
+			ExecutedCommand: "Device.DeviceInfo.X_VENDOR_Info()",
+			OperationResp: &usp_msg.OperateResp_OperationResult_ReqOutputArgs{
+				ReqOutputArgs: &usp_msg.OperateResp_OperationResult_OutputArgs{OutputArgs: map[string]string{"Uptime": "100"}},
+			},
+		},
+		{
+			ExecutedCommand: "Device.Reboot()",
+			OperationResp: &usp_msg.OperateResp_OperationResult_CmdFailure{
+				CmdFailure: &usp_msg.OperateResp_OperationResult_CommandFailure{ErrCode: 7022, ErrMsg: "Command failure"},
+			},
+		},
+	}})
+	want := OperateResponse{Results: []OperationResult{
+		{Command: "Device.IP.Diagnostics.IPPing()", Path: "Device.LocalAgent.Request.4."},
+		{Command: "Device.DeviceInfo.X_VENDOR_Info()", Outputs: map[string]string{"Uptime": "100"}},
+		{Command: "Device.Reboot()", Error: &PathError{Path: "Device.Reboot()", Code: 7022, Message: "Command failure"}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewOperateResponse() = %+v, want %+v", got, want)
+	}
+}
+
+func TestNewGetInstancesResponse(t *testing.T) {
+	got := NewGetInstancesResponse(&usp_msg.GetInstancesResp{ReqPathResults: []*usp_msg.GetInstancesResp_RequestedPathResult{
+		{
+			RequestedPath: "Device.WiFi.SSID.",
+			CurrInsts: []*usp_msg.GetInstancesResp_CurrInstance{
+				{InstantiatedObjPath: "Device.WiFi.SSID.1.", UniqueKeys: map[string]string{"Alias": "cpe-1"}},
+				{InstantiatedObjPath: "Device.WiFi.SSID.2."},
+			},
+		},
+		{RequestedPath: "Device.Foo.", ErrCode: 7026, ErrMsg: "Invalid path"},
+	}})
+	want := GetInstancesResponse{
+		Instances: []Instance{
+			{Path: "Device.WiFi.SSID.1.", UniqueKeys: map[string]string{"Alias": "cpe-1"}},
+			{Path: "Device.WiFi.SSID.2."},
+		},
+		Errors: []PathError{{Path: "Device.Foo.", Code: 7026, Message: "Invalid path"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewGetInstancesResponse() = %+v, want %+v", got, want)
+	}
+}
+
+func TestNewGetSupportedDMResponse(t *testing.T) {
+	got := NewGetSupportedDMResponse(&usp_msg.GetSupportedDMResp{ReqObjResults: []*usp_msg.GetSupportedDMResp_RequestedObjectResult{
+		{
+			ReqObjPath: "Device.WiFi.",
+			SupportedObjs: []*usp_msg.GetSupportedDMResp_SupportedObjectResult{
+				{
+					SupportedObjPath: "Device.WiFi.SSID.{i}.",
+					Access:           usp_msg.GetSupportedDMResp_OBJ_ADD_DELETE,
+					IsMultiInstance:  true,
+					SupportedParams: []*usp_msg.GetSupportedDMResp_SupportedParamResult{
+						{ParamName: "SSID", Access: usp_msg.GetSupportedDMResp_PARAM_READ_WRITE, ValueType: usp_msg.GetSupportedDMResp_PARAM_STRING},
+						{ParamName: "Enable", Access: usp_msg.GetSupportedDMResp_PARAM_READ_WRITE, ValueType: usp_msg.GetSupportedDMResp_PARAM_BOOLEAN},
+					},
+				},
+				{
+					SupportedObjPath: "Device.WiFi.",
+					Access:           usp_msg.GetSupportedDMResp_OBJ_READ_ONLY,
+					SupportedCommands: []*usp_msg.GetSupportedDMResp_SupportedCommandResult{{
+						CommandName:    "NeighboringWiFiDiagnostic()",
+						CommandType:    usp_msg.GetSupportedDMResp_CMD_ASYNC,
+						OutputArgNames: []string{"Status"},
+					}},
+					SupportedEvents: []*usp_msg.GetSupportedDMResp_SupportedEventResult{{EventName: "Changed!", ArgNames: []string{"SSID"}}},
+				},
+			},
+		},
+		{ReqObjPath: "Device.Foo.", ErrCode: 7026, ErrMsg: "Invalid path"},
+	}})
+	want := GetSupportedDMResponse{
+		Objects: []SupportedObject{
+			{
+				Path:          "Device.WiFi.SSID.{i}.",
+				Access:        "addDelete",
+				MultiInstance: true,
+				Params: []SupportedParam{
+					{Name: "SSID", Access: "readWrite", Type: "string"},
+					{Name: "Enable", Access: "readWrite", Type: "boolean"},
+				},
+			},
+			{
+				Path:     "Device.WiFi.",
+				Access:   "readOnly",
+				Commands: []SupportedCommand{{Name: "NeighboringWiFiDiagnostic()", Type: "async", Outputs: []string{"Status"}}},
+				Events:   []SupportedEvent{{Name: "Changed!", Args: []string{"SSID"}}},
+			},
+		},
+		Errors: []PathError{{Path: "Device.Foo.", Code: 7026, Message: "Invalid path"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewGetSupportedDMResponse() = %+v, want %+v", got, want)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	got := NewError(&usp_msg.Error{
+		ErrCode: 7000,
+		ErrMsg:  "Message failed",
+		ParamErrs: []*usp_msg.Error_ParamError{
+			{ParamPath: "Device.WiFi.SSID.1.SSID", ErrCode: 7012, ErrMsg: "Not writable"},
+		},
+	})
+	want := &Error{
+		Code:    7000,
+		Message: "Message failed",
+		Params:  []PathError{{Path: "Device.WiFi.SSID.1.SSID", Code: 7012, Message: "Not writable"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewError() = %+v, want %+v", got, want)
+	}
+}
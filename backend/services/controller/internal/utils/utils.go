@@ -14,6 +14,9 @@ const (
 	Offline
 )
 
+// Endpoint ID the controller sends its records from
+const ControllerId = "oktopusController"
+
 // Get interfaces MACs, and the first interface MAC is gonna be used as mqtt clientId
 func GetMacAddr() ([]string, error) {
 	ifas, err := net.Interfaces()
@@ -34,7 +37,7 @@ func NewUspRecord(p []byte, toId string) usp_record.Record {
 	return usp_record.Record{
 		Version:         "0.1",
 		ToId:            toId,
-		FromId:          "oktopusController",
+		FromId:          ControllerId,
 		PayloadSecurity: usp_record.Record_PLAINTEXT,
 		RecordType: &usp_record.Record_NoSessionContext{
 			NoSessionContext: &usp_record.NoSessionContextRecord{
@@ -44,8 +47,8 @@ func NewUspRecord(p []byte, toId string) usp_record.Record {
 	}
 }
 
-func NewCreateMsg(createStuff usp_msg.Add) usp_msg.Msg {
-	return usp_msg.Msg{
+func NewCreateMsg(createStuff *usp_msg.Add) *usp_msg.Msg {
+	return &usp_msg.Msg{
 		Header: &usp_msg.Header{
 			MsgId:   uuid.NewString(),
 			MsgType: usp_msg.Header_ADD,
@@ -54,7 +57,7 @@ func NewCreateMsg(createStuff usp_msg.Add) usp_msg.Msg {
 			MsgBody: &usp_msg.Body_Request{
 				Request: &usp_msg.Request{
 					ReqType: &usp_msg.Request_Add{
-						Add: &createStuff,
+						Add: createStuff,
 					},
 				},
 			},
@@ -62,8 +65,8 @@ func NewCreateMsg(createStuff usp_msg.Add) usp_msg.Msg {
 	}
 }
 
-func NewGetMsg(getStuff usp_msg.Get) usp_msg.Msg {
-	return usp_msg.Msg{
+func NewGetMsg(getStuff *usp_msg.Get) *usp_msg.Msg {
+	return &usp_msg.Msg{
 		Header: &usp_msg.Header{
 			MsgId:   uuid.NewString(),
 			MsgType: usp_msg.Header_GET,
@@ -72,7 +75,7 @@ func NewGetMsg(getStuff usp_msg.Get) usp_msg.Msg {
 			MsgBody: &usp_msg.Body_Request{
 				Request: &usp_msg.Request{
 					ReqType: &usp_msg.Request_Get{
-						Get: &getStuff,
+						Get: getStuff,
 					},
 				},
 			},
@@ -80,8 +83,8 @@ func NewGetMsg(getStuff usp_msg.Get) usp_msg.Msg {
 	}
 }
 
-func NewDelMsg(getStuff usp_msg.Delete) usp_msg.Msg {
-	return usp_msg.Msg{
+func NewDelMsg(getStuff *usp_msg.Delete) *usp_msg.Msg {
+	return &usp_msg.Msg{
 		Header: &usp_msg.Header{
 			MsgId:   uuid.NewString(),
 			MsgType: usp_msg.Header_DELETE,
@@ -90,7 +93,7 @@ func NewDelMsg(getStuff usp_msg.Delete) usp_msg.Msg {
 			MsgBody: &usp_msg.Body_Request{
 				Request: &usp_msg.Request{
 					ReqType: &usp_msg.Request_Delete{
-						Delete: &getStuff,
+						Delete: getStuff,
 					},
 				},
 			},
@@ -98,8 +101,8 @@ func NewDelMsg(getStuff usp_msg.Delete) usp_msg.Msg {
 	}
 }
 
-func NewSetMsg(updateStuff usp_msg.Set) usp_msg.Msg {
-	return usp_msg.Msg{
+func NewSetMsg(updateStuff *usp_msg.Set) *usp_msg.Msg {
+	return &usp_msg.Msg{
 		Header: &usp_msg.Header{
 			MsgId:   uuid.NewString(),
 			MsgType: usp_msg.Header_SET,
@@ -108,7 +111,7 @@ func NewSetMsg(updateStuff usp_msg.Set) usp_msg.Msg {
 			MsgBody: &usp_msg.Body_Request{
 				Request: &usp_msg.Request{
 					ReqType: &usp_msg.Request_Set{
-						Set: &updateStuff,
+						Set: updateStuff,
 					},
 				},
 			},
@@ -116,8 +119,8 @@ func NewSetMsg(updateStuff usp_msg.Set) usp_msg.Msg {
 	}
 }
 
-func NewGetSupportedParametersMsg(getStuff usp_msg.GetSupportedDM) usp_msg.Msg {
-	return usp_msg.Msg{
+func NewGetSupportedParametersMsg(getStuff *usp_msg.GetSupportedDM) *usp_msg.Msg {
+	return &usp_msg.Msg{
 		Header: &usp_msg.Header{
 			MsgId:   uuid.NewString(),
 			MsgType: usp_msg.Header_GET_SUPPORTED_DM,
@@ -126,7 +129,7 @@ func NewGetSupportedParametersMsg(getStuff usp_msg.GetSupportedDM) usp_msg.Msg {
 			MsgBody: &usp_msg.Body_Request{
 				Request: &usp_msg.Request{
 					ReqType: &usp_msg.Request_GetSupportedDm{
-						GetSupportedDm: &getStuff,
+						GetSupportedDm: getStuff,
 					},
 				},
 			},
@@ -134,8 +137,8 @@ func NewGetSupportedParametersMsg(getStuff usp_msg.GetSupportedDM) usp_msg.Msg {
 	}
 }
 
-func NewGetParametersInstancesMsg(getStuff usp_msg.GetInstances) usp_msg.Msg {
-	return usp_msg.Msg{
+func NewGetParametersInstancesMsg(getStuff *usp_msg.GetInstances) *usp_msg.Msg {
+	return &usp_msg.Msg{
 		Header: &usp_msg.Header{
 			MsgId:   uuid.NewString(),
 			MsgType: usp_msg.Header_GET_INSTANCES,
@@ -144,7 +147,7 @@ func NewGetParametersInstancesMsg(getStuff usp_msg.GetInstances) usp_msg.Msg {
 			MsgBody: &usp_msg.Body_Request{
 				Request: &usp_msg.Request{
 					ReqType: &usp_msg.Request_GetInstances{
-						GetInstances: &getStuff,
+						GetInstances: getStuff,
 					},
 				},
 			},
@@ -152,8 +155,8 @@ func NewGetParametersInstancesMsg(getStuff usp_msg.GetInstances) usp_msg.Msg {
 	}
 }
 
-func NewOperateMsg(getStuff usp_msg.Operate) usp_msg.Msg {
-	return usp_msg.Msg{
+func NewOperateMsg(getStuff *usp_msg.Operate) *usp_msg.Msg {
+	return &usp_msg.Msg{
 		Header: &usp_msg.Header{
 			MsgId:   uuid.NewString(),
 			MsgType: usp_msg.Header_OPERATE,
@@ -162,7 +165,29 @@ func NewOperateMsg(getStuff usp_msg.Operate) usp_msg.Msg {
 			MsgBody: &usp_msg.Body_Request{
 				Request: &usp_msg.Request{
 					ReqType: &usp_msg.Request_Operate{
-						Operate: &getStuff,
+						Operate: getStuff,
+					},
+				},
+			},
+		},
+	}
+}
+
+// Acknowledges the notification with message id msgId, as agents asking for
+// an answer keep sending it until they get one
+func NewNotifyRespMsg(msgId, subscriptionId string) *usp_msg.Msg {
+	return &usp_msg.Msg{
+		Header: &usp_msg.Header{
+			MsgId:   msgId,
+			MsgType: usp_msg.Header_NOTIFY_RESP,
+		},
+		Body: &usp_msg.Body{
+			MsgBody: &usp_msg.Body_Response{
+				Response: &usp_msg.Response{
+					RespType: &usp_msg.Response_NotifyResp{
+						NotifyResp: &usp_msg.NotifyResp{
+							SubscriptionId: subscriptionId,
+						},
 					},
 				},
 			},
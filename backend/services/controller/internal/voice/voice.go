@@ -0,0 +1,318 @@
+// Reads and provisions the SIP phone lines of voice gateways, as modeled by
+// TR-104 version 2.
+package voice
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const serviceTable = "Device.Services.VoiceService."
+
+var transports = []string{"UDP", "TCP", "TLS", "SCTP"}
+
+type Service struct {
+	Path     string    `json:"path"`
+	Networks []Network `json:"networks"`
+	Lines    []Line    `json:"lines"`
+}
+
+// SIP network, the registrar and proxies lines register through
+type Network struct {
+	Path                     string `json:"path"`
+	Enable                   bool   `json:"enable"`
+	Status                   string `json:"status"`
+	RegistrarServer          string `json:"registrarServer"`
+	RegistrarServerPort      int    `json:"registrarServerPort"`
+	RegistrarServerTransport string `json:"registrarServerTransport"`
+	ProxyServer              string `json:"proxyServer"`
+	ProxyServerPort          int    `json:"proxyServerPort"`
+	ProxyServerTransport     string `json:"proxyServerTransport"`
+	OutboundProxy            string `json:"outboundProxy"`
+	OutboundProxyPort        int    `json:"outboundProxyPort"`
+	UserAgentDomain          string `json:"userAgentDomain"`
+	RegisterExpires          int    `json:"registerExpires"`
+}
+
+/*
+Line is a phone line along with the SIP client it registers through, the
+Provider of the line. Registration is the status of the client, "Up" once
+registered. Passwords are write only, so they are never read back.
+*/
+type Line struct {
+	Path            string    `json:"path"`
+	Enable          bool      `json:"enable"`
+	Status          string    `json:"status"`
+	CallStatus      string    `json:"callStatus"`
+	DirectoryNumber string    `json:"directoryNumber"`
+	Client          string    `json:"client,omitempty"`
+	Network         string    `json:"network,omitempty"`
+	Registration    string    `json:"registration,omitempty"`
+	Registered      bool      `json:"registered"`
+	AuthUserName    string    `json:"authUserName"`
+	RegisterURI     string    `json:"registerURI"`
+	Stats           LineStats `json:"stats"`
+}
+
+// Call counters of a line since the device last reset them, times are in seconds
+type LineStats struct {
+	IncomingReceived  int `json:"incomingReceived"`
+	IncomingConnected int `json:"incomingConnected"`
+	IncomingFailed    int `json:"incomingFailed"`
+	IncomingDropped   int `json:"incomingDropped"`
+	IncomingCallTime  int `json:"incomingCallTime"`
+	OutgoingAttempted int `json:"outgoingAttempted"`
+	OutgoingConnected int `json:"outgoingConnected"`
+	OutgoingFailed    int `json:"outgoingFailed"`
+	OutgoingDropped   int `json:"outgoingDropped"`
+	OutgoingCallTime  int `json:"outgoingCallTime"`
+}
+
+// Changes to apply, fields left out are kept as they are
+type NetworkChange struct {
+	Path                     string  `json:"path"`
+	Enable                   *bool   `json:"enable,omitempty"`
+	RegistrarServer          *string `json:"registrarServer,omitempty"`
+	RegistrarServerPort      *int    `json:"registrarServerPort,omitempty"`
+	RegistrarServerTransport *string `json:"registrarServerTransport,omitempty"`
+	ProxyServer              *string `json:"proxyServer,omitempty"`
+	ProxyServerPort          *int    `json:"proxyServerPort,omitempty"`
+	ProxyServerTransport     *string `json:"proxyServerTransport,omitempty"`
+	OutboundProxy            *string `json:"outboundProxy,omitempty"`
+	OutboundProxyPort        *int    `json:"outboundProxyPort,omitempty"`
+	UserAgentDomain          *string `json:"userAgentDomain,omitempty"`
+	RegisterExpires          *int    `json:"registerExpires,omitempty"`
+}
+
+// Enable turns both the line and its SIP client on or off
+type LineChange struct {
+	Path            string  `json:"path"`
+	Enable          *bool   `json:"enable,omitempty"`
+	DirectoryNumber *string `json:"directoryNumber,omitempty"`
+	AuthUserName    *string `json:"authUserName,omitempty"`
+	AuthPassword    *string `json:"authPassword,omitempty"`
+	RegisterURI     *string `json:"registerURI,omitempty"`
+}
+
+type Request struct {
+	Networks []NetworkChange `json:"networks"`
+	Lines    []LineChange    `json:"lines"`
+}
+
+// Get reads every voice service of the device with its SIP networks and lines.
+func Get(ctx context.Context, d *usp.Dispatcher, sn string) ([]Service, error) {
+	resp, err := usp.Get.Run(ctx, d, sn, usp.GetRequest{Paths: []string{serviceTable}})
+	if err != nil {
+		return nil, err
+	}
+	values := resp.Params
+
+	result := []Service{}
+	for _, path := range dm.Instances(values, serviceTable) {
+		s := Service{Path: path, Networks: []Network{}, Lines: []Line{}}
+		for _, n := range dm.Instances(values, path+"SIP.Network.") {
+			s.Networks = append(s.Networks, Network{
+				Path:                     n,
+				Enable:                   dm.ParseBool(values[n+"Enable"]),
+				Status:                   values[n+"Status"],
+				RegistrarServer:          values[n+"RegistrarServer"],
+				RegistrarServerPort:      dm.Atoi(values[n+"RegistrarServerPort"]),
+				RegistrarServerTransport: values[n+"RegistrarServerTransport"],
+				ProxyServer:              values[n+"ProxyServer"],
+				ProxyServerPort:          dm.Atoi(values[n+"ProxyServerPort"]),
+				ProxyServerTransport:     values[n+"ProxyServerTransport"],
+				OutboundProxy:            values[n+"OutboundProxy"],
+				OutboundProxyPort:        dm.Atoi(values[n+"OutboundProxyPort"]),
+				UserAgentDomain:          values[n+"UserAgentDomain"],
+				RegisterExpires:          dm.Atoi(values[n+"RegisterExpires"]),
+			})
+		}
+		for _, l := range dm.Instances(values, path+"CallControl.Line.") {
+			line := Line{
+				Path:            l,
+				Enable:          dm.ParseBool(values[l+"Enable"]),
+				Status:          values[l+"Status"],
+				CallStatus:      values[l+"CallStatus"],
+				DirectoryNumber: values[l+"DirectoryNumber"],
+				Stats: LineStats{
+					IncomingReceived:  dm.Atoi(values[l+"Stats.IncomingCalls.CallsReceived"]),
+					IncomingConnected: dm.Atoi(values[l+"Stats.IncomingCalls.CallsConnected"]),
+					IncomingFailed:    dm.Atoi(values[l+"Stats.IncomingCalls.CallsFailed"]),
+					IncomingDropped:   dm.Atoi(values[l+"Stats.IncomingCalls.CallsDropped"]),
+					IncomingCallTime:  dm.Atoi(values[l+"Stats.IncomingCalls.TotalCallTime"]),
+					OutgoingAttempted: dm.Atoi(values[l+"Stats.OutgoingCalls.CallsAttempted"]),
+					OutgoingConnected: dm.Atoi(values[l+"Stats.OutgoingCalls.CallsConnected"]),
+					OutgoingFailed:    dm.Atoi(values[l+"Stats.OutgoingCalls.CallsFailed"]),
+					OutgoingDropped:   dm.Atoi(values[l+"Stats.OutgoingCalls.CallsDropped"]),
+					OutgoingCallTime:  dm.Atoi(values[l+"Stats.OutgoingCalls.TotalCallTime"]),
+				},
+			}
+			if c := dm.WithDot(values[l+"Provider"]); strings.HasPrefix(c, path+"SIP.Client.") {
+				line.Client = c
+				line.Network = dm.WithDot(values[c+"Network"])
+				line.Registration = values[c+"Status"]
+				line.Registered = line.Registration == "Up"
+				line.AuthUserName = values[c+"AuthUserName"]
+				line.RegisterURI = values[c+"RegisterURI"]
+			}
+			s.Lines = append(s.Lines, line)
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+/*
+Set validates the changes, then applies them all at once, so either every
+change is applied or none is. Lines registering through no SIP client only
+take their own settings, not credentials.
+*/
+func Set(ctx context.Context, d *usp.Dispatcher, sn string, req Request) ([]Service, error) {
+	if len(req.Networks) == 0 && len(req.Lines) == 0 {
+		return nil, fmt.Errorf("%w: no changes", usp.ErrInvalidRequest)
+	}
+	current, err := Get(ctx, d, sn)
+	if err != nil {
+		return nil, err
+	}
+
+	set := map[string]string{}
+	for _, change := range req.Networks {
+		if err := networkParams(current, change, set); err != nil {
+			return nil, err
+		}
+	}
+	for _, change := range req.Lines {
+		if err := lineParams(current, change, set); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = usp.Set.Run(ctx, d, sn, usp.SetRequest{Params: set})
+	if err != nil {
+		return nil, err
+	}
+	return Get(ctx, d, sn)
+}
+
+func networkParams(services []Service, change NetworkChange, set map[string]string) error {
+	found := false
+	for _, s := range services {
+		for _, n := range s.Networks {
+			found = found || n.Path == dm.WithDot(change.Path)
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: no SIP network %s", usp.ErrInvalidRequest, change.Path)
+	}
+	path := dm.WithDot(change.Path)
+
+	if change.Enable != nil {
+		set[path+"Enable"] = strconv.FormatBool(*change.Enable)
+	}
+	for _, x := range []struct {
+		name      string
+		host      *string
+		port      *int
+		transport *string
+	}{
+		{"RegistrarServer", change.RegistrarServer, change.RegistrarServerPort, change.RegistrarServerTransport},
+		{"ProxyServer", change.ProxyServer, change.ProxyServerPort, change.ProxyServerTransport},
+		{"OutboundProxy", change.OutboundProxy, change.OutboundProxyPort, nil},
+	} {
+		if x.host != nil {
+			if len(*x.host) > 256 || strings.ContainsAny(*x.host, " \t") {
+				return fmt.Errorf("%w: invalid %s %q", usp.ErrInvalidRequest, x.name, *x.host)
+			}
+			set[path+x.name] = *x.host
+		}
+		if x.port != nil {
+			if *x.port < 0 || *x.port > 65535 {
+				return fmt.Errorf("%w: %sPort must be up to 65535", usp.ErrInvalidRequest, x.name)
+			}
+			set[path+x.name+"Port"] = strconv.Itoa(*x.port)
+		}
+		if x.transport != nil {
+			if !dm.Contains(transports, *x.transport) {
+				return fmt.Errorf("%w: %sTransport must be one of %v", usp.ErrInvalidRequest, x.name, transports)
+			}
+			set[path+x.name+"Transport"] = *x.transport
+		}
+	}
+	if change.UserAgentDomain != nil {
+		set[path+"UserAgentDomain"] = *change.UserAgentDomain
+	}
+	if change.RegisterExpires != nil {
+		if *change.RegisterExpires <= 0 {
+			return fmt.Errorf("%w: register expires must be a number of seconds", usp.ErrInvalidRequest)
+		}
+		set[path+"RegisterExpires"] = strconv.Itoa(*change.RegisterExpires)
+	}
+	return nil
+}
+
+func lineParams(services []Service, change LineChange, set map[string]string) error {
+	var line *Line
+	for i := range services {
+		for j := range services[i].Lines {
+			if services[i].Lines[j].Path == dm.WithDot(change.Path) {
+				line = &services[i].Lines[j]
+			}
+		}
+	}
+	if line == nil {
+		return fmt.Errorf("%w: no line %s", usp.ErrInvalidRequest, change.Path)
+	}
+	path := line.Path
+
+	if change.Enable != nil {
+		set[path+"Enable"] = strconv.FormatBool(*change.Enable)
+		if line.Client != "" {
+			set[line.Client+"Enable"] = strconv.FormatBool(*change.Enable)
+		}
+	}
+	if change.DirectoryNumber != nil {
+		if !validNumber(*change.DirectoryNumber) {
+			return fmt.Errorf("%w: directory number must be digits, optionally after a +", usp.ErrInvalidRequest)
+		}
+		set[path+"DirectoryNumber"] = *change.DirectoryNumber
+	}
+	if change.AuthUserName == nil && change.AuthPassword == nil && change.RegisterURI == nil {
+		return nil
+	}
+
+	if line.Client == "" {
+		return fmt.Errorf("%w: line %s has no SIP client to set its credentials", usp.ErrInvalidRequest, path)
+	}
+	if change.AuthUserName != nil {
+		if len(*change.AuthUserName) > 128 {
+			return fmt.Errorf("%w: user name must have up to 128 characters", usp.ErrInvalidRequest)
+		}
+		set[line.Client+"AuthUserName"] = *change.AuthUserName
+	}
+	if change.AuthPassword != nil {
+		if len(*change.AuthPassword) > 128 {
+			return fmt.Errorf("%w: password must have up to 128 characters", usp.ErrInvalidRequest)
+		}
+		set[line.Client+"AuthPassword"] = *change.AuthPassword
+	}
+	if change.RegisterURI != nil {
+		set[line.Client+"RegisterURI"] = *change.RegisterURI
+	}
+	return nil
+}
+
+func validNumber(s string) bool {
+	s = strings.TrimPrefix(s, "+")
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(s) <= 32
+}
@@ -0,0 +1,227 @@
+// Gathers the WAN connectivity of devices into a single view.
+package wan
+
+import (
+	"context"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const (
+	ipTable     = "Device.IP.Interface."
+	pppTable    = "Device.PPP.Interface."
+	dnsTable    = "Device.DNS.Client.Server."
+	routerTable = "Device.Routing.Router."
+)
+
+var params = []string{
+	"Device.DeviceInfo.UpTime",
+	ipTable + "*.Enable",
+	ipTable + "*.Status",
+	ipTable + "*.Name",
+	ipTable + "*.Alias",
+	ipTable + "*.Type",
+	ipTable + "*.LowerLayers",
+	ipTable + "*.LastChange",
+	ipTable + "*.IPv4Address.*.",
+	ipTable + "*.IPv6Address.*.",
+	pppTable + "*.Enable",
+	pppTable + "*.Status",
+	pppTable + "*.Name",
+	pppTable + "*.ConnectionStatus",
+	pppTable + "*.LastConnectionError",
+	pppTable + "*.LastChange",
+	pppTable + "*.Username",
+	pppTable + "*.LowerLayers",
+	pppTable + "*.IPCP.LocalIPAddress",
+	pppTable + "*.IPCP.RemoteIPAddress",
+	pppTable + "*.Stats.ErrorsSent",
+	pppTable + "*.Stats.ErrorsReceived",
+	dnsTable + "*.",
+	routerTable + "*.IPv4Forwarding.*.",
+	routerTable + "*.IPv6Forwarding.*.",
+}
+
+type Address struct {
+	Path    string `json:"path"`
+	Enable  bool   `json:"enable"`
+	Status  string `json:"status"`
+	Address string `json:"address"`
+	// Subnet mask of IPv4 addresses
+	SubnetMask string `json:"subnetMask,omitempty"`
+	// AddressingType of IPv4 addresses, Origin of IPv6 ones
+	Origin string `json:"origin,omitempty"`
+}
+
+// LastChange is how long ago, in seconds, the interface got its status.
+// Interfaces holding a default route are WAN ones.
+type Interface struct {
+	Path        string    `json:"path"`
+	Name        string    `json:"name"`
+	Alias       string    `json:"alias,omitempty"`
+	Enable      bool      `json:"enable"`
+	Status      string    `json:"status"`
+	Type        string    `json:"type,omitempty"`
+	LowerLayers string    `json:"lowerLayers,omitempty"`
+	LastChange  int       `json:"lastChange"`
+	WAN         bool      `json:"wan"`
+	IPv4        []Address `json:"ipv4"`
+	IPv6        []Address `json:"ipv6"`
+}
+
+type PPPInterface struct {
+	Path                string `json:"path"`
+	Name                string `json:"name"`
+	Enable              bool   `json:"enable"`
+	Status              string `json:"status"`
+	ConnectionStatus    string `json:"connectionStatus"`
+	LastConnectionError string `json:"lastConnectionError,omitempty"`
+	LastChange          int    `json:"lastChange"`
+	Username            string `json:"username,omitempty"`
+	LowerLayers         string `json:"lowerLayers,omitempty"`
+	LocalIPAddress      string `json:"localIPAddress,omitempty"`
+	RemoteIPAddress     string `json:"remoteIPAddress,omitempty"`
+	ErrorsSent          int    `json:"errorsSent"`
+	ErrorsReceived      int    `json:"errorsReceived"`
+}
+
+type DNSServer struct {
+	Path      string `json:"path"`
+	Enable    bool   `json:"enable"`
+	Status    string `json:"status"`
+	Server    string `json:"server"`
+	Type      string `json:"type,omitempty"`
+	Interface string `json:"interface,omitempty"`
+}
+
+type Route struct {
+	Path      string `json:"path"`
+	Status    string `json:"status"`
+	Gateway   string `json:"gateway"`
+	Interface string `json:"interface"`
+	Metric    int    `json:"metric"`
+	Origin    string `json:"origin,omitempty"`
+}
+
+// UpTime is how long ago, in seconds, the device booted.
+type Status struct {
+	UpTime        int            `json:"upTime"`
+	Interfaces    []Interface    `json:"interfaces"`
+	PPP           []PPPInterface `json:"ppp"`
+	DNSServers    []DNSServer    `json:"dnsServers"`
+	DefaultRoutes []Route        `json:"defaultRoutes"`
+}
+
+// Get reads the WAN status of the device with a single request. Params the
+// device lacks are left empty.
+func Get(ctx context.Context, d *usp.Dispatcher, sn string) (Status, error) {
+	resp, err := usp.Get.Run(ctx, d, sn, usp.GetRequest{Paths: params})
+	if err != nil {
+		return Status{}, err
+	}
+	values := resp.Params
+
+	status := Status{
+		UpTime:        dm.Atoi(values["Device.DeviceInfo.UpTime"]),
+		Interfaces:    []Interface{},
+		PPP:           []PPPInterface{},
+		DNSServers:    []DNSServer{},
+		DefaultRoutes: []Route{},
+	}
+
+	for _, router := range dm.Instances(values, routerTable) {
+		for _, path := range dm.Instances(values, router+"IPv4Forwarding.") {
+			dest, mask := values[path+"DestIPAddress"], values[path+"DestSubnetMask"]
+			if (dest == "" || dest == "0.0.0.0") && (mask == "" || mask == "0.0.0.0") {
+				status.DefaultRoutes = append(status.DefaultRoutes, route(values, path, "GatewayIPAddress"))
+			}
+		}
+		for _, path := range dm.Instances(values, router+"IPv6Forwarding.") {
+			if prefix := values[path+"DestIPPrefix"]; prefix == "" || prefix == "::/0" {
+				status.DefaultRoutes = append(status.DefaultRoutes, route(values, path, "NextHop"))
+			}
+		}
+	}
+	wan := map[string]bool{}
+	for _, r := range status.DefaultRoutes {
+		wan[r.Interface] = true
+	}
+
+	for _, path := range dm.Instances(values, ipTable) {
+		x := Interface{
+			Path:        path,
+			Name:        values[path+"Name"],
+			Alias:       values[path+"Alias"],
+			Enable:      dm.ParseBool(values[path+"Enable"]),
+			Status:      values[path+"Status"],
+			Type:        values[path+"Type"],
+			LowerLayers: values[path+"LowerLayers"],
+			LastChange:  dm.Atoi(values[path+"LastChange"]),
+			WAN:         wan[path],
+			IPv4:        []Address{},
+			IPv6:        []Address{},
+		}
+		for _, a := range dm.Instances(values, path+"IPv4Address.") {
+			x.IPv4 = append(x.IPv4, Address{
+				Path:       a,
+				Enable:     dm.ParseBool(values[a+"Enable"]),
+				Status:     values[a+"Status"],
+				Address:    values[a+"IPAddress"],
+				SubnetMask: values[a+"SubnetMask"],
+				Origin:     values[a+"AddressingType"],
+			})
+		}
+		for _, a := range dm.Instances(values, path+"IPv6Address.") {
+			x.IPv6 = append(x.IPv6, Address{
+				Path:    a,
+				Enable:  dm.ParseBool(values[a+"Enable"]),
+				Status:  values[a+"Status"],
+				Address: values[a+"IPAddress"],
+				Origin:  values[a+"Origin"],
+			})
+		}
+		status.Interfaces = append(status.Interfaces, x)
+	}
+
+	for _, path := range dm.Instances(values, pppTable) {
+		status.PPP = append(status.PPP, PPPInterface{
+			Path:                path,
+			Name:                values[path+"Name"],
+			Enable:              dm.ParseBool(values[path+"Enable"]),
+			Status:              values[path+"Status"],
+			ConnectionStatus:    values[path+"ConnectionStatus"],
+			LastConnectionError: values[path+"LastConnectionError"],
+			LastChange:          dm.Atoi(values[path+"LastChange"]),
+			Username:            values[path+"Username"],
+			LowerLayers:         values[path+"LowerLayers"],
+			LocalIPAddress:      values[path+"IPCP.LocalIPAddress"],
+			RemoteIPAddress:     values[path+"IPCP.RemoteIPAddress"],
+			ErrorsSent:          dm.Atoi(values[path+"Stats.ErrorsSent"]),
+			ErrorsReceived:      dm.Atoi(values[path+"Stats.ErrorsReceived"]),
+		})
+	}
+
+	for _, path := range dm.Instances(values, dnsTable) {
+		status.DNSServers = append(status.DNSServers, DNSServer{
+			Path:      path,
+			Enable:    dm.ParseBool(values[path+"Enable"]),
+			Status:    values[path+"Status"],
+			Server:    values[path+"DNSServer"],
+			Type:      values[path+"Type"],
+			Interface: dm.WithDot(values[path+"Interface"]),
+		})
+	}
+	return status, nil
+}
+
+func route(values map[string]string, path, gateway string) Route {
+	return Route{
+		Path:      path,
+		Status:    values[path+"Status"],
+		Gateway:   values[path+gateway],
+		Interface: dm.WithDot(values[path+"Interface"]),
+		Metric:    dm.Atoi(values[path+"ForwardingMetric"]),
+		Origin:    values[path+"Origin"],
+	}
+}
@@ -0,0 +1,205 @@
+package wifi
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/leandrofars/oktopus/internal/command"
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const (
+	scanCommand = "Device.WiFi.NeighboringWiFiDiagnostic()"
+	// Where agents not returning the results as output arguments keep them
+	scanTable = "Device.WiFi.NeighboringWiFiDiagnostic.Result."
+)
+
+// Channels recommended on bands whose radio doesn't tell its possible ones,
+// the non overlapping ones on 2.4GHz and the ones free of DFS on 5GHz
+var defaultChannels = map[string][]int{
+	"2.4GHz": {1, 6, 11},
+	"5GHz":   {36, 40, 44, 48, 149, 153, 157, 161, 165},
+}
+
+type Neighbor struct {
+	SSID             string `json:"ssid"`
+	BSSID            string `json:"bssid"`
+	Radio            string `json:"radio,omitempty"`
+	FrequencyBand    string `json:"frequencyBand"`
+	Channel          int    `json:"channel"`
+	ChannelBandwidth string `json:"channelBandwidth,omitempty"`
+	// In dBm
+	SignalStrength int    `json:"signalStrength"`
+	Noise          int    `json:"noise,omitempty"`
+	Security       string `json:"security,omitempty"`
+}
+
+// Recommendation is the channel of the band least interfered by neighbors.
+// Interference is the sum of the power of overlapping neighbors, in mW.
+type Recommendation struct {
+	Radio               string  `json:"radio"`
+	FrequencyBand       string  `json:"frequencyBand"`
+	Channel             int     `json:"channel"`
+	Interference        float64 `json:"interference"`
+	CurrentChannel      int     `json:"currentChannel"`
+	CurrentInterference float64 `json:"currentInterference"`
+}
+
+type ScanResult struct {
+	Neighbors       []Neighbor       `json:"neighbors"`
+	Recommendations []Recommendation `json:"recommendations"`
+}
+
+/*
+Scan runs the neighboring WiFi diagnostic of the device, which may take a
+while, and recommends a channel for each of its radios.
+*/
+func Scan(ctx context.Context, r *command.Runner, sn string) (ScanResult, error) {
+	radios, err := Get(ctx, r.Usp, sn)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	outputs, err := r.Run(ctx, sn, scanCommand, nil)
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	neighbors := parseNeighbors(outputs, "Result.")
+	if len(neighbors) == 0 {
+		resp, err := usp.Get.Run(ctx, r.Usp, sn, usp.GetRequest{Paths: []string{scanTable}})
+		if err != nil {
+			return ScanResult{}, err
+		}
+		neighbors = parseNeighbors(resp.Params, scanTable)
+	}
+
+	result := ScanResult{Neighbors: neighbors, Recommendations: []Recommendation{}}
+	for _, radio := range radios {
+		if rec, ok := recommend(radio, neighbors); ok {
+			result.Recommendations = append(result.Recommendations, rec)
+		}
+	}
+	return result, nil
+}
+
+// Neighbors found under the prefix, followed by the result instance number,
+// the strongest first
+func parseNeighbors(values map[string]string, prefix string) []Neighbor {
+	byInstance := map[string]map[string]string{}
+	for path, value := range values {
+		rest := strings.TrimPrefix(path, prefix)
+		i := strings.Index(rest, ".")
+		if rest == path || i <= 0 {
+			continue
+		}
+		if byInstance[rest[:i]] == nil {
+			byInstance[rest[:i]] = map[string]string{}
+		}
+		byInstance[rest[:i]][rest[i+1:]] = value
+	}
+
+	result := []Neighbor{}
+	for _, x := range byInstance {
+		result = append(result, Neighbor{
+			SSID:             x["SSID"],
+			BSSID:            x["BSSID"],
+			Radio:            x["Radio"],
+			FrequencyBand:    x["OperatingFrequencyBand"],
+			Channel:          dm.Atoi(x["Channel"]),
+			ChannelBandwidth: x["OperatingChannelBandwidth"],
+			SignalStrength:   dm.Atoi(x["SignalStrength"]),
+			Noise:            dm.Atoi(x["Noise"]),
+			Security:         x["SecurityModeEnabled"],
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].SignalStrength > result[j].SignalStrength
+	})
+	return result
+}
+
+// Picks the channel of the radio band with the least interference, the
+// lowest one on ties
+func recommend(radio Radio, neighbors []Neighbor) (Recommendation, bool) {
+	candidates := defaultChannels[radio.FrequencyBand]
+	if len(radio.PossibleChannels) > 0 {
+		possible := radio.PossibleChannels
+		if radio.FrequencyBand == "2.4GHz" {
+			// Only non overlapping channels are worth recommending there
+			possible = nil
+			for _, c := range radio.PossibleChannels {
+				if dm.Contains(defaultChannels["2.4GHz"], c) {
+					possible = append(possible, c)
+				}
+			}
+		}
+		if len(possible) > 0 {
+			candidates = possible
+		}
+	}
+	if len(candidates) == 0 {
+		return Recommendation{}, false
+	}
+
+	var band []Neighbor
+	for _, n := range neighbors {
+		if n.FrequencyBand == radio.FrequencyBand || (n.FrequencyBand == "" && sameBand(radio.FrequencyBand, n.Channel)) {
+			band = append(band, n)
+		}
+	}
+
+	width := bandwidth(radio.CurrentChannelBandwidth)
+	rec := Recommendation{
+		Radio:               radio.Path,
+		FrequencyBand:       radio.FrequencyBand,
+		CurrentChannel:      radio.Channel,
+		CurrentInterference: interference(radio.Channel, width, band),
+		Interference:        math.Inf(1),
+	}
+	for _, c := range candidates {
+		if score := interference(c, width, band); score < rec.Interference {
+			rec.Channel = c
+			rec.Interference = score
+		}
+	}
+	return rec, true
+}
+
+// Power of the neighbors overlapping a channel of the width, weighted by how
+// much they overlap. Channel numbers are 5MHz apart on every band.
+func interference(channel, width int, neighbors []Neighbor) float64 {
+	var total float64
+	for _, n := range neighbors {
+		span := float64(width+bandwidth(n.ChannelBandwidth)) / 2
+		distance := math.Abs(float64(channel-n.Channel)) * 5
+		if distance >= span {
+			continue
+		}
+		total += math.Pow(10, float64(n.SignalStrength)/10) * (1 - distance/span)
+	}
+	return total
+}
+
+// Width in MHz of a channel bandwidth, as "40MHz", 20MHz if unknown
+func bandwidth(s string) int {
+	n, err := strconv.Atoi(strings.TrimSuffix(s, "MHz"))
+	if err != nil || n <= 0 {
+		return 20
+	}
+	return n
+}
+
+// Guesses the band of a channel number, for neighbors not telling it
+func sameBand(band string, channel int) bool {
+	switch band {
+	case "2.4GHz":
+		return channel >= 1 && channel <= 14
+	case "5GHz":
+		return channel >= 32 && channel <= 177
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package wifi
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInterference(t *testing.T) {
+	// -50 dBm is 1e-5 mW, -60 dBm is 1e-6 mW
+	tests := []struct {
+		name      string
+		channel   int
+		width     int
+		neighbors []Neighbor
+		want      float64
+	}{
+		{"no neighbors", 6, 20, nil, 0},
+		{"same channel", 6, 20, []Neighbor{{Channel: 6, SignalStrength: -50}}, 1e-5},
+		{"apart", 6, 20, []Neighbor{{Channel: 1, SignalStrength: -50}, {Channel: 11, SignalStrength: -50}}, 0},
+		{"half overlap", 3, 20, []Neighbor{{Channel: 1, SignalStrength: -50}}, 0.5e-5},
+		{"wider channel", 6, 40, []Neighbor{{Channel: 1, SignalStrength: -50}}, 1e-5 / 6},
+		{"wider neighbor", 40, 20, []Neighbor{{Channel: 36, SignalStrength: -50, ChannelBandwidth: "80MHz"}}, 0.6e-5},
+		{"sum", 6, 20, []Neighbor{{Channel: 6, SignalStrength: -50}, {Channel: 6, SignalStrength: -60}}, 1.1e-5},
+	}
+	for _, tt := range tests {
+		got := interference(tt.channel, tt.width, tt.neighbors)
+		if math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%s: interference() = %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecommend(t *testing.T) {
+	radio24 := Radio{Path: "Device.WiFi.Radio.1.", FrequencyBand: "2.4GHz", Channel: 1, CurrentChannelBandwidth: "20MHz"}
+	radio5 := Radio{Path: "Device.WiFi.Radio.2.", FrequencyBand: "5GHz", Channel: 36, CurrentChannelBandwidth: "20MHz"}
+
+	tests := []struct {
+		name      string
+		radio     Radio
+		neighbors []Neighbor
+		channel   int
+		ok        bool
+	}{
+		{"quiet band takes the lowest channel", radio24, nil, 1, true},
+		{"avoids busy channels", radio24, []Neighbor{
+			{FrequencyBand: "2.4GHz", Channel: 1, SignalStrength: -40},
+			{FrequencyBand: "2.4GHz", Channel: 6, SignalStrength: -60},
+			{FrequencyBand: "2.4GHz", Channel: 11, SignalStrength: -70},
+		}, 11, true},
+		{"ignores other bands", radio24, []Neighbor{
+			{FrequencyBand: "5GHz", Channel: 1, SignalStrength: -30},
+		}, 1, true},
+		{"guesses the band of neighbors", radio24, []Neighbor{
+			{Channel: 1, SignalStrength: -40},
+			{Channel: 6, SignalStrength: -40},
+		}, 11, true},
+		{"only non overlapping channels on 2.4GHz", func() Radio {
+			r := radio24
+			r.PossibleChannels = []int{1, 2, 3, 4, 5, 6}
+			return r
+		}(), []Neighbor{{FrequencyBand: "2.4GHz", Channel: 1, SignalStrength: -40}}, 6, true},
+		{"defaults when no possible channel is worth it", func() Radio {
+			r := radio24
+			r.PossibleChannels = []int{2, 3}
+			return r
+		}(), []Neighbor{{FrequencyBand: "2.4GHz", Channel: 1, SignalStrength: -40}}, 6, true},
+		{"possible channels of the radio", func() Radio {
+			r := radio5
+			r.PossibleChannels = []int{36, 40, 100}
+			return r
+		}(), []Neighbor{
+			{FrequencyBand: "5GHz", Channel: 36, SignalStrength: -40},
+			{FrequencyBand: "5GHz", Channel: 40, SignalStrength: -50},
+		}, 100, true},
+		{"unknown band", Radio{FrequencyBand: "6GHz"}, nil, 0, false},
+	}
+	for _, tt := range tests {
+		rec, ok := recommend(tt.radio, tt.neighbors)
+		if ok != tt.ok || rec.Channel != tt.channel {
+			t.Errorf("%s: recommend() = %d, %v, want %d, %v", tt.name, rec.Channel, ok, tt.channel, tt.ok)
+		}
+		if ok && rec.Interference > rec.CurrentInterference {
+			t.Errorf("%s: recommended interference %g is over the current one %g", tt.name, rec.Interference, rec.CurrentInterference)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+// Reads and changes the WiFi configuration of devices, whatever their number of radios.
+package wifi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/leandrofars/oktopus/internal/usp"
+	"github.com/leandrofars/oktopus/internal/usp/dm"
+)
+
+const (
+	radioTable = "Device.WiFi.Radio."
+	ssidTable  = "Device.WiFi.SSID."
+	apTable    = "Device.WiFi.AccessPoint."
+)
+
+// Params read, with * standing for every instance
+var params = []string{
+	radioTable + "*.Enable",
+	radioTable + "*.Status",
+	radioTable + "*.OperatingFrequencyBand",
+	radioTable + "*.SupportedFrequencyBands",
+	radioTable + "*.AutoChannelSupported",
+	radioTable + "*.AutoChannelEnable",
+	radioTable + "*.Channel",
+	radioTable + "*.PossibleChannels",
+	radioTable + "*.OperatingChannelBandwidth",
+	radioTable + "*.CurrentOperatingChannelBandwidth",
+	radioTable + "*.SupportedOperatingChannelBandwidths",
+	ssidTable + "*.Enable",
+	ssidTable + "*.Status",
+	ssidTable + "*.SSID",
+	ssidTable + "*.BSSID",
+	ssidTable + "*.LowerLayers",
+	apTable + "*.Enable",
+	apTable + "*.SSIDReference",
+	apTable + "*.Security.ModeEnabled",
+	apTable + "*.Security.ModesSupported",
+}
+
+type Radio struct {
+	Path                       string   `json:"path"`
+	Enable                     bool     `json:"enable"`
+	Status                     string   `json:"status"`
+	FrequencyBand              string   `json:"frequencyBand"`
+	SupportedFrequencyBands    []string `json:"supportedFrequencyBands"`
+	AutoChannelSupported       bool     `json:"autoChannelSupported"`
+	AutoChannelEnable          bool     `json:"autoChannelEnable"`
+	Channel                    int      `json:"channel"`
+	PossibleChannels           []int    `json:"possibleChannels"`
+	ChannelBandwidth           string   `json:"channelBandwidth"`
+	CurrentChannelBandwidth    string   `json:"currentChannelBandwidth"`
+	SupportedChannelBandwidths []string `json:"supportedChannelBandwidths"`
+	SSIDs                      []SSID   `json:"ssids"`
+}
+
+// SSID along with the access point using it, if any. Passwords are write
+// only, so they are never read back.
+type SSID struct {
+	Path                 string   `json:"path"`
+	Enable               bool     `json:"enable"`
+	Status               string   `json:"status"`
+	SSID                 string   `json:"ssid"`
+	BSSID                string   `json:"bssid"`
+	AccessPoint          string   `json:"accessPoint,omitempty"`
+	Security             string   `json:"security,omitempty"`
+	SecurityCapabilities []string `json:"securityCapabilities,omitempty"`
+}
+
+// Changes to apply, fields left out are kept as they are
+type RadioChange struct {
+	Path              string  `json:"path"`
+	Enable            *bool   `json:"enable,omitempty"`
+	AutoChannelEnable *bool   `json:"autoChannelEnable,omitempty"`
+	Channel           *int    `json:"channel,omitempty"`
+	ChannelBandwidth  *string `json:"channelBandwidth,omitempty"`
+}
+
+type SSIDChange struct {
+	Path     string  `json:"path"`
+	Enable   *bool   `json:"enable,omitempty"`
+	SSID     *string `json:"ssid,omitempty"`
+	Security *string `json:"security,omitempty"`
+	Password *string `json:"password,omitempty"`
+}
+
+type Request struct {
+	Radios []RadioChange `json:"radios"`
+	SSIDs  []SSIDChange  `json:"ssids"`
+}
+
+/*
+Get reads the radios of the device with their SSIDs. SSIDs are tied to radios
+through their LowerLayers, and to access points through the SSIDReference of
+these. SSIDs on no known radio are left out.
+*/
+func Get(ctx context.Context, d *usp.Dispatcher, sn string) ([]Radio, error) {
+	resp, err := usp.Get.Run(ctx, d, sn, usp.GetRequest{Paths: params})
+	if err != nil {
+		return nil, err
+	}
+	values := resp.Params
+
+	radios := map[string]*Radio{}
+	for _, path := range dm.Instances(values, radioTable) {
+		radios[path] = &Radio{
+			Path:                       path,
+			Enable:                     dm.ParseBool(values[path+"Enable"]),
+			Status:                     values[path+"Status"],
+			FrequencyBand:              values[path+"OperatingFrequencyBand"],
+			SupportedFrequencyBands:    dm.List(values[path+"SupportedFrequencyBands"]),
+			AutoChannelSupported:       dm.ParseBool(values[path+"AutoChannelSupported"]),
+			AutoChannelEnable:          dm.ParseBool(values[path+"AutoChannelEnable"]),
+			Channel:                    dm.Atoi(values[path+"Channel"]),
+			PossibleChannels:           channels(values[path+"PossibleChannels"]),
+			ChannelBandwidth:           values[path+"OperatingChannelBandwidth"],
+			CurrentChannelBandwidth:    values[path+"CurrentOperatingChannelBandwidth"],
+			SupportedChannelBandwidths: dm.List(values[path+"SupportedOperatingChannelBandwidths"]),
+			SSIDs:                      []SSID{},
+		}
+	}
+
+	accessPoints := map[string]string{}
+	for _, path := range dm.Instances(values, apTable) {
+		if ssid := reference(values[path+"SSIDReference"], ssidTable); ssid != "" {
+			accessPoints[ssid] = path
+		}
+	}
+
+	for _, path := range dm.Instances(values, ssidTable) {
+		radio, ok := radios[reference(values[path+"LowerLayers"], radioTable)]
+		if !ok {
+			continue
+		}
+		ssid := SSID{
+			Path:   path,
+			Enable: dm.ParseBool(values[path+"Enable"]),
+			Status: values[path+"Status"],
+			SSID:   values[path+"SSID"],
+			BSSID:  values[path+"BSSID"],
+		}
+		if ap, ok := accessPoints[path]; ok {
+			ssid.AccessPoint = ap
+			ssid.Security = values[ap+"Security.ModeEnabled"]
+			ssid.SecurityCapabilities = dm.List(values[ap+"Security.ModesSupported"])
+		}
+		radio.SSIDs = append(radio.SSIDs, ssid)
+	}
+
+	result := []Radio{}
+	for _, path := range dm.Instances(values, radioTable) {
+		result = append(result, *radios[path])
+	}
+	return result, nil
+}
+
+/*
+Set validates the changes against what the device supports, then applies
+them all at once, so either every change is applied or none is.
+*/
+func Set(ctx context.Context, d *usp.Dispatcher, sn string, req Request) ([]Radio, error) {
+	if len(req.Radios) == 0 && len(req.SSIDs) == 0 {
+		return nil, fmt.Errorf("%w: no changes", usp.ErrInvalidRequest)
+	}
+	current, err := Get(ctx, d, sn)
+	if err != nil {
+		return nil, err
+	}
+
+	set := map[string]string{}
+	for _, change := range req.Radios {
+		if err := radioParams(current, change, set); err != nil {
+			return nil, err
+		}
+	}
+	for _, change := range req.SSIDs {
+		if err := ssidParams(current, change, set); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = usp.Set.Run(ctx, d, sn, usp.SetRequest{Params: set})
+	if err != nil {
+		return nil, err
+	}
+	return Get(ctx, d, sn)
+}
+
+func radioParams(radios []Radio, change RadioChange, set map[string]string) error {
+	var radio *Radio
+	for i := range radios {
+		if radios[i].Path == dm.WithDot(change.Path) {
+			radio = &radios[i]
+		}
+	}
+	if radio == nil {
+		return fmt.Errorf("%w: no radio %s", usp.ErrInvalidRequest, change.Path)
+	}
+	path := radio.Path
+
+	if change.Enable != nil {
+		set[path+"Enable"] = strconv.FormatBool(*change.Enable)
+	}
+	if change.Channel != nil {
+		if len(radio.PossibleChannels) > 0 && !dm.Contains(radio.PossibleChannels, *change.Channel) {
+			return fmt.Errorf("%w: channel %d isn't possible on %s, it must be one of %v", usp.ErrInvalidRequest, *change.Channel, path, radio.PossibleChannels)
+		}
+		set[path+"Channel"] = strconv.Itoa(*change.Channel)
+		// A fixed channel only sticks without auto channel
+		if change.AutoChannelEnable == nil && radio.AutoChannelEnable {
+			set[path+"AutoChannelEnable"] = "false"
+		}
+	}
+	if change.AutoChannelEnable != nil {
+		if *change.AutoChannelEnable && !radio.AutoChannelSupported {
+			return fmt.Errorf("%w: %s doesn't support auto channel", usp.ErrInvalidRequest, path)
+		}
+		set[path+"AutoChannelEnable"] = strconv.FormatBool(*change.AutoChannelEnable)
+	}
+	if change.ChannelBandwidth != nil {
+		if len(radio.SupportedChannelBandwidths) > 0 && !dm.Contains(radio.SupportedChannelBandwidths, *change.ChannelBandwidth) {
+			return fmt.Errorf("%w: bandwidth %s isn't supported by %s, it must be one of %v", usp.ErrInvalidRequest, *change.ChannelBandwidth, path, radio.SupportedChannelBandwidths)
+		}
+		set[path+"OperatingChannelBandwidth"] = *change.ChannelBandwidth
+	}
+	return nil
+}
+
+func ssidParams(radios []Radio, change SSIDChange, set map[string]string) error {
+	var ssid *SSID
+	for i := range radios {
+		for j := range radios[i].SSIDs {
+			if radios[i].SSIDs[j].Path == dm.WithDot(change.Path) {
+				ssid = &radios[i].SSIDs[j]
+			}
+		}
+	}
+	if ssid == nil {
+		return fmt.Errorf("%w: no ssid %s", usp.ErrInvalidRequest, change.Path)
+	}
+	path := ssid.Path
+
+	if change.Enable != nil {
+		set[path+"Enable"] = strconv.FormatBool(*change.Enable)
+	}
+	if change.SSID != nil {
+		if len(*change.SSID) == 0 || len(*change.SSID) > 32 {
+			return fmt.Errorf("%w: ssid must have from 1 to 32 bytes", usp.ErrInvalidRequest)
+		}
+		set[path+"SSID"] = *change.SSID
+	}
+	if change.Security == nil && change.Password == nil {
+		return nil
+	}
+
+	if ssid.AccessPoint == "" {
+		return fmt.Errorf("%w: ssid %s has no access point to set its security", usp.ErrInvalidRequest, path)
+	}
+	ap := ssid.AccessPoint
+	mode := ssid.Security
+	if change.Security != nil {
+		mode = *change.Security
+		if len(ssid.SecurityCapabilities) > 0 && !dm.Contains(ssid.SecurityCapabilities, mode) {
+			return fmt.Errorf("%w: security mode %s isn't supported by %s, it must be one of %v", usp.ErrInvalidRequest, mode, ap, ssid.SecurityCapabilities)
+		}
+		set[ap+"Security.ModeEnabled"] = mode
+	}
+	if change.Password == nil {
+		return nil
+	}
+
+	password := *change.Password
+	switch {
+	case mode == "None":
+		return fmt.Errorf("%w: security mode None takes no password", usp.ErrInvalidRequest)
+	case strings.Contains(mode, "Enterprise"):
+		return fmt.Errorf("%w: security mode %s authenticates through a RADIUS server, not a password", usp.ErrInvalidRequest, mode)
+	case strings.HasPrefix(mode, "WEP"):
+		if !isHex(password) || (len(password) != 10 && len(password) != 26) {
+			return fmt.Errorf("%w: WEP key must have 10 or 26 hexadecimal digits", usp.ErrInvalidRequest)
+		}
+		set[ap+"Security.WEPKey"] = password
+	default:
+		if !validPassphrase(password) {
+			return fmt.Errorf("%w: password must have from 8 to 63 printable characters, or 64 hexadecimal digits", usp.ErrInvalidRequest)
+		}
+		// WPA3 uses its own passphrase, transition modes take both
+		if strings.Contains(mode, "WPA3") {
+			set[ap+"Security.SAEPassphrase"] = password
+		}
+		if mode != "WPA3-Personal" {
+			set[ap+"Security.KeyPassphrase"] = password
+		}
+	}
+	return nil
+}
+
+// First path of the comma separated list in the table, devices may leave
+// out the trailing dot
+func reference(value, table string) string {
+	for _, path := range dm.List(value) {
+		if strings.HasPrefix(path, table) {
+			return dm.WithDot(path)
+		}
+	}
+	return ""
+}
+
+// Parses lists of channels and ranges of them, as "1-11" or "36,40,44"
+func channels(value string) []int {
+	result := []int{}
+	for _, x := range dm.List(value) {
+		bounds := strings.SplitN(x, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		for c := first; c <= last; c++ {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func validPassphrase(s string) bool {
+	if len(s) == 64 {
+		return isHex(s)
+	}
+	if len(s) < 8 || len(s) > 63 {
+		return false
+	}
+	for _, c := range s {
+		if c < 32 || c > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,67 @@
+package wifi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChannels(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int
+	}{
+		{"", []int{}},
+		{"1-11", []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{"36,40,44,48", []int{36, 40, 44, 48}},
+		{"36, 40", []int{36, 40}},
+		{"1-3,6", []int{1, 2, 3, 6}},
+		{"36,x,40-y,44", []int{36, 44}},
+		{"11-1", []int{}},
+	}
+	for _, tt := range tests {
+		if got := channels(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("channels(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestValidPassphrase(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{"8 characters", "12345678", true},
+		{"63 characters", strings.Repeat("a", 63), true},
+		{"64 hexadecimal digits", strings.Repeat("aF09", 16), true},
+		{"spaces and symbols", "my wifi pa$$word!", true},
+		{"too short", "1234567", false},
+		{"64 characters not hexadecimal", strings.Repeat("g", 64), false},
+		{"too long", strings.Repeat("a", 65), false},
+		{"control character", "12345678\n", false},
+		{"not ascii", "contraseña", false},
+	}
+	for _, tt := range tests {
+		if got := validPassphrase(tt.s); got != tt.want {
+			t.Errorf("%s: validPassphrase(%q) = %v, want %v", tt.name, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestReference(t *testing.T) {
+	tests := []struct {
+		value, table, want string
+	}{
+		{"Device.WiFi.Radio.1.", "Device.WiFi.Radio.", "Device.WiFi.Radio.1."},
+		{"Device.WiFi.Radio.2", "Device.WiFi.Radio.", "Device.WiFi.Radio.2."},
+		{"Device.Ethernet.Link.1.,Device.WiFi.Radio.3.", "Device.WiFi.Radio.", "Device.WiFi.Radio.3."},
+		{"Device.Ethernet.Link.1.", "Device.WiFi.Radio.", ""},
+		{"", "Device.WiFi.Radio.", ""},
+	}
+	for _, tt := range tests {
+		if got := reference(tt.value, tt.table); got != tt.want {
+			t.Errorf("reference(%q, %q) = %q, want %q", tt.value, tt.table, got, tt.want)
+		}
+	}
+}
@@ -55,17 +55,17 @@ const getDeviceParameters = async (raw) =>{
 
     initialize(
     JSON.stringify({
-        "obj_paths": ["Device."],
-        "first_level_only" : true,
-        "return_commands" : false,
-        "return_events" : false,
-        "return_params" : true 
+        "paths": ["Device."],
+        "firstLevelOnly" : true,
+        "commands" : false,
+        "events" : false,
+        "params" : true 
         })
     );
   },[])
 
 //Together with showParameters, this function renders all the device parameters the device supports
-//but you must set req with first_level_only property to false
+//but you must set req with firstLevelOnly property to false
 //   const showPathParameters = (pathParamsList) => {
 //     return pathParamsList.map((x,i)=>{
 //         return(
@@ -79,7 +79,7 @@ const getDeviceParameters = async (raw) =>{
 //                 }}
 //             >
 //             <ListItemText
-//                 primary={x.param_name}
+//                 primary={x.name}
 //             />
 //             </ListItem>
 //     </List>
@@ -90,11 +90,11 @@ const getDeviceParameters = async (raw) =>{
   const updateDeviceParameters = async (param) => {
     
     let raw = JSON.stringify({
-            "obj_paths": [param],
-            "first_level_only" : true,
-            "return_commands" : true,
-            "return_events" : true,
-            "return_params" : true 
+            "paths": [param],
+            "firstLevelOnly" : true,
+            "commands" : true,
+            "events" : true,
+            "params" : true 
     })
 
     let content = await getDeviceParameters(raw)
@@ -106,14 +106,14 @@ const getDeviceParameters = async (raw) =>{
 
   const showParameters = () => {
     console.log(deviceParameters)
-    return deviceParameters.req_obj_results[0].supported_objs.map((x,i)=> {
+    return deviceParameters.objects.map((x,i)=> {
         return (
-        <List dense={true} key={x.supported_obj_path}>
+        <List dense={true} key={x.path}>
             <ListItem
-                key={x.supported_obj_path}
+                key={x.path}
                 divider={true}
                 secondaryAction={
-                    <IconButton onClick={()=>updateDeviceParameters(x.supported_obj_path)}>
+                    <IconButton onClick={()=>updateDeviceParameters(x.path)}>
                         <SvgIcon>
                             <PlusCircleIcon></PlusCircleIcon>
                         </SvgIcon>
@@ -124,17 +124,17 @@ const getDeviceParameters = async (raw) =>{
                 }}
             >
                 <ListItemText
-                    primary={<b>{x.supported_obj_path}</b>}
+                    primary={<b>{x.path}</b>}
                     sx={{fontWeight:'bold'}}
                 />
             </ListItem>
-            { x.supported_params &&
-                x.supported_params.map((y)=>{
+            { x.params &&
+                x.params.map((y)=>{
                     return <List 
                     component="div" 
                     disablePadding 
                     dense={true}
-                    key={y.param_name}
+                    key={y.name}
                     >
                     <ListItem
                         key={i}
@@ -145,19 +145,19 @@ const getDeviceParameters = async (raw) =>{
                         }}
                     >
                         <ListItemText
-                            primary={y.param_name}
+                            primary={y.name}
                         />
                     </ListItem>
                 </List>
                 })
             }
-            { x.supported_commands &&
-                x.supported_commands.map((y)=>{
+            { x.commands &&
+                x.commands.map((y)=>{
                     return <List 
                     component="div" 
                     disablePadding 
                     dense={true}
-                    key={y.command_name}
+                    key={y.name}
                     >
                     <ListItem
                         key={i}
@@ -168,19 +168,19 @@ const getDeviceParameters = async (raw) =>{
                         }}
                     >
                         <ListItemText
-                            primary={y.command_name}
+                            primary={y.name}
                         />
                     </ListItem>
                 </List>
                 })
             }
-            { x.supported_events &&
-                x.supported_events.map((y)=>{
+            { x.events &&
+                x.events.map((y)=>{
                     return <List 
                     component="div" 
                     disablePadding 
                     dense={true}
-                    key={y.event_name}
+                    key={y.name}
                     >
                     <ListItem
                         key={i}
@@ -191,7 +191,7 @@ const getDeviceParameters = async (raw) =>{
                         }}
                     >
                         <ListItemText
-                            primary={y.event_name}
+                            primary={y.name}
                         />
                     </ListItem>
                 </List>
@@ -39,13 +39,13 @@ const [content, setContent] = useState('')
 const [age, setAge] = useState(2);
 
 const [value, setValue] = useState(`{
-  "param_paths": [
+  "paths": [
       "Device.WiFi.SSID.[Name==wlan0].",
       "Device.IP.Interface.*.Alias",
       "Device.DeviceInfo.FirmwareImage.*.Alias",
       "Device.IP.Interface.1.IPv4Address.1.IPAddress"
   ],
-  "max_depth": 2
+  "maxDepth": 2
 }`)
 
 const handleClose = () => {
@@ -101,54 +101,41 @@ const handleOpen = () => {
     switch(event.target.value) {
       case 1:
         setValue(`{
-          "allow_partial": true,
-          "create_objs": [
+          "allowPartial": true,
+          "objects": [
               {
-                  "obj_path": "Device.IP.Interface.",
-                  "param_settings": [
-                      {
-                          "param": "Alias",
-                          "value": "test",
-                          "required": true
-                      }
-                  ]
+                  "path": "Device.IP.Interface.",
+                  "params": {
+                      "Alias": "test"
+                  }
               }
           ]
       }`)
         break;
       case 2:
         setValue(`{
-          "param_paths": [
+          "paths": [
               "Device.WiFi.SSID.[Name==wlan0].",
               "Device.IP.Interface.*.Alias",
               "Device.DeviceInfo.FirmwareImage.*.Alias",
               "Device.IP.Interface.1.IPv4Address.1.IPAddress"
           ],
-          "max_depth": 2
+          "maxDepth": 2
       }`)
         break;
       case 3:
         setValue(`
         {
-          "allow_partial":true,
-          "update_objs":[
-              {
-                  "obj_path":"Device.IP.Interface.[Alias==pamonha].",
-                  "param_settings":[
-                      {
-                      "param":"Alias",
-                      "value":"goiaba",
-                      "required":true
-                      }
-                  ]
-              }
-          ]
+          "allowPartial":true,
+          "params":{
+              "Device.IP.Interface.[Alias==pamonha].Alias":"goiaba"
+          }
       }`)
         break;
       case 4:
         setValue(`{
-          "allow_partial": true,
-          "obj_paths": [
+          "allowPartial": true,
+          "paths": [
               "Device.IP.Interface.3."
           ]
       }`)